@@ -90,8 +90,8 @@ func (stream *Stream) Backup(w io.Writer, since uint64) (uint64, error) {
 				}
 			}
 
-			// clear txn bits
-			meta := item.meta &^ (bitTxn | bitFinTxn)
+			// clear txn bits, and the shared value bit as the value is copied out.
+			meta := item.meta &^ (bitTxn | bitFinTxn | bitSharedValue)
 			kv := y.NewKV(a)
 			*kv = pb.KV{
 				Key:       a.Copy(item.Key()),
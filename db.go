@@ -20,8 +20,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"expvar"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
@@ -57,6 +59,7 @@ type closers struct {
 	valueGC     *z.Closer
 	pub         *z.Closer
 	cacheHealth *z.Closer
+	levelSize   *z.Closer
 }
 
 type lockedKeys struct {
@@ -114,12 +117,26 @@ type DB struct {
 	flushChan chan *memTable // For flushing memtables.
 	closeOnce sync.Once      // For closing DB only once.
 
+	// compactorsLock guards compactorsStopped, the number of callers of stopCompactions which have
+	// yet to call startCompactions, and the restart of closers.compactors.
+	compactorsLock    sync.Mutex
+	compactorsStopped int
+
 	blockWrites atomic.Int32
 	isClosed    atomic.Uint32
+	// l0StallThreshold is the number of L0 tables at which memtable flushes stall. It starts out
+	// as Options.NumLevelZeroTablesStall and can be changed with SetL0StallThreshold.
+	l0StallThreshold atomic.Int64
 
 	orc              *oracle
 	bannedNamespaces *lockedKeys
 	threshold        *vlogThreshold
+	tableEvents      *tableEventLog
+	iterMem          *memGate
+	compactionMem    *memGate
+	// levelSizeCh queues the levels whose size changed, for Options.OnLevelSizeChange. A level is
+	// queued at most once at a time, see levelHandler.sizeChanged.
+	levelSizeCh chan int
 
 	pub        *publisher
 	registry   *KeyRegistry
@@ -171,6 +188,33 @@ func checkAndSetOptions(opt *Options) error {
 		return ErrValueLogSize
 	}
 
+	if opt.CompactStaleRatio < 0 || opt.CompactStaleRatio > 1 {
+		return errors.New("CompactStaleRatio must be within range of 0.0-1.0")
+	}
+
+	for level, fp := range opt.LevelBloomFalsePositive {
+		if fp < 0 || fp >= 1 {
+			return errors.Errorf("Invalid LevelBloomFalsePositive %v for level %d, must be "+
+				"within range of 0.0-1.0", fp, level)
+		}
+	}
+
+	for level, n := range opt.LevelVersionsToKeep {
+		if n < 0 {
+			return errors.Errorf("Invalid LevelVersionsToKeep %d for level %d, must be >= 0",
+				n, level)
+		}
+	}
+
+	if !opt.InMemory {
+		if err := checkDiscardStatsSize(opt.DiscardStatsInitialSize); err != nil {
+			return err
+		}
+		if err := checkDiscardStatsGrowth(*opt); err != nil {
+			return err
+		}
+	}
+
 	if opt.ReadOnly {
 		// Do not perform compaction in read only mode.
 		opt.CompactL0OnClose = false
@@ -253,9 +297,14 @@ func Open(opt Options) (*DB, error) {
 		allocPool:        z.NewAllocatorPool(8),
 		bannedNamespaces: &lockedKeys{keys: make(map[uint64]struct{})},
 		threshold:        initVlogThreshold(&opt),
+		tableEvents:      newTableEventLog(opt.TableEventLogSize),
+		iterMem:          newMemGate(opt.MaxConcurrentIteratorMemory),
+		compactionMem:    newMemGate(opt.MaxCompactionMemory),
+		levelSizeCh:      make(chan int, opt.MaxLevels),
 	}
 
 	db.syncChan = opt.syncChan
+	db.l0StallThreshold.Store(int64(opt.NumLevelZeroTablesStall))
 
 	// Cleanup all the goroutines started by badger in case of an error.
 	defer func() {
@@ -347,6 +396,11 @@ func Open(opt Options) (*DB, error) {
 		return db, err
 	}
 
+	if opt.OnLevelSizeChange != nil {
+		db.closers.levelSize = z.NewCloser(1)
+		go db.reportLevelSizes(db.closers.levelSize)
+	}
+
 	// Initialize vlog struct.
 	db.vlog.init(db)
 
@@ -500,6 +554,9 @@ func (db *DB) cleanup() {
 	if db.closers.pub != nil {
 		db.closers.pub.Signal()
 	}
+	if db.closers.levelSize != nil {
+		db.closers.levelSize.Signal()
+	}
 
 	db.orc.Stop()
 
@@ -507,6 +564,48 @@ func (db *DB) cleanup() {
 	// want to truncate files unless the user has specified the truncate flag.
 }
 
+// LevelReadMetrics are the read counters of a level, as returned by DB.ResetLevelReadMetrics.
+type LevelReadMetrics struct {
+	Level     int
+	Gets      int64 // Lookups which reached the level.
+	BloomHits int64 // Tables of the level skipped thanks to their bloom filter.
+	// Tables of the level looked at for a key they didn't hold, though they have a bloom filter.
+	BloomFalsePositives int64
+}
+
+// BloomFalsePositiveRate returns the fraction of the lookups of keys missing from a table which
+// its bloom filter failed to rule out, to compare with Options.BloomFalsePositive. It returns 0 if
+// there were no such lookups.
+func (m LevelReadMetrics) BloomFalsePositiveRate() float64 {
+	if m.BloomHits+m.BloomFalsePositives == 0 {
+		return 0
+	}
+	return float64(m.BloomFalsePositives) / float64(m.BloomHits+m.BloomFalsePositives)
+}
+
+// ResetLevelReadMetrics returns, for each level, the gets, bloom filter hits and bloom filter
+// false positives counted by the badger_get_num_lsm, badger_hit_num_lsm_bloom_filter and
+// badger_false_positive_num_lsm_bloom_filter metrics since the previous call, and resets them, so
+// that periodic reports get rates without keeping track of the previous values. Reads running
+// concurrently are counted either by this call or by the next one. The metrics are shared by all
+// the DBs of the process, so this resets them for all of them. It returns nothing if metrics are
+// disabled.
+func (db *DB) ResetLevelReadMetrics() []LevelReadMetrics {
+	if !db.opt.MetricsEnabled {
+		return nil
+	}
+	metrics := make([]LevelReadMetrics, 0, len(db.lc.levels))
+	for _, l := range db.lc.levels {
+		metrics = append(metrics, LevelReadMetrics{
+			Level:               l.level,
+			Gets:                y.NumLSMGetsReset(true, l.strLevel),
+			BloomHits:           y.NumLSMBloomHitsReset(true, l.strLevel),
+			BloomFalsePositives: y.NumLSMBloomFalsePositivesReset(true, l.strLevel),
+		})
+	}
+	return metrics
+}
+
 // BlockCacheMetrics returns the metrics for the underlying block cache.
 func (db *DB) BlockCacheMetrics() *ristretto.Metrics {
 	if db.blockCache != nil {
@@ -547,6 +646,8 @@ func (db *DB) close() (err error) {
 
 	db.blockWrites.Store(1)
 	db.isClosed.Store(1)
+	// Fail the iterators waiting for memory.
+	db.iterMem.close()
 
 	if !db.opt.InMemory {
 		// Stop value GC first.
@@ -628,6 +729,9 @@ func (db *DB) close() (err error) {
 	}
 	db.opt.Debugf("Waiting for closer")
 	db.closers.updateSize.SignalAndWait()
+	if db.closers.levelSize != nil {
+		db.closers.levelSize.SignalAndWait()
+	}
 	db.orc.Stop()
 	db.blockCache.Close()
 	db.indexCache.Close()
@@ -674,6 +778,14 @@ func (db *DB) VerifyChecksum() error {
 	return db.lc.verifyChecksum()
 }
 
+// VerifyChecksums verifies the checksums of all the blocks of all tables on all levels, a few tables
+// at a time, and logs the progress. Unlike VerifyChecksum, it doesn't stop at the first corrupt
+// table: the IDs of all the corrupt tables are listed in the returned error. It stops early, and
+// returns ctx.Err(), when ctx is done.
+func (db *DB) VerifyChecksums(ctx context.Context) error {
+	return db.lc.verifyChecksums(ctx)
+}
+
 const (
 	lockFile = "LOCK"
 )
@@ -712,6 +824,11 @@ func (db *DB) Sync() error {
 	db.lock.RUnlock()
 
 	vLogSyncError := db.vlog.sync()
+	if db.vlog.discardStats != nil {
+		// The discard stats aren't needed for recovery, but losing them makes value log GC
+		// miss the files it could have rewritten.
+		vLogSyncError = y.CombineErrors(vLogSyncError, db.vlog.discardStats.Sync())
+	}
 	return y.CombineErrors(memtableSyncError, vLogSyncError)
 }
 
@@ -785,6 +902,30 @@ func (db *DB) get(key []byte) (y.ValueStruct, error) {
 	return db.lc.get(key, maxVs, 0)
 }
 
+// getWithConsistency looks up key with the given consistency level. Strong is the same as get.
+func (db *DB) getWithConsistency(key []byte, level ConsistencyLevel) (y.ValueStruct, error) {
+	if level != Fast {
+		return db.get(key)
+	}
+	if db.IsClosed() {
+		return y.ValueStruct{}, ErrDBClosed
+	}
+	tables, decr := db.getMemTables() // Lock should be released.
+	defer decr()
+
+	y.NumGetsAdd(db.opt.MetricsEnabled, 1)
+	for i := 0; i < len(tables); i++ {
+		vs := tables[i].sl.Get(key)
+		y.NumMemtableGetsAdd(db.opt.MetricsEnabled, 1)
+		if vs.Meta == 0 && vs.Value == nil {
+			continue
+		}
+		y.NumGetsWithResultsAdd(db.opt.MetricsEnabled, 1)
+		return vs, nil
+	}
+	return db.lc.getFirst(key)
+}
+
 var requestPool = sync.Pool{
 	New: func() interface{} {
 		return new(request)
@@ -1072,6 +1213,7 @@ func buildL0Table(iter y.Iterator, dropPrefixes [][]byte, bopts table.Options) *
 // handleMemTableFlush must be run serially.
 func (db *DB) handleMemTableFlush(mt *memTable, dropPrefixes [][]byte) error {
 	bopts := buildTableOptions(db)
+	bopts.BloomFalsePositive = db.opt.bloomFalsePositive(0)
 	itr := mt.sl.NewUniIterator(false)
 	builder := buildL0Table(itr, nil, bopts)
 	defer builder.Close()
@@ -1209,6 +1351,33 @@ func (db *DB) updateSize(lc *z.Closer) {
 	}
 }
 
+// reportLevelSizes calls Options.OnLevelSizeChange for the levels queued in levelSizeCh, with their
+// latest sizes, if they differ from the ones last reported.
+func (db *DB) reportLevelSizes(lc *z.Closer) {
+	defer lc.Done()
+
+	type sizes struct{ total, stale int64 }
+	reported := make(map[int]sizes)
+	for {
+		select {
+		case level := <-db.levelSizeCh:
+			h := db.lc.levels[level]
+			// Changes from now on queue the level again.
+			h.sizeChangePending.Store(false)
+			h.RLock()
+			cur := sizes{total: h.totalSize, stale: h.totalStaleSize}
+			h.RUnlock()
+			if last, ok := reported[level]; ok && last == cur {
+				continue
+			}
+			reported[level] = cur
+			db.opt.OnLevelSizeChange(level, cur.total, cur.stale)
+		case <-lc.HasBeenClosed():
+			return
+		}
+	}
+}
+
 // RunValueLogGC triggers a value log garbage collection.
 //
 // It picks value log files to perform GC based on statistics that are collected
@@ -1384,11 +1553,258 @@ func (db *DB) Tables() []TableInfo {
 	return db.lc.getTableInfo()
 }
 
+// ColdTables returns the TableInfo of the tables which haven't served a get or been picked by an
+// iterator within d, nor been opened, sorted like Tables. Reads by compactions don't count. As
+// TableInfo.LastAccess is kept to the second, d is too.
+func (db *DB) ColdTables(d time.Duration) []TableInfo {
+	cutoff := time.Now().Add(-d)
+	var cold []TableInfo
+	for _, info := range db.lc.getTableInfo() {
+		if info.LastAccess.Before(cutoff) {
+			cold = append(cold, info)
+		}
+	}
+	return cold
+}
+
+// FindTable returns the TableInfo of the table with the given ID, which gives its level and key
+// range, for example to follow up on a table ID found in the logs. It returns false if no level
+// holds the table, which is the case once a compaction has removed it. Each level is looked at
+// under its own lock, so a table added by a compaction running concurrently may be missed.
+func (db *DB) FindTable(id uint64) (*TableInfo, bool) {
+	for _, l := range db.lc.levels {
+		if info, ok := l.findTable(id); ok {
+			return &info, true
+		}
+	}
+	return nil, false
+}
+
+// LevelForKey returns the level of the LSM tree holding the latest version of key, and false if no
+// level holds any version of it. The memtables are not looked at, so a version of key still in
+// memory is not reported. Only the winning level is returned, even when other levels hold older
+// versions too. Every level is looked at, as value log GC rewrites can move older versions of a key
+// into newer tables, so a deeper level can hold a newer version than the first level holding one.
+// It is meant for debugging, and is as costly as a read of key going down to the last level.
+func (db *DB) LevelForKey(key []byte) (int, bool) {
+	if db.IsClosed() {
+		return 0, false
+	}
+	internalKey := y.KeyWithTs(key, math.MaxUint64)
+	level, found := 0, false
+	var maxVersion uint64
+	for _, h := range db.lc.levels {
+		vs, err := h.get(internalKey) // Calls h.RLock() and h.RUnlock().
+		if err != nil {
+			db.opt.Warningf("LevelForKey: unable to read level %d: %v", h.level, err)
+			continue
+		}
+		if vs.Value == nil && vs.Meta == 0 {
+			continue
+		}
+		if !found || vs.Version > maxVersion {
+			level, found, maxVersion = h.level, true, vs.Version
+		}
+	}
+	return level, found
+}
+
+// SnapshotLevel returns the tables of the given level at this point in time, for tools reading the
+// table files directly, along with a function to call once done with them. Until it is called, the
+// tables are referenced, so their files are not deleted even if compactions remove the tables from
+// the level: holding on to a snapshot keeps the disk space of those files in use. The release
+// function must be called exactly once, before the DB is closed. The tables of level 0 are sorted
+// by age, oldest first, and the ones of other levels by key.
+func (db *DB) SnapshotLevel(level int) ([]TableRef, func() error, error) {
+	if db.IsClosed() {
+		return nil, nil, ErrDBClosed
+	}
+	if level < 0 || level >= len(db.lc.levels) {
+		return nil, nil, errors.Errorf("Invalid level %d, must be within range of 0-%d", level,
+			len(db.lc.levels)-1)
+	}
+	tables, release := db.lc.levels[level].snapshot()
+	refs := make([]TableRef, 0, len(tables))
+	for _, t := range tables {
+		ref := TableRef{
+			ID:    t.ID(),
+			Level: level,
+			Left:  y.Copy(t.Smallest()),
+			Right: y.Copy(t.Biggest()),
+			Size:  t.Size(),
+		}
+		if !t.IsInmemory {
+			ref.Path = t.Filename()
+		}
+		refs = append(refs, ref)
+	}
+	return refs, release, nil
+}
+
+// NewLevelsIterator returns an iterator merging the tables of the levels minLevel to maxLevel, both
+// included, for tools such as repair tools which look at some levels only. The iterator must be
+// closed, before the DB is.
+//
+// This is NOT a consistent view of the DB: the memtables and the other levels are left out, so keys
+// are missing, and the versions and deletes of those levels don't shadow the ones of the levels
+// selected. Like the iterators used by compactions, it returns the entries as stored in the tables:
+// all their versions, including deletes and expired entries, with the keys holding their
+// timestamps (see y.ParseKey and y.ParseTs), and the values kept in the value log as pointers to
+// them. Each level is picked under its own lock, so a compaction running concurrently can make an
+// entry show up in two levels, or in none of them.
+//
+// The tables are picked with opt as for Txn.NewIterator, which skips the ones without keys in the
+// range or with the prefix, but the keys of the tables picked are not filtered. opt.Reverse gives
+// the direction of the iterator.
+func (db *DB) NewLevelsIterator(minLevel, maxLevel int, opt IteratorOptions) (y.Iterator, error) {
+	if db.IsClosed() {
+		return nil, ErrDBClosed
+	}
+	for _, level := range []int{minLevel, maxLevel} {
+		if level < 0 || level >= len(db.lc.levels) {
+			return nil, errors.Errorf("Invalid level %d, must be within range of 0-%d", level,
+				len(db.lc.levels)-1)
+		}
+	}
+	if minLevel > maxLevel {
+		return nil, errors.Errorf("Invalid level range %d-%d", minLevel, maxLevel)
+	}
+	iters := db.lc.appendLevelIterators(nil, &opt, minLevel, maxLevel)
+	if len(iters) == 0 {
+		var topt int
+		if opt.Reverse {
+			topt = table.REVERSED
+		}
+		// An iterator over no tables, which is never valid.
+		return table.NewConcatIterator(nil, topt), nil
+	}
+	return table.NewMergeIterator(iters, opt.Reverse), nil
+}
+
+// TablesOverlapping returns the TableInfo of the tables at the given level holding keys in the
+// range [start, end], both ends included. It returns nothing if start or end is empty, if start
+// comes after end, or if the level doesn't exist.
+func (db *DB) TablesOverlapping(level int, start, end []byte) []TableInfo {
+	if len(start) == 0 || len(end) == 0 || bytes.Compare(start, end) > 0 {
+		return nil
+	}
+	kr := keyRange{left: y.KeyWithTs(start, math.MaxUint64), right: y.KeyWithTs(end, 0)}
+	return db.lc.getOverlappingTableInfo(level, kr)
+}
+
+// AllTableStats returns the stats of every table in the LSM tree, taken from the table indices
+// without reading any data block. MinVersion and TombstoneCount are zero for tables written by
+// older versions of badger, which didn't record them.
+func (db *DB) AllTableStats() []TableStat {
+	return db.lc.getTableStats()
+}
+
+// LevelStats returns a snapshot of each level of the LSM tree. The values of a level are read
+// together, so they are consistent with each other, but different levels may be read at slightly
+// different times.
+func (db *DB) LevelStats() []LevelStats {
+	stats := make([]LevelStats, 0, len(db.lc.levels))
+	for _, l := range db.lc.levels {
+		stats = append(stats, l.stats())
+	}
+	return stats
+}
+
+// TableSizeHistogram returns, for each level, the distribution of the sizes of its tables, to spot
+// tables much bigger or smaller than the target file size of their level. The sizes are kept in
+// memory, so no table is read. Each level is read under its own lock, so different levels may be
+// read at slightly different times.
+func (db *DB) TableSizeHistogram() []TableSizeStats {
+	stats := make([]TableSizeStats, 0, len(db.lc.levels))
+	for _, l := range db.lc.levels {
+		stats = append(stats, l.tableSizeStats())
+	}
+	return stats
+}
+
+// EstimatedKeysPerLevel returns, for each level, the number of keys in its tables, summed from the
+// key counts kept with the tables, without reading any data. It's an estimate of the number of
+// distinct keys: each version of a key is counted, including deletes, and a key present on several
+// levels is counted on each. Memtables are not included.
+func (db *DB) EstimatedKeysPerLevel() []int64 {
+	counts := make([]int64, 0, len(db.lc.levels))
+	for _, l := range db.lc.levels {
+		counts = append(counts, l.estimatedKeys())
+	}
+	return counts
+}
+
 // Levels gets the LevelInfo.
 func (db *DB) Levels() []LevelInfo {
 	return db.lc.getLevelInfo()
 }
 
+// OverlapCount returns, for each level, the number of tables whose key range holds the given key.
+// This is the number of tables a lookup of the key may have to examine on that level, without
+// taking bloom filters into account. Memtables are not included.
+func (db *DB) OverlapCount(key []byte) []int {
+	return db.lc.overlapCount(key)
+}
+
+// IsVersionLive returns true if version is the newest version of key, and that version is neither
+// a delete marker nor expired. A version which is not live has been superseded by a newer write or
+// delete of the key, and is only needed by reads at timestamps older than that write. The lookup is
+// not bound to a read timestamp, so all committed versions are taken into account.
+func (db *DB) IsVersionLive(key []byte, version uint64) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrEmptyKey
+	}
+	vs, err := db.get(y.KeyWithTs(key, math.MaxUint64))
+	if err != nil {
+		return false, y.Wrapf(err, "DB::IsVersionLive key: %q", key)
+	}
+	if vs.Value == nil && vs.Meta == 0 {
+		return false, nil
+	}
+	return vs.Version == version && !isDeletedOrExpired(vs.Meta, vs.ExpiresAt), nil
+}
+
+// KeyBounds returns the smallest and the largest keys present in the DB, without their versions.
+// The bounds are computed from the table metadata and the memtables, so no data is scanned. Since
+// nothing is read, the bounds include deleted and expired keys which haven't been compacted away
+// yet, as well as internal badger keys. Both keys are nil if the DB is empty.
+func (db *DB) KeyBounds() (smallest, largest []byte, err error) {
+	if db.IsClosed() {
+		return nil, nil, ErrDBClosed
+	}
+	update := func(lo, hi []byte) {
+		if lo == nil {
+			return
+		}
+		if smallest == nil || y.CompareKeys(lo, smallest) < 0 {
+			smallest = lo
+		}
+		if largest == nil || y.CompareKeys(hi, largest) > 0 {
+			largest = hi
+		}
+	}
+
+	tables, decr := db.getMemTables()
+	defer decr()
+	for _, mt := range tables {
+		itr := mt.sl.NewIterator()
+		itr.SeekToFirst()
+		if itr.Valid() {
+			lo := itr.Key()
+			itr.SeekToLast()
+			update(lo, itr.Key())
+		}
+		_ = itr.Close()
+	}
+	update(db.lc.keyBounds())
+
+	if smallest == nil {
+		return nil, nil, nil
+	}
+	// Copy the keys, as the memtables can be released once we return.
+	return y.SafeCopy(nil, y.ParseKey(smallest)), y.SafeCopy(nil, y.ParseKey(largest)), nil
+}
+
 // EstimateSize can be used to get rough estimate of data size for a given prefix.
 func (db *DB) EstimateSize(prefix []byte) (uint64, uint64) {
 	var onDiskSize, uncompressedSize uint64
@@ -1536,16 +1952,34 @@ func (db *DB) stopMemoryFlush() {
 	}
 }
 
+// stopCompactions stops the compactors, until startCompactions is called as many times as
+// stopCompactions was, so that callers stopping them concurrently don't restart them under each
+// other.
 func (db *DB) stopCompactions() {
+	db.compactorsLock.Lock()
+	defer db.compactorsLock.Unlock()
+	db.stopCompactionsLocked()
+}
+
+func (db *DB) stopCompactionsLocked() {
+	db.compactorsStopped++
 	// Stop compactions.
-	if db.closers.compactors != nil {
+	if db.compactorsStopped == 1 && db.closers.compactors != nil {
 		db.closers.compactors.SignalAndWait()
 	}
 }
 
+// startCompactions restarts the compactors stopped by stopCompactions, unless the DB is closing.
 func (db *DB) startCompactions() {
+	db.compactorsLock.Lock()
+	defer db.compactorsLock.Unlock()
+	db.startCompactionsLocked()
+}
+
+func (db *DB) startCompactionsLocked() {
+	db.compactorsStopped--
 	// Resume compactions.
-	if db.closers.compactors != nil {
+	if db.compactorsStopped == 0 && db.closers.compactors != nil && !db.IsClosed() {
 		db.closers.compactors = z.NewCloser(1)
 		db.lc.startCompact(db.closers.compactors)
 	}
@@ -1562,6 +1996,188 @@ func (db *DB) startMemoryFlush() {
 	}
 }
 
+// PauseCompaction stops the compactors from picking up new compactions, without closing the DB.
+// Compactions which are already running are allowed to finish. If wait is true, PauseCompaction
+// blocks until they do, so no compaction I/O happens once it returns. Explicit requests like
+// Flatten and DropPrefix are not affected. Note that writes would stall once level 0 reaches
+// NumLevelZeroTablesStall tables, until ResumeCompaction is called.
+func (db *DB) PauseCompaction(wait bool) {
+	db.lc.pauseCompactions(wait)
+}
+
+// ResumeCompaction lets the compactors pick up new compactions again, after a call to
+// PauseCompaction.
+func (db *DB) ResumeCompaction() {
+	db.lc.resumeCompactions()
+}
+
+// RequestCompaction asks for the given level to be compacted next, ahead of the levels the
+// compactors would pick on their own, for example to deal with a known hotspot. The compaction
+// picks tables as usual: level 0 is compacted into the base level, and other levels have a table
+// compacted into the next level. The request is queued, and RequestCompaction returns without
+// waiting for it to run. It returns an error if the level is empty, already being compacted, or
+// already requested.
+func (db *DB) RequestCompaction(level int) error {
+	return db.lc.requestCompaction(level)
+}
+
+// CompactionPlan estimates the cost of compacting all the tables of the given level, without
+// running any compaction: the tables read from the level and from the level it would be compacted
+// into, the bytes read, and the bytes and tables written once the stale data recorded by the
+// tables is dropped. The estimate is based on the sizes kept by the levels, so versions which
+// became stale without being recorded as such are counted as written.
+func (db *DB) CompactionPlan(level int) (CompactionPlan, error) {
+	if db.IsClosed() {
+		return CompactionPlan{}, ErrDBClosed
+	}
+	return db.lc.compactionPlan(level)
+}
+
+// DropLevel deletes all the tables of the given level, and returns the number of tables and bytes
+// dropped. Keys held by the level are then read from the levels below it, if present there, so
+// DropLevel is meant for tests and for repairing a tree, not for deleting data. Level 0 may have
+// been given new tables by memtable flushes by the time DropLevel returns. It returns an error if
+// the level is being compacted.
+func (db *DB) DropLevel(level int) (int, int64, error) {
+	if db.IsClosed() {
+		return 0, 0, ErrDBClosed
+	}
+	if db.opt.ReadOnly {
+		return 0, 0, errors.New("Cannot drop a level in read-only mode")
+	}
+	n, size, err := db.lc.dropLevel(level)
+	if err != nil {
+		return 0, 0, err
+	}
+	db.opt.Infof("Dropped %d tables (%d bytes) from level %d", n, size, level)
+	return n, size, nil
+}
+
+// PinRange pins the tables holding keys from start to end, both included, on all levels. All the
+// blocks of a pinned table are kept in memory, outside the block cache, so lookups of keys in a
+// small and hot range don't suffer from the cache evicting them. It returns the number of tables
+// pinned. Only the tables present when PinRange is called are pinned: a pinned table is unpinned
+// once compacted away, and the tables written by the compaction aren't pinned, so PinRange should be
+// called again after compactions to keep the range pinned.
+func (db *DB) PinRange(start, end []byte) (int, error) {
+	if db.IsClosed() {
+		return 0, ErrDBClosed
+	}
+	return db.lc.pinRange(start, end, true)
+}
+
+// UnpinRange unpins the tables holding keys from start to end, both included, on all levels, and
+// returns the number of tables unpinned. See PinRange.
+func (db *DB) UnpinRange(start, end []byte) (int, error) {
+	if db.IsClosed() {
+		return 0, ErrDBClosed
+	}
+	return db.lc.pinRange(start, end, false)
+}
+
+// EffectiveLevelMultipliers returns, for each level but the last, the ratio between the target size
+// of the next level and its own, as currently used by compactions. Targets are derived from the
+// size of the last level, divided by LevelSizeMultiplier for each level up, and never go below
+// BaseLevelSize, so levels above the base level can have a multiplier lower than
+// LevelSizeMultiplier. The multiplier of level 0 is zero, as level 0 has no size target.
+func (db *DB) EffectiveLevelMultipliers() []float64 {
+	t := db.lc.levelTargets()
+	multipliers := make([]float64, len(t.targetSz)-1)
+	for i := range multipliers {
+		if t.targetSz[i] > 0 {
+			multipliers[i] = float64(t.targetSz[i+1]) / float64(t.targetSz[i])
+		}
+	}
+	return multipliers
+}
+
+// TableEventLog returns the most recent table creations and deletions across all levels, oldest
+// first. At most Options.TableEventLogSize events are kept. Tables loaded when the DB is opened are
+// not reported.
+func (db *DB) TableEventLog() []TableEvent {
+	return db.tableEvents.get()
+}
+
+// CompactionLag returns, for each level, how long the level has been over its target as seen by
+// the compaction scheduler. A level within its target has a lag of zero. Level 0 is over its
+// target once it holds NumLevelZeroTables tables. A growing lag means compaction is falling
+// behind on that level.
+func (db *DB) CompactionLag() []time.Duration {
+	now := time.Now()
+	lag := make([]time.Duration, len(db.lc.levels))
+	for i, l := range db.lc.levels {
+		lag[i] = l.compactionLag(now)
+	}
+	return lag
+}
+
+// WaitForL0Space blocks until level 0 would accept one more table, which with the default
+// Options.L0StallPolicy is once it holds fewer than L0StallThreshold tables, so that a memtable
+// flush would not stall. It returns ctx.Err() if ctx is done first. Applications can use it to hold
+// back writes while compactions catch up.
+func (db *DB) WaitForL0Space(ctx context.Context) error {
+	if db.IsClosed() {
+		return ErrDBClosed
+	}
+	return db.lc.levels[0].waitForSpace(ctx)
+}
+
+// SetL0StallThreshold sets the number of level 0 tables at which memtable flushes stall, replacing
+// Options.NumLevelZeroTablesStall. It can be raised during bulk loads and lowered back afterwards.
+// n must be at least NumLevelZeroTables. Flushes already stalled are let through if L0 now holds
+// fewer than n tables.
+func (db *DB) SetL0StallThreshold(n int) error {
+	if n < db.opt.NumLevelZeroTables {
+		return errors.Errorf("L0 stall threshold %d is less than NumLevelZeroTables %d",
+			n, db.opt.NumLevelZeroTables)
+	}
+	db.l0StallThreshold.Store(int64(n))
+	l0 := db.lc.levels[0]
+	l0.Lock()
+	l0.signalShrink(true)
+	l0.Unlock()
+	return nil
+}
+
+// L0StallThreshold returns the number of level 0 tables at which memtable flushes stall.
+func (db *DB) L0StallThreshold() int {
+	return int(db.l0StallThreshold.Load())
+}
+
+// PurgeExpired rewrites the tables in the LSM tree which hold entries with an ExpiresAt at or
+// before now (in unix seconds), dropping those entries. Tables without such entries are left
+// untouched. Entries still in the memtables are not affected. Live compactions are stopped while
+// PurgeExpired runs.
+func (db *DB) PurgeExpired(now uint64) error {
+	if db.IsClosed() {
+		return ErrDBClosed
+	}
+	db.stopCompactions()
+	defer db.startCompactions()
+
+	db.opt.Infof("Purging entries expiring at or before %d", now)
+	if err := db.lc.purgeExpired(now); err != nil {
+		return err
+	}
+	db.opt.Infof("Purged expired entries")
+	return nil
+}
+
+// CompactTablesWhere compacts the tables in the LSM tree for which pred returns true, for example
+// tables over a given size or with a large share of stale data. Tables picked on level 1 and below
+// are rewritten in place, on the same level. Picking any level 0 table compacts all of level 0 into
+// the base level. pred is called with the level lock held, so it must not call into the DB. Live
+// compactions are stopped while CompactTablesWhere runs.
+func (db *DB) CompactTablesWhere(pred func(TableMeta) bool) error {
+	if db.IsClosed() {
+		return ErrDBClosed
+	}
+	db.stopCompactions()
+	defer db.startCompactions()
+
+	return db.lc.compactTablesWhere(pred)
+}
+
 // Flatten can be used to force compactions on the LSM tree so all the tables fall on the same
 // level. This ensures that all the versions of keys are colocated and not split across multiple
 // levels, which is necessary after a restore from backup. During Flatten, live compactions are
@@ -2016,6 +2632,39 @@ func (db *DB) StreamDB(outOptions Options) error {
 	return nil
 }
 
+// StreamTombstones calls f for every key whose latest version is a delete marker, passing the key
+// and the version of the marker. Keys which were deleted and then set again are skipped. The keys
+// are visited in sorted order over a snapshot of the DB, one at a time, so the memory usage stays
+// bounded irrespective of the number of tombstones. The key passed to f is only valid until f
+// returns. If f returns an error, streaming stops and the error is returned. This can be used to
+// cancel the stream, e.g. by returning ctx.Err() once the context is done.
+func (db *DB) StreamTombstones(f func(key []byte, version uint64) error) error {
+	return db.View(func(txn *Txn) error {
+		opt := DefaultIteratorOptions
+		opt.AllVersions = true
+		opt.PrefetchValues = false
+		itr := txn.NewIterator(opt)
+		defer itr.Close()
+
+		var lastKey []byte
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			item := itr.Item()
+			if bytes.Equal(item.Key(), lastKey) {
+				// This is an older version of a key we've already looked at.
+				continue
+			}
+			lastKey = item.KeyCopy(lastKey)
+			if item.meta&bitDelete == 0 {
+				continue
+			}
+			if err := f(lastKey, item.Version()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Opts returns a copy of the DB options.
 func (db *DB) Opts() Options {
 	return db.opt
@@ -2060,6 +2709,70 @@ func (db *DB) CacheMaxCost(cache CacheType, maxCost int64) (int64, error) {
 	}
 }
 
+// DumpDiscardStats writes the discard stats of the value log files to w, as one JSON object per
+// line of the form {"fid":1,"discard_bytes":1024}, sorted by fid. The stats are copied under the
+// lock and then written out one line at a time, so a slow writer doesn't hold up value log GC.
+// Nothing is written in InMemory mode, which has no discard stats.
+func (db *DB) DumpDiscardStats(w io.Writer) error {
+	if db.vlog.discardStats == nil {
+		return nil
+	}
+	type fileStat struct {
+		Fid          uint64 `json:"fid"`
+		DiscardBytes uint64 `json:"discard_bytes"`
+	}
+	enc := json.NewEncoder(w)
+	var err error
+	db.vlog.discardStats.Iterate(func(fid, discard uint64) {
+		if err == nil {
+			err = enc.Encode(fileStat{Fid: fid, DiscardBytes: discard})
+		}
+	})
+	return y.Wrapf(err, "while dumping discard stats")
+}
+
+// VlogFileInfo describes a value log file, as returned by DB.ValueLogInfo.
+type VlogFileInfo struct {
+	Fid          uint32
+	SizeBytes    int64
+	DiscardBytes int64
+	// LiveBytes is SizeBytes minus DiscardBytes, or zero if the discard stats account for more
+	// than the size of the file.
+	LiveBytes int64
+}
+
+// ValueLogInfo returns the size and discard bytes of each value log file, sorted by fid, to help
+// deciding which files to garbage collect. The discard stats are copied under their lock before
+// being joined with the files, so they may lag a little behind the files. Files pending deletion
+// are left out, as are discard stats of files which don't exist anymore. It returns nothing in
+// InMemory mode, which has no value log.
+func (db *DB) ValueLogInfo() []VlogFileInfo {
+	if db.vlog.discardStats == nil {
+		return nil
+	}
+	discard := make(map[uint32]int64)
+	db.vlog.discardStats.Iterate(func(fid, stats uint64) {
+		discard[uint32(fid)] = int64(stats)
+	})
+
+	db.vlog.filesLock.RLock()
+	defer db.vlog.filesLock.RUnlock()
+	fids := db.vlog.sortedFids()
+	info := make([]VlogFileInfo, 0, len(fids))
+	for _, fid := range fids {
+		fi := VlogFileInfo{
+			Fid:          fid,
+			SizeBytes:    int64(db.vlog.filesMap[fid].size.Load()),
+			DiscardBytes: discard[fid],
+		}
+		if fi.SizeBytes > fi.DiscardBytes {
+			fi.LiveBytes = fi.SizeBytes - fi.DiscardBytes
+		}
+		info = append(info, fi)
+	}
+	return info
+}
+
 func (db *DB) LevelsToString() string {
 	levels := db.Levels()
 	h := func(sz int64) string {
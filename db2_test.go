@@ -439,24 +439,28 @@ func TestCompactionFilePicking(t *testing.T) {
 		// Each table has difference of 1 between smallest and largest key.
 		tab := createTableWithRange(t, db, 2*i-1, 2*i)
 		addToManifest(t, db, tab, 3)
-		require.NoError(t, l3.replaceTables([]*table.Table{}, []*table.Table{tab}))
+		_, err := l3.replaceTables([]*table.Table{}, []*table.Table{tab})
+		require.NoError(t, err)
 	}
 
 	l2 := db.lc.levels[2]
 	// First table has keys 1 and 4.
 	tab := createTableWithRange(t, db, 1, 4)
 	addToManifest(t, db, tab, 2)
-	require.NoError(t, l2.replaceTables([]*table.Table{}, []*table.Table{tab}))
+	_, err = l2.replaceTables([]*table.Table{}, []*table.Table{tab})
+	require.NoError(t, err)
 
 	// Second table has keys 5 and 12.
 	tab = createTableWithRange(t, db, 5, 12)
 	addToManifest(t, db, tab, 2)
-	require.NoError(t, l2.replaceTables([]*table.Table{}, []*table.Table{tab}))
+	_, err = l2.replaceTables([]*table.Table{}, []*table.Table{tab})
+	require.NoError(t, err)
 
 	// Third table has keys 13 and 18.
 	tab = createTableWithRange(t, db, 13, 18)
 	addToManifest(t, db, tab, 2)
-	require.NoError(t, l2.replaceTables([]*table.Table{}, []*table.Table{tab}))
+	_, err = l2.replaceTables([]*table.Table{}, []*table.Table{tab})
+	require.NoError(t, err)
 
 	cdef := &compactDef{
 		thisLevel: db.lc.levels[2],
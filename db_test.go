@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"math"
@@ -104,7 +105,9 @@ func (s *DB) validate() error { return s.lc.validate() }
 func getTestOptions(dir string) Options {
 	opt := DefaultOptions(dir).
 		WithSyncWrites(false).
-		WithLoggingLevel(WARNING)
+		WithLoggingLevel(WARNING).
+		WithVerifyTableDeletes(true).
+		WithVerifyTableOverlaps(true)
 	return opt
 }
 
@@ -339,6 +342,174 @@ func TestGetAfterDelete(t *testing.T) {
 	})
 }
 
+func TestKeyBounds(t *testing.T) {
+	opt := getTestOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		check := func(expSmallest, expLargest []byte) {
+			smallest, largest, err := db.KeyBounds()
+			require.NoError(t, err)
+			require.Equal(t, expSmallest, smallest)
+			require.Equal(t, expLargest, largest)
+		}
+		// Empty DB.
+		check(nil, nil)
+
+		createAndOpen(db, []keyValVersion{{"c", "v", 1, 0}, {"f", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"k", "v", 1, 0}, {"m", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"d", "v", 2, 0}}, 0)
+		check([]byte("c"), []byte("m"))
+
+		// Keys in the memtable extend the bounds.
+		txnSet(t, db, []byte("a"), []byte("v"), 0)
+		check([]byte("a"), []byte("m"))
+		txnSet(t, db, []byte("z"), []byte("v"), 0)
+		check([]byte("a"), []byte("z"))
+	})
+}
+
+func TestStreamTombstones(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 10; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("val"), 0)
+		}
+		for _, i := range []int{1, 3, 5, 7} {
+			txnDelete(t, db, []byte(fmt.Sprintf("key%d", i)))
+		}
+		// key7 is set again, so its latest version is not a tombstone anymore.
+		txnSet(t, db, []byte("key7"), []byte("val"), 0)
+
+		var keys []string
+		var versions []uint64
+		require.NoError(t, db.StreamTombstones(func(key []byte, version uint64) error {
+			keys = append(keys, string(key))
+			versions = append(versions, version)
+			return nil
+		}))
+		require.Equal(t, []string{"key1", "key3", "key5"}, keys)
+		for _, v := range versions {
+			// The deletes were committed after all the ten sets.
+			require.Greater(t, v, uint64(10))
+		}
+
+		// Returning an error stops the stream.
+		errStop := errors.New("stop")
+		var count int
+		err := db.StreamTombstones(func(key []byte, version uint64) error {
+			count++
+			return errStop
+		})
+		require.Equal(t, errStop, err)
+		require.Equal(t, 1, count)
+	})
+}
+
+func TestPurgeExpired(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithNumCompactors(0)
+
+	now := uint64(time.Now().Unix())
+	db, err := Open(opt)
+	require.NoError(t, err)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%02d", i)) }
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 10; i++ {
+			e := NewEntry(key(i), []byte("val"))
+			switch i % 3 {
+			case 0:
+				// Expires well before the purge deadline.
+				e.ExpiresAt = now + 1000
+			case 1:
+				// Expires after the purge deadline.
+				e.ExpiresAt = now + 1e6
+			}
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	// Closing the DB flushes the memtable to level 0.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NotEmpty(t, db.Tables())
+
+	require.NoError(t, db.PurgeExpired(now+2000))
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 10; i++ {
+			_, err := txn.Get(key(i))
+			if i%3 == 0 {
+				require.Equal(t, ErrKeyNotFound, err, "key %d", i)
+			} else {
+				require.NoError(t, err, "key %d", i)
+			}
+		}
+		return nil
+	}))
+	tableIDs := func() []uint64 {
+		var ids []uint64
+		var keyCount uint32
+		for _, ti := range db.Tables() {
+			ids = append(ids, ti.ID)
+			keyCount += ti.KeyCount
+		}
+		require.Equal(t, uint32(6), keyCount)
+		return ids
+	}
+	before := tableIDs()
+
+	// Nothing is left to purge, so the tables must not be rewritten.
+	require.NoError(t, db.PurgeExpired(now+2000))
+	require.Equal(t, before, tableIDs())
+}
+
+func TestIsVersionLive(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		version := func() uint64 {
+			var v uint64
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get(key)
+				require.NoError(t, err)
+				v = item.Version()
+				return nil
+			}))
+			return v
+		}
+		live, err := db.IsVersionLive(key, 1)
+		require.NoError(t, err)
+		require.False(t, live)
+
+		txnSet(t, db, key, []byte("val1"), 0)
+		v1 := version()
+		live, err = db.IsVersionLive(key, v1)
+		require.NoError(t, err)
+		require.True(t, live)
+
+		txnSet(t, db, key, []byte("val2"), 0)
+		v2 := version()
+		require.Greater(t, v2, v1)
+		live, err = db.IsVersionLive(key, v1)
+		require.NoError(t, err)
+		require.False(t, live)
+		live, err = db.IsVersionLive(key, v2)
+		require.NoError(t, err)
+		require.True(t, live)
+
+		// The newest version is superseded by the delete marker.
+		txnDelete(t, db, key)
+		live, err = db.IsVersionLive(key, v2)
+		require.NoError(t, err)
+		require.False(t, live)
+
+		_, err = db.IsVersionLive(nil, v2)
+		require.Equal(t, ErrEmptyKey, err)
+	})
+}
+
 func TestTxnTooBig(t *testing.T) {
 	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
 		data := func(i int) []byte {
@@ -2224,6 +2395,40 @@ func TestVerifyChecksum(t *testing.T) {
 	})
 }
 
+func TestVerifyChecksums(t *testing.T) {
+	opt := getTestOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		for i := 0; i < 5; i++ {
+			var kvs []keyValVersion
+			for j := 0; j < 100; j++ {
+				kvs = append(kvs, keyValVersion{fmt.Sprintf("key%d-%03d", i, j), "value", 1, 0})
+			}
+			createAndOpen(db, kvs, 1)
+		}
+		var ids []uint64
+		for _, tab := range db.lc.levels[1].tables {
+			ids = append(ids, tab.ID())
+		}
+		require.NoError(t, db.VerifyChecksums(context.Background()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.Equal(t, context.Canceled, db.VerifyChecksums(ctx))
+
+		// Corrupt the first block of two tables, in the file the tables are mapped from.
+		for _, tab := range []int{1, 3} {
+			f, err := os.OpenFile(db.lc.levels[1].tables[tab].Filename(), os.O_RDWR, 0)
+			require.NoError(t, err)
+			_, err = f.WriteAt([]byte("corrupt"), 10)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+		}
+		err := db.VerifyChecksums(context.Background())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), fmt.Sprintf("[%d %d]", ids[1], ids[3]))
+	})
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	os.Exit(m.Run())
@@ -17,43 +17,122 @@
 package badger
 
 import (
+	"container/heap"
 	"encoding/binary"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"sync"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+
 	"github.com/dgraph-io/badger/v4/y"
 	"github.com/dgraph-io/ristretto/z"
 )
 
 // discardStats keeps track of the amount of data that could be discarded for
 // a given logfile.
+//
+// The DISCARD file starts with a header of discardHeaderSize bytes, followed by the slots of 16
+// bytes, each holding a fid and its discard. The header holds discardMagic, the version of the
+// format, and the checksum of the slots in use: the sum of the xxhash of each of them. As the sum
+// doesn't depend on the order of the slots, it's kept up to date as slots are changed, added and
+// removed, without reading the others.
+//
+// When the DB is opened with Options.ReadOnly, the file is read into memory instead, so that
+// nothing is written to the directory, which may be on a read-only filesystem. The stats can then
+// be read, but not changed: see readOnly.
 type discardStats struct {
 	sync.Mutex
 
 	*z.MmapFile
 	opt           Options
 	nextEmptySlot int
+	checksum      uint64
+	// readOnly makes the methods changing the stats no-ops, and MaxDiscard and MaxDiscardRatio
+	// return no file, as value log GC can't run.
+	readOnly bool
+}
+
+const (
+	discardFname string = "DISCARD"
+
+	discardHeaderSize = 16
+	discardMagic      = 0xBAD6E2D5
+	discardVersion    = 1
+)
+
+// checkDiscardStatsSize returns an error if size can't be the size of the discard stats file.
+func checkDiscardStatsSize(size int64) error {
+	if size < discardHeaderSize+16 || size%16 != 0 {
+		return errors.Errorf("Invalid DiscardStatsInitialSize %d, must be a multiple of 16 of at "+
+			"least %d", size, discardHeaderSize+16)
+	}
+	return nil
 }
 
-const discardFname string = "DISCARD"
+// checkDiscardStatsGrowth returns an error if the options can't make the discard stats file grow.
+func checkDiscardStatsGrowth(opt Options) error {
+	if inc := opt.DiscardStatsGrowthIncrement; inc != 0 {
+		if inc < 0 || inc%16 != 0 {
+			return errors.Errorf("Invalid DiscardStatsGrowthIncrement %d, must be a positive "+
+				"multiple of 16", inc)
+		}
+		return nil
+	}
+	if opt.DiscardStatsGrowthFactor <= 1 {
+		return errors.Errorf("Invalid DiscardStatsGrowthFactor %v, must be greater than 1",
+			opt.DiscardStatsGrowthFactor)
+	}
+	return nil
+}
 
 func InitDiscardStats(opt Options) (*discardStats, error) {
+	if err := checkDiscardStatsSize(opt.DiscardStatsInitialSize); err != nil {
+		return nil, err
+	}
+	if err := checkDiscardStatsGrowth(opt); err != nil {
+		return nil, err
+	}
 	fname := filepath.Join(opt.ValueDir, discardFname)
 
-	// 1MB file can store 65.536 discard entries. Each entry is 16 bytes.
-	mf, err := z.OpenMmapFile(fname, os.O_CREATE|os.O_RDWR, 1<<20)
+	var mf *z.MmapFile
+	var err error
+	if opt.ReadOnly {
+		mf, err = readDiscardFile(fname)
+	} else if err = migrateDiscardFile(fname, opt); err != nil {
+		return nil, y.Wrapf(err, "while adding a header to file: %s", discardFname)
+	} else {
+		// Each entry is 16 bytes, so the default 1MB file can store 65.536 discard entries.
+		mf, err = z.OpenMmapFile(fname, os.O_CREATE|os.O_RDWR, int(opt.DiscardStatsInitialSize))
+	}
 	lf := &discardStats{
 		MmapFile: mf,
 		opt:      opt,
+		readOnly: opt.ReadOnly,
 	}
+	trusted := true
 	if err == z.NewFile {
-		// We don't need to zero out the entire 1MB.
+		// We don't need to zero out the entire file.
+		lf.writeHeader()
 		lf.zeroOut()
 
 	} else if err != nil {
 		return nil, y.Wrapf(err, "while opening file: %s\n", discardFname)
+	} else {
+		if trusted, err = lf.checkHeader(); err != nil {
+			closeErr := lf.Close(-1)
+			return nil, y.Wrapf(y.CombineErrors(err, closeErr), "while loading file: %s",
+				discardFname)
+		}
+		if int64(len(lf.Data)) < opt.DiscardStatsInitialSize && !lf.readOnly {
+			// An existing file keeps its entries, and gets the room asked for.
+			if err := lf.Truncate(opt.DiscardStatsInitialSize); err != nil {
+				return nil, y.Wrapf(err, "while growing file: %s", discardFname)
+			}
+		}
 	}
 
 	for slot := 0; slot < lf.maxSlot(); slot++ {
@@ -62,11 +141,189 @@ func InitDiscardStats(opt Options) (*discardStats, error) {
 			break
 		}
 	}
+	if sum := lf.sumSlots(); !trusted || sum != lf.headerChecksum() {
+		// A slot or the header was torn by a crash, so none of the slots can be trusted. The
+		// stats are only used to pick the value log files to GC, so starting over only delays GC.
+		opt.Warningf("Discard stats are corrupt, got checksum %d, want %d. Resetting the "+
+			"discard stats of %d files.", sum, lf.headerChecksum(), lf.nextEmptySlot)
+		lf.writeHeader()
+		lf.nextEmptySlot = 0
+		lf.zeroOut()
+		lf.setChecksum(0)
+	}
+	lf.checksum = lf.headerChecksum()
+	// Slots store fids as uint64, but value log fids are uint32, and the API hands them out as
+	// such. A larger fid can only come from a corrupt file, and would be silently truncated.
+	for slot := 0; slot < lf.nextEmptySlot; slot++ {
+		if fid := lf.get(16 * slot); fid > math.MaxUint32 {
+			closeErr := lf.Close(-1)
+			return nil, y.Wrapf(y.CombineErrors(errors.Errorf("invalid fid %d in slot %d",
+				fid, slot), closeErr), "while loading file: %s", discardFname)
+		}
+	}
 	sort.Sort(lf)
 	opt.Infof("Discard stats nextEmptySlot: %d\n", lf.nextEmptySlot)
 	return lf, nil
 }
 
+// readDiscardFile reads the discard stats file at fname into memory, without changing it. A missing
+// or empty file reads as an empty one, with room for a single slot, and z.NewFile is returned along
+// with it, like z.OpenMmapFile does for a file it creates.
+func readDiscardFile(fname string) (*z.MmapFile, error) {
+	data, err := os.ReadFile(fname)
+	switch {
+	case os.IsNotExist(err) || (err == nil && len(data) == 0):
+		return &z.MmapFile{Data: make([]byte, discardHeaderSize+16)}, z.NewFile
+	case err != nil:
+		return nil, err
+	}
+	// Without an Fd, z.MmapFile.Close is a no-op.
+	return &z.MmapFile{Data: data}, nil
+}
+
+// migrateDiscardFile adds a header to the discard stats file at fname if it was written before the
+// header was added. The new file is written next to the old one, and renamed over it, so that a
+// crash leaves one or the other, and never a file migrated twice.
+func migrateDiscardFile(fname string, opt Options) error {
+	tmp := fname + ".tmp"
+	// Left behind by a crash before the rename.
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	data, err := os.ReadFile(fname)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data[0:4]) != 0 {
+		// Empty, or not a legacy file. InitDiscardStats deals with it.
+		return nil
+	}
+	// Without an Fd, checkHeader migrates the file in memory.
+	lf := &discardStats{MmapFile: &z.MmapFile{Data: data}, opt: opt}
+	if _, err := lf.checkHeader(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(lf.Data); err != nil {
+		return y.CombineErrors(err, f.Close())
+	}
+	if err := f.Sync(); err != nil {
+		return y.CombineErrors(err, f.Close())
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(fname))
+}
+
+// grow grows the file to size bytes. A file read into memory by readDiscardFile only grows in
+// memory.
+func (lf *discardStats) grow(size int64) error {
+	if lf.Fd == nil {
+		data := make([]byte, size)
+		copy(data, lf.Data)
+		lf.Data = data
+		return nil
+	}
+	return lf.Truncate(size)
+}
+
+// writeHeader writes the header of a new file, whose slots are all empty.
+func (lf *discardStats) writeHeader() {
+	binary.BigEndian.PutUint32(lf.Data[0:4], discardMagic)
+	lf.Data[4] = discardVersion
+	lf.setChecksum(0)
+}
+
+// checkHeader checks the header of an existing file, and returns false if it's corrupt, in which
+// case the slots can't be trusted either. A file written before the header was added starts with
+// the fid of its first slot, whose upper half is zero as fids are uint32. Its slots are moved
+// after a new header, along with their checksum. This is only done in memory, by
+// migrateDiscardFile and for a file read by readDiscardFile, as a crash halfway through would
+// leave a file which looks like it still needs to be migrated.
+func (lf *discardStats) checkHeader() (bool, error) {
+	size := len(lf.Data)
+	if size < 16 || size%16 != 0 {
+		return false, errors.Errorf("invalid size %d", size)
+	}
+	switch binary.BigEndian.Uint32(lf.Data[0:4]) {
+	case discardMagic:
+		if v := lf.Data[4]; v != discardVersion {
+			return false, errors.Errorf("unsupported version %d", v)
+		}
+		if size < discardHeaderSize+16 {
+			return false, errors.Errorf("invalid size %d", size)
+		}
+		return true, nil
+	case 0:
+		if lf.Fd != nil {
+			return false, errors.New("missing header, the file must be migrated first")
+		}
+		if err := lf.grow(int64(size + discardHeaderSize)); err != nil {
+			return false, y.Wrapf(err, "while growing file")
+		}
+		copy(lf.Data[discardHeaderSize:], lf.Data[:size])
+		lf.writeHeader()
+		var sum uint64
+		for slot := 0; slot < lf.maxSlot() && lf.get(16*slot) != 0; slot++ {
+			sum += lf.slotHash(slot)
+		}
+		lf.setChecksum(sum)
+		lf.opt.Infof("Added a header to the discard stats file")
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (lf *discardStats) headerChecksum() uint64 {
+	return binary.BigEndian.Uint64(lf.Data[8:16])
+}
+
+func (lf *discardStats) setChecksum(sum uint64) {
+	binary.BigEndian.PutUint64(lf.Data[8:16], sum)
+}
+
+// slots returns the part of the file holding the slots, after the header.
+func (lf *discardStats) slots() []byte {
+	return lf.Data[discardHeaderSize:]
+}
+
+// slotHash returns the contribution of a slot to the checksum.
+func (lf *discardStats) slotHash(slot int) uint64 {
+	return xxhash.Sum64(lf.slots()[16*slot : 16*slot+16])
+}
+
+// sumSlots computes the checksum of the slots in use.
+func (lf *discardStats) sumSlots() uint64 {
+	var sum uint64
+	for slot := 0; slot < lf.nextEmptySlot; slot++ {
+		sum += lf.slotHash(slot)
+	}
+	return sum
+}
+
+// addChecksum adds the hash of a slot to the checksum, or removes it if remove is set. This should
+// be called while holding the lock.
+func (lf *discardStats) addChecksum(slot int, remove bool) {
+	if remove {
+		lf.checksum -= lf.slotHash(slot)
+	} else {
+		lf.checksum += lf.slotHash(slot)
+	}
+	lf.setChecksum(lf.checksum)
+}
+
 func (lf *discardStats) Len() int {
 	return lf.nextEmptySlot
 }
@@ -74,20 +331,20 @@ func (lf *discardStats) Less(i, j int) bool {
 	return lf.get(16*i) < lf.get(16*j)
 }
 func (lf *discardStats) Swap(i, j int) {
-	left := lf.Data[16*i : 16*i+16]
-	right := lf.Data[16*j : 16*j+16]
+	left := lf.slots()[16*i : 16*i+16]
+	right := lf.slots()[16*j : 16*j+16]
 	var tmp [16]byte
 	copy(tmp[:], left)
 	copy(left, right)
 	copy(right, tmp[:])
 }
 
-// offset is not slot.
+// offset is not slot, and starts after the header.
 func (lf *discardStats) get(offset int) uint64 {
-	return binary.BigEndian.Uint64(lf.Data[offset : offset+8])
+	return binary.BigEndian.Uint64(lf.slots()[offset : offset+8])
 }
 func (lf *discardStats) set(offset int, val uint64) {
-	binary.BigEndian.PutUint64(lf.Data[offset:offset+8], val)
+	binary.BigEndian.PutUint64(lf.slots()[offset:offset+8], val)
 }
 
 // zeroOut would zero out the next slot.
@@ -97,17 +354,50 @@ func (lf *discardStats) zeroOut() {
 }
 
 func (lf *discardStats) maxSlot() int {
-	return len(lf.Data) / 16
+	return len(lf.slots()) / 16
 }
 
 // Update would update the discard stats for the given file id. If discard is
 // 0, it would return the current value of discard for the file. If discard is
-// < 0, it would set the current value of discard to zero for the file.
+// < 0, it would set the current value of discard to zero for the file. If the stats are read-only,
+// it only returns the current value.
 func (lf *discardStats) Update(fidu uint32, discard int64) int64 {
-	fid := uint64(fidu)
 	lf.Lock()
 	defer lf.Unlock()
 
+	if lf.readOnly {
+		return lf.update(fidu, 0)
+	}
+	val := lf.update(fidu, discard)
+	if discard < 0 {
+		lf.maybeCompact()
+	}
+	return val
+}
+
+// UpdateBatch applies Update to each of the given file ids under a single lock.
+func (lf *discardStats) UpdateBatch(stats map[uint32]int64) {
+	lf.Lock()
+	defer lf.Unlock()
+
+	if lf.readOnly {
+		return
+	}
+
+	var reset bool
+	for fid, discard := range stats {
+		lf.update(fid, discard)
+		reset = reset || discard < 0
+	}
+	if reset {
+		lf.maybeCompact()
+	}
+}
+
+// This should be called while holding the lock. The fid is widened to the uint64 stored in the
+// slots before any comparison, so fids near math.MaxUint32 are ordered correctly.
+func (lf *discardStats) update(fidu uint32, discard int64) int64 {
+	fid := uint64(fidu)
 	idx := sort.Search(lf.nextEmptySlot, func(slot int) bool {
 		return lf.get(slot*16) >= fid
 	})
@@ -117,6 +407,8 @@ func (lf *discardStats) Update(fidu uint32, discard int64) int64 {
 		if discard == 0 {
 			return int64(curDisc)
 		}
+		lf.addChecksum(idx, true)
+		defer lf.addChecksum(idx, false)
 		if discard < 0 {
 			lf.set(off, 0)
 			return 0
@@ -129,23 +421,148 @@ func (lf *discardStats) Update(fidu uint32, discard int64) int64 {
 		return 0
 	}
 
-	// Could not find the fid. Add the entry.
-	idx = lf.nextEmptySlot
+	// Could not find the fid. Add the entry at idx, so that the slots stay sorted by fid. New fids
+	// are usually the largest ones, in which case there is nothing to shift. There is always room
+	// for the shift, because the slot at nextEmptySlot is within the file.
+	if idx < lf.nextEmptySlot {
+		slots := lf.slots()
+		copy(slots[16*idx+16:16*lf.nextEmptySlot+16], slots[16*idx:16*lf.nextEmptySlot])
+	}
 	lf.set(idx*16, fid)
 	lf.set(idx*16+8, uint64(discard))
+	lf.addChecksum(idx, false)
 
 	// Move to next slot.
 	lf.nextEmptySlot++
 	for lf.nextEmptySlot >= lf.maxSlot() {
-		y.Check(lf.Truncate(2 * int64(len(lf.Data))))
+		y.Check(lf.Truncate(lf.grownSize()))
 	}
 	lf.zeroOut()
+	return discard
+}
 
-	sort.Sort(lf)
+// grownSize returns the size the file grows to once it's full, following
+// Options.DiscardStatsGrowthIncrement or Options.DiscardStatsGrowthFactor. It is rounded up to a
+// whole number of slots, and leaves room for at least one more.
+func (lf *discardStats) grownSize() int64 {
+	cur := int64(len(lf.Data))
+	size := int64(float64(cur) * lf.opt.DiscardStatsGrowthFactor)
+	if inc := lf.opt.DiscardStatsGrowthIncrement; inc > 0 {
+		size = cur + inc
+	}
+	size = (size + 15) / 16 * 16
+	if size < cur+16 {
+		size = cur + 16
+	}
+	return size
+}
+
+// maybeCompact compacts the stats once the fraction of slots with zero discard goes over
+// Options.DiscardStatsCompactZeroRatio. This should be called while holding the lock.
+func (lf *discardStats) maybeCompact() {
+	ratio := lf.opt.DiscardStatsCompactZeroRatio
+	if ratio <= 0 || lf.nextEmptySlot == 0 {
+		return
+	}
+	var zeros int
+	for slot := 0; slot < lf.nextEmptySlot; slot++ {
+		if lf.get(16*slot+8) == 0 {
+			zeros++
+		}
+	}
+	if float64(zeros)/float64(lf.nextEmptySlot) > ratio {
+		lf.compact()
+	}
+}
+
+// Compact removes the slots of files with zero discard, which are left behind once value log GC
+// has reset them. It returns the number of slots reclaimed.
+func (lf *discardStats) Compact() int {
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.readOnly {
+		return 0
+	}
+	return lf.compact()
+}
+
+// This should be called while holding the lock.
+func (lf *discardStats) compact() int {
+	next := 0
+	for slot := 0; slot < lf.nextEmptySlot; slot++ {
+		if lf.get(16*slot+8) == 0 {
+			lf.addChecksum(slot, true)
+			continue
+		}
+		if slot != next {
+			slots := lf.slots()
+			copy(slots[16*next:16*next+16], slots[16*slot:16*slot+16])
+		}
+		next++
+	}
+	// The slots keep their order, so they stay sorted by fid.
+	reclaimed := lf.nextEmptySlot - next
+	lf.nextEmptySlot = next
+	lf.zeroOut()
+	return reclaimed
+}
+
+// Reset clears the stats of all the files, for example after a value log GC pass that rewrote
+// all of them. The file keeps its size.
+func (lf *discardStats) Reset() {
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.readOnly {
+		return
+	}
+	lf.nextEmptySlot = 0
+	lf.zeroOut()
+	lf.checksum = 0
+	lf.setChecksum(0)
+}
+
+// ResetFid removes the stats of the given file id. Unlike Update with a negative discard, which
+// leaves a slot with zero discard behind, the slot is reclaimed right away. It returns the discard
+// the file had.
+func (lf *discardStats) ResetFid(fidu uint32) int64 {
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.readOnly {
+		return 0
+	}
+
+	fid := uint64(fidu)
+	idx := sort.Search(lf.nextEmptySlot, func(slot int) bool {
+		return lf.get(slot*16) >= fid
+	})
+	if idx == lf.nextEmptySlot || lf.get(idx*16) != fid {
+		return 0
+	}
+	discard := int64(lf.get(idx*16 + 8))
+	lf.addChecksum(idx, true)
+	slots := lf.slots()
+	copy(slots[16*idx:16*lf.nextEmptySlot], slots[16*idx+16:16*lf.nextEmptySlot])
+	lf.nextEmptySlot--
+	lf.zeroOut()
 	return discard
 }
 
+// Iterate calls f with the discard stats of each file, in increasing order of file id. It works
+// on a copy of the stats taken under the lock, so it is safe to call concurrently with Update,
+// even when Update grows and remaps the file, and f may call the other methods of discardStats.
 func (lf *discardStats) Iterate(f func(fid, stats uint64)) {
+	lf.Lock()
+	data := make([]byte, 16*lf.nextEmptySlot)
+	copy(data, lf.slots())
+	lf.Unlock()
+
+	for idx := 0; idx < len(data); idx += 16 {
+		f(binary.BigEndian.Uint64(data[idx:idx+8]), binary.BigEndian.Uint64(data[idx+8:idx+16]))
+	}
+}
+
+// This should be called while holding the lock.
+func (lf *discardStats) iterate(f func(fid, stats uint64)) {
 	for slot := 0; slot < lf.nextEmptySlot; slot++ {
 		idx := 16 * slot
 		f(lf.get(idx), lf.get(idx+8))
@@ -156,9 +573,12 @@ func (lf *discardStats) Iterate(f func(fid, stats uint64)) {
 func (lf *discardStats) MaxDiscard() (uint32, int64) {
 	lf.Lock()
 	defer lf.Unlock()
+	if lf.readOnly {
+		return 0, 0
+	}
 
 	var maxFid, maxVal uint64
-	lf.Iterate(func(fid, val uint64) {
+	lf.iterate(func(fid, val uint64) {
 		if maxVal < val {
 			maxVal = val
 			maxFid = fid
@@ -166,3 +586,138 @@ func (lf *discardStats) MaxDiscard() (uint32, int64) {
 	})
 	return uint32(maxFid), int64(maxVal)
 }
+
+// MaxDiscardRatio returns the file id with the largest fraction of discard bytes, out of the
+// files with at least minDiscard discard bytes. size returns the size of the file with the given
+// id, or a value <= 0 to skip the file, for example because it doesn't exist anymore. size is
+// called with the lock held, so it must not call back into discardStats. Unlike MaxDiscard, it
+// prefers a small file which is mostly stale over a big one which is mostly live, though the
+// latter has more discard bytes. It returns 0 if there is no such file.
+func (lf *discardStats) MaxDiscardRatio(size func(fid uint32) int64,
+	minDiscard int64) (uint32, int64) {
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.readOnly {
+		return 0, 0
+	}
+
+	var maxFid, maxVal uint64
+	var maxRatio float64
+	lf.iterate(func(fid, val uint64) {
+		if val == 0 || int64(val) < minDiscard {
+			return
+		}
+		sz := size(uint32(fid))
+		if sz <= 0 {
+			return
+		}
+		if ratio := float64(val) / float64(sz); maxRatio < ratio {
+			maxRatio = ratio
+			maxVal = val
+			maxFid = fid
+		}
+	})
+	return uint32(maxFid), int64(maxVal)
+}
+
+// fileDiscard is the discard of a single file, as returned by TopDiscard.
+type fileDiscard struct {
+	Fid     uint32
+	Discard int64
+}
+
+// discardHeap keeps the entry with the least discard on top. Among equal discards, the one with
+// the higher fid is on top, so that lower fids are kept.
+type discardHeap []fileDiscard
+
+func (h discardHeap) Len() int { return len(h) }
+func (h discardHeap) Less(i, j int) bool {
+	if h[i].Discard != h[j].Discard {
+		return h[i].Discard < h[j].Discard
+	}
+	return h[i].Fid > h[j].Fid
+}
+func (h discardHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *discardHeap) Push(x interface{}) { *h = append(*h, x.(fileDiscard)) }
+func (h *discardHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// TopDiscard returns up to n files with the most discard bytes, sorted by decreasing discard.
+// Files with the same discard are sorted by fid. Files with zero discard are left out.
+func (lf *discardStats) TopDiscard(n int) []fileDiscard {
+	if n <= 0 {
+		return nil
+	}
+	lf.Lock()
+	defer lf.Unlock()
+
+	h := make(discardHeap, 0, n)
+	lf.iterate(func(fid, val uint64) {
+		e := fileDiscard{Fid: uint32(fid), Discard: int64(val)}
+		switch {
+		case e.Discard == 0:
+		case len(h) < n:
+			heap.Push(&h, e)
+		case h[0].Discard < e.Discard:
+			// Slots are sorted by fid, so e never wins a tie against the top.
+			h[0] = e
+			heap.Fix(&h, 0)
+		}
+	})
+	top := make([]fileDiscard, len(h))
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(&h).(fileDiscard)
+	}
+	return top
+}
+
+// Sync flushes the discard stats to disk. Update mutates the memory map in place, so the stats
+// only survive a crash once they have been synced. Holding the lock keeps a concurrent Update
+// from remapping the file while it's being synced, so the region added by a grow is covered too.
+func (lf *discardStats) Sync() error {
+	lf.Lock()
+	defer lf.Unlock()
+	if lf.readOnly {
+		return nil
+	}
+	return y.Wrapf(lf.MmapFile.Sync(), "while syncing file: %s", discardFname)
+}
+
+// SnapshotTo writes a point-in-time copy of the discard stats to the file at path. The copy is
+// written to a temporary file in the same directory, which is then renamed to path, so path
+// either holds a complete snapshot or is left as it was. A snapshot named DISCARD can be loaded
+// back with InitDiscardStats.
+func (lf *discardStats) SnapshotTo(path string) error {
+	lf.Lock()
+	defer lf.Unlock()
+
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return y.Wrapf(err, "while creating temporary file for discard stats snapshot")
+	}
+	tmpName := f.Name()
+	// Remove the temporary file if anything below fails. It's a no-op after the rename.
+	defer os.Remove(tmpName)
+
+	if _, err := f.Write(lf.Data); err != nil {
+		f.Close()
+		return y.Wrapf(err, "while writing discard stats snapshot to %s", tmpName)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return y.Wrapf(err, "while syncing discard stats snapshot %s", tmpName)
+	}
+	if err := f.Close(); err != nil {
+		return y.Wrapf(err, "while closing discard stats snapshot %s", tmpName)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return y.Wrapf(err, "while renaming discard stats snapshot to %s", path)
+	}
+	return syncDir(dir)
+}
@@ -17,8 +17,19 @@
 package badger
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -53,6 +64,291 @@ func TestDiscardStats(t *testing.T) {
 	})
 }
 
+func TestDiscardStatsInitialSize(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	for _, size := range []int64{0, 8, 16, 40} {
+		_, err := InitDiscardStats(DefaultOptions(dir).WithDiscardStatsInitialSize(size))
+		require.Error(t, err)
+		_, err = Open(DefaultOptions(dir).WithDiscardStatsInitialSize(size))
+		require.Error(t, err)
+	}
+
+	// A file with room for two entries has to grow several times.
+	opt := DefaultOptions(dir).WithDiscardStatsInitialSize(32)
+	ds, err := InitDiscardStats(opt)
+	require.NoError(t, err)
+	require.Len(t, ds.Data, 32)
+	for i := uint32(1); i <= 10; i++ {
+		require.Equal(t, int64(i*100), ds.Update(i, int64(i*100)))
+	}
+	require.Len(t, ds.Data, 256)
+	var ids []uint64
+	ds.Iterate(func(id, val uint64) {
+		ids = append(ids, id)
+		require.Equal(t, id*100, val)
+	})
+	require.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, ids)
+	require.NoError(t, ds.Close(-1))
+
+	// An existing file is grown to the initial size, and keeps its entries.
+	ds, err = InitDiscardStats(opt.WithDiscardStatsInitialSize(1024))
+	require.NoError(t, err)
+	require.Len(t, ds.Data, 1024)
+	require.Equal(t, 10, ds.nextEmptySlot)
+	require.Equal(t, int64(700), ds.Update(7, 0))
+	require.NoError(t, ds.Close(-1))
+}
+
+func TestDiscardStatsChecksum(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	fname := filepath.Join(dir, discardFname)
+
+	fill := func() {
+		ds, err := InitDiscardStats(DefaultOptions(dir))
+		require.NoError(t, err)
+		ds.Reset()
+		for i := uint32(1); i <= 10; i++ {
+			ds.Update(i, int64(i*100))
+		}
+		ds.Update(3, -1)
+		ds.ResetFid(5)
+		require.NoError(t, ds.Close(-1))
+	}
+	load := func() []uint64 {
+		ds, err := InitDiscardStats(DefaultOptions(dir))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, ds.Close(-1)) }()
+		require.Equal(t, ds.sumSlots(), ds.headerChecksum())
+		var ids []uint64
+		ds.Iterate(func(id, val uint64) {
+			ids = append(ids, id)
+		})
+		return ids
+	}
+	want := []uint64{1, 2, 3, 4, 6, 7, 8, 9, 10}
+
+	fill()
+	require.Equal(t, want, load())
+
+	// Flipping a byte of a slot, or of the header, resets the stats.
+	for _, off := range []int64{discardHeaderSize + 16*4 + 12, discardHeaderSize + 3, 9, 2} {
+		fill()
+		f, err := os.OpenFile(fname, os.O_RDWR, 0)
+		require.NoError(t, err)
+		var b [1]byte
+		_, err = f.ReadAt(b[:], off)
+		require.NoError(t, err)
+		b[0] ^= 0x40
+		_, err = f.WriteAt(b[:], off)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.Empty(t, load(), "offset %d", off)
+
+		// The reset stats can be used again.
+		ds, err := InitDiscardStats(DefaultOptions(dir))
+		require.NoError(t, err)
+		require.Equal(t, int64(70), ds.Update(7, 70))
+		require.NoError(t, ds.Close(-1))
+		require.Equal(t, []uint64{7}, load())
+	}
+
+	// A file of an unknown version is rejected.
+	fill()
+	data, err := os.ReadFile(fname)
+	require.NoError(t, err)
+	data[4] = discardVersion + 1
+	require.NoError(t, os.WriteFile(fname, data, 0600))
+	_, err = InitDiscardStats(DefaultOptions(dir))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported version")
+}
+
+func TestDiscardStatsWithoutHeader(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// A file written before the header was added holds the slots only.
+	data := make([]byte, 64)
+	for i, fid := range []uint64{2, 5, 9} {
+		binary.BigEndian.PutUint64(data[16*i:], fid)
+		binary.BigEndian.PutUint64(data[16*i+8:], fid*10)
+	}
+	fname := filepath.Join(dir, discardFname)
+	require.NoError(t, os.WriteFile(fname, data, 0600))
+	// A crash before the migrated file was renamed into place leaves it behind, half written.
+	require.NoError(t, os.WriteFile(fname+".tmp", data[:20], 0600))
+
+	ds, err := InitDiscardStats(DefaultOptions(dir).WithDiscardStatsInitialSize(32))
+	require.NoError(t, err)
+	require.Len(t, ds.Data, 64+discardHeaderSize)
+	_, err = os.Stat(fname + ".tmp")
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, 3, ds.nextEmptySlot)
+	require.Equal(t, int64(50), ds.Update(5, 0))
+	require.Equal(t, int64(91), ds.Update(9, 1))
+	require.Equal(t, int64(7), ds.Update(12, 7))
+	require.NoError(t, ds.Close(-1))
+
+	// The file now has a header, and keeps the stats.
+	ds, err = InitDiscardStats(DefaultOptions(dir))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ds.Close(-1)) }()
+	require.Equal(t, uint32(discardMagic), binary.BigEndian.Uint32(ds.Data))
+	require.Equal(t, 4, ds.nextEmptySlot)
+	require.Equal(t, int64(20), ds.Update(2, 0))
+	require.Equal(t, int64(91), ds.Update(9, 0))
+	require.Equal(t, int64(7), ds.Update(12, 0))
+}
+
+func TestDiscardStatsEmptyFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	fname := filepath.Join(dir, discardFname)
+
+	for _, readOnly := range []bool{true, false} {
+		require.NoError(t, os.WriteFile(fname, nil, 0600))
+		ds, err := InitDiscardStats(DefaultOptions(dir).WithReadOnly(readOnly))
+		require.NoError(t, err)
+		require.Zero(t, ds.nextEmptySlot)
+		require.Equal(t, uint32(discardMagic), binary.BigEndian.Uint32(ds.Data))
+		require.NoError(t, ds.Close(-1))
+	}
+}
+
+func TestDiscardStatsGrowth(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	for _, opt := range []Options{
+		DefaultOptions(dir).WithDiscardStatsGrowthFactor(1),
+		DefaultOptions(dir).WithDiscardStatsGrowthFactor(0.5),
+		DefaultOptions(dir).WithDiscardStatsGrowthIncrement(-16),
+		DefaultOptions(dir).WithDiscardStatsGrowthIncrement(40),
+	} {
+		_, err := InitDiscardStats(opt)
+		require.Error(t, err)
+		_, err = Open(opt)
+		require.Error(t, err)
+	}
+
+	tests := []struct {
+		opt   Options
+		sizes []int
+	}{
+		// Rounded up to a multiple of 16, and always by at least one slot.
+		{DefaultOptions(dir).WithDiscardStatsGrowthFactor(1.25), []int{48, 64, 80, 112, 144, 192}},
+		{DefaultOptions(dir).WithDiscardStatsGrowthFactor(1.01), []int{48, 64, 80, 96, 112, 128}},
+		// The increment takes precedence over the factor.
+		{DefaultOptions(dir).WithDiscardStatsGrowthIncrement(64), []int{96, 160, 224, 288, 352, 416}},
+	}
+	for _, tt := range tests {
+		require.NoError(t, os.RemoveAll(filepath.Join(dir, discardFname)))
+		ds, err := InitDiscardStats(tt.opt.WithDiscardStatsInitialSize(32))
+		require.NoError(t, err)
+		var sizes []int
+		for fid, last := uint32(1), 32; len(sizes) < len(tt.sizes); fid++ {
+			ds.Update(fid, 1)
+			if n := len(ds.Data); n != last {
+				sizes, last = append(sizes, n), n
+			}
+		}
+		require.Equal(t, tt.sizes, sizes)
+		require.NoError(t, ds.Close(-1))
+	}
+}
+
+func TestDiscardStatsReadOnly(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	fname := filepath.Join(dir, discardFname)
+
+	// A missing file isn't created.
+	ds, err := InitDiscardStats(DefaultOptions(dir).WithReadOnly(true))
+	require.NoError(t, err)
+	require.Zero(t, ds.Update(1, 100))
+	require.NoError(t, ds.Sync())
+	require.NoError(t, ds.Close(-1))
+	_, err = os.Stat(fname)
+	require.True(t, os.IsNotExist(err))
+
+	ds, err = InitDiscardStats(DefaultOptions(dir))
+	require.NoError(t, err)
+	ds.Update(1, 100)
+	ds.Update(2, 300)
+	require.NoError(t, ds.Close(-1))
+	data, err := os.ReadFile(fname)
+	require.NoError(t, err)
+
+	// An existing file can be read, but nothing changes it.
+	ds, err = InitDiscardStats(DefaultOptions(dir).WithReadOnly(true).
+		WithDiscardStatsInitialSize(4 << 20))
+	require.NoError(t, err)
+	require.Equal(t, int64(100), ds.Update(1, 50))
+	require.Equal(t, int64(300), ds.Update(2, -1))
+	require.Zero(t, ds.Update(3, 10))
+	ds.UpdateBatch(map[uint32]int64{1: 10, 4: 10})
+	require.Zero(t, ds.ResetFid(1))
+	ds.Reset()
+	require.Zero(t, ds.Compact())
+	fid, discard := ds.MaxDiscard()
+	require.Zero(t, fid)
+	require.Zero(t, discard)
+	fid, discard = ds.MaxDiscardRatio(func(uint32) int64 { return 1000 }, 0)
+	require.Zero(t, fid)
+	require.Zero(t, discard)
+	var ids []uint64
+	ds.Iterate(func(id, val uint64) { ids = append(ids, id) })
+	require.Equal(t, []uint64{1, 2}, ids)
+	require.NoError(t, ds.Sync())
+	require.NoError(t, ds.Close(-1))
+	after, err := os.ReadFile(fname)
+	require.NoError(t, err)
+	require.Equal(t, data, after)
+}
+
+func TestDiscardStatsReadOnlyDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ReadOnly is not supported on Windows")
+	}
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	txnSet(t, db, []byte("key"), []byte("value"), 0)
+	require.NoError(t, db.Close())
+	// A snapshot copied without its DISCARD file.
+	require.NoError(t, os.Remove(filepath.Join(dir, discardFname)))
+
+	require.NoError(t, os.Chmod(dir, 0555))
+	defer func() { require.NoError(t, os.Chmod(dir, 0755)) }()
+	db, err = Open(getTestOptions(dir).WithReadOnly(true))
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("key"))
+		require.NoError(t, err)
+		require.NoError(t, item.Value(func(val []byte) error {
+			require.Equal(t, []byte("value"), val)
+			return nil
+		}))
+		return nil
+	}))
+	require.Equal(t, ErrNoRewrite, db.RunValueLogGC(0.5))
+	require.NoError(t, db.Close())
+	_, err = os.Stat(filepath.Join(dir, discardFname))
+	require.True(t, os.IsNotExist(err))
+}
+
 func TestReloadDiscardStats(t *testing.T) {
 	dir, err := os.MkdirTemp("", "badger-test")
 	require.NoError(t, err)
@@ -75,3 +371,543 @@ func TestReloadDiscardStats(t *testing.T) {
 	require.Zero(t, ds2.Update(uint32(1), 0))
 	require.Equal(t, 1, int(ds2.Update(uint32(2), 0)))
 }
+
+func TestDiscardStatsSync(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	copyDir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(copyDir)
+
+	// Start small so that the file is grown and remapped before it's synced.
+	ds, err := InitDiscardStats(DefaultOptions(dir).WithDiscardStatsInitialSize(32))
+	require.NoError(t, err)
+	for i := uint32(1); i <= 10; i++ {
+		ds.Update(i, int64(i*100))
+	}
+	require.Len(t, ds.Data, 256)
+	require.NoError(t, ds.Sync())
+
+	// Load what is in the file, without going through Close.
+	data, err := os.ReadFile(filepath.Join(dir, discardFname))
+	require.NoError(t, err)
+	require.Equal(t, ds.Data, data)
+	require.NoError(t, os.WriteFile(filepath.Join(copyDir, discardFname), data, 0600))
+	ds2, err := InitDiscardStats(DefaultOptions(copyDir))
+	require.NoError(t, err)
+	require.Equal(t, 10, ds2.nextEmptySlot)
+	ds2.Iterate(func(id, val uint64) {
+		require.Equal(t, id*100, val)
+	})
+	require.NoError(t, ds2.Close(-1))
+	require.NoError(t, ds.Close(-1))
+
+	// DB.Sync syncs the discard stats too.
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	db.vlog.discardStats.Update(uint32(20), 2000)
+	require.NoError(t, db.Sync())
+	require.Equal(t, int64(2000), db.vlog.discardStats.Update(uint32(20), 0))
+	require.NoError(t, db.Close())
+}
+
+func TestDiscardStatsAutoCompact(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := DefaultOptions(dir).WithDiscardStatsCompactZeroRatio(0.5)
+	ds, err := InitDiscardStats(opt)
+	require.NoError(t, err)
+	for i := uint32(1); i <= 10; i++ {
+		ds.Update(i, int64(i*100))
+	}
+
+	// Half of the slots being zero doesn't cross the ratio.
+	for i := uint32(1); i <= 5; i++ {
+		ds.Update(i, -1)
+	}
+	require.Equal(t, 10, ds.nextEmptySlot)
+
+	// One more reset crosses it, and the zero slots are reclaimed.
+	ds.UpdateBatch(map[uint32]int64{6: -1, 7: 50})
+	require.Equal(t, 4, ds.nextEmptySlot)
+	var ids []uint64
+	ds.Iterate(func(id, val uint64) {
+		ids = append(ids, id)
+		if id == 7 {
+			require.Equal(t, uint64(750), val)
+			return
+		}
+		require.Equal(t, id*100, val)
+	})
+	require.Equal(t, []uint64{7, 8, 9, 10}, ids)
+	require.Zero(t, ds.Update(uint32(3), 0))
+	require.Equal(t, int64(900), ds.Update(uint32(9), 0))
+
+	// The compacted stats are what gets loaded back.
+	require.NoError(t, ds.Close(-1))
+	ds, err = InitDiscardStats(opt)
+	require.NoError(t, err)
+	require.Equal(t, 4, ds.nextEmptySlot)
+	require.Zero(t, ds.Compact())
+}
+
+func TestDiscardStatsReset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	ds, err := InitDiscardStats(DefaultOptions(dir))
+	require.NoError(t, err)
+	for i := uint32(1); i <= 10; i++ {
+		ds.Update(i, int64(i*100))
+	}
+
+	// ResetFid takes the slot out, and leaves the others sorted.
+	require.Equal(t, int64(500), ds.ResetFid(5))
+	require.Zero(t, ds.ResetFid(5))
+	require.Zero(t, ds.ResetFid(42))
+	require.Equal(t, int64(1000), ds.ResetFid(10))
+	require.Equal(t, 8, ds.nextEmptySlot)
+	var ids []uint64
+	ds.Iterate(func(id, val uint64) {
+		ids = append(ids, id)
+		require.Equal(t, id*100, val)
+	})
+	require.Equal(t, []uint64{1, 2, 3, 4, 6, 7, 8, 9}, ids)
+	fid, discard := ds.MaxDiscard()
+	require.Equal(t, uint32(9), fid)
+	require.Equal(t, int64(900), discard)
+
+	size := len(ds.Data)
+	ds.Reset()
+	require.Len(t, ds.Data, size)
+	require.Zero(t, ds.nextEmptySlot)
+	fid, discard = ds.MaxDiscard()
+	require.Zero(t, fid)
+	require.Zero(t, discard)
+
+	// The stats can be filled again, and the reset is what gets loaded back.
+	require.Equal(t, int64(70), ds.Update(7, 70))
+	require.NoError(t, ds.Close(-1))
+	ds, err = InitDiscardStats(DefaultOptions(dir))
+	require.NoError(t, err)
+	require.Equal(t, 1, ds.nextEmptySlot)
+	require.Zero(t, ds.Update(3, 0))
+	require.Equal(t, int64(70), ds.Update(7, 0))
+	require.NoError(t, ds.Close(-1))
+}
+
+func TestDiscardStatsCompactInterleaved(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// No automatic compaction, so that all the zero slots are left for Compact.
+	ds, err := InitDiscardStats(DefaultOptions(dir).WithDiscardStatsCompactZeroRatio(0))
+	require.NoError(t, err)
+	for i := uint32(1); i <= 12; i++ {
+		ds.Update(i, int64(i*100))
+	}
+	// Zero out every third slot, and a run of two at the end.
+	for _, fid := range []uint32{1, 4, 7, 11, 12} {
+		ds.Update(fid, -1)
+	}
+	require.Equal(t, 12, ds.nextEmptySlot)
+
+	require.Equal(t, 5, ds.Compact())
+	require.Equal(t, 7, ds.nextEmptySlot)
+	require.Zero(t, ds.get(16*ds.nextEmptySlot))
+	var ids []uint64
+	ds.Iterate(func(id, val uint64) {
+		ids = append(ids, id)
+		require.Equal(t, id*100, val)
+	})
+	require.Equal(t, []uint64{2, 3, 5, 6, 8, 9, 10}, ids)
+
+	// The binary search still finds every fid, and new ones are inserted in order.
+	for _, id := range ids {
+		require.Equal(t, int64(id*100), ds.Update(uint32(id), 0))
+	}
+	require.Zero(t, ds.Update(4, 0))
+	require.Equal(t, int64(40), ds.Update(4, 40))
+	require.Zero(t, ds.Compact())
+	require.NoError(t, ds.Close(-1))
+}
+
+func TestDiscardStatsConcurrentIterate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// Start small, so that the updates keep growing and remapping the file.
+	ds, err := InitDiscardStats(DefaultOptions(dir).WithDiscardStatsInitialSize(32))
+	require.NoError(t, err)
+	defer ds.Close(-1)
+
+	const n = 2000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint32(1); i <= n; i++ {
+			ds.Update(i, int64(i))
+		}
+	}()
+
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		var last uint64
+		ds.Iterate(func(id, val uint64) {
+			require.Greater(t, id, last)
+			require.Equal(t, id, val)
+			last = id
+		})
+	}
+
+	// f can call back into discardStats.
+	var count int
+	ds.Iterate(func(id, val uint64) {
+		require.Equal(t, int64(val), ds.Update(uint32(id), 0))
+		count++
+	})
+	require.Equal(t, n, count)
+}
+
+func TestDiscardStatsTopDiscard(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	ds, err := InitDiscardStats(DefaultOptions(dir))
+	require.NoError(t, err)
+	defer ds.Close(-1)
+	require.Empty(t, ds.TopDiscard(3))
+
+	discards := map[uint32]int64{1: 300, 2: 900, 3: 100, 4: 900, 5: 500, 6: 700, 7: 0}
+	for fid, discard := range discards {
+		ds.Update(fid, discard)
+	}
+	ds.Update(8, 50)
+	ds.Update(8, -1)
+
+	require.Nil(t, ds.TopDiscard(0))
+	require.Equal(t, []fileDiscard{{2, 900}, {4, 900}, {6, 700}}, ds.TopDiscard(3))
+	require.Equal(t, []fileDiscard{{2, 900}}, ds.TopDiscard(1))
+	// Files with zero discard aren't returned.
+	require.Equal(t, []fileDiscard{{2, 900}, {4, 900}, {6, 700}, {5, 500}, {1, 300}, {3, 100}},
+		ds.TopDiscard(10))
+
+	// The first entry matches MaxDiscard.
+	fid, discard := ds.MaxDiscard()
+	require.Equal(t, fileDiscard{fid, discard}, ds.TopDiscard(1)[0])
+}
+
+func TestDiscardStatsMaxDiscardRatio(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	ds, err := InitDiscardStats(DefaultOptions(dir))
+	require.NoError(t, err)
+	defer ds.Close(-1)
+
+	sizes := map[uint32]int64{
+		1: 1 << 30, // Big, and mostly live.
+		2: 1 << 20, // Small, and mostly stale.
+		3: 1 << 20,
+		4: 0, // Deleted.
+	}
+	size := func(fid uint32) int64 { return sizes[fid] }
+	fid, discard := ds.MaxDiscardRatio(size, 0)
+	require.Zero(t, fid)
+	require.Zero(t, discard)
+
+	ds.Update(1, 100<<20)
+	ds.Update(2, 900<<10)
+	ds.Update(3, 300<<10)
+	ds.Update(4, 2<<30)
+
+	// MaxDiscard goes for the most bytes, MaxDiscardRatio for the most stale file.
+	fid, _ = ds.MaxDiscard()
+	require.Equal(t, uint32(4), fid)
+	fid, discard = ds.MaxDiscardRatio(size, 0)
+	require.Equal(t, uint32(2), fid)
+	require.Equal(t, int64(900<<10), discard)
+
+	// Files below the minimum discard are skipped, however stale they are.
+	fid, discard = ds.MaxDiscardRatio(size, 1<<20)
+	require.Equal(t, uint32(1), fid)
+	require.Equal(t, int64(100<<20), discard)
+	fid, _ = ds.MaxDiscardRatio(size, 1<<30)
+	require.Zero(t, fid)
+}
+
+func TestDumpDiscardStats(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		var buf bytes.Buffer
+		require.NoError(t, db.DumpDiscardStats(&buf))
+		require.Zero(t, buf.Len())
+
+		for _, fid := range []uint32{7, 3, 12, 1} {
+			db.vlog.discardStats.Update(fid, int64(fid*100))
+		}
+		require.NoError(t, db.DumpDiscardStats(&buf))
+
+		type fileStat struct {
+			Fid          uint64 `json:"fid"`
+			DiscardBytes uint64 `json:"discard_bytes"`
+		}
+		var fids []uint64
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			var st fileStat
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &st))
+			require.Equal(t, st.Fid*100, st.DiscardBytes)
+			fids = append(fids, st.Fid)
+		}
+		require.NoError(t, scanner.Err())
+		require.Equal(t, []uint64{1, 3, 7, 12}, fids)
+	})
+
+	opt := DefaultOptions("").WithInMemory(true)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+	var buf bytes.Buffer
+	require.NoError(t, db.DumpDiscardStats(&buf))
+	require.Zero(t, buf.Len())
+}
+
+func TestValueLogInfo(t *testing.T) {
+	opt := getTestOptions("")
+	opt.ValueThreshold = 32
+	opt.ValueLogFileSize = 1 << 20
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		val := make([]byte, 1<<10)
+		for i := 0; i < 2000; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.SetEntry(NewEntry([]byte(fmt.Sprintf("key%d", i)), val))
+			}))
+		}
+		info := db.ValueLogInfo()
+		require.Greater(t, len(info), 1)
+
+		first, last := info[0], info[len(info)-1]
+		db.vlog.discardStats.Update(first.Fid, first.SizeBytes/4)
+		db.vlog.discardStats.Update(last.Fid, last.SizeBytes*2)
+		// Discard stats of a deleted file are left out.
+		db.vlog.discardStats.Update(last.Fid+100, 1)
+
+		info = db.ValueLogInfo()
+		for i, fi := range info {
+			if i > 0 {
+				require.Less(t, info[i-1].Fid, fi.Fid)
+			}
+			require.Equal(t, int64(db.vlog.filesMap[fi.Fid].size.Load()), fi.SizeBytes)
+			switch fi.Fid {
+			case first.Fid:
+				require.Equal(t, fi.SizeBytes/4, fi.DiscardBytes)
+				require.Equal(t, fi.SizeBytes-fi.DiscardBytes, fi.LiveBytes)
+			case last.Fid:
+				require.Equal(t, last.SizeBytes*2, fi.DiscardBytes)
+				require.Zero(t, fi.LiveBytes)
+			default:
+				require.Zero(t, fi.DiscardBytes)
+				require.Equal(t, fi.SizeBytes, fi.LiveBytes)
+			}
+			require.NotEqual(t, last.Fid+100, fi.Fid)
+		}
+	})
+
+	db, err := Open(DefaultOptions("").WithInMemory(true))
+	require.NoError(t, err)
+	defer db.Close()
+	require.Empty(t, db.ValueLogInfo())
+}
+
+func TestDiscardStatsFidBoundary(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	ds, err := InitDiscardStats(DefaultOptions(dir))
+	require.NoError(t, err)
+	fids := []uint32{math.MaxUint32, 1, math.MaxUint32 - 1, 1 << 31, math.MaxInt32}
+	for i, fid := range fids {
+		ds.Update(fid, int64(i+1))
+	}
+	var ids []uint64
+	ds.Iterate(func(id, val uint64) {
+		ids = append(ids, id)
+	})
+	require.Equal(t, []uint64{1, math.MaxInt32, 1 << 31, math.MaxUint32 - 1, math.MaxUint32}, ids)
+	for i, fid := range fids {
+		require.Equal(t, int64(i+1), ds.Update(fid, 0))
+	}
+	ds.Update(math.MaxUint32, 100)
+	fid, discard := ds.MaxDiscard()
+	require.Equal(t, uint32(math.MaxUint32), fid)
+	require.Equal(t, int64(101), discard)
+	require.Equal(t, []fileDiscard{{math.MaxUint32, 101}}, ds.TopDiscard(1))
+	require.Equal(t, int64(101), ds.ResetFid(math.MaxUint32))
+
+	// A fid which doesn't fit in uint32 can't be loaded, even with a matching checksum.
+	ds.set(16*ds.nextEmptySlot, math.MaxUint32+1)
+	ds.set(16*ds.nextEmptySlot+8, 1)
+	ds.addChecksum(ds.nextEmptySlot, false)
+	require.NoError(t, ds.Close(-1))
+	_, err = InitDiscardStats(DefaultOptions(dir))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid fid")
+}
+
+func TestDiscardStatsSnapshot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	snapDir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(snapDir)
+
+	ds, err := InitDiscardStats(DefaultOptions(dir))
+	require.NoError(t, err)
+	for i := uint32(1); i <= 20; i++ {
+		ds.Update(i, int64(i*100))
+	}
+	require.NoError(t, ds.SnapshotTo(filepath.Join(snapDir, discardFname)))
+
+	// Changes after the snapshot must not show up in it.
+	ds.Update(uint32(5), -1)
+	ds.Update(uint32(30), 3000)
+	require.Zero(t, ds.Update(uint32(5), 0))
+
+	snap, err := InitDiscardStats(DefaultOptions(snapDir))
+	require.NoError(t, err)
+	require.Equal(t, 20, snap.nextEmptySlot)
+	snap.Iterate(func(id, val uint64) {
+		require.Equal(t, id*100, val)
+	})
+	require.Zero(t, snap.Update(uint32(30), 0))
+	fid, discard := snap.MaxDiscard()
+	require.Equal(t, uint32(20), fid)
+	require.Equal(t, int64(2000), discard)
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(snapDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestDiscardStatsOrder(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	ds, err := InitDiscardStats(DefaultOptions(dir).WithDiscardStatsInitialSize(32))
+	require.NoError(t, err)
+	defer ds.Close(-1)
+
+	// New fids come in out of order, and in between the existing ones.
+	want := make(map[uint64]uint64)
+	for _, fid := range rand.Perm(500) {
+		ds.Update(uint32(fid+1), int64(fid+1))
+		want[uint64(fid+1)] += uint64(fid + 1)
+		if fid%3 == 0 {
+			ds.Update(uint32(fid/3+1), 10)
+			want[uint64(fid/3+1)] += 10
+		}
+	}
+	require.Equal(t, 500, ds.nextEmptySlot)
+	var last uint64
+	ds.Iterate(func(id, val uint64) {
+		require.Greater(t, id, last)
+		require.Equal(t, want[id], val)
+		last = id
+	})
+	for fid, val := range want {
+		require.Equal(t, int64(val), ds.Update(uint32(fid), 0))
+	}
+	// The zero slot right after the entries is kept.
+	require.Zero(t, ds.get(16*ds.nextEmptySlot))
+}
+
+func BenchmarkDiscardStatsUpdate(b *testing.B) {
+	const n = 50000
+	fids := map[string][]uint32{
+		"increasing": make([]uint32, n),
+		"random":     make([]uint32, n),
+	}
+	for i, fid := range rand.Perm(n) {
+		fids["increasing"][i] = uint32(i + 1)
+		fids["random"][i] = uint32(fid + 1)
+	}
+	for _, name := range []string{"increasing", "random"} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dir, err := os.MkdirTemp("", "badger-test")
+				require.NoError(b, err)
+				ds, err := InitDiscardStats(DefaultOptions(dir).WithLogger(nil))
+				require.NoError(b, err)
+				b.StartTimer()
+
+				for _, fid := range fids[name] {
+					ds.Update(fid, 100)
+				}
+
+				b.StopTimer()
+				require.NoError(b, ds.Close(-1))
+				removeDir(dir)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// BenchmarkDiscardStatsGrowth reports the latency of the updates which add new fids, with each of
+// the ways the file can grow. The updates which grow the file make the tail of the distribution.
+func BenchmarkDiscardStatsGrowth(b *testing.B) {
+	const n = 100000
+	for _, bc := range []struct {
+		name string
+		opt  func(Options) Options
+	}{
+		{"factor=2", func(opt Options) Options { return opt }},
+		{"factor=1.25", func(opt Options) Options { return opt.WithDiscardStatsGrowthFactor(1.25) }},
+		{"increment=64KB", func(opt Options) Options { return opt.WithDiscardStatsGrowthIncrement(64 << 10) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			lat := make([]time.Duration, 0, n*b.N)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dir, err := os.MkdirTemp("", "badger-test")
+				require.NoError(b, err)
+				opt := bc.opt(DefaultOptions(dir).WithLogger(nil).WithDiscardStatsInitialSize(4 << 10))
+				ds, err := InitDiscardStats(opt)
+				require.NoError(b, err)
+				b.StartTimer()
+
+				for fid := uint32(1); fid <= n; fid++ {
+					start := time.Now()
+					ds.Update(fid, 100)
+					lat = append(lat, time.Since(start))
+				}
+
+				b.StopTimer()
+				require.NoError(b, ds.Close(-1))
+				removeDir(dir)
+				b.StartTimer()
+			}
+			sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+			b.ReportMetric(float64(lat[len(lat)/2].Nanoseconds()), "p50-ns")
+			b.ReportMetric(float64(lat[len(lat)*99/100].Nanoseconds()), "p99-ns")
+			b.ReportMetric(float64(lat[len(lat)-1].Nanoseconds()), "max-ns")
+		})
+	}
+}
@@ -54,6 +54,7 @@ type Item struct {
 	status   prefetchStatus
 	meta     byte // We need to store meta to know about bitValuePointer.
 	userMeta byte
+	tableID  uint64
 }
 
 // String returns a string representation of Item
@@ -274,6 +275,14 @@ func (item *Item) ExpiresAt() uint64 {
 	return item.expiresAt
 }
 
+// TableID returns the ID of the table the item was read from by Txn.Get, which also tells the level
+// it was read from, see DB.Tables. It is only tracked when Options.MetricsEnabled is set, and is
+// zero otherwise, as well as for items read from the memtables, the writes pending in the
+// transaction, or through an Iterator.
+func (item *Item) TableID() uint64 {
+	return item.tableID
+}
+
 // TODO: Switch this to use linked list container in Go.
 type list struct {
 	head *Item
@@ -329,6 +338,18 @@ type IteratorOptions struct {
 	prefixIsKey bool   // If set, use the prefix for bloom filter lookup.
 	Prefix      []byte // Only iterate over this given prefix.
 	SinceTs     uint64 // Only read data that has version > SinceTs.
+
+	// StartKey and EndKey limit iteration to the keys in [StartKey, EndKey): StartKey is
+	// included, EndKey is not. An empty StartKey or EndKey leaves that side unbounded. Tables
+	// entirely out of the range are not picked, Rewind starts at the edge of the range, and Seek
+	// to a key out of the range goes to the edge of the range. They apply together with Prefix.
+	StartKey []byte
+	EndKey   []byte
+
+	// RecordStaleVersions makes the iterator note the versions it skips over because a newer
+	// version of the same key is visible, so that they can be fed to value log GC later. They
+	// are returned by Iterator.StaleVersions. Ignored if AllVersions is set.
+	RecordStaleVersions bool
 }
 
 func (opt *IteratorOptions) compareToPrefix(key []byte) int {
@@ -340,11 +361,24 @@ func (opt *IteratorOptions) compareToPrefix(key []byte) int {
 	return bytes.Compare(key, opt.Prefix)
 }
 
+// beforeRange returns true if key comes before StartKey.
+func (opt *IteratorOptions) beforeRange(key []byte) bool {
+	return len(opt.StartKey) > 0 && bytes.Compare(y.ParseKey(key), opt.StartKey) < 0
+}
+
+// afterRange returns true if key comes at or after EndKey.
+func (opt *IteratorOptions) afterRange(key []byte) bool {
+	return len(opt.EndKey) > 0 && bytes.Compare(y.ParseKey(key), opt.EndKey) >= 0
+}
+
 func (opt *IteratorOptions) pickTable(t table.TableInterface) bool {
 	// Ignore this table if its max version is less than the sinceTs.
 	if t.MaxVersion() < opt.SinceTs {
 		return false
 	}
+	if opt.beforeRange(t.Biggest()) || opt.afterRange(t.Smallest()) {
+		return false
+	}
 	if len(opt.Prefix) == 0 {
 		return true
 	}
@@ -379,6 +413,18 @@ func (opt *IteratorOptions) pickTables(all []*table.Table) []*table.Table {
 		return tables
 	}
 
+	// Trim the tables out of [StartKey, EndKey).
+	if len(opt.StartKey) > 0 {
+		all = all[sort.Search(len(all), func(i int) bool {
+			return !opt.beforeRange(all[i].Biggest())
+		}):]
+	}
+	if len(opt.EndKey) > 0 {
+		all = all[:sort.Search(len(all), func(i int) bool {
+			return opt.afterRange(all[i].Smallest())
+		})]
+	}
+
 	if len(opt.Prefix) == 0 {
 		out := make([]*table.Table, len(all))
 		copy(out, all)
@@ -445,9 +491,11 @@ type Iterator struct {
 	waste list
 
 	lastKey []byte // Used to skip over multiple versions of the same key.
+	stale   []StaleVersion
 
 	closed  bool
-	scanned int // Used to estimate the size of data scanned by iterator.
+	scanned int   // Used to estimate the size of data scanned by iterator.
+	memSize int64 // Memory reserved from DB.iterMem, released on Close.
 
 	// ThreadId is an optional value that can be set to identify which goroutine created
 	// the iterator. It can be used, for example, to uniquely identify each of the
@@ -475,6 +523,15 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 		panic(ErrDBClosed)
 	}
 
+	// Each table iterator holds on to the block it is positioned at. Reserve the memory before
+	// taking any reference, so that an iterator waiting for the budget doesn't keep tables and
+	// value log files from being deleted. The estimate is trimmed below to the tables picked.
+	blockSize := int64(txn.db.opt.BlockSize)
+	memSize, err := txn.db.iterMem.acquire(int64(txn.db.lc.maxTableIterators())*blockSize, nil)
+	if err != nil {
+		panic(err)
+	}
+
 	y.NumIteratorsCreatedAdd(txn.db.opt.MetricsEnabled, 1)
 
 	// Keep track of the number of active iterators.
@@ -491,12 +548,27 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 	for i := 0; i < len(tables); i++ {
 		iters = append(iters, tables[i].sl.NewUniIterator(opt.Reverse))
 	}
+	numMemIters := len(iters)
 	iters = txn.db.lc.appendIterators(iters, &opt) // This will increment references.
+
+	if used := int64(len(iters)-numMemIters) * blockSize; used < memSize {
+		txn.db.iterMem.release(memSize - used)
+		memSize = used
+	}
 	res := &Iterator{
-		txn:    txn,
-		iitr:   table.NewMergeIterator(iters, opt.Reverse),
-		opt:    opt,
-		readTs: txn.readTs,
+		txn:     txn,
+		iitr:    table.NewMergeIterator(iters, opt.Reverse),
+		opt:     opt,
+		readTs:  txn.readTs,
+		memSize: memSize,
+	}
+	// Stop the iterators below at the end of the range, so that tables past it aren't opened.
+	if mi, ok := res.iitr.(*table.MergeIterator); ok {
+		if !opt.Reverse && len(opt.EndKey) > 0 {
+			mi.SetBound(opt.EndKey)
+		} else if opt.Reverse && len(opt.StartKey) > 0 {
+			mi.SetBound(opt.StartKey)
+		}
 	}
 	return res
 }
@@ -535,6 +607,13 @@ func (it *Iterator) Valid() bool {
 	if it.item == nil {
 		return false
 	}
+	if it.opt.Reverse {
+		if len(it.opt.StartKey) > 0 && bytes.Compare(it.item.key, it.opt.StartKey) < 0 {
+			return false
+		}
+	} else if len(it.opt.EndKey) > 0 && bytes.Compare(it.item.key, it.opt.EndKey) >= 0 {
+		return false
+	}
 	if it.opt.prefixIsKey {
 		return bytes.Equal(it.item.key, it.opt.Prefix)
 	}
@@ -570,6 +649,7 @@ func (it *Iterator) Close() {
 	}
 	waitFor(it.waste)
 	waitFor(it.data)
+	it.txn.db.iterMem.release(it.memSize)
 
 	// TODO: We could handle this error.
 	_ = it.txn.db.vlog.decrIteratorCount()
@@ -662,6 +742,11 @@ func (it *Iterator) parseItem() bool {
 	// be sufficient.
 	if !it.opt.Reverse {
 		if y.SameKey(it.lastKey, key) {
+			if it.opt.RecordStaleVersions {
+				vs := mi.Value()
+				it.stale = append(it.stale,
+					newStaleVersion(y.ParseKey(key), version, vs.Meta, vs.Value))
+			}
 			mi.Next()
 			return false
 		}
@@ -677,6 +762,16 @@ FILL:
 	// If deleted, advance and return.
 	vs := mi.Value()
 	if isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+		if it.opt.Reverse && it.opt.RecordStaleVersions {
+			// In reverse, a deleted version is stale if a newer version of the key follows.
+			sv := newStaleVersion(y.ParseKey(mi.Key()), y.ParseTs(mi.Key()), vs.Meta, vs.Value)
+			mi.Next()
+			if mi.Valid() && y.ParseTs(mi.Key()) <= it.readTs &&
+				bytes.Equal(y.ParseKey(mi.Key()), sv.Key) {
+				it.stale = append(it.stale, sv)
+			}
+			return false
+		}
 		mi.Next()
 		return false
 	}
@@ -697,6 +792,10 @@ FILL:
 	mik := y.ParseKey(mi.Key())
 	if nextTs <= it.readTs && bytes.Equal(mik, item.key) {
 		// This is a valid potential candidate.
+		if it.opt.RecordStaleVersions {
+			it.stale = append(it.stale,
+				newStaleVersion(item.key, item.version, item.meta, item.vptr))
+		}
 		goto FILL
 	}
 	// Ignore the next candidate. Return the current one.
@@ -704,6 +803,34 @@ FILL:
 	return true
 }
 
+// StaleVersion is a version of a key which was superseded by a newer version visible to the
+// iterator that skipped over it.
+type StaleVersion struct {
+	Key     []byte
+	Version uint64
+	// Fid and Len locate the value in the value log. Both are zero if the value was stored
+	// inline in the LSM tree.
+	Fid uint32
+	Len uint32
+}
+
+func newStaleVersion(key []byte, version uint64, meta byte, value []byte) StaleVersion {
+	sv := StaleVersion{Key: y.SafeCopy(nil, key), Version: version}
+	if meta&bitValuePointer > 0 {
+		var vp valuePointer
+		vp.Decode(value)
+		sv.Fid, sv.Len = vp.Fid, vp.Len
+	}
+	return sv
+}
+
+// StaleVersions returns the superseded versions the iterator has skipped over so far, if it was
+// created with IteratorOptions.RecordStaleVersions set. The iterator parses entries ahead of the
+// current item, so the list is only complete once the iteration is over.
+func (it *Iterator) StaleVersions() []StaleVersion {
+	return it.stale
+}
+
 func (it *Iterator) fill(item *Item) {
 	vs := it.iitr.Value()
 	item.meta = vs.Meta
@@ -764,6 +891,19 @@ func (it *Iterator) Seek(key []byte) {
 	if len(key) == 0 {
 		key = it.opt.Prefix
 	}
+	// Keys out of the range are moved to its edge.
+	switch {
+	case !it.opt.Reverse && len(it.opt.StartKey) > 0 &&
+		(len(key) == 0 || bytes.Compare(key, it.opt.StartKey) < 0):
+		key = it.opt.StartKey
+	case it.opt.Reverse && len(it.opt.EndKey) > 0 &&
+		(len(key) == 0 || bytes.Compare(key, it.opt.EndKey) >= 0):
+		// Land on the last version before EndKey, which sorts right before all versions of
+		// EndKey.
+		it.iitr.Seek(y.KeyWithTs(it.opt.EndKey, math.MaxUint64))
+		it.prefetch()
+		return
+	}
 	if len(key) == 0 {
 		it.iitr.Rewind()
 		it.prefetch()
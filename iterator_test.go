@@ -23,8 +23,11 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -125,6 +128,121 @@ func TestPickSortTables(t *testing.T) {
 	require.Equal(t, y.ParseKey(filtered[0].Biggest()), []byte("abc"))
 }
 
+func TestAppendIteratorsPrefix(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"a1", "v", 3, 0}, {"a2", "v", 3, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"a9", "v", 4, 0}, {"b3", "v", 4, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"x", "v", 5, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"a1", "v", 1, 0}, {"a2", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"b1", "v", 1, 0}, {"b2", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"b5", "v", 1, 0}, {"c1", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"c2", "v", 1, 0}, {"c3", "v", 1, 0}}, 1)
+
+		// keys returns all the keys of the tables behind the iterators. Table iterators don't
+		// filter on the prefix, so keys of tables which don't hold the prefix would show up.
+		keys := func(iters []y.Iterator) []string {
+			var out []string
+			for _, it := range iters {
+				for it.Rewind(); it.Valid(); it.Next() {
+					out = append(out, string(y.ParseKey(it.Key())))
+				}
+				require.NoError(t, it.Close())
+			}
+			return out
+		}
+		iopt := DefaultIteratorOptions
+		iopt.Prefix = []byte("b")
+
+		// Level 0 tables are checked one by one, newest first.
+		iters := db.lc.levels[0].appendIterators(nil, &iopt)
+		require.Len(t, iters, 1)
+		require.Equal(t, []string{"a9", "b3"}, keys(iters))
+
+		// Other levels get a single iterator over the tables holding the prefix.
+		iters = db.lc.levels[1].appendIterators(nil, &iopt)
+		require.Len(t, iters, 1)
+		require.IsType(t, &table.ConcatIterator{}, iters[0])
+		require.Equal(t, []string{"b1", "b2", "b5", "c1"}, keys(iters))
+
+		iopt.Prefix = []byte("d")
+		require.Empty(t, db.lc.levels[0].appendIterators(nil, &iopt))
+		require.Empty(t, db.lc.levels[1].appendIterators(nil, &iopt))
+	})
+}
+
+func TestIteratorKeyRange(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"k03", "v", 2, 0}, {"k12", "v", 2, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"k15", "v", 2, 0}, {"k17", "v", 2, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"k00", "v", 1, 0}, {"k02", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"k04", "v", 1, 0}, {"k05", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"k07", "v", 1, 0}, {"k08", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"k10", "v", 1, 0}, {"k11", "v", 1, 0}}, 1)
+
+		txn := db.NewTransactionAt(10, false)
+		defer txn.Discard()
+		scan := func(iopt IteratorOptions, seek string) []string {
+			it := txn.NewIterator(iopt)
+			defer it.Close()
+			var keys []string
+			for it.Seek([]byte(seek)); it.Valid(); it.Next() {
+				keys = append(keys, string(it.Item().Key()))
+			}
+			return keys
+		}
+		iopt := DefaultIteratorOptions
+		// StartKey is included, EndKey is not.
+		iopt.StartKey, iopt.EndKey = []byte("k05"), []byte("k10")
+		require.Equal(t, []string{"k05", "k07", "k08"}, scan(iopt, ""))
+		require.Equal(t, []string{"k05", "k07", "k08"}, scan(iopt, "k01"))
+		require.Equal(t, []string{"k07", "k08"}, scan(iopt, "k06"))
+		require.Empty(t, scan(iopt, "k10"))
+
+		iopt.Reverse = true
+		require.Equal(t, []string{"k08", "k07", "k05"}, scan(iopt, ""))
+		require.Equal(t, []string{"k08", "k07", "k05"}, scan(iopt, "k10"))
+		require.Equal(t, []string{"k08", "k07", "k05"}, scan(iopt, "k19"))
+		require.Equal(t, []string{"k07", "k05"}, scan(iopt, "k07"))
+		require.Empty(t, scan(iopt, "k04"))
+
+		// Either side can be left open, and the range applies with the prefix.
+		iopt = DefaultIteratorOptions
+		iopt.EndKey = []byte("k04")
+		require.Equal(t, []string{"k00", "k02", "k03"}, scan(iopt, ""))
+		iopt.EndKey, iopt.StartKey = nil, []byte("k12")
+		require.Equal(t, []string{"k12", "k15", "k17"}, scan(iopt, ""))
+		iopt.Reverse = true
+		require.Equal(t, []string{"k17", "k15", "k12"}, scan(iopt, ""))
+		iopt = DefaultIteratorOptions
+		iopt.Prefix, iopt.StartKey = []byte("k0"), []byte("k05")
+		require.Equal(t, []string{"k05", "k07", "k08"}, scan(iopt, ""))
+
+		// Only the tables overlapping the range are picked. Table iterators don't filter on the
+		// range, so keys of other tables would show up.
+		keys := func(iters []y.Iterator) []string {
+			var out []string
+			for _, it := range iters {
+				for it.Rewind(); it.Valid(); it.Next() {
+					out = append(out, string(y.ParseKey(it.Key())))
+				}
+				require.NoError(t, it.Close())
+			}
+			return out
+		}
+		iopt = DefaultIteratorOptions
+		iopt.StartKey, iopt.EndKey = []byte("k05"), []byte("k10")
+		require.Equal(t, []string{"k04", "k05", "k07", "k08"},
+			keys(db.lc.levels[1].appendIterators(nil, &iopt)))
+		require.Equal(t, []string{"k03", "k12"}, keys(db.lc.levels[0].appendIterators(nil, &iopt)))
+		iopt.StartKey, iopt.EndKey = []byte("k12"), []byte("k15")
+		require.Empty(t, db.lc.levels[1].appendIterators(nil, &iopt))
+		require.Equal(t, []string{"k03", "k12"}, keys(db.lc.levels[0].appendIterators(nil, &iopt)))
+	})
+}
+
 func TestIterateSinceTs(t *testing.T) {
 	bkey := func(i int) []byte {
 		return []byte(fmt.Sprintf("%04d", i))
@@ -179,6 +297,125 @@ func TestIterateSinceTsWithPendingWrites(t *testing.T) {
 	})
 }
 
+func TestIteratorMemoryLimit(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	// Room for the blocks of two iterators over a single table.
+	opt = opt.WithMaxConcurrentIteratorMemory(2 * int64(opt.BlockSize))
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"a", "v", 1, 0}, {"b", "v", 1, 0}}, 0)
+		numWaiters := func() int {
+			db.iterMem.Lock()
+			defer db.iterMem.Unlock()
+			return len(db.iterMem.waiters)
+		}
+		count := func(it *Iterator) int {
+			var n int
+			for it.Rewind(); it.Valid(); it.Next() {
+				n++
+			}
+			return n
+		}
+
+		txn := db.NewTransactionAt(10, false)
+		defer txn.Discard()
+		it1 := txn.NewIterator(DefaultIteratorOptions)
+		it2 := txn.NewIterator(DefaultIteratorOptions)
+		require.Equal(t, opt.MaxConcurrentIteratorMemory, db.iterMem.used)
+
+		// A third iterator waits for one of the others to be closed, before it takes any reference.
+		done := make(chan int)
+		go func() {
+			txn := db.NewTransactionAt(10, false)
+			defer txn.Discard()
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			done <- count(it)
+		}()
+		require.Eventually(t, func() bool { return numWaiters() == 1 }, time.Second, time.Millisecond)
+		require.Equal(t, int32(2), db.vlog.numActiveIterators.Load())
+
+		require.Equal(t, 2, count(it1))
+		it1.Close()
+		require.Equal(t, 2, <-done)
+		require.Equal(t, 2, count(it2))
+		it2.Close()
+		require.Zero(t, db.iterMem.used)
+
+		// An iterator estimated larger than the whole budget still runs on its own.
+		createAndOpen(db, []keyValVersion{{"c", "v", 2, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"d", "v", 3, 0}}, 0)
+		it := txn.NewIterator(DefaultIteratorOptions)
+		require.Equal(t, opt.MaxConcurrentIteratorMemory, db.iterMem.used)
+		it.Close()
+		require.Zero(t, db.iterMem.used)
+	})
+}
+
+func TestIterateRecordStaleVersions(t *testing.T) {
+	opt := getTestOptions("").WithValueThreshold(32)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		bigVal := bytes.Repeat([]byte("v"), 64)
+		// a has an inline value overwritten twice, b has a value log value overwritten once,
+		// c is deleted and set again, and d is written once.
+		txnSet(t, db, []byte("a"), []byte("a1"), 0)
+		txnSet(t, db, []byte("a"), []byte("a2"), 0)
+		txnSet(t, db, []byte("a"), []byte("a3"), 0)
+		txnSet(t, db, []byte("b"), bigVal, 0)
+		txnSet(t, db, []byte("b"), bigVal, 0)
+		txnSet(t, db, []byte("c"), []byte("c1"), 0)
+		txnDelete(t, db, []byte("c"))
+		txnSet(t, db, []byte("c"), []byte("c3"), 0)
+		txnSet(t, db, []byte("d"), []byte("d1"), 0)
+
+		scan := func(reverse bool) map[string][]uint64 {
+			iopt := DefaultIteratorOptions
+			iopt.Reverse = reverse
+			iopt.RecordStaleVersions = true
+			stale := make(map[string][]uint64)
+			require.NoError(t, db.View(func(txn *Txn) error {
+				it := txn.NewIterator(iopt)
+				defer it.Close()
+				var keys []string
+				for it.Rewind(); it.Valid(); it.Next() {
+					keys = append(keys, string(it.Item().Key()))
+				}
+				require.Len(t, keys, 4)
+				for _, sv := range it.StaleVersions() {
+					stale[string(sv.Key)] = append(stale[string(sv.Key)], sv.Version)
+					if string(sv.Key) == "b" {
+						require.NotZero(t, sv.Len)
+					} else {
+						require.Zero(t, sv.Len)
+					}
+				}
+				return nil
+			}))
+			for _, versions := range stale {
+				sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+			}
+			return stale
+		}
+		expected := map[string][]uint64{
+			"a": {1, 2},
+			"b": {4},
+			"c": {6, 7},
+		}
+		require.Equal(t, expected, scan(false))
+		require.Equal(t, expected, scan(true))
+
+		// Nothing is recorded unless asked for.
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+			}
+			require.Empty(t, it.StaleVersions())
+			return nil
+		}))
+	})
+}
+
 func TestIteratePrefix(t *testing.T) {
 	if !*manual {
 		t.Skip("Skipping test meant to be run manually.")
@@ -424,3 +661,73 @@ func BenchmarkIteratePrefixSingleKey(b *testing.B) {
 		}
 	})
 }
+
+func TestAppendIteratorsL0Snapshot(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumLevelZeroTables(100).
+		WithNumLevelZeroTablesStall(200)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		l0 := db.lc.levels[0]
+		const n = 50
+		tables := make([]*table.Table, n)
+		for i := range tables {
+			tables[i] = createTable(db, []keyValVersion{{fmt.Sprintf("k%03d", i), "v", 1, 0}})
+			defer func(tab *table.Table) { require.NoError(t, tab.DecrRef()) }(tables[i])
+		}
+		// keys returns the keys behind the iterators, which come newest table first.
+		keys := func(iters []y.Iterator) []string {
+			var out []string
+			for _, it := range iters {
+				for it.Rewind(); it.Valid(); it.Next() {
+					out = append(out, string(y.ParseKey(it.Key())))
+				}
+			}
+			return out
+		}
+		// prefix returns the keys of the first i tables, newest first.
+		prefix := func(i int) []string {
+			var out []string
+			for ; i > 0; i-- {
+				out = append(out, fmt.Sprintf("k%03d", i-1))
+			}
+			return out
+		}
+
+		done := make(chan struct{})
+		var refused atomic.Int32
+		go func() {
+			defer close(done)
+			for _, tab := range tables {
+				if added, _ := l0.tryAddLevel0Table(tab); !added {
+					refused.Add(1)
+				}
+			}
+		}()
+		iopt := DefaultIteratorOptions
+		for finished := false; !finished; {
+			select {
+			case <-done:
+				finished = true
+			default:
+			}
+			iters := l0.appendIterators(nil, &iopt)
+			// Each table is either fully in or out, without gaps.
+			require.Equal(t, prefix(len(iters)), keys(iters))
+			for _, it := range iters {
+				require.NoError(t, it.Close())
+			}
+		}
+
+		require.Zero(t, refused.Load())
+
+		// The tables picked stay with the iterators, whatever happens to the level afterwards.
+		iters := l0.appendIterators(nil, &iopt)
+		require.Len(t, iters, n)
+		_, err := l0.deleteTables(tables[:n/2])
+		require.NoError(t, err)
+		require.Equal(t, n/2, l0.numTables())
+		require.Equal(t, prefix(n), keys(iters))
+		for _, it := range iters {
+			require.NoError(t, it.Close())
+		}
+	})
+}
@@ -17,12 +17,20 @@
 package badger
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"math"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/dgraph-io/badger/v4/table"
 	"github.com/dgraph-io/badger/v4/y"
+	"github.com/dgraph-io/ristretto/z"
 )
 
 type levelHandler struct {
@@ -35,6 +43,26 @@ type levelHandler struct {
 	tables         []*table.Table
 	totalSize      int64
 	totalStaleSize int64
+	// shrinkCh is closed, and replaced, each time tables are removed from the level.
+	shrinkCh chan struct{}
+	// stallStart is when tryAddLevel0Table first refused a table, zero if it isn't stalled. It holds
+	// a monotonic clock reading.
+	stallStart time.Time
+
+	// versionsExamined is a histogram of the number of versions of a key looked at by each get
+	// which found the key on this level. It is nil if metrics are disabled.
+	versionsExaminedMu sync.Mutex
+	versionsExamined   *z.HistogramData
+
+	// overTargetSince is the time, in unix nanoseconds, at which the compaction scheduler first
+	// saw this level over its target. It is zero while the level is within its target.
+	overTargetSince atomic.Int64
+
+	// compactionRequested is set by DB.RequestCompaction, until a compactor picks up the request.
+	compactionRequested atomic.Bool
+
+	// sizeChangePending is set while the level is queued in db.levelSizeCh.
+	sizeChangePending atomic.Bool
 
 	// The following are initialized once and const.
 	level    int
@@ -84,9 +112,12 @@ func (s *levelHandler) initTables(tables []*table.Table) {
 	}
 }
 
-// deleteTables remove tables idx0, ..., idx1-1.
-func (s *levelHandler) deleteTables(toDel []*table.Table) error {
+// deleteTables removes toDel from the level, and returns the IDs of the tables which were deleted
+// because the level held their last reference. The others are deleted once released by their
+// other holders, like iterators.
+func (s *levelHandler) deleteTables(toDel []*table.Table) ([]uint64, error) {
 	s.Lock() // s.Unlock() below
+	wasEmpty := len(s.tables) == 0
 
 	toDelMap := make(map[uint64]struct{})
 	for _, t := range toDel {
@@ -104,19 +135,25 @@ func (s *levelHandler) deleteTables(toDel []*table.Table) error {
 		s.subtractSize(t)
 	}
 	s.tables = newTables
+	isEmpty := len(s.tables) == 0
+	s.signalShrink(len(toDel) > 0)
 
 	s.Unlock() // Unlock s _before_ we DecrRef our tables, which can be slow.
 
-	return decrRefs(toDel)
+	s.db.tableEvents.record(TableDeleted, s.level, toDel)
+	s.notifyEmptyChange(wasEmpty, isEmpty)
+	return s.decrRefs(toDel)
 }
 
 // replaceTables will replace tables[left:right] with newTables. Note this EXCLUDES tables[right].
-// You must call decr() to delete the old tables _after_ writing the update to the manifest.
-func (s *levelHandler) replaceTables(toDel, toAdd []*table.Table) error {
+// You must call decr() to delete the old tables _after_ writing the update to the manifest. Like
+// deleteTables, it returns the IDs of the tables of toDel which were deleted.
+func (s *levelHandler) replaceTables(toDel, toAdd []*table.Table) ([]uint64, error) {
 	// Need to re-search the range of tables in this level to be replaced as other goroutines might
 	// be changing it as well.  (They can't touch our tables, but if they add/remove other tables,
 	// the indices get shifted around.)
 	s.Lock() // We s.Unlock() below.
+	wasEmpty := len(s.tables) == 0
 
 	toDelMap := make(map[uint64]struct{})
 	for _, t := range toDel {
@@ -124,28 +161,154 @@ func (s *levelHandler) replaceTables(toDel, toAdd []*table.Table) error {
 	}
 	var newTables []*table.Table
 	for _, t := range s.tables {
-		_, found := toDelMap[t.ID()]
-		if !found {
+		if _, found := toDelMap[t.ID()]; !found {
 			newTables = append(newTables, t)
-			continue
 		}
-		s.subtractSize(t)
 	}
+	numKept := len(newTables)
+	newTables = append(newTables, toAdd...)
+	sort.Slice(newTables, func(i, j int) bool {
+		return y.CompareKeys(newTables[i].Smallest(), newTables[j].Smallest()) < 0
+	})
+
+	for _, t := range s.tables {
+		if _, found := toDelMap[t.ID()]; found {
+			s.subtractSize(t)
+		}
+	}
+	s.signalShrink(len(toAdd) < len(s.tables)-numKept)
 
 	// Increase totalSize first.
 	for _, t := range toAdd {
 		s.addSize(t)
 		t.IncrRef()
-		newTables = append(newTables, t)
 	}
 
 	// Assign tables.
 	s.tables = newTables
-	sort.Slice(s.tables, func(i, j int) bool {
-		return y.CompareKeys(s.tables[i].Smallest(), s.tables[j].Smallest()) < 0
+	isEmpty := len(s.tables) == 0
+	s.Unlock() // s.Unlock before we DecrRef tables -- that can be slow.
+
+	s.db.tableEvents.record(TableDeleted, s.level, toDel)
+	s.db.tableEvents.record(TableCreated, s.level, toAdd)
+	s.notifyEmptyChange(wasEmpty, isEmpty)
+	return s.decrRefs(toDel)
+}
+
+// verifyTablesToDelete returns an error if Options.VerifyTableDeletes is set and toDel holds a
+// table twice, or tables which are not in the level. Otherwise, deleteTables and replaceTables skip
+// those tables. It must be called before the deletion is written to the manifest, so that a failure
+// leaves both the manifest and the level as they were.
+func (s *levelHandler) verifyTablesToDelete(toDel []*table.Table) error {
+	if !s.db.opt.VerifyTableDeletes {
+		return nil
+	}
+	s.RLock()
+	defer s.RUnlock()
+	missing := make(map[uint64]struct{}, len(toDel))
+	for _, t := range toDel {
+		if _, ok := missing[t.ID()]; ok {
+			return errors.Errorf("Table %d is deleted twice from level %d", t.ID(), s.level)
+		}
+		missing[t.ID()] = struct{}{}
+	}
+	for _, t := range s.tables {
+		delete(missing, t.ID())
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	ids := make([]uint64, 0, len(missing))
+	for id := range missing {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return errors.Errorf("Tables %v to delete are not in level %d", ids, s.level)
+}
+
+// verifyTableOverlaps returns an error if Options.VerifyTableOverlaps is set, the level is not level
+// 0, and replacing toDel with toAdd would leave overlapping tables in the level. Like
+// verifyTablesToDelete, it must be called before the change is written to the manifest.
+func (s *levelHandler) verifyTableOverlaps(toDel, toAdd []*table.Table) error {
+	if !s.db.opt.VerifyTableOverlaps || s.level == 0 {
+		return nil
+	}
+	toDelMap := make(map[uint64]struct{}, len(toDel))
+	for _, t := range toDel {
+		toDelMap[t.ID()] = struct{}{}
+	}
+	s.RLock()
+	var tables []*table.Table
+	for _, t := range s.tables {
+		if _, found := toDelMap[t.ID()]; !found {
+			tables = append(tables, t)
+		}
+	}
+	s.RUnlock()
+	tables = append(tables, toAdd...)
+	sort.Slice(tables, func(i, j int) bool {
+		return y.CompareKeys(tables[i].Smallest(), tables[j].Smallest()) < 0
 	})
+	for i := 1; i < len(tables); i++ {
+		prev, next := tables[i-1], tables[i]
+		if y.CompareKeys(prev.Biggest(), next.Smallest()) >= 0 {
+			return errors.Errorf("Tables %d and %d of level %d overlap. Biggest: %q Smallest: %q",
+				prev.ID(), next.ID(), s.level, prev.Biggest(), next.Smallest())
+		}
+	}
+	return nil
+}
+
+// replaceOneTable swaps the table with ID oldID for newTable, which must have the same key range so
+// that the tables in the level keep their order and don't overlap. It is meant for putting back a
+// rewritten copy of a single table, without running a compaction. The caller is responsible for
+// updating the manifest.
+func (s *levelHandler) replaceOneTable(oldID uint64, newTable *table.Table) error {
+	s.Lock() // We s.Unlock() below.
+
+	idx := -1
+	for i, t := range s.tables {
+		if t.ID() == oldID {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		s.Unlock()
+		return errors.Errorf("table %d not found at level %d", oldID, s.level)
+	}
+	old := s.tables[idx]
+	if y.CompareKeys(old.Smallest(), newTable.Smallest()) != 0 ||
+		y.CompareKeys(old.Biggest(), newTable.Biggest()) != 0 {
+		s.Unlock()
+		return errors.Errorf("table %d with range [%x, %x] can't replace table %d with range "+
+			"[%x, %x] at level %d", newTable.ID(), newTable.Smallest(), newTable.Biggest(),
+			oldID, old.Smallest(), old.Biggest(), s.level)
+	}
+
+	// Make a copy as iterators might be keeping a slice of tables.
+	newTables := make([]*table.Table, len(s.tables))
+	copy(newTables, s.tables)
+	newTables[idx] = newTable
+	s.subtractSize(old)
+	s.addSize(newTable)
+	newTable.IncrRef()
+
+	if s.level == 0 {
+		sort.Slice(newTables, func(i, j int) bool {
+			return newTables[i].ID() < newTables[j].ID()
+		})
+	} else {
+		sort.Slice(newTables, func(i, j int) bool {
+			return y.CompareKeys(newTables[i].Smallest(), newTables[j].Smallest()) < 0
+		})
+	}
+	s.tables = newTables
 	s.Unlock() // s.Unlock before we DecrRef tables -- that can be slow.
-	return decrRefs(toDel)
+
+	s.db.tableEvents.record(TableDeleted, s.level, []*table.Table{old})
+	s.db.tableEvents.record(TableCreated, s.level, []*table.Table{newTable})
+	return old.DecrRef()
 }
 
 // addTable adds toAdd table to levelHandler. Normally when we add tables to levelHandler, we sort
@@ -155,86 +318,444 @@ func (s *levelHandler) replaceTables(toDel, toAdd []*table.Table) error {
 // NOTE: levelHandler.sortTables() should be called after call addTable calls are done.
 func (s *levelHandler) addTable(t *table.Table) {
 	s.Lock()
-	defer s.Unlock()
-
+	wasEmpty := len(s.tables) == 0
 	s.addSize(t) // Increase totalSize first.
 	t.IncrRef()
 	s.tables = append(s.tables, t)
+	s.Unlock()
+
+	s.db.tableEvents.record(TableCreated, s.level, []*table.Table{t})
+	s.notifyEmptyChange(wasEmpty, false)
+}
+
+// signalShrink wakes up the goroutines waiting for the level to shrink, if it did. This should be
+// called while holding the lock.
+func (s *levelHandler) signalShrink(shrunk bool) {
+	if !shrunk {
+		return
+	}
+	close(s.shrinkCh)
+	s.shrinkCh = make(chan struct{})
 }
 
-// sortTables sorts tables of levelHandler based on table.Smallest.
+// waitForSpace blocks until level 0 would accept a table, as decided by Options.L0StallPolicy, or
+// ctx is done. The policy is consulted again each time the level shrinks, or signalShrink is
+// called.
+func (s *levelHandler) waitForSpace(ctx context.Context) error {
+	for {
+		s.RLock()
+		n, ch := len(s.tables), s.shrinkCh
+		s.RUnlock()
+		if accept, _ := s.l0StallPolicy(n); accept {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notifyEmptyChange calls Options.OnLevelEmptyChange if the level went from holding tables to
+// holding none, or the other way around. It must not be called while holding the lock of the level.
+func (s *levelHandler) notifyEmptyChange(wasEmpty, isEmpty bool) {
+	if wasEmpty == isEmpty || s.db.opt.OnLevelEmptyChange == nil {
+		return
+	}
+	s.db.opt.OnLevelEmptyChange(s.level, isEmpty)
+}
+
+// sortTables sorts tables of levelHandler based on table.Smallest, or on their IDs for level 0.
 // Normally it should be called after all addTable calls.
 func (s *levelHandler) sortTables() {
-	s.RLock()
-	defer s.RUnlock()
+	s.Lock()
+	defer s.Unlock()
 
+	if s.level == 0 {
+		sort.Slice(s.tables, func(i, j int) bool {
+			return s.tables[i].ID() < s.tables[j].ID()
+		})
+		return
+	}
 	sort.Slice(s.tables, func(i, j int) bool {
 		return y.CompareKeys(s.tables[i].Smallest(), s.tables[j].Smallest()) < 0
 	})
 }
 
+// decrRefs releases the level's references to tables, and returns the IDs of the tables whose last
+// reference it dropped, which were deleted, in increasing order. With more than one
+// NumTableDeleteWorkers, the references are dropped concurrently; every table is then released
+// even if one fails, and the first error is returned.
+func (s *levelHandler) decrRefs(tables []*table.Table) ([]uint64, error) {
+	if s.db.opt.NumTableDeleteWorkers <= 1 {
+		return decrRefsDeleted(tables)
+	}
+	var mu sync.Mutex
+	var deleted []uint64
+	_, err := forEachTable(tables, s.db.opt.NumTableDeleteWorkers, func(t *table.Table) error {
+		ok, err := t.DecrRefDeleted()
+		if ok {
+			mu.Lock()
+			deleted = append(deleted, t.ID())
+			mu.Unlock()
+		}
+		return err
+	})
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i] < deleted[j] })
+	return deleted, err
+}
+
 func decrRefs(tables []*table.Table) error {
+	_, err := decrRefsDeleted(tables)
+	return err
+}
+
+// decrRefsDeleted is like decrRefs, but also returns the IDs of the tables whose last reference it
+// dropped, in increasing order.
+func decrRefsDeleted(tables []*table.Table) ([]uint64, error) {
+	var deleted []uint64
 	for _, table := range tables {
-		if err := table.DecrRef(); err != nil {
-			return err
+		ok, err := table.DecrRefDeleted()
+		if ok {
+			deleted = append(deleted, table.ID())
+		}
+		if err != nil {
+			return deleted, err
 		}
 	}
-	return nil
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i] < deleted[j] })
+	return deleted, nil
 }
 
 func newLevelHandler(db *DB, level int) *levelHandler {
-	return &levelHandler{
+	s := &levelHandler{
 		level:    level,
 		strLevel: fmt.Sprintf("l%d", level),
 		db:       db,
+		shrinkCh: make(chan struct{}),
+	}
+	if db.opt.MetricsEnabled {
+		s.versionsExamined = z.NewHistogramData(z.HistogramBounds(0, 10))
+	}
+	return s
+}
+
+func (s *levelHandler) updateVersionsExamined(n int64) {
+	if s.versionsExamined == nil || n == 0 {
+		return
 	}
+	s.versionsExaminedMu.Lock()
+	s.versionsExamined.Update(n)
+	s.versionsExaminedMu.Unlock()
+}
+
+// getVersionsExamined returns a copy of the versionsExamined histogram.
+func (s *levelHandler) getVersionsExamined() *z.HistogramData {
+	s.versionsExaminedMu.Lock()
+	defer s.versionsExaminedMu.Unlock()
+	return s.versionsExamined.Copy()
 }
 
-// tryAddLevel0Table returns true if ok and no stalling.
-func (s *levelHandler) tryAddLevel0Table(t *table.Table) bool {
+// updateOverTarget records when the level first went over its target, and clears the record once
+// the level is back within its target.
+func (s *levelHandler) updateOverTarget(over bool, now time.Time) {
+	if !over {
+		s.overTargetSince.Store(0)
+		return
+	}
+	s.overTargetSince.CompareAndSwap(0, now.UnixNano())
+}
+
+// compactionLag returns how long the level has been over its target, or zero if it is not.
+func (s *levelHandler) compactionLag(now time.Time) time.Duration {
+	since := s.overTargetSince.Load()
+	if since == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, since))
+}
+
+// l0StallPolicy returns whether a level 0 holding n tables accepts one more, and how long to delay
+// the flush by, as decided by Options.L0StallPolicy.
+func (s *levelHandler) l0StallPolicy(n int) (bool, time.Duration) {
+	policy := s.db.opt.L0StallPolicy
+	if policy == nil {
+		policy = DefaultL0StallPolicy
+	}
+	return policy(n, s.db.opt.NumLevelZeroTables, s.db.L0StallThreshold())
+}
+
+// tryAddLevel0Table returns true if ok and no stalling. The duration returned is the delay to
+// apply to the flush, once the table is added.
+func (s *levelHandler) tryAddLevel0Table(t *table.Table) (bool, time.Duration) {
 	y.AssertTrue(s.level == 0)
+	// The policy is user code, which might call back into the DB, so it runs without the lock.
+	s.RLock()
+	n := len(s.tables)
+	s.RUnlock()
+	accept, delay := s.l0StallPolicy(n)
+
 	// Need lock as we may be deleting the first table during a level 0 compaction.
 	s.Lock()
-	defer s.Unlock()
-	// Stall (by returning false) if we are above the specified stall setting for L0.
-	if len(s.tables) >= s.db.opt.NumLevelZeroTablesStall {
-		return false
+	if accept && len(s.tables) > n {
+		// Tables were added since the policy was asked. Ask again.
+		s.Unlock()
+		return s.tryAddLevel0Table(t)
+	}
+	// Stall (by returning false) if the policy refuses more tables on L0.
+	if !accept {
+		if s.stallStart.IsZero() {
+			s.stallStart = time.Now()
+		}
+		s.Unlock()
+		y.NumLSMStallsAdd(s.db.opt.MetricsEnabled, s.strLevel, 1)
+		return false, 0
+	}
+	var stalled time.Duration
+	if !s.stallStart.IsZero() {
+		stalled = time.Since(s.stallStart)
+		s.stallStart = time.Time{}
 	}
 
+	wasEmpty := len(s.tables) == 0
 	s.tables = append(s.tables, t)
 	t.IncrRef()
 	s.addSize(t)
+	s.Unlock()
 
-	return true
+	if stalled > 0 {
+		y.NumLSMStallNsAdd(s.db.opt.MetricsEnabled, s.strLevel, stalled.Nanoseconds())
+	}
+	s.db.tableEvents.record(TableCreated, s.level, []*table.Table{t})
+	s.notifyEmptyChange(wasEmpty, false)
+	return true, delay
 }
 
 // This should be called while holding the lock on the level.
 func (s *levelHandler) addSize(t *table.Table) {
 	s.totalSize += t.Size()
 	s.totalStaleSize += int64(t.StaleDataSize())
+	s.sizeChanged()
 }
 
 // This should be called while holding the lock on the level.
 func (s *levelHandler) subtractSize(t *table.Table) {
 	s.totalSize -= t.Size()
 	s.totalStaleSize -= int64(t.StaleDataSize())
+	s.sizeChanged()
 }
+
+// sizeChanged queues the level for Options.OnLevelSizeChange, unless it is already queued. The
+// channel can hold all the levels, so this never blocks.
+func (s *levelHandler) sizeChanged() {
+	if s.db.opt.OnLevelSizeChange == nil || !s.sizeChangePending.CompareAndSwap(false, true) {
+		return
+	}
+	s.db.levelSizeCh <- s.level
+}
+
+// LevelStats is a snapshot of the tables held by a level.
+type LevelStats struct {
+	Level          int
+	NumTables      int
+	TotalSize      int64
+	TotalStaleSize int64
+	// StaleRatio is TotalStaleSize over TotalSize, or zero for an empty level.
+	StaleRatio float64
+	// Smallest and Biggest are the bounds of the keys in the level, without versions. Both are nil
+	// for an empty level.
+	Smallest    []byte
+	Biggest     []byte
+	IsLastLevel bool
+}
+
+// iterateTables calls f for each table of the level in order, L0 tables by ID and the others by
+// key, until f returns false. The read lock is held throughout, so f blocks compactions and
+// flushes on the level until it returns, and must not call back into the level. A table is only
+// guaranteed to stay open while f runs, so f has to IncrRef it to use it afterwards.
+func (s *levelHandler) iterateTables(f func(*table.Table) bool) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, t := range s.tables {
+		if !f(t) {
+			return
+		}
+	}
+}
+
+// stats returns a snapshot of the level, taken under a single read lock.
+func (s *levelHandler) stats() LevelStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	st := LevelStats{
+		Level:          s.level,
+		NumTables:      len(s.tables),
+		TotalSize:      s.totalSize,
+		TotalStaleSize: s.totalStaleSize,
+		IsLastLevel:    s.isLastLevel(),
+	}
+	if st.TotalSize > 0 {
+		st.StaleRatio = float64(st.TotalStaleSize) / float64(st.TotalSize)
+	}
+	if len(s.tables) == 0 {
+		return st
+	}
+	var smallest, biggest []byte
+	if s.level == 0 {
+		// Level 0 tables can overlap, so look at all of them.
+		for _, t := range s.tables {
+			if smallest == nil || y.CompareKeys(t.Smallest(), smallest) < 0 {
+				smallest = t.Smallest()
+			}
+			if biggest == nil || y.CompareKeys(t.Biggest(), biggest) > 0 {
+				biggest = t.Biggest()
+			}
+		}
+	} else {
+		smallest, biggest = s.tables[0].Smallest(), s.tables[len(s.tables)-1].Biggest()
+	}
+	st.Smallest = y.SafeCopy(nil, y.ParseKey(smallest))
+	st.Biggest = y.SafeCopy(nil, y.ParseKey(biggest))
+	return st
+}
+
 func (s *levelHandler) numTables() int {
 	s.RLock()
 	defer s.RUnlock()
 	return len(s.tables)
 }
 
-func (s *levelHandler) close() error {
+// TableSizeStats describes the distribution of the sizes of the tables of a level. The
+// percentiles are nearest-rank ones, so they are sizes of actual tables. All the sizes are zero
+// for an empty level.
+type TableSizeStats struct {
+	Level     int
+	NumTables int
+	Min       int64
+	Max       int64
+	Mean      float64
+	P50       int64
+	P90       int64
+	P99       int64
+}
+
+// tableSizeStats returns the distribution of the sizes of the tables. The sizes are kept in
+// memory, so no table is read, and they are copied under the read lock so they can be sorted
+// after releasing it.
+func (s *levelHandler) tableSizeStats() TableSizeStats {
+	s.RLock()
+	sizes := make([]int64, 0, len(s.tables))
+	for _, t := range s.tables {
+		sizes = append(sizes, t.Size())
+	}
+	s.RUnlock()
+
+	st := TableSizeStats{Level: s.level, NumTables: len(sizes)}
+	if len(sizes) == 0 {
+		return st
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	var total int64
+	for _, sz := range sizes {
+		total += sz
+	}
+	percentile := func(p int) int64 {
+		// The smallest size with at least p percent of the sizes at or below it.
+		rank := (p*len(sizes) + 99) / 100
+		return sizes[rank-1]
+	}
+	st.Min = sizes[0]
+	st.Max = sizes[len(sizes)-1]
+	st.Mean = float64(total) / float64(len(sizes))
+	st.P50 = percentile(50)
+	st.P90 = percentile(90)
+	st.P99 = percentile(99)
+	return st
+}
+
+// findTable returns the TableInfo of the table of the level with the given ID, if there is one.
+// The tables of a level aren't sorted by ID, except on level 0, so all of them are looked at.
+func (s *levelHandler) findTable(id uint64) (TableInfo, bool) {
 	s.RLock()
 	defer s.RUnlock()
-	var err error
 	for _, t := range s.tables {
-		if closeErr := t.Close(-1); closeErr != nil && err == nil {
-			err = closeErr
+		if t.ID() == id {
+			return newTableInfo(t, s.level), true
 		}
 	}
-	return y.Wrap(err, "levelHandler.close")
+	return TableInfo{}, false
+}
+
+// estimatedKeys returns the sum of the key counts of the tables, which are kept in memory, so no
+// table is read. Every version of a key is counted.
+func (s *levelHandler) estimatedKeys() int64 {
+	s.RLock()
+	defer s.RUnlock()
+	var n int64
+	for _, t := range s.tables {
+		n += int64(t.KeyCount())
+	}
+	return n
+}
+
+func (s *levelHandler) close() error {
+	// Copy the tables so the lock isn't held while the files are being closed.
+	s.RLock()
+	tables := append([]*table.Table{}, s.tables...)
+	s.RUnlock()
+
+	failed, err := forEachTable(tables, s.db.opt.NumTableCloseWorkers, func(t *table.Table) error {
+		t.Unpin()
+		return t.Close(-1)
+	})
+	if err != nil {
+		return y.Wrapf(err, "levelHandler.close: %d of %d tables at level %d failed to close",
+			failed, len(tables), s.level)
+	}
+	return nil
+}
+
+// forEachTable calls fn on each of the tables, running up to workers calls at a time. fn is called
+// for every table even after one of the calls fails. It returns the number of calls that failed
+// and the first error returned.
+func forEachTable(tables []*table.Table, workers int, fn func(*table.Table) error) (int, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(tables) {
+		workers = len(tables)
+	}
+	var (
+		mu       sync.Mutex
+		failed   int
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	ch := make(chan *table.Table)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range ch {
+				if err := fn(t); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, t := range tables {
+		ch <- t
+	}
+	close(ch)
+	wg.Wait()
+	return failed, firstErr
 }
 
 // getTableForKey acquires a read-lock to access s.tables. It returns a list of tableHandlers.
@@ -273,39 +794,273 @@ func (s *levelHandler) getTableForKey(key []byte) ([]*table.Table, func() error)
 	return []*table.Table{tbl}, tbl.DecrRef
 }
 
+// getCandidateTablesForKey is like getTableForKey, but skips the tables whose bloom filter rules out
+// a key with the given hash, before taking a reference on them. hash must be y.Hash of the key
+// without its timestamp.
+func (s *levelHandler) getCandidateTablesForKey(key []byte, hash uint32) ([]*table.Table,
+	func() error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var out []*table.Table
+	var bloomHits int64
+	if s.level == 0 {
+		// Newest tables first, as in getTableForKey.
+		for i := len(s.tables) - 1; i >= 0; i-- {
+			if s.tables[i].DoesNotHave(hash) {
+				bloomHits++
+				continue
+			}
+			out = append(out, s.tables[i])
+		}
+	} else {
+		idx := sort.Search(len(s.tables), func(i int) bool {
+			return y.CompareKeys(s.tables[i].Biggest(), key) >= 0
+		})
+		if idx < len(s.tables) {
+			if s.tables[idx].DoesNotHave(hash) {
+				bloomHits++
+			} else {
+				out = append(out, s.tables[idx])
+			}
+		}
+	}
+	if bloomHits > 0 {
+		y.NumLSMBloomHitsAdd(s.db.opt.MetricsEnabled, s.strLevel, bloomHits)
+	}
+	touchTables(out)
+	for _, t := range out {
+		t.IncrRef()
+	}
+	return out, func() error { return decrRefs(out) }
+}
+
+// touchTables records that tables are serving a read, for table.Table.LastAccess. It takes the
+// time once for all of them.
+func touchTables(tables []*table.Table) {
+	if len(tables) == 0 {
+		return
+	}
+	now := time.Now().Unix()
+	for _, t := range tables {
+		t.Touch(now)
+	}
+}
+
+// snapshot returns the tables of the level, taking a reference on each of them, along with a
+// function releasing them.
+func (s *levelHandler) snapshot() ([]*table.Table, func() error) {
+	s.RLock()
+	defer s.RUnlock()
+	out := append([]*table.Table(nil), s.tables...)
+	for _, t := range out {
+		t.IncrRef()
+	}
+	return out, func() error { return decrRefs(out) }
+}
+
 // get returns value for a given key or the key after that. If not found, return nil.
 func (s *levelHandler) get(key []byte) (y.ValueStruct, error) {
-	tables, decr := s.getTableForKey(key)
-	keyNoTs := y.ParseKey(key)
+	return s.lookup(key, 0, false)
+}
+
+// getAtLeast is like get, but stops looking at further tables once it has found a version of the
+// key of at least minVersion. A minVersion of zero looks at every table.
+func (s *levelHandler) getAtLeast(key []byte, minVersion uint64) (y.ValueStruct, error) {
+	return s.lookup(key, minVersion, false)
+}
+
+// lookup returns the latest version of key found in the tables of the level which could hold it.
+// If first is set, it returns the first version found instead, looking at the newest table first.
+// If minVersion is not zero, it returns as soon as it finds a version of at least minVersion.
+func (s *levelHandler) lookup(key []byte, minVersion uint64, first bool) (y.ValueStruct, error) {
+	hash := y.Hash(y.ParseKey(key))
+	tables, decr := s.getCandidateTablesForKey(key, hash)
 
-	hash := y.Hash(keyNoTs)
 	var maxVs y.ValueStruct
+	var numVersions, falsePositives int64
 	for _, th := range tables {
-		if th.DoesNotHave(hash) {
-			y.NumLSMBloomHitsAdd(s.db.opt.MetricsEnabled, s.strLevel, 1)
-			continue
-		}
-
 		it := th.NewIterator(0)
 		defer it.Close()
 
 		y.NumLSMGetsAdd(s.db.opt.MetricsEnabled, s.strLevel, 1)
 		it.Seek(key)
-		if !it.Valid() {
+		if !it.Valid() || !y.SameKey(key, it.Key()) {
+			// The bloom filter, if any, let the table through though it doesn't hold the key.
+			if s.db.opt.MetricsEnabled && th.BloomFilterSize() > 0 && !holdsUserKey(it, key) {
+				falsePositives++
+			}
 			continue
 		}
-		if y.SameKey(key, it.Key()) {
+		numVersions++
+		if version := y.ParseTs(it.Key()); maxVs.Version < version {
+			maxVs = it.ValueCopy()
+			maxVs.Version = version
+			if s.db.opt.MetricsEnabled {
+				maxVs.TableID = th.ID()
+			}
+		}
+		if first || (minVersion > 0 && maxVs.Version >= minVersion) {
+			break
+		}
+	}
+	if falsePositives > 0 {
+		y.NumLSMBloomFalsePositivesAdd(s.db.opt.MetricsEnabled, s.strLevel, falsePositives)
+	}
+	s.updateVersionsExamined(numVersions)
+	return maxVs, decr()
+}
+
+// holdsUserKey returns true if the table of it holds the user key of key at any version. A table
+// whose bloom filter let a get through, but which only holds the key at versions above the read
+// timestamp, doesn't hold a false positive. It moves the iterator.
+func holdsUserKey(it *table.Iterator, key []byte) bool {
+	userKey := y.ParseKey(key)
+	it.Seek(y.KeyWithTs(userKey, math.MaxUint64))
+	return it.Valid() && bytes.Equal(y.ParseKey(it.Key()), userKey)
+}
+
+// getBatch is like get for several keys at once. The keys are looked up in sorted order, with the
+// tables picked under a single read lock, and a single iterator per table which only ever moves
+// forward, so that lookups of nearby keys share the work of finding them. The values are returned
+// in the order of keys.
+func (s *levelHandler) getBatch(keys [][]byte) ([]y.ValueStruct, error) {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return y.CompareKeys(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	// keyTable holds, for each key in sorted order, the position in tables of the only table of a
+	// level >= 1 which could hold it, or -1 if there is none.
+	var tables []*table.Table
+	var keyTable []int
+	s.RLock()
+	if s.level == 0 {
+		// Newest tables first, as in getTableForKey.
+		for i := len(s.tables) - 1; i >= 0; i-- {
+			tables = append(tables, s.tables[i])
+		}
+	} else {
+		keyTable = make([]int, len(order))
+		idx := 0
+		for i, k := range order {
+			// The keys are sorted, so the table of a key is never before the one of the previous key.
+			idx += sort.Search(len(s.tables)-idx, func(j int) bool {
+				return y.CompareKeys(s.tables[idx+j].Biggest(), keys[k]) >= 0
+			})
+			switch {
+			case idx == len(s.tables):
+				keyTable[i] = -1
+			case len(tables) > 0 && tables[len(tables)-1] == s.tables[idx]:
+				keyTable[i] = len(tables) - 1
+			default:
+				tables = append(tables, s.tables[idx])
+				keyTable[i] = len(tables) - 1
+			}
+		}
+	}
+	touchTables(tables)
+	for _, t := range tables {
+		t.IncrRef()
+	}
+	s.RUnlock()
+
+	type tableIter struct {
+		it     *table.Iterator
+		seeked bool
+	}
+	iters := make([]tableIter, len(tables))
+	// seek moves the iterator of the table at position i to key, which is never before the key it
+	// was last sought to. It returns false if the table has no key at or after it.
+	seek := func(i int, key []byte) bool {
+		ti := &iters[i]
+		if ti.it == nil {
+			ti.it = tables[i].NewIterator(0)
+		}
+		switch {
+		case !ti.seeked:
+			ti.it.Seek(key)
+			ti.seeked = true
+		case !ti.it.Valid():
+			// The table has no key after the previous one, so none after this one either.
+			return false
+		case y.CompareKeys(ti.it.Key(), key) < 0:
+			ti.it.Seek(key)
+		}
+		return ti.it.Valid()
+	}
+
+	vals := make([]y.ValueStruct, len(keys))
+	var bloomHits, falsePositives int64
+	for i, k := range order {
+		key := keys[k]
+		hash := y.Hash(y.ParseKey(key))
+		candidates := []int{-1}
+		if s.level == 0 {
+			candidates = candidates[:0]
+			for j := range tables {
+				candidates = append(candidates, j)
+			}
+		} else {
+			candidates[0] = keyTable[i]
+		}
+
+		var maxVs y.ValueStruct
+		var numVersions int64
+		for _, j := range candidates {
+			if j < 0 {
+				continue
+			}
+			if tables[j].DoesNotHave(hash) {
+				bloomHits++
+				continue
+			}
+			y.NumLSMGetsAdd(s.db.opt.MetricsEnabled, s.strLevel, 1)
+			if !seek(j, key) || !y.SameKey(key, iters[j].it.Key()) {
+				// Moving the iterator back is fine, as seek moves it forward again if needed.
+				if s.db.opt.MetricsEnabled && tables[j].BloomFilterSize() > 0 &&
+					!holdsUserKey(iters[j].it, key) {
+					falsePositives++
+				}
+				continue
+			}
+			it := iters[j].it
+			numVersions++
 			if version := y.ParseTs(it.Key()); maxVs.Version < version {
 				maxVs = it.ValueCopy()
 				maxVs.Version = version
+				if s.db.opt.MetricsEnabled {
+					maxVs.TableID = tables[j].ID()
+				}
 			}
 		}
+		s.updateVersionsExamined(numVersions)
+		vals[k] = maxVs
 	}
-	return maxVs, decr()
+	if bloomHits > 0 {
+		y.NumLSMBloomHitsAdd(s.db.opt.MetricsEnabled, s.strLevel, bloomHits)
+	}
+	if falsePositives > 0 {
+		y.NumLSMBloomFalsePositivesAdd(s.db.opt.MetricsEnabled, s.strLevel, falsePositives)
+	}
+	// The iterators must be closed before the tables are released.
+	for _, ti := range iters {
+		if ti.it != nil {
+			ti.it.Close()
+		}
+	}
+	return vals, decrRefs(tables)
 }
 
 // appendIterators appends iterators to an array of iterators, for merging.
 // Note: This obtains references for the table handlers. Remember to close these iterators.
+// The read lock is held until all the iterators are created, and creating an iterator references
+// its tables, so the iterators see the tables of the level at a single point in time: a table
+// added or removed by a concurrent flush or compaction is either fully seen or not at all, and the
+// tables picked stay readable until the iterators are closed.
 func (s *levelHandler) appendIterators(iters []y.Iterator, opt *IteratorOptions) []y.Iterator {
 	s.RLock()
 	defer s.RUnlock()
@@ -324,6 +1079,7 @@ func (s *levelHandler) appendIterators(iters []y.Iterator, opt *IteratorOptions)
 				out = append(out, t)
 			}
 		}
+		touchTables(out)
 		return appendIteratorsReversed(iters, out, topt)
 	}
 
@@ -331,7 +1087,8 @@ func (s *levelHandler) appendIterators(iters []y.Iterator, opt *IteratorOptions)
 	if len(tables) == 0 {
 		return iters
 	}
-	return append(iters, table.NewConcatIterator(tables, topt))
+	touchTables(tables)
+	return append(iters, table.NewIteratorOverTables(tables, opt.Reverse))
 }
 
 type levelHandlerRLocked struct{}
@@ -343,6 +1100,12 @@ func (s *levelHandler) overlappingTables(_ levelHandlerRLocked, kr keyRange) (in
 	if len(kr.left) == 0 || len(kr.right) == 0 {
 		return 0, 0
 	}
+	if y.CompareKeys(kr.left, kr.right) > 0 {
+		// A reversed range would make the two searches below return garbage indices.
+		s.db.opt.Warningf("overlappingTables called with reversed key range %s on level %d",
+			kr, s.level)
+		return 0, 0
+	}
 	left := sort.Search(len(s.tables), func(i int) bool {
 		return y.CompareKeys(kr.left, s.tables[i].Biggest()) <= 0
 	})
@@ -351,3 +1114,17 @@ func (s *levelHandler) overlappingTables(_ levelHandlerRLocked, kr keyRange) (in
 	})
 	return left, right
 }
+
+// overlappingTablesWithSize is like overlappingTables, but acquires the read lock itself and also
+// returns the total size and total stale data size of the tables in the interval.
+func (s *levelHandler) overlappingTablesWithSize(kr keyRange) (left, right int, size,
+	staleSize int64) {
+	s.RLock()
+	defer s.RUnlock()
+	left, right = s.overlappingTables(levelHandlerRLocked{}, kr)
+	for _, t := range s.tables[left:right] {
+		size += t.Size()
+		staleSize += int64(t.StaleDataSize())
+	}
+	return left, right, size, staleSize
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright 2026 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"encoding/hex"
+	"sort"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+
+	"github.com/dgraph-io/badger/v4/pb"
+	"github.com/dgraph-io/badger/v4/table"
+	"github.com/dgraph-io/badger/v4/y"
+)
+
+// LevelWriter writes pre-built tables directly into one level of the LSM tree, without going
+// through the memtables or compactions. Unlike StreamWriter, it doesn't drop the existing data, but
+// the tables written into a level other than 0 must not overlap with each other, nor with the
+// tables already in the level. The tables only become visible once Flush is called.
+//
+// The versions of the keys are taken as they are. Outside of managed mode, versions above the
+// current read timestamp of the DB are not visible to transactions until it catches up. A
+// LevelWriter must not be used concurrently.
+type LevelWriter struct {
+	db     *DB
+	level  int
+	tables []*table.Table
+	done   bool
+}
+
+// StreamIntoLevel returns a LevelWriter writing tables into the given level.
+func (db *DB) StreamIntoLevel(level int) (*LevelWriter, error) {
+	if db.IsClosed() {
+		return nil, ErrDBClosed
+	}
+	if db.opt.ReadOnly {
+		return nil, errors.New("Cannot stream into a level in read-only mode")
+	}
+	if level < 0 || level >= len(db.lc.levels) {
+		return nil, errors.Errorf("Invalid level %d, must be within range of 0-%d", level,
+			len(db.lc.levels)-1)
+	}
+	return &LevelWriter{db: db, level: level}, nil
+}
+
+// NewTableBuilder returns a table builder using the table options of the DB, to build the tables
+// passed to Write.
+func (w *LevelWriter) NewTableBuilder() *table.Builder {
+	return table.NewTableBuilder(buildTableOptions(w.db))
+}
+
+// Write writes the table built by b to disk, to be added to the level by Flush. The keys must have
+// been added to b in sorted order, as usual. Write closes b, and an empty b is ignored.
+func (w *LevelWriter) Write(b *table.Builder) error {
+	defer b.Close()
+	if w.done {
+		return errors.New("LevelWriter is already flushed or canceled")
+	}
+	if b.Empty() {
+		b.Finish()
+		return nil
+	}
+
+	fileID := w.db.lc.reserveFileID()
+	var tbl *table.Table
+	var err error
+	if w.db.opt.InMemory {
+		tbl, err = table.OpenInMemoryTable(b.Finish(), fileID, b.Opts())
+	} else {
+		tbl, err = table.CreateTable(table.NewFilename(fileID, w.db.opt.Dir), b)
+	}
+	if err != nil {
+		return y.Wrapf(err, "while creating table %d for level %d", fileID, w.level)
+	}
+	w.tables = append(w.tables, tbl)
+	return nil
+}
+
+// Flush adds all the written tables to the level in a single MANIFEST update. It fails without
+// adding any table if the tables written into a level other than 0 overlap with each other or
+// with the tables of the level. Compactions are paused while the tables are added, so that no
+// overlapping table is moved into the level meanwhile. Whether it succeeds or not, the LevelWriter
+// can't be used afterwards, and the tables not added are deleted.
+//
+// Flush returns ErrDBClosed once the DB is closing, and ErrBlockedWrites while DropAll, DropPrefix
+// or a StreamWriter is running. Flushes of several LevelWriters run one at a time. A Flush into
+// level 0 first waits for level 0 to accept a table, like a memtable flush does, as decided by
+// Options.L0StallPolicy. All the tables are then added at once, so that a Flush of several tables
+// can take level 0 past the stall threshold.
+func (w *LevelWriter) Flush() error {
+	if w.done {
+		return errors.New("LevelWriter is already flushed or canceled")
+	}
+	defer w.Cancel()
+	if len(w.tables) == 0 {
+		return nil
+	}
+
+	lh := w.db.lc.levels[w.level]
+	if w.level == 0 {
+		// The background context never gets done, so there is no error to handle.
+		_ = lh.waitForSpace(context.Background())
+	}
+
+	// Holding compactorsLock keeps Close, DropAll and the StreamWriter from stopping or restarting
+	// the compactors until the tables are added.
+	db := w.db
+	db.compactorsLock.Lock()
+	defer db.compactorsLock.Unlock()
+	if db.IsClosed() {
+		return ErrDBClosed
+	}
+	if db.blockWrites.Load() == 1 {
+		return ErrBlockedWrites
+	}
+	db.stopCompactionsLocked()
+	defer db.startCompactionsLocked()
+
+	if w.level > 0 {
+		if err := w.checkOverlaps(lh); err != nil {
+			return err
+		}
+	}
+	if !w.db.opt.InMemory {
+		if err := w.db.syncDir(w.db.opt.Dir); err != nil {
+			return err
+		}
+	}
+
+	changes := make([]*pb.ManifestChange, 0, len(w.tables))
+	for _, tbl := range w.tables {
+		change := newCreateChange(tbl.ID(), w.level, tbl.KeyID(), tbl.CompressionType())
+		changes = append(changes, change)
+	}
+	if err := w.db.manifest.addChanges(changes); err != nil {
+		return err
+	}
+
+	// We are not calling lh.replaceTables() here, as it sorts tables on every addition. We sort
+	// all tables only once after adding them.
+	var size int64
+	for _, tbl := range w.tables {
+		lh.addTable(tbl)
+		size += tbl.Size()
+	}
+	lh.sortTables()
+	w.db.opt.Infof("Streamed %d tables into level %d. Size: %s\n", len(w.tables), w.level,
+		humanize.IBytes(uint64(size)))
+
+	// The level holds its own reference to the tables now, and the deferred Cancel releases the
+	// ones held by OpenTable.
+	return nil
+}
+
+// checkOverlaps returns an error if the written tables overlap with each other, with the tables of
+// the level, or with a key range being compacted into the level. It sorts w.tables by key.
+func (w *LevelWriter) checkOverlaps(lh *levelHandler) error {
+	sort.Slice(w.tables, func(i, j int) bool {
+		return y.CompareKeys(w.tables[i].Smallest(), w.tables[j].Smallest()) < 0
+	})
+	for i := 1; i < len(w.tables); i++ {
+		prev, next := w.tables[i-1], w.tables[i]
+		if y.CompareKeys(prev.Biggest(), next.Smallest()) >= 0 {
+			return errors.Errorf("Tables %d and %d overlap. Biggest: %s Smallest: %s",
+				prev.ID(), next.ID(), hex.Dump(prev.Biggest()), hex.Dump(next.Smallest()))
+		}
+	}
+
+	lh.RLock()
+	defer lh.RUnlock()
+	for _, tbl := range w.tables {
+		kr := keyRange{left: tbl.Smallest(), right: tbl.Biggest()}
+		if left, right := lh.overlappingTables(levelHandlerRLocked{}, kr); left < right {
+			return errors.Errorf("Table %d overlaps with table %d of level %d", tbl.ID(),
+				lh.tables[left].ID(), w.level)
+		}
+		if w.db.lc.cstatus.overlapsWith(w.level, kr) {
+			return errors.Errorf("Table %d overlaps with a compaction into level %d", tbl.ID(),
+				w.level)
+		}
+	}
+	return nil
+}
+
+// Cancel deletes the tables written but not flushed yet. The LevelWriter can't be used afterwards.
+func (w *LevelWriter) Cancel() {
+	w.done = true
+	for _, tbl := range w.tables {
+		_ = tbl.DecrRef()
+	}
+	w.tables = nil
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2026 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dgraph-io/badger/v4/y"
+)
+
+func TestStreamIntoLevel(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithNumCompactors(0)
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	_, err = db.StreamIntoLevel(len(db.lc.levels))
+	require.Error(t, err)
+
+	createAndOpen(db, []keyValVersion{{"m", "m1", 1, 0}}, 3)
+	write := func(w *LevelWriter, keys ...string) {
+		b := w.NewTableBuilder()
+		for _, k := range keys {
+			b.Add(y.KeyWithTs([]byte(k), 1), y.ValueStruct{Value: []byte(k + "1")}, 0)
+		}
+		require.NoError(t, w.Write(b))
+	}
+	numFiles := func() int {
+		files, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+		require.NoError(t, err)
+		return len(files)
+	}
+
+	w, err := db.StreamIntoLevel(3)
+	require.NoError(t, err)
+	write(w, "x")
+	write(w, "a", "b")
+	write(w, "c")
+	write(w) // Empty tables are ignored.
+	require.NoError(t, w.Flush())
+	require.Error(t, w.Write(w.NewTableBuilder()))
+	require.NoError(t, db.lc.levels[3].validate())
+	require.Len(t, db.lc.levels[3].tables, 4)
+
+	for _, k := range []string{"a", "b", "c", "m", "x"} {
+		vs, err := db.get(y.KeyWithTs([]byte(k), math.MaxUint64))
+		require.NoError(t, err)
+		require.Equal(t, k+"1", string(vs.Value))
+	}
+
+	// Tables overlapping with a table of the level, or with each other, are rejected, and deleted.
+	before := numFiles()
+	w, err = db.StreamIntoLevel(3)
+	require.NoError(t, err)
+	write(w, "d")
+	write(w, "l", "n")
+	require.Error(t, w.Flush())
+	w, err = db.StreamIntoLevel(3)
+	require.NoError(t, err)
+	write(w, "e", "g")
+	write(w, "f")
+	require.Error(t, w.Flush())
+	require.Len(t, db.lc.levels[3].tables, 4)
+	require.Equal(t, before, numFiles())
+
+	// Level 0 takes overlapping tables, kept in the order they were written.
+	w, err = db.StreamIntoLevel(0)
+	require.NoError(t, err)
+	write(w, "b", "y")
+	write(w, "a")
+	require.NoError(t, w.Flush())
+	l0 := db.lc.levels[0].tables
+	require.Len(t, l0, 2)
+	require.Less(t, l0[0].ID(), l0[1].ID())
+	require.Equal(t, "b", string(y.ParseKey(l0[0].Smallest())))
+
+	// The tables are in the MANIFEST.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.Len(t, db.lc.levels[0].tables, 2)
+	require.Len(t, db.lc.levels[3].tables, 4)
+	getAllAndCheck(t, db, []keyValVersion{
+		{"a", "a1", 1, 0}, {"b", "b1", 1, 0}, {"c", "c1", 1, 0}, {"m", "m1", 1, 0},
+		{"x", "x1", 1, 0}, {"y", "y1", 1, 0},
+	})
+}
+
+func TestStreamIntoLevelExclusion(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	newWriter := func(level int, key string) *LevelWriter {
+		w, err := db.StreamIntoLevel(level)
+		require.NoError(t, err)
+		b := w.NewTableBuilder()
+		b.Add(y.KeyWithTs([]byte(key), 1), y.ValueStruct{Value: []byte(key)}, 0)
+		require.NoError(t, w.Write(b))
+		return w
+	}
+	numStopped := func() int {
+		db.compactorsLock.Lock()
+		defer db.compactorsLock.Unlock()
+		return db.compactorsStopped
+	}
+
+	// Flushes running at the same time leave the compactors running once they are done.
+	var wg sync.WaitGroup
+	for i := 1; i < 4; i++ {
+		w := newWriter(i, fmt.Sprintf("key%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, w.Flush())
+		}()
+	}
+	wg.Wait()
+	require.Zero(t, numStopped())
+
+	// A StreamWriter keeps the tables of a LevelWriter out.
+	sw := db.NewStreamWriter()
+	require.NoError(t, sw.Prepare())
+	require.Equal(t, ErrBlockedWrites, newWriter(1, "a").Flush())
+	sw.Cancel()
+	require.Zero(t, numStopped())
+
+	// Once the DB is closing, Flush fails and the compactors stay stopped.
+	w := newWriter(1, "b")
+	require.NoError(t, db.Close())
+	require.Equal(t, ErrDBClosed, w.Flush())
+	require.Equal(t, 1, numStopped())
+}
@@ -43,6 +43,18 @@ type levelsController struct {
 	nextFileID atomic.Uint64
 	l0stallsMs atomic.Int64
 
+	// compactionsPaused stops the compactors from picking up new compactions. numRunning is the
+	// number of compactions picked up by the compactors which haven't finished yet, guarded by
+	// runningMu. runningCond is broadcast when it drops to zero.
+	compactionsPaused atomic.Bool
+	runningMu         sync.Mutex
+	runningCond       *sync.Cond
+	numRunning        int
+
+	// compactRequests holds the levels passed to DB.RequestCompaction, which the compactors run
+	// before the ones they pick. A level is queued at most once, so it never fills up.
+	compactRequests chan int
+
 	// The following are initialized once and const.
 	levels []*levelHandler
 	kv     *DB
@@ -78,9 +90,11 @@ func revertToManifest(kv *DB, mf *Manifest, idMap map[uint64]struct{}) error {
 func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 	y.AssertTrue(db.opt.NumLevelZeroTablesStall > db.opt.NumLevelZeroTables)
 	s := &levelsController{
-		kv:     db,
-		levels: make([]*levelHandler, db.opt.MaxLevels),
+		kv:              db,
+		levels:          make([]*levelHandler, db.opt.MaxLevels),
+		compactRequests: make(chan int, db.opt.MaxLevels),
 	}
+	s.runningCond = sync.NewCond(&s.runningMu)
 	s.cstatus.tables = make(map[uint64]struct{})
 	s.cstatus.levels = make([]*levelCompactStatus, db.opt.MaxLevels)
 
@@ -171,10 +185,24 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 	db.opt.Infof("All %d tables opened in %s\n", numOpened.Load(),
 		time.Since(start).Round(time.Millisecond))
 	s.nextFileID.Store(maxFileID + 1)
+	if db.opt.VerifyInvariantsOnOpen {
+		// initTables sorts level 0 by file ID, so check the order of the manifest before.
+		if err := verifyLevel0Order(mf, tables[0]); err != nil {
+			closeAllTables(tables)
+			return nil, y.Wrap(err, "Invariant verification")
+		}
+	}
 	for i, tbls := range tables {
 		s.levels[i].initTables(tbls)
 	}
 
+	if db.opt.VerifyInvariantsOnOpen {
+		if err := s.verifyInvariants(); err != nil {
+			_ = s.cleanupLevels()
+			return nil, y.Wrap(err, "Invariant verification")
+		}
+	}
+
 	// Make sure key ranges do not overlap etc.
 	if err := s.validate(); err != nil {
 		_ = s.cleanupLevels()
@@ -244,6 +272,7 @@ func (s *levelsController) dropTree() (int, error) {
 	for _, l := range s.levels {
 		l.Lock()
 		l.totalSize = 0
+		l.signalShrink(len(l.tables) > 0)
 		l.tables = l.tables[:0]
 		l.Unlock()
 	}
@@ -255,6 +284,113 @@ func (s *levelsController) dropTree() (int, error) {
 	return len(all), nil
 }
 
+// dropLevel deletes all the tables of the given level. The whole level is reserved in cstatus
+// while the tables are dropped, so no compaction can pick up or write tables on it in the
+// meantime. It refuses to drop a level which is already being compacted.
+func (s *levelsController) dropLevel(level int) (int, int64, error) {
+	if level < 0 || level >= len(s.levels) {
+		return 0, 0, errors.Errorf("Invalid level %d, must be within range of 0-%d", level,
+			len(s.levels)-1)
+	}
+	s.cstatus.Lock()
+	lcs := s.cstatus.levels[level]
+	if len(lcs.ranges) > 0 {
+		s.cstatus.Unlock()
+		return 0, 0, errors.Errorf("Level %d is being compacted", level)
+	}
+	lcs.ranges = append(lcs.ranges, infRange)
+	s.cstatus.Unlock()
+	defer func() {
+		s.cstatus.Lock()
+		lcs.remove(infRange)
+		s.cstatus.Unlock()
+	}()
+
+	l := s.levels[level]
+	l.RLock()
+	toDel := append([]*table.Table(nil), l.tables...)
+	l.RUnlock()
+	if len(toDel) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := l.verifyTablesToDelete(toDel); err != nil {
+		return 0, 0, err
+	}
+	var size int64
+	changes := []*pb.ManifestChange{}
+	for _, t := range toDel {
+		size += t.Size()
+		// Add a delete change only if the table is not in memory.
+		if !t.IsInmemory {
+			changes = append(changes, newDeleteChange(t.ID()))
+		}
+	}
+	if err := s.kv.manifest.addChanges(changes); err != nil {
+		return 0, 0, err
+	}
+	deleted, err := l.deleteTables(toDel)
+	s.kv.tableEvents.recordIDs(TableFileDeleted, level, deleted)
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(toDel), size, nil
+}
+
+// pinRange pins, or unpins, the tables of all levels holding keys in the range [start, end]. It
+// returns the number of tables whose pinning changed.
+func (s *levelsController) pinRange(start, end []byte, pin bool) (int, error) {
+	kr := keyRange{
+		left:  y.KeyWithTs(start, math.MaxUint64),
+		right: y.KeyWithTs(end, 0),
+	}
+	var tables []*table.Table
+	for _, l := range s.levels {
+		picked := len(tables)
+		l.RLock()
+		if l.level == 0 {
+			// Level 0 tables aren't sorted by key, so they can't be searched.
+			for _, t := range l.tables {
+				if getKeyRange(t).overlapsWith(kr) {
+					tables = append(tables, t)
+				}
+			}
+		} else {
+			left, right := l.overlappingTables(levelHandlerRLocked{}, kr)
+			tables = append(tables, l.tables[left:right]...)
+		}
+		for _, t := range tables[picked:] {
+			t.IncrRef()
+		}
+		l.RUnlock()
+	}
+	defer func() {
+		for _, t := range tables {
+			if err := t.DecrRef(); err != nil {
+				s.kv.opt.Errorf("unable to decrease reference of table: %s while "+
+					"pinning tables with error: %s", t.Filename(), err)
+			}
+		}
+	}()
+
+	var changed int
+	for _, t := range tables {
+		if t.IsPinned() == pin {
+			continue
+		}
+		if !pin {
+			t.Unpin()
+			changed++
+			continue
+		}
+		if err := t.Pin(); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
 // dropPrefix runs a L0->L1 compaction, and then runs same level compaction on the rest of the
 // levels. For L0->L1 compaction, it runs compactions normally, but skips over
 // all the keys with the provided prefix.
@@ -347,6 +483,156 @@ func (s *levelsController) dropPrefixes(prefixes [][]byte) error {
 	return nil
 }
 
+// purgeExpired rewrites the tables which hold entries expiring at or before now, so that those
+// entries are dropped from disk. The rewrite goes through the regular compaction path, so versions
+// above discardTs and markers needed to shadow older versions in lower levels are retained. Like
+// dropPrefixes, it runs a L0->Lbase compaction for level 0 and same level compactions for the rest,
+// iterating levels in reverse order so that stale versions are never exposed.
+func (s *levelsController) purgeExpired(now uint64) error {
+	opt := s.kv.opt
+	for i := len(s.levels) - 1; i >= 0; i-- {
+		l := s.levels[i]
+
+		l.RLock()
+		if l.level == 0 {
+			var expired bool
+			for _, t := range l.tables {
+				if containsExpired(t, now) {
+					expired = true
+					break
+				}
+			}
+			l.RUnlock()
+
+			if expired {
+				cp := compactionPriority{
+					level: 0,
+					score: 1.76,
+					// A unique number greater than 1.0 does two things. Helps identify this
+					// function in logs, and forces a compaction.
+					expiryTs: now,
+				}
+				if err := s.doCompact(176, cp); err != nil {
+					return errors.Wrapf(err, "while purging expired entries from level 0")
+				}
+			}
+			continue
+		}
+
+		// Bottom tables of a compaction must be consecutive, so group consecutive tables holding
+		// expired entries together.
+		var tableGroups [][]*table.Table
+		var tableGroup []*table.Table
+		finishGroup := func() {
+			if len(tableGroup) > 0 {
+				tableGroups = append(tableGroups, tableGroup)
+				tableGroup = nil
+			}
+		}
+		for _, t := range l.tables {
+			if containsExpired(t, now) {
+				tableGroup = append(tableGroup, t)
+			} else {
+				finishGroup()
+			}
+		}
+		finishGroup()
+		l.RUnlock()
+
+		if len(tableGroups) == 0 {
+			continue
+		}
+		_, span := otrace.StartSpan(context.Background(), "Badger.Compaction")
+		span.Annotatef(nil, "Compaction level: %v", l.level)
+		span.Annotatef(nil, "Purge expired at: %d", now)
+		defer span.End()
+		opt.Infof("Purging expired entries at level %d (%d tableGroups)", l.level, len(tableGroups))
+		for _, operation := range tableGroups {
+			cd := compactDef{
+				span:      span,
+				thisLevel: l,
+				nextLevel: l,
+				bot:       operation,
+				expiryTs:  now,
+				t:         s.levelTargets(),
+			}
+			cd.t.baseLevel = l.level
+			if err := s.runCompactDef(-1, l.level, cd); err != nil {
+				opt.Warningf("While running compact def: %+v. Error: %v", cd, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compactTablesWhere compacts the tables for which pred returns true. If any level 0 table is
+// picked, all of level 0 is compacted into the base level, as level 0 tables can overlap. Tables
+// picked on other levels are rewritten in place, with consecutive tables compacted together.
+func (s *levelsController) compactTablesWhere(pred func(TableMeta) bool) error {
+	opt := s.kv.opt
+	for i := len(s.levels) - 1; i >= 0; i-- {
+		l := s.levels[i]
+
+		var tableGroups [][]*table.Table
+		var tableGroup []*table.Table
+		finishGroup := func() {
+			if len(tableGroup) > 0 {
+				tableGroups = append(tableGroups, tableGroup)
+				tableGroup = nil
+			}
+		}
+		l.RLock()
+		for _, t := range l.tables {
+			if pred(newTableInfo(t, l.level)) {
+				tableGroup = append(tableGroup, t)
+			} else {
+				finishGroup()
+			}
+		}
+		finishGroup()
+		l.RUnlock()
+
+		if len(tableGroups) == 0 {
+			continue
+		}
+		if l.level == 0 {
+			cp := compactionPriority{
+				level: 0,
+				score: 1.77,
+				// A unique number greater than 1.0 does two things. Helps identify this
+				// function in logs, and forces a compaction.
+				allL0: true,
+			}
+			if err := s.doCompact(177, cp); err != nil {
+				return errors.Wrapf(err, "while compacting level 0 tables")
+			}
+			continue
+		}
+
+		_, span := otrace.StartSpan(context.Background(), "Badger.Compaction")
+		span.Annotatef(nil, "Compaction level: %v", l.level)
+		defer span.End()
+		opt.Infof("Compacting matching tables at level %d (%d tableGroups)",
+			l.level, len(tableGroups))
+		for _, operation := range tableGroups {
+			cd := compactDef{
+				span:      span,
+				thisLevel: l,
+				nextLevel: l,
+				bot:       operation,
+				t:         s.levelTargets(),
+			}
+			cd.t.baseLevel = l.level
+			if err := s.runCompactDef(-1, l.level, cd); err != nil {
+				opt.Warningf("While running compact def: %+v. Error: %v", cd, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (s *levelsController) startCompact(lc *z.Closer) {
 	n := s.kv.opt.NumCompactors
 	lc.AddRunning(n - 1)
@@ -462,11 +748,27 @@ func (s *levelsController) runCompactor(id int, lc *z.Closer) {
 	}
 
 	run := func(p compactionPriority) bool {
-		err := s.doCompact(id, p)
+		// Register as running before checking for a pause, so that pauseCompactions either sees
+		// this compaction or this compaction sees the pause.
+		s.runningMu.Lock()
+		s.numRunning++
+		s.runningMu.Unlock()
+		defer func() {
+			s.runningMu.Lock()
+			s.numRunning--
+			if s.numRunning == 0 {
+				s.runningCond.Broadcast()
+			}
+			s.runningMu.Unlock()
+		}()
+		if s.compactionsPaused.Load() {
+			return false
+		}
+		err := s.doCompactUntil(id, p, lc.HasBeenClosed())
 		switch err {
 		case nil:
 			return true
-		case errFillTables:
+		case errFillTables, errMemCanceled:
 			// pass
 		default:
 			s.kv.opt.Warningf("While running doCompact: %v\n", err)
@@ -474,8 +776,32 @@ func (s *levelsController) runCompactor(id int, lc *z.Closer) {
 		return false
 	}
 
+	// runRequested runs a compaction queued by requestCompaction, if there is one.
+	runRequested := func() bool {
+		if s.compactionsPaused.Load() {
+			// Leave the request queued until compactions are resumed.
+			return false
+		}
+		select {
+		case level := <-s.compactRequests:
+			s.levels[level].compactionRequested.Store(false)
+			// A unique score, to identify requested compactions in logs. A zero adjusted score
+			// lets level 0 be compacted into the base level whatever its number of tables.
+			if !run(compactionPriority{level: level, score: 1.78}) {
+				s.kv.opt.Infof("[Compactor: %d] Requested compaction of level %d not done",
+					id, level)
+			}
+			return true
+		default:
+			return false
+		}
+	}
+
 	var priosBuffer []compactionPriority
 	runOnce := func() bool {
+		if runRequested() {
+			return true
+		}
 		prios := s.pickCompactLevels(priosBuffer)
 		defer func() {
 			priosBuffer = prios
@@ -527,11 +853,120 @@ func (s *levelsController) runCompactor(id int, lc *z.Closer) {
 	}
 }
 
+// pauseCompactions stops the compactors from picking up new compactions. If wait is true, it
+// blocks until the running compactions are done.
+func (s *levelsController) pauseCompactions(wait bool) {
+	s.compactionsPaused.Store(true)
+	if !wait {
+		return
+	}
+	s.runningMu.Lock()
+	defer s.runningMu.Unlock()
+	for s.numRunning > 0 {
+		s.runningCond.Wait()
+	}
+}
+
+func (s *levelsController) resumeCompactions() {
+	s.compactionsPaused.Store(false)
+}
+
+// requestCompaction queues a compaction of the given level, to be run by the next compactor
+// looking for work.
+func (s *levelsController) requestCompaction(level int) error {
+	if s.kv.opt.NumCompactors == 0 || s.kv.opt.ReadOnly {
+		return errors.New("Compactions are disabled")
+	}
+	if level < 0 || level >= len(s.levels) {
+		return errors.Errorf("Invalid level %d, must be within range of 0-%d", level,
+			len(s.levels)-1)
+	}
+	l := s.levels[level]
+	if l.numTables() == 0 {
+		return errors.Errorf("Level %d is empty", level)
+	}
+	s.cstatus.RLock()
+	compacting := len(s.cstatus.levels[level].ranges) > 0
+	s.cstatus.RUnlock()
+	if compacting {
+		return errors.Errorf("Level %d is already being compacted", level)
+	}
+	if !l.compactionRequested.CompareAndSwap(false, true) {
+		return errors.Errorf("Compaction of level %d is already requested", level)
+	}
+	s.compactRequests <- level
+	return nil
+}
+
+// CompactionPlan is the estimated cost of compacting all the tables of a level, as returned by
+// DB.CompactionPlan.
+type CompactionPlan struct {
+	Level     int
+	NextLevel int // Level the tables would be compacted into.
+	// NumTables is the number of tables of Level, and NumNextTables the number of tables of
+	// NextLevel overlapping with them. Both are read by the compaction.
+	NumTables     int
+	NumNextTables int
+	BytesRead     int64
+	// StaleBytes is the size of the stale data recorded by the input tables, which the compaction
+	// is expected to drop.
+	StaleBytes            int64
+	EstimatedBytesWritten int64
+	EstimatedNumTables    int // Tables written, based on the target file size of NextLevel.
+}
+
+// compactionPlan estimates the cost of compacting all the tables of the given level, from the
+// sizes kept by the levels, without reading any table. Level 0 is compacted into the base level,
+// the last level into itself, and other levels into the next one, as done by the compactors.
+func (s *levelsController) compactionPlan(level int) (CompactionPlan, error) {
+	if level < 0 || level >= len(s.levels) {
+		return CompactionPlan{}, errors.Errorf("Invalid level %d, must be within range of 0-%d",
+			level, len(s.levels)-1)
+	}
+	t := s.levelTargets()
+	this := s.levels[level]
+	next := this
+	if level == 0 {
+		next = s.levels[t.baseLevel]
+	} else if !this.isLastLevel() {
+		next = s.levels[level+1]
+	}
+
+	plan := CompactionPlan{Level: level, NextLevel: next.level}
+	this.RLock()
+	plan.NumTables = len(this.tables)
+	plan.BytesRead = this.totalSize
+	plan.StaleBytes = this.totalStaleSize
+	kr := getKeyRange(this.tables...)
+	this.RUnlock()
+	if plan.NumTables == 0 {
+		return plan, nil
+	}
+
+	if next != this {
+		left, right, size, staleSize := next.overlappingTablesWithSize(kr)
+		plan.NumNextTables = right - left
+		plan.BytesRead += size
+		plan.StaleBytes += staleSize
+	}
+	plan.EstimatedBytesWritten = plan.BytesRead - plan.StaleBytes
+	if plan.EstimatedBytesWritten < 0 {
+		plan.EstimatedBytesWritten = 0
+	}
+	if fileSz := t.fileSz[next.level]; fileSz > 0 {
+		plan.EstimatedNumTables = int((plan.EstimatedBytesWritten + fileSz - 1) / fileSz)
+	}
+	return plan, nil
+}
+
 type compactionPriority struct {
 	level        int
 	score        float64
 	adjusted     float64
 	dropPrefixes [][]byte
+	expiryTs     uint64
+	allL0        bool // Compact all the level 0 tables into the base level.
+	staleData    bool // Picked for its stale data, see Options.CompactStaleRatio.
 	t            targets
 }
 
@@ -575,6 +1010,13 @@ func (s *levelsController) pickCompactLevels(priosBuffer []compactionPriority) (
 	}
 	y.AssertTrue(len(prios) == len(s.levels))
 
+	// Track how long each level has been over its target, for DB.CompactionLag. The last level is
+	// never compacted to make room, so it is never considered over target.
+	now := time.Now()
+	for i, p := range prios {
+		s.levels[i].updateOverTarget(i < len(s.levels)-1 && p.score >= 1.0, now)
+	}
+
 	// The following code is borrowed from PebbleDB and results in healthier LSM tree structure.
 	// If Li-1 has score > 1.0, then we'll divide Li-1 score by Li. If Li score is >= 1.0, then Li-1
 	// score is reduced, which means we'll prioritize the compaction of lower levels (L5, L4 and so
@@ -598,6 +1040,23 @@ func (s *levelsController) pickCompactLevels(priosBuffer []compactionPriority) (
 		prevLevel = level
 	}
 
+	// Levels with too much stale data are compacted whatever their size. This is done after the
+	// adjustment above, so that a full level below doesn't hold them back.
+	if ratio := s.kv.opt.CompactStaleRatio; ratio > 0 {
+		for i := 1; i < len(s.levels)-1; i++ {
+			l := s.levels[i]
+			l.RLock()
+			size, staleSize := l.totalSize, l.totalStaleSize
+			l.RUnlock()
+			if size == 0 || float64(staleSize)/float64(size) <= ratio {
+				continue
+			}
+			prios[i].staleData = true
+			prios[i].score = math.Max(prios[i].score, 1.0)
+			prios[i].adjusted = math.Max(prios[i].adjusted, 1.0)
+		}
+	}
+
 	// Pick all the levels whose original score is >= 1.0, irrespective of their adjusted score.
 	// We'll still sort them by their adjusted score below. Having both these scores allows us to
 	// make better decisions about compacting L0. If we see a score >= 1.0, we can do L0->L0
@@ -661,7 +1120,9 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 		if s.kv.opt.InMemory {
 			return
 		}
-		if vs.Meta&bitValuePointer > 0 {
+		// A shared value is still in use by the key it was written for. Its own copy was
+		// accounted for when the value got shared.
+		if vs.Meta&bitValuePointer > 0 && vs.Meta&bitSharedValue == 0 {
 			var vp valuePointer
 			vp.Decode(vs.Value)
 			discardStats[vp.Fid] += int64(vp.Len)
@@ -684,9 +1145,14 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 		return r-l >= 10
 	}
 
+	// The most recent versions of each key which have to be kept, whatever the versions above them.
+	versionsToKeep := s.kv.opt.versionsToKeep(cd.nextLevel.level)
+
 	var (
 		lastKey, skipKey       []byte
 		numBuilds, numVersions int
+		// Number of versions of lastKey seen so far, including the ones above discardTs.
+		numSeen int
 		// Denotes if the first key is a series of duplicate keys had
 		// "DiscardEarlierVersions" set
 		firstKeyHasDiscardSet bool
@@ -707,12 +1173,13 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 
 			// See if we need to skip this key.
 			if len(skipKey) > 0 {
-				if y.SameKey(it.Key(), skipKey) {
+				switch {
+				case !y.SameKey(it.Key(), skipKey):
+					skipKey = skipKey[:0]
+				case numSeen >= versionsToKeep:
 					numSkips++
 					updateStats(it.Value())
 					continue
-				} else {
-					skipKey = skipKey[:0]
 				}
 			}
 
@@ -729,6 +1196,7 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 				}
 				lastKey = y.SafeCopy(lastKey, it.Key())
 				numVersions = 0
+				numSeen = 0
 				firstKeyHasDiscardSet = it.Value().Meta&bitDiscardEarlierVersions > 0
 
 				if len(tableKr.left) == 0 {
@@ -752,8 +1220,11 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 
 			vs := it.Value()
 			version := y.ParseTs(it.Key())
+			keep := numSeen < versionsToKeep
+			numSeen++
 
-			isExpired := isDeletedOrExpired(vs.Meta, vs.ExpiresAt)
+			isExpired := isDeletedOrExpired(vs.Meta, vs.ExpiresAt) ||
+				(cd.expiryTs > 0 && vs.ExpiresAt > 0 && vs.ExpiresAt <= cd.expiryTs)
 
 			// Do not discard entries inserted by merge operator. These entries will be
 			// discarded once they're merged
@@ -780,6 +1251,9 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 					case !isExpired && lastValidVersion:
 						// Add this key. We have set skipKey, so the following key versions
 						// would be skipped.
+					case keep:
+						// This version is one of the versionsToKeep most recent ones, so it
+						// has to be added even though it's deleted or expired.
 					case hasOverlap:
 						// If this key range has overlap with lower levels, then keep the deletion
 						// marker with the latest version, discarding the rest. We have set skipKey,
@@ -796,6 +1270,13 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 			var vp valuePointer
 			if vs.Meta&bitValuePointer > 0 {
 				vp.Decode(vs.Value)
+				if shared, ok := cd.dedup.dedupValue(vp); ok {
+					// The copy of the value at vp is no longer needed.
+					updateStats(vs)
+					vs.Meta |= bitSharedValue
+					vs.Value = shared.Encode()
+					vp = shared
+				}
 			}
 			switch {
 			case firstKeyHasDiscardSet:
@@ -828,6 +1309,7 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 		bopts := buildTableOptions(s.kv)
 		// Set TableSize to the target file size for that level.
 		bopts.TableSize = uint64(cd.t.fileSz[cd.nextLevel.level])
+		bopts.BloomFalsePositive = s.kv.opt.bloomFalsePositive(cd.nextLevel.level)
 		builder := table.NewTableBuilder(bopts)
 
 		// This would do the iteration and add keys to builder.
@@ -1034,6 +1516,22 @@ func containsAnyPrefixes(table *table.Table, listOfPrefixes [][]byte) bool {
 	return false
 }
 
+// containsExpired returns true if the table has at least one entry expiring at or before now.
+func containsExpired(t *table.Table, now uint64) bool {
+	if minExpiresAt := t.MinExpiresAt(); minExpiresAt > 0 {
+		return minExpiresAt <= now
+	}
+	// The index of tables written before it recorded expiry doesn't help, iterate over the table.
+	it := t.NewIterator(table.NOCACHE)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		if expiresAt := it.Value().ExpiresAt; expiresAt > 0 && expiresAt <= now {
+			return true
+		}
+	}
+	return false
+}
+
 type compactDef struct {
 	span *otrace.Span
 
@@ -1053,6 +1551,10 @@ type compactDef struct {
 	thisSize int64
 
 	dropPrefixes [][]byte
+	// If non-zero, entries with an ExpiresAt at or before expiryTs are treated as expired.
+	expiryTs uint64
+	// Set if CompactionValueDedup is enabled.
+	dedup *valueDedup
 }
 
 // addSplits can allow us to run multiple sub-compactions in parallel across the split key ranges.
@@ -1202,7 +1704,7 @@ func (s *levelsController) fillTablesL0ToLbase(cd *compactDef) bool {
 	}
 
 	var out []*table.Table
-	if len(cd.dropPrefixes) > 0 {
+	if len(cd.dropPrefixes) > 0 || cd.expiryTs > 0 || cd.p.allL0 {
 		// Use all tables if drop prefix is set. We don't want to compact only a
 		// sub-range. We want to compact all the tables.
 		out = top
@@ -1375,9 +1877,14 @@ func (s *levelsController) fillTables(cd *compactDef) bool {
 	if cd.thisLevel.isLastLevel() {
 		return s.fillMaxLevelTables(tables, cd)
 	}
-	// We pick tables, so we compact older tables first. This is similar to
-	// kOldestLargestSeqFirst in RocksDB.
-	s.sortByHeuristic(tables, cd)
+	if cd.p.staleData {
+		// The level was picked for its stale data, so reclaim the most of it first.
+		s.sortByStaleDataSize(tables, cd)
+	} else {
+		// We pick tables, so we compact older tables first. This is similar to
+		// kOldestLargestSeqFirst in RocksDB.
+		s.sortByHeuristic(tables, cd)
+	}
 
 	for _, t := range tables {
 		cd.thisSize = t.Size()
@@ -1435,6 +1942,10 @@ func (s *levelsController) runCompactDef(id, l int, cd compactDef) (err error) {
 	// Table should never be moved directly between levels,
 	// always be rewritten to allow discarding invalid versions.
 
+	if s.kv.opt.CompactionValueDedup && !s.kv.opt.InMemory {
+		cd.dedup = newValueDedup(&s.kv.vlog)
+	}
+
 	newTables, decr, err := s.compactBuildTables(l, cd)
 	if err != nil {
 		return err
@@ -1445,6 +1956,23 @@ func (s *levelsController) runCompactDef(id, l int, cd compactDef) (err error) {
 			err = decErr
 		}
 	}()
+	if cd.dedup != nil {
+		// Keep value log GC away from the shared values until the new tables are installed.
+		unlock, err := cd.dedup.lock()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if err := nextLevel.verifyTablesToDelete(cd.bot); err != nil {
+		return err
+	}
+	if err := nextLevel.verifyTableOverlaps(cd.bot, newTables); err != nil {
+		return err
+	}
+	if err := thisLevel.verifyTablesToDelete(cd.top); err != nil {
+		return err
+	}
 	changeSet := buildChangeSet(&cd, newTables)
 
 	// We write to the manifest _before_ we delete files (and after we created files)
@@ -1470,10 +1998,14 @@ func (s *levelsController) runCompactDef(id, l int, cd compactDef) (err error) {
 
 	// See comment earlier in this function about the ordering of these ops, and the order in which
 	// we access levels when reading.
-	if err := nextLevel.replaceTables(cd.bot, newTables); err != nil {
+	deleted, err := nextLevel.replaceTables(cd.bot, newTables)
+	s.kv.tableEvents.recordIDs(TableFileDeleted, nextLevel.level, deleted)
+	if err != nil {
 		return err
 	}
-	if err := thisLevel.deleteTables(cd.top); err != nil {
+	deleted, err = thisLevel.deleteTables(cd.top)
+	s.kv.tableEvents.recordIDs(TableFileDeleted, thisLevel.level, deleted)
+	if err != nil {
 		return err
 	}
 
@@ -1503,6 +2035,19 @@ func (s *levelsController) runCompactDef(id, l int, cd compactDef) (err error) {
 	return nil
 }
 
+// estimatedMemory returns the memory the compaction is estimated to use for
+// Options.MaxCompactionMemory: the total size of its input tables.
+func (cd *compactDef) estimatedMemory() int64 {
+	var size int64
+	for _, t := range cd.top {
+		size += t.Size()
+	}
+	for _, t := range cd.bot {
+		size += t.Size()
+	}
+	return size
+}
+
 func tablesToString(tables []*table.Table) []string {
 	var res []string
 	for _, t := range tables {
@@ -1516,6 +2061,13 @@ var errFillTables = errors.New("Unable to fill tables")
 
 // doCompact picks some table on level l and compacts it away to the next level.
 func (s *levelsController) doCompact(id int, p compactionPriority) error {
+	return s.doCompactUntil(id, p, nil)
+}
+
+// doCompactUntil is like doCompact, but gives up waiting for Options.MaxCompactionMemory once
+// cancel is closed.
+func (s *levelsController) doCompactUntil(id int, p compactionPriority,
+	cancel <-chan struct{}) error {
 	l := p.level
 	y.AssertTrue(l < s.kv.opt.MaxLevels) // Sanity check.
 	if p.t.baseLevel == 0 {
@@ -1525,32 +2077,62 @@ func (s *levelsController) doCompact(id int, p compactionPriority) error {
 	_, span := otrace.StartSpan(context.Background(), "Badger.Compaction")
 	defer span.End()
 
-	cd := compactDef{
-		compactorId:  id,
-		span:         span,
-		p:            p,
-		t:            p.t,
-		thisLevel:    s.levels[l],
-		dropPrefixes: p.dropPrefixes,
-	}
+	fill := func() (compactDef, bool) {
+		cd := compactDef{
+			compactorId:  id,
+			span:         span,
+			p:            p,
+			t:            p.t,
+			thisLevel:    s.levels[l],
+			dropPrefixes: p.dropPrefixes,
+			expiryTs:     p.expiryTs,
+		}
 
-	// While picking tables to be compacted, both levels' tables are expected to
-	// remain unchanged.
-	if l == 0 {
-		cd.nextLevel = s.levels[p.t.baseLevel]
-		if !s.fillTablesL0(&cd) {
-			return errFillTables
+		// While picking tables to be compacted, both levels' tables are expected to
+		// remain unchanged.
+		if l == 0 {
+			cd.nextLevel = s.levels[p.t.baseLevel]
+			return cd, s.fillTablesL0(&cd)
 		}
-	} else {
 		cd.nextLevel = cd.thisLevel
 		// We're not compacting the last level so pick the next level.
 		if !cd.thisLevel.isLastLevel() {
 			cd.nextLevel = s.levels[l+1]
 		}
-		if !s.fillTables(&cd) {
+		return cd, s.fillTables(&cd)
+	}
+	cd, ok := fill()
+	if !ok {
+		return errFillTables
+	}
+
+	gate := s.kv.compactionMem
+	mem, ok := gate.tryAcquire(cd.estimatedMemory())
+	if !ok {
+		// Don't keep the tables reserved while waiting for the running compactions to release
+		// enough of the memory budget. Wait in line with the other compactions, so that this one
+		// isn't starved by smaller ones, and pick the tables again once the memory is reserved.
+		s.cstatus.delete(cd)
+		var err error
+		if mem, err = gate.acquire(cd.estimatedMemory(), cancel); err != nil {
+			return err
+		}
+		if cd, ok = fill(); !ok {
+			gate.release(mem)
 			return errFillTables
 		}
+		if need := gate.clamp(cd.estimatedMemory()); need > mem {
+			// The tables grew in the meantime. Retry later if the rest doesn't fit.
+			more, ok := gate.tryAcquire(need - mem)
+			if !ok {
+				s.cstatus.delete(cd)
+				gate.release(mem)
+				return errFillTables
+			}
+			mem += more
+		}
 	}
+	defer gate.release(mem)
 	defer s.cstatus.delete(cd) // Remove the ranges from compaction status.
 
 	span.Annotatef(nil, "Compaction: %+v", cd)
@@ -1580,20 +2162,26 @@ func (s *levelsController) addLevel0Table(t *table.Table) error {
 		}
 	}
 
-	for !s.levels[0].tryAddLevel0Table(t) {
+	for {
+		added, delay := s.levels[0].tryAddLevel0Table(t)
+		if added {
+			if delay > 0 {
+				// The policy slows down flushes, and so writes, as level 0 fills up. This is
+				// deliberate throttling, so it isn't counted in l0stallsMs.
+				time.Sleep(delay)
+			}
+			return nil
+		}
 		// Before we unstall, we need to make sure that level 0 is healthy.
 		timeStart := time.Now()
-		for s.levels[0].numTables() >= s.kv.opt.NumLevelZeroTablesStall {
-			time.Sleep(10 * time.Millisecond)
-		}
+		// The background context never gets done, so there is no error to handle.
+		_ = s.levels[0].waitForSpace(context.Background())
 		dur := time.Since(timeStart)
 		if dur > time.Second {
 			s.kv.opt.Infof("L0 was stalled for %s\n", dur.Round(time.Millisecond))
 		}
 		s.l0stallsMs.Add(int64(dur.Round(time.Millisecond)))
 	}
-
-	return nil
 }
 
 func (s *levelsController) close() error {
@@ -1606,6 +2194,19 @@ func (s *levelsController) close() error {
 // it returns an empty y.ValueStruct.
 func (s *levelsController) get(key []byte, maxVs y.ValueStruct, startLevel int) (
 	y.ValueStruct, error) {
+	return s.getAtLeast(key, maxVs, startLevel, 0)
+}
+
+// getAtLeast is like get, but returns as soon as it has found a version of the key of at least
+// minVersion, without looking at the remaining tables and levels. A minVersion of zero makes it
+// the same as get.
+//
+// Value log GC rewrites move older versions of a key into newer tables, so a table or level looked
+// at later can still hold a newer version than the one returned. It must only be used by callers
+// that are fine with any version at or above minVersion. Value log GC itself needs the latest
+// version, and goes through get.
+func (s *levelsController) getAtLeast(key []byte, maxVs y.ValueStruct, startLevel int,
+	minVersion uint64) (y.ValueStruct, error) {
 	if s.kv.IsClosed() {
 		return y.ValueStruct{}, ErrDBClosed
 	}
@@ -1620,7 +2221,7 @@ func (s *levelsController) get(key []byte, maxVs y.ValueStruct, startLevel int)
 		if h.level < startLevel {
 			continue
 		}
-		vs, err := h.get(key) // Calls h.RLock() and h.RUnlock().
+		vs, err := h.getAtLeast(key, minVersion) // Calls h.RLock() and h.RUnlock().
 		if err != nil {
 			return y.ValueStruct{}, y.Wrapf(err, "get key: %q", key)
 		}
@@ -1634,6 +2235,9 @@ func (s *levelsController) get(key []byte, maxVs y.ValueStruct, startLevel int)
 		if maxVs.Version < vs.Version {
 			maxVs = vs
 		}
+		if minVersion > 0 && maxVs.Version >= minVersion {
+			break
+		}
 	}
 	if len(maxVs.Value) > 0 {
 		y.NumGetsWithResultsAdd(s.kv.opt.MetricsEnabled, 1)
@@ -1641,6 +2245,27 @@ func (s *levelsController) get(key []byte, maxVs y.ValueStruct, startLevel int)
 	return maxVs, nil
 }
 
+// getFirst returns the first version of key found, looking at the levels from level 0 on. See
+// Fast for when this differs from get.
+func (s *levelsController) getFirst(key []byte) (y.ValueStruct, error) {
+	if s.kv.IsClosed() {
+		return y.ValueStruct{}, ErrDBClosed
+	}
+	for _, h := range s.levels {
+		vs, err := h.lookup(key, 0, true) // Calls h.RLock() and h.RUnlock().
+		if err != nil {
+			return y.ValueStruct{}, y.Wrapf(err, "get key: %q", key)
+		}
+		if vs.Value == nil && vs.Meta == 0 {
+			continue
+		}
+		y.NumBytesReadsLSMAdd(s.kv.opt.MetricsEnabled, int64(len(vs.Value)))
+		y.NumGetsWithResultsAdd(s.kv.opt.MetricsEnabled, 1)
+		return vs, nil
+	}
+	return y.ValueStruct{}, nil
+}
+
 func appendIteratorsReversed(out []y.Iterator, th []*table.Table, opt int) []y.Iterator {
 	for i := len(th) - 1; i >= 0; i-- {
 		// This will increment the reference of the table handler.
@@ -1653,9 +2278,33 @@ func appendIteratorsReversed(out []y.Iterator, th []*table.Table, opt int) []y.I
 // Note: This obtains references for the table handlers. Remember to close these iterators.
 func (s *levelsController) appendIterators(
 	iters []y.Iterator, opt *IteratorOptions) []y.Iterator {
+	return s.appendLevelIterators(iters, opt, 0, len(s.levels)-1)
+}
+
+// maxTableIterators returns the number of table iterators appendIterators adds at most: one per
+// level 0 table, and one per other level with tables.
+func (s *levelsController) maxTableIterators() int {
+	var n int
+	for _, l := range s.levels {
+		l.RLock()
+		switch {
+		case l.level == 0:
+			n += len(l.tables)
+		case len(l.tables) > 0:
+			n++
+		}
+		l.RUnlock()
+	}
+	return n
+}
+
+// appendLevelIterators is like appendIterators, for the levels minLevel to maxLevel only, both
+// included.
+func (s *levelsController) appendLevelIterators(iters []y.Iterator, opt *IteratorOptions,
+	minLevel, maxLevel int) []y.Iterator {
 	// Just like with get, it's important we iterate the levels from 0 on upward, to avoid missing
 	// data when there's a compaction.
-	for _, level := range s.levels {
+	for _, level := range s.levels[minLevel : maxLevel+1] {
 		iters = level.appendIterators(iters, opt)
 	}
 	return iters
@@ -1674,26 +2323,76 @@ type TableInfo struct {
 	MaxVersion       uint64
 	IndexSz          int
 	BloomFilterSize  int
+	// LastAccess is the last time the table served a get or was picked by an iterator, to the
+	// second, or the time it was opened, for a table which didn't since.
+	LastAccess time.Time
+}
+
+// TableRef describes a table of the snapshot of a level taken by DB.SnapshotLevel.
+type TableRef struct {
+	ID    uint64
+	Level int
+	Path  string // Path of the table file, empty for in-memory tables.
+	Left  []byte // Smallest key of the table, with its timestamp.
+	Right []byte // Biggest key of the table, with its timestamp.
+	Size  int64  // Size of the table file.
+}
+
+// TableMeta describes a table to the predicate passed to DB.CompactTablesWhere.
+type TableMeta = TableInfo
+
+func newTableInfo(t *table.Table, level int) TableInfo {
+	return TableInfo{
+		ID:               t.ID(),
+		Level:            level,
+		Left:             t.Smallest(),
+		Right:            t.Biggest(),
+		KeyCount:         t.KeyCount(),
+		OnDiskSize:       t.OnDiskSize(),
+		StaleDataSize:    t.StaleDataSize(),
+		IndexSz:          t.IndexSize(),
+		BloomFilterSize:  t.BloomFilterSize(),
+		UncompressedSize: t.UncompressedSize(),
+		MaxVersion:       t.MaxVersion(),
+		LastAccess:       t.LastAccess(),
+	}
+}
+
+// getOverlappingTableInfo returns the TableInfo of the tables at the given level that intersect
+// with kr. An empty key range overlaps with nothing.
+func (s *levelsController) getOverlappingTableInfo(level int, kr keyRange) []TableInfo {
+	if level < 0 || level >= len(s.levels) {
+		return nil
+	}
+	l := s.levels[level]
+	l.RLock()
+	defer l.RUnlock()
+
+	var result []TableInfo
+	if level == 0 {
+		// L0 tables are sorted by ID, not by key, so each of them has to be checked.
+		if len(kr.left) == 0 || len(kr.right) == 0 || y.CompareKeys(kr.left, kr.right) > 0 {
+			return nil
+		}
+		for _, t := range l.tables {
+			if getKeyRange(t).overlapsWith(kr) {
+				result = append(result, newTableInfo(t, level))
+			}
+		}
+		return result
+	}
+	left, right := l.overlappingTables(levelHandlerRLocked{}, kr)
+	for _, t := range l.tables[left:right] {
+		result = append(result, newTableInfo(t, level))
+	}
+	return result
 }
 
 func (s *levelsController) getTableInfo() (result []TableInfo) {
 	for _, l := range s.levels {
 		l.RLock()
 		for _, t := range l.tables {
-			info := TableInfo{
-				ID:               t.ID(),
-				Level:            l.level,
-				Left:             t.Smallest(),
-				Right:            t.Biggest(),
-				KeyCount:         t.KeyCount(),
-				OnDiskSize:       t.OnDiskSize(),
-				StaleDataSize:    t.StaleDataSize(),
-				IndexSz:          t.IndexSize(),
-				BloomFilterSize:  t.BloomFilterSize(),
-				UncompressedSize: t.UncompressedSize(),
-				MaxVersion:       t.MaxVersion(),
-			}
-			result = append(result, info)
+			result = append(result, newTableInfo(t, l.level))
 		}
 		l.RUnlock()
 	}
@@ -1706,6 +2405,151 @@ func (s *levelsController) getTableInfo() (result []TableInfo) {
 	return
 }
 
+// TableStat holds the statistics of a table, as recorded in its index.
+type TableStat struct {
+	Level          int
+	ID             uint64
+	Size           int64
+	StaleSize      uint32
+	KeyCount       uint32 // Number of entries, including all the versions of each key.
+	Smallest       []byte // Smallest key in the table, with its version.
+	Biggest        []byte // Biggest key in the table, with its version.
+	MinVersion     uint64
+	MaxVersion     uint64
+	TombstoneCount uint32
+}
+
+// getTableStats returns the stats of all the tables, sorted by level and then by ID. All the
+// levels are read locked together, so that every table is listed exactly once.
+func (s *levelsController) getTableStats() []TableStat {
+	for _, l := range s.levels {
+		l.RLock()
+		defer l.RUnlock()
+	}
+	var stats []TableStat
+	for _, l := range s.levels {
+		for _, t := range l.tables {
+			stats = append(stats, TableStat{
+				Level:          l.level,
+				ID:             t.ID(),
+				Size:           t.Size(),
+				StaleSize:      t.StaleDataSize(),
+				KeyCount:       t.KeyCount(),
+				Smallest:       t.Smallest(),
+				Biggest:        t.Biggest(),
+				MinVersion:     t.MinVersion(),
+				MaxVersion:     t.MaxVersion(),
+				TombstoneCount: t.TombstoneCount(),
+			})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Level != stats[j].Level {
+			return stats[i].Level < stats[j].Level
+		}
+		return stats[i].ID < stats[j].ID
+	})
+	return stats
+}
+
+// keyBounds returns the smallest and the biggest keys across all the tables in the LSM tree, using
+// only table metadata. The returned keys have timestamps. Both are nil if there are no tables.
+func (s *levelsController) keyBounds() (smallest, biggest []byte) {
+	update := func(t *table.Table) {
+		if smallest == nil || y.CompareKeys(t.Smallest(), smallest) < 0 {
+			smallest = t.Smallest()
+		}
+		if biggest == nil || y.CompareKeys(t.Biggest(), biggest) > 0 {
+			biggest = t.Biggest()
+		}
+	}
+	for _, l := range s.levels {
+		l.RLock()
+		switch {
+		case len(l.tables) == 0:
+		case l.level == 0:
+			// Level 0 tables can overlap. So, we need to look at all of them.
+			for _, t := range l.tables {
+				update(t)
+			}
+		default:
+			// Tables are sorted by key ranges for levels >= 1.
+			update(l.tables[0])
+			update(l.tables[len(l.tables)-1])
+		}
+		l.RUnlock()
+	}
+	return smallest, biggest
+}
+
+// hasSharedValues returns true if any table holds a key pointing at a value in the value log file
+// fid which was written for another key.
+func (s *levelsController) hasSharedValues(fid uint32) bool {
+	var tables []*table.Table
+	for _, l := range s.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			t.IncrRef()
+			tables = append(tables, t)
+		}
+		l.RUnlock()
+	}
+	defer func() {
+		if err := decrRefs(tables); err != nil {
+			s.kv.opt.Errorf("while decrementing table refs: %v", err)
+		}
+	}()
+
+	for _, t := range tables {
+		found := func() bool {
+			it := t.NewIterator(table.NOCACHE)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				vs := it.Value()
+				if vs.Meta&bitSharedValue == 0 || vs.Meta&bitValuePointer == 0 {
+					continue
+				}
+				var vp valuePointer
+				vp.Decode(vs.Value)
+				if vp.Fid == fid {
+					return true
+				}
+			}
+			return false
+		}()
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapCount returns, for each level, the number of tables whose key range holds key, which
+// has no timestamp. Level 0 tables can overlap, so all of them are checked. For levels >= 1 the
+// count is at most one.
+func (s *levelsController) overlapCount(key []byte) []int {
+	kr := keyRange{
+		left:  y.KeyWithTs(key, math.MaxUint64),
+		right: y.KeyWithTs(key, 0),
+	}
+	counts := make([]int, len(s.levels))
+	for i, l := range s.levels {
+		l.RLock()
+		if l.level == 0 {
+			for _, t := range l.tables {
+				if kr.overlapsWith(getKeyRange(t)) {
+					counts[i]++
+				}
+			}
+		} else {
+			left, right := l.overlappingTables(levelHandlerRLocked{}, kr)
+			counts[i] = right - left
+		}
+		l.RUnlock()
+	}
+	return counts
+}
+
 type LevelInfo struct {
 	Level          int
 	NumTables      int
@@ -1716,6 +2560,9 @@ type LevelInfo struct {
 	Score          float64
 	Adjusted       float64
 	StaleDatSize   int64
+	// VersionsExaminedPerGet is a histogram of the number of versions of a key looked at by each
+	// get which found the key on this level. It is nil if metrics are disabled.
+	VersionsExaminedPerGet *z.HistogramData
 }
 
 func (s *levelsController) getLevelInfo() []LevelInfo {
@@ -1731,6 +2578,8 @@ func (s *levelsController) getLevelInfo() []LevelInfo {
 
 		l.RUnlock()
 
+		result[i].VersionsExaminedPerGet = l.getVersionsExamined()
+
 		result[i].TargetSize = t.targetSz[i]
 		result[i].TargetFileSize = t.fileSz[i]
 		result[i].IsBaseLevel = t.baseLevel == i
@@ -1770,6 +2619,68 @@ func (s *levelsController) verifyChecksum() error {
 	return nil
 }
 
+// verifyChecksums verifies the checksums of all the tables, three tables at a time. Unlike
+// verifyChecksum, it carries on past corrupt tables, and reports all of them in the returned error.
+func (s *levelsController) verifyChecksums(ctx context.Context) error {
+	type levelTable struct {
+		level int
+		t     *table.Table
+	}
+	var tables []levelTable
+	for _, l := range s.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			t.IncrRef()
+			tables = append(tables, levelTable{level: l.level, t: t})
+		}
+		l.RUnlock()
+	}
+	defer func() {
+		for _, lt := range tables {
+			if err := lt.t.DecrRef(); err != nil {
+				s.kv.opt.Errorf("unable to decrease reference of table: %s while "+
+					"verifying checksums with error: %s", lt.t.Filename(), err)
+			}
+		}
+	}()
+
+	var (
+		mu      sync.Mutex
+		corrupt []uint64
+		done    atomic.Int32
+	)
+	throttle := y.NewThrottle(3)
+	for _, lt := range tables {
+		if ctx.Err() != nil {
+			break
+		}
+		// Errors are collected in corrupt, so Do never fails.
+		y.Check(throttle.Do())
+		go func(lt levelTable) {
+			defer throttle.Done(nil)
+			err := lt.t.VerifyChecksum()
+			n := done.Add(1)
+			if err != nil {
+				s.kv.opt.Errorf("Checksum verification failed for table %d at level %d: %v",
+					lt.t.ID(), lt.level, err)
+				mu.Lock()
+				corrupt = append(corrupt, lt.t.ID())
+				mu.Unlock()
+				return
+			}
+			s.kv.opt.Infof("Verified checksums of table %d at level %d (%d/%d)",
+				lt.t.ID(), lt.level, n, len(tables))
+		}(lt)
+	}
+	y.Check(throttle.Finish())
+
+	if len(corrupt) > 0 {
+		sort.Slice(corrupt, func(i, j int) bool { return corrupt[i] < corrupt[j] })
+		return errors.Errorf("checksum verification failed for tables: %v", corrupt)
+	}
+	return ctx.Err()
+}
+
 // Returns the sorted list of splits for all the levels and tables based
 // on the block offsets.
 func (s *levelsController) keySplits(numPerTable int, prefix []byte) []string {
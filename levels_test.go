@@ -17,11 +17,18 @@
 package badger
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"expvar"
 	"fmt"
 	"math"
 	"math/rand"
 	"os"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -34,11 +41,32 @@ import (
 )
 
 // createAndOpen creates a table with the given data and adds it to the given level.
+// tryAddLevel0Table is l.tryAddLevel0Table, without the flush delay.
+func tryAddLevel0Table(l *levelHandler, t *table.Table) bool {
+	added, _ := l.tryAddLevel0Table(t)
+	return added
+}
+
 func createAndOpen(db *DB, td []keyValVersion, level int) {
+	tab := createTable(db, td)
+	if err := db.manifest.addChanges([]*pb.ManifestChange{
+		newCreateChange(tab.ID(), level, 0, tab.CompressionType()),
+	}); err != nil {
+		panic(err)
+	}
+	db.lc.levels[level].Lock()
+	// Add table to the given level.
+	db.lc.levels[level].tables = append(db.lc.levels[level].tables, tab)
+	db.lc.levels[level].Unlock()
+}
+
+// createTable builds a table holding td, without adding it to any level.
+func createTable(db *DB, td []keyValVersion) *table.Table {
 	opts := table.Options{
 		BlockSize:          db.opt.BlockSize,
 		BloomFalsePositive: db.opt.BloomFalsePositive,
 		ChkMode:            options.NoVerification,
+		TombstoneMeta:      bitDelete,
 	}
 	b := table.NewTableBuilder(opts)
 	defer b.Close()
@@ -54,15 +82,7 @@ func createAndOpen(db *DB, td []keyValVersion, level int) {
 	if err != nil {
 		panic(err)
 	}
-	if err := db.manifest.addChanges([]*pb.ManifestChange{
-		newCreateChange(tab.ID(), level, 0, tab.CompressionType()),
-	}); err != nil {
-		panic(err)
-	}
-	db.lc.levels[level].Lock()
-	// Add table to the given level.
-	db.lc.levels[level].tables = append(db.lc.levels[level].tables, tab)
-	db.lc.levels[level].Unlock()
+	return tab
 }
 
 type keyValVersion struct {
@@ -509,6 +529,58 @@ func TestCompactionTwoVersions(t *testing.T) {
 	})
 }
 
+func TestCompactionLevelVersionsToKeep(t *testing.T) {
+	// Keep a single version of each key, except for the three most recent ones on level 1.
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(1).
+		WithLevelVersionsToKeep([]int{0, 3})
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		// The versions of each key are spread over several tables and levels.
+		createAndOpen(db, []keyValVersion{{"del", "", 4, bitDelete}, {"foo", "bar", 5, 0},
+			{"foo", "bar", 4, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"del", "v", 3, 0}, {"foo", "bar", 3, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"del", "v", 2, 0}, {"del", "v", 1, 0},
+			{"foo", "bar", 2, 0}, {"foo", "bar", 1, 0}}, 1)
+		db.SetDiscardTs(10)
+
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			bot:       db.lc.levels[1].tables,
+			t:         db.lc.levelTargets(),
+		}
+		cdef.t.baseLevel = 1
+		require.NoError(t, db.lc.runCompactDef(-1, 0, cdef))
+		// The three most recent versions are kept, though the delete marker and NumVersionsToKeep
+		// would have dropped them.
+		getAllAndCheck(t, db, []keyValVersion{
+			{"del", "", 4, bitDelete},
+			{"del", "v", 3, 0},
+			{"del", "v", 2, 0},
+			{"foo", "bar", 5, 0},
+			{"foo", "bar", 4, 0},
+			{"foo", "bar", 3, 0},
+		})
+
+		// Level 2 doesn't keep any extra version.
+		cdef = compactDef{
+			thisLevel: db.lc.levels[1],
+			nextLevel: db.lc.levels[2],
+			top:       db.lc.levels[1].tables,
+			bot:       db.lc.levels[2].tables,
+			t:         db.lc.levelTargets(),
+		}
+		cdef.t.baseLevel = 2
+		require.NoError(t, db.lc.runCompactDef(-1, 1, cdef))
+		getAllAndCheck(t, db, []keyValVersion{{"foo", "bar", 5, 0}})
+	})
+
+	_, err := Open(DefaultOptions("").WithInMemory(true).WithLevelVersionsToKeep([]int{0, -1}))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "LevelVersionsToKeep")
+}
+
 func TestCompactionAllVersions(t *testing.T) {
 	// Disable compactions and keep all versions of the each key.
 	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(math.MaxInt32)
@@ -1302,3 +1374,2052 @@ func TestStaleDataCleanup(t *testing.T) {
 
 	})
 }
+
+func TestVerifyInvariantsOnOpen(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions(dir).WithNumCompactors(0)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	createAndOpen(db, []keyValVersion{{"a", "v", 1, 0}, {"m", "v", 1, 0}}, 1)
+	require.NoError(t, db.Close())
+
+	// A healthy level passes the verification.
+	opt = opt.WithVerifyInvariantsOnOpen(true)
+	db, err = Open(opt)
+	require.NoError(t, err)
+	// Add a table to level 2 whose keys were added out of order, so that its smallest key comes
+	// after its biggest one. validate doesn't look at the first table of a level.
+	createAndOpen(db, []keyValVersion{{"z", "v", 1, 0}, {"f", "v", 1, 0}}, 2)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt.WithVerifyInvariantsOnOpen(false))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = Open(opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Invariant verification")
+	require.Contains(t, err.Error(), "Level 2")
+	require.Contains(t, err.Error(), "smallest key")
+}
+
+func TestVerifyInvariantsOnOpenLevel0(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions(dir).WithNumCompactors(0).WithVerifyInvariantsOnOpen(true)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	older := createTable(db, []keyValVersion{{"a", "v", 1, 0}})
+	newer := createTable(db, []keyValVersion{{"a", "v", 2, 0}})
+	require.Less(t, older.ID(), newer.ID())
+	// Add the newer table to level 0 of the manifest first.
+	for _, tab := range []*table.Table{newer, older} {
+		require.NoError(t, db.manifest.addChanges([]*pb.ManifestChange{
+			newCreateChange(tab.ID(), 0, 0, tab.CompressionType()),
+		}))
+		db.lc.levels[0].addTable(tab)
+		require.NoError(t, tab.DecrRef())
+	}
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt.WithVerifyInvariantsOnOpen(false))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = Open(opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Invariant verification")
+	require.Contains(t, err.Error(), fmt.Sprintf("Level 0: table %d was added to the manifest "+
+		"after table %d", older.ID(), newer.ID()))
+}
+
+func TestPauseCompaction(t *testing.T) {
+	opt := getTestOptions("").WithNumLevelZeroTables(1).WithNumLevelZeroTablesStall(10)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		db.PauseCompaction(true)
+		for i := 0; i < 3; i++ {
+			createAndOpen(db, []keyValVersion{{fmt.Sprintf("key%d", i), "val", i + 1, 0}}, 0)
+		}
+		// The compactors start after a random delay of up to a second and then run every 50ms.
+		// L0 has a score of 3, so it would have been compacted by now if compactions were running.
+		time.Sleep(1500 * time.Millisecond)
+		require.Equal(t, 3, db.lc.levels[0].numTables())
+
+		db.ResumeCompaction()
+		require.Eventually(t, func() bool {
+			return db.lc.levels[0].numTables() == 0
+		}, 10*time.Second, 50*time.Millisecond)
+		getAllAndCheck(t, db, []keyValVersion{
+			{"key0", "val", 1, 0}, {"key1", "val", 2, 0}, {"key2", "val", 3, 0}})
+	})
+}
+
+func TestVersionsExaminedPerGet(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		// Level 0 has a version of foo in each of its three tables, while level 1 has all the
+		// older versions of foo in a single table.
+		for v := 3; v <= 5; v++ {
+			createAndOpen(db, []keyValVersion{{"foo", fmt.Sprintf("bar%d", v), v, 0}}, 0)
+		}
+		createAndOpen(db, []keyValVersion{{"foo", "bar2", 2, 0}, {"foo", "bar1", 1, 0}}, 1)
+
+		vs, err := db.lc.get(y.KeyWithTs([]byte("foo"), 10), y.ValueStruct{}, 0)
+		require.NoError(t, err)
+		require.Equal(t, "bar5", string(vs.Value))
+
+		levels := db.Levels()
+		l0 := levels[0].VersionsExaminedPerGet
+		require.EqualValues(t, 1, l0.Count)
+		require.EqualValues(t, 3, l0.Sum)
+		// The get seeks once into the level 1 table, which lands on the latest version.
+		l1 := levels[1].VersionsExaminedPerGet
+		require.EqualValues(t, 1, l1.Count)
+		require.EqualValues(t, 1, l1.Sum)
+		// Other levels don't have the key.
+		require.EqualValues(t, 0, levels[2].VersionsExaminedPerGet.Count)
+	})
+
+	opt = opt.WithMetricsEnabled(false)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		for _, li := range db.Levels() {
+			require.Nil(t, li.VersionsExaminedPerGet)
+		}
+	})
+}
+
+func TestOverlappingTablesReversedRange(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"a", "v", 1, 0}, {"c", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"e", "v", 1, 0}, {"g", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"i", "v", 1, 0}, {"k", "v", 1, 0}}, 1)
+
+		l1 := db.lc.levels[1]
+		l1.RLock()
+		defer l1.RUnlock()
+		kr := keyRange{
+			left:  y.KeyWithTs([]byte("b"), math.MaxUint64),
+			right: y.KeyWithTs([]byte("f"), 0),
+		}
+		left, right := l1.overlappingTables(levelHandlerRLocked{}, kr)
+		require.Equal(t, 0, left)
+		require.Equal(t, 2, right)
+
+		kr.left, kr.right = kr.right, kr.left
+		left, right = l1.overlappingTables(levelHandlerRLocked{}, kr)
+		require.Equal(t, 0, left)
+		require.Equal(t, 0, right)
+	})
+}
+
+func TestCompactionLag(t *testing.T) {
+	opt := getTestOptions("").WithNumLevelZeroTables(2).WithNumLevelZeroTablesStall(10)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		for _, lag := range db.CompactionLag() {
+			require.Zero(t, lag)
+		}
+
+		// With compactions paused, L0 stays over its target and the lag keeps growing.
+		db.PauseCompaction(true)
+		for i := 0; i < 3; i++ {
+			createAndOpen(db, []keyValVersion{{fmt.Sprintf("key%d", i), "val", i + 1, 0}}, 0)
+		}
+		require.Eventually(t, func() bool {
+			return db.CompactionLag()[0] > 0
+		}, 10*time.Second, 10*time.Millisecond)
+		lag := db.CompactionLag()[0]
+		time.Sleep(200 * time.Millisecond)
+		require.True(t, db.CompactionLag()[0] >= lag+200*time.Millisecond)
+
+		// Once compaction catches up, the lag goes back to zero.
+		db.ResumeCompaction()
+		require.Eventually(t, func() bool {
+			return db.lc.levels[0].numTables() < 2 && db.CompactionLag()[0] == 0
+		}, 10*time.Second, 50*time.Millisecond)
+	})
+}
+
+func TestOverlapCount(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumLevelZeroTablesStall(20)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		// Five level 0 tables cover k, and two don't.
+		for i := 0; i < 4; i++ {
+			createAndOpen(db, []keyValVersion{{"a", "v", i + 1, 0}, {"z", "v", i + 1, 0}}, 0)
+		}
+		createAndOpen(db, []keyValVersion{{"a", "v", 5, 0}, {"b", "v", 5, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"k", "v", 6, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"m", "v", 6, 0}, {"n", "v", 6, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"a", "v", 1, 0}, {"f", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"j", "v", 1, 0}, {"p", "v", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"b", "v", 1, 0}, {"c", "v", 1, 0}}, 2)
+
+		counts := db.OverlapCount([]byte("k"))
+		require.Len(t, counts, opt.MaxLevels)
+		require.Equal(t, 5, counts[0])
+		require.Equal(t, 1, counts[1])
+		for _, c := range counts[2:] {
+			require.Zero(t, c)
+		}
+
+		counts = db.OverlapCount([]byte("zz"))
+		for _, c := range counts {
+			require.Zero(t, c)
+		}
+	})
+}
+
+func TestReplaceOneTable(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"a", "1", 1, 0}, {"c", "1", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"e", "1", 1, 0}, {"g", "1", 1, 0}}, 1)
+		l1 := db.lc.levels[1]
+		oldID, oldSize := l1.tables[0].ID(), l1.tables[0].Size()
+		// createAndOpen doesn't account for table sizes, so only check the change in size.
+		size := l1.getTotalSize()
+
+		// The replacement must cover the same range.
+		wider := createTable(db, []keyValVersion{{"a", "2", 1, 0}, {"d", "2", 1, 0}})
+		defer func() { require.NoError(t, wider.DecrRef()) }()
+		require.Error(t, l1.replaceOneTable(oldID, wider))
+
+		newTable := createTable(db, []keyValVersion{
+			{"a", "2", 1, 0}, {"b", "2", 1, 0}, {"c", "2", 1, 0}})
+		require.Error(t, l1.replaceOneTable(12345, newTable))
+		require.NoError(t, l1.replaceOneTable(oldID, newTable))
+		// The level now holds a reference to the new table.
+		require.NoError(t, newTable.DecrRef())
+
+		require.Equal(t, 2, l1.numTables())
+		require.Equal(t, newTable.ID(), l1.tables[0].ID())
+		require.Equal(t, size-oldSize+newTable.Size(), l1.getTotalSize())
+		getAllAndCheck(t, db, []keyValVersion{
+			{"a", "2", 1, 0}, {"b", "2", 1, 0}, {"c", "2", 1, 0},
+			{"e", "1", 1, 0}, {"g", "1", 1, 0},
+		})
+	})
+}
+
+func TestGetWithConsistency(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		// Level 0 holds an older version of foo than level 1, as if value log GC had rewritten
+		// version 3 after version 5 was compacted down. bar is laid out as usual.
+		createAndOpen(db, []keyValVersion{{"foo", "old", 3, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"bar", "new", 5, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"bar", "old", 3, 0}, {"foo", "new", 5, 0}}, 1)
+
+		check := func(key string, level ConsistencyLevel, val string, version uint64) {
+			item, err := db.GetWithConsistency([]byte(key), level)
+			require.NoError(t, err)
+			require.Equal(t, version, item.Version())
+			// The value is still readable after the read transaction is gone.
+			require.Equal(t, val, string(getItemValue(t, item)))
+		}
+		check("foo", Strong, "new", 5)
+		check("foo", Fast, "old", 3)
+		check("bar", Strong, "new", 5)
+		check("bar", Fast, "new", 5)
+
+		_, err := db.GetWithConsistency([]byte("baz"), Fast)
+		require.Equal(t, ErrKeyNotFound, err)
+	})
+}
+
+func TestTableEventLog(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(1)
+	opt.managedTxns = true
+	compact := func(db *DB) {
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			bot:       db.lc.levels[1].tables,
+			t:         db.lc.levelTargets(),
+		}
+		cdef.t.baseLevel = 1
+		require.NoError(t, db.lc.runCompactDef(-1, 0, cdef))
+	}
+	t.Run("compaction", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createAndOpen(db, []keyValVersion{{"foo", "bar", 3, 0}}, 0)
+			createAndOpen(db, []keyValVersion{{"fooz", "baz", 2, 0}}, 0)
+			createAndOpen(db, []keyValVersion{{"foo", "bar", 1, 0}}, 1)
+			// Tables put in place directly by the test are not reported.
+			require.Empty(t, db.TableEventLog())
+
+			var deleted []uint64
+			for _, tab := range db.lc.levels[0].tables {
+				deleted = append(deleted, tab.ID())
+			}
+			deleted = append(deleted, db.lc.levels[1].tables[0].ID())
+			before := time.Now()
+			compact(db)
+
+			events := db.TableEventLog()
+			var gotDeleted, gotCreated, gotFileDeleted []uint64
+			for _, ev := range events {
+				require.False(t, ev.Time.Before(before))
+				switch ev.Type {
+				case TableDeleted:
+					gotDeleted = append(gotDeleted, ev.TableID)
+					if ev.TableID == deleted[2] {
+						require.Equal(t, 1, ev.Level)
+					} else {
+						require.Equal(t, 0, ev.Level)
+					}
+				case TableCreated:
+					gotCreated = append(gotCreated, ev.TableID)
+					require.Equal(t, 1, ev.Level)
+				case TableFileDeleted:
+					gotFileDeleted = append(gotFileDeleted, ev.TableID)
+				}
+			}
+			require.ElementsMatch(t, deleted, gotDeleted)
+			// The levels held the last references to the compacted tables.
+			require.ElementsMatch(t, deleted, gotFileDeleted)
+			require.Len(t, gotCreated, 1)
+			require.Equal(t, db.lc.levels[1].tables[0].ID(), gotCreated[0])
+		})
+	})
+	t.Run("bounded", func(t *testing.T) {
+		opt := opt.WithTableEventLogSize(2)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createAndOpen(db, []keyValVersion{{"foo", "bar", 3, 0}}, 0)
+			createAndOpen(db, []keyValVersion{{"foo", "bar", 2, 0}}, 1)
+			l0 := db.lc.levels[0].tables[0].ID()
+			compact(db)
+
+			// Five events were recorded, only the last two are kept, oldest first.
+			events := db.TableEventLog()
+			require.Len(t, events, 2)
+			require.Equal(t, TableDeleted, events[0].Type)
+			require.Equal(t, TableFileDeleted, events[1].Type)
+			for _, ev := range events {
+				require.Equal(t, l0, ev.TableID)
+				require.Equal(t, 0, ev.Level)
+			}
+		})
+	})
+}
+
+func TestCompactTablesWhere(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		var big []keyValVersion
+		for i := 0; i < 100; i++ {
+			big = append(big, keyValVersion{fmt.Sprintf("k%02d", i), "val", 1, 0})
+		}
+		createAndOpen(db, []keyValVersion{{"a", "val", 1, 0}}, 1)
+		createAndOpen(db, big, 1)
+		createAndOpen(db, []keyValVersion{{"z", "val", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"b", "val", 2, 0}}, 2)
+
+		tables := db.lc.levels[1].tables
+		small, bigID := tables[0].OnDiskSize(), tables[1].ID()
+		require.Greater(t, tables[1].OnDiskSize(), 2*small)
+		var picked []uint64
+		require.NoError(t, db.CompactTablesWhere(func(tm TableMeta) bool {
+			if tm.OnDiskSize > 2*small {
+				picked = append(picked, tm.ID)
+				return true
+			}
+			return false
+		}))
+		require.Equal(t, []uint64{bigID}, picked)
+
+		// Only the big table was rewritten, in place.
+		tables = db.lc.levels[1].tables
+		require.Len(t, tables, 3)
+		require.Equal(t, []byte("a"), y.ParseKey(tables[0].Smallest()))
+		require.Equal(t, []byte("z"), y.ParseKey(tables[2].Smallest()))
+		require.NotEqual(t, bigID, tables[1].ID())
+		require.Equal(t, uint32(100), tables[1].KeyCount())
+		require.Len(t, db.lc.levels[2].tables, 1)
+		getAllAndCheck(t, db, append(append([]keyValVersion{{"a", "val", 1, 0}, {"b", "val", 2, 0}},
+			big...), keyValVersion{"z", "val", 1, 0}))
+
+		// Picking a level 0 table moves all of level 0 into the base level.
+		createAndOpen(db, []keyValVersion{{"c", "val", 3, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"d", "val", 3, 0}}, 0)
+		require.NoError(t, db.CompactTablesWhere(func(tm TableMeta) bool {
+			return tm.Level == 0 && string(y.ParseKey(tm.Left)) == "d"
+		}))
+		require.Zero(t, db.lc.levels[0].numTables())
+	})
+}
+
+func TestEffectiveLevelMultipliers(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithMaxLevels(7).
+		WithBaseLevelSize(10 << 20).WithLevelSizeMultiplier(10)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		// With an empty tree all the targets are BaseLevelSize.
+		require.Equal(t, []float64{0, 1, 1, 1, 1, 1}, db.EffectiveLevelMultipliers())
+
+		// A last level a thousand times BaseLevelSize brings L3 down to BaseLevelSize, and the
+		// levels above are held at BaseLevelSize.
+		l6 := db.lc.levels[6]
+		l6.Lock()
+		l6.totalSize = 1000 * opt.BaseLevelSize
+		l6.Unlock()
+		require.Equal(t, []float64{0, 1, 1, 10, 10, 10}, db.EffectiveLevelMultipliers())
+	})
+}
+
+func TestOnLevelEmptyChange(t *testing.T) {
+	type change struct {
+		level int
+		empty bool
+	}
+	var mu sync.Mutex
+	var changes []change
+	opt := DefaultOptions("").WithNumCompactors(0).
+		WithOnLevelEmptyChange(func(level int, empty bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, change{level, empty})
+		})
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"foo", "bar", 2, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"fooz", "baz", 1, 0}}, 0)
+
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			t:         db.lc.levelTargets(),
+		}
+		cdef.t.baseLevel = 1
+		require.NoError(t, db.lc.runCompactDef(-1, 0, cdef))
+		require.Zero(t, db.lc.levels[0].numTables())
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, []change{{1, false}, {0, true}}, changes)
+	})
+}
+
+func TestOnLevelSizeChange(t *testing.T) {
+	type sizes struct{ total, stale int64 }
+	var mu sync.Mutex
+	reported := make(map[int]sizes)
+	var db *DB
+	opt := DefaultOptions("").WithNumCompactors(0).
+		WithOnLevelSizeChange(func(level int, total, stale int64) {
+			// Calling back into the level doesn't deadlock.
+			require.GreaterOrEqual(t, db.lc.levels[level].getTotalSize(), int64(0))
+			mu.Lock()
+			defer mu.Unlock()
+			reported[level] = sizes{total, stale}
+		})
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, d *DB) {
+		db = d
+		check := func() {
+			require.Eventually(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, h := range db.lc.levels {
+					want := sizes{h.getTotalSize(), h.getTotalStaleSize()}
+					if got, ok := reported[h.level]; want != got && (ok || want != sizes{}) {
+						return false
+					}
+				}
+				return true
+			}, 5*time.Second, 10*time.Millisecond)
+		}
+		for i := 0; i < 3; i++ {
+			tab := createTable(db, []keyValVersion{{fmt.Sprintf("foo%d", i), "bar", 2, 0}})
+			require.NoError(t, db.manifest.addChanges([]*pb.ManifestChange{
+				newCreateChange(tab.ID(), 0, 0, tab.CompressionType()),
+			}))
+			db.lc.levels[0].addTable(tab)
+			require.NoError(t, tab.DecrRef())
+		}
+		check()
+		mu.Lock()
+		require.Greater(t, reported[0].total, int64(0))
+		mu.Unlock()
+
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			t:         db.lc.levelTargets(),
+		}
+		cdef.t.baseLevel = 1
+		require.NoError(t, db.lc.runCompactDef(-1, 0, cdef))
+		check()
+		mu.Lock()
+		defer mu.Unlock()
+		require.Zero(t, reported[0].total)
+		require.Greater(t, reported[1].total, int64(0))
+	})
+}
+
+func TestAllTableStats(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{
+			{"a", "", 9, bitDelete}, {"a", "v", 4, 0}, {"c", "", 7, bitDelete}, {"d", "v", 5, 0},
+		}, 0)
+		createAndOpen(db, []keyValVersion{{"b", "v", 3, 0}, {"e", "v", 8, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"f", "v", 2, 0}, {"g", "", 6, bitDelete}}, 2)
+
+		stats := db.AllTableStats()
+		require.Len(t, stats, 3)
+		type want struct {
+			level          int
+			keyCount       uint32
+			smallest       string
+			biggest        string
+			minVersion     uint64
+			maxVersion     uint64
+			tombstoneCount uint32
+		}
+		wants := []want{
+			{0, 4, "a", "d", 4, 9, 2},
+			{0, 2, "b", "e", 3, 8, 0},
+			{2, 2, "f", "g", 2, 6, 1},
+		}
+		for i, w := range wants {
+			st := stats[i]
+			require.Equal(t, w.level, st.Level)
+			require.Equal(t, w.keyCount, st.KeyCount)
+			require.Equal(t, w.smallest, string(y.ParseKey(st.Smallest)))
+			require.Equal(t, w.biggest, string(y.ParseKey(st.Biggest)))
+			require.Equal(t, w.minVersion, st.MinVersion)
+			require.Equal(t, w.maxVersion, st.MaxVersion)
+			require.Equal(t, w.tombstoneCount, st.TombstoneCount)
+			require.Greater(t, st.Size, int64(0))
+		}
+		require.Less(t, stats[0].ID, stats[1].ID)
+		for _, ti := range db.Tables() {
+			var found bool
+			for _, st := range stats {
+				found = found || (st.ID == ti.ID && st.Level == ti.Level)
+			}
+			require.True(t, found, "table %d", ti.ID)
+		}
+	})
+}
+
+func TestLevelStats(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		add := func(level int, td []keyValVersion) *table.Table {
+			tab := createTable(db, td)
+			db.lc.levels[level].addTable(tab)
+			require.NoError(t, tab.DecrRef())
+			return tab
+		}
+		t1 := add(0, []keyValVersion{{"c", "v", 2, 0}, {"m", "v", 2, 0}})
+		t2 := add(0, []keyValVersion{{"a", "v", 3, 0}, {"f", "v", 3, 0}})
+		t3 := add(1, []keyValVersion{{"b", "v", 1, 0}, {"d", "v", 1, 0}})
+		t4 := add(1, []keyValVersion{{"k", "v", 1, 0}, {"x", "v", 1, 0}})
+		db.lc.levels[1].sortTables()
+		db.lc.levels[1].Lock()
+		db.lc.levels[1].totalStaleSize = t4.Size()
+		db.lc.levels[1].Unlock()
+
+		stats := db.LevelStats()
+		require.Len(t, stats, opt.MaxLevels)
+		require.Equal(t, LevelStats{
+			Level:     0,
+			NumTables: 2,
+			TotalSize: t1.Size() + t2.Size(),
+			Smallest:  []byte("a"),
+			Biggest:   []byte("m"),
+		}, stats[0])
+		require.Equal(t, 1, stats[1].Level)
+		require.Equal(t, 2, stats[1].NumTables)
+		require.Equal(t, t3.Size()+t4.Size(), stats[1].TotalSize)
+		require.InDelta(t, float64(t4.Size())/float64(t3.Size()+t4.Size()), stats[1].StaleRatio, 1e-9)
+		require.Equal(t, []byte("b"), stats[1].Smallest)
+		require.Equal(t, []byte("x"), stats[1].Biggest)
+		for i, st := range stats[2:] {
+			require.Zero(t, st.NumTables)
+			require.Nil(t, st.Smallest)
+			require.Equal(t, i+2 == opt.MaxLevels-1, st.IsLastLevel)
+		}
+	})
+}
+
+func TestWaitForL0Space(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumLevelZeroTables(1).
+		WithNumLevelZeroTablesStall(2)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.NoError(t, db.WaitForL0Space(context.Background()))
+		createAndOpen(db, []keyValVersion{{"foo", "bar", 2, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"fooz", "baz", 1, 0}}, 0)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		require.Equal(t, context.DeadlineExceeded, db.WaitForL0Space(ctx))
+
+		done := make(chan error, 1)
+		go func() { done <- db.WaitForL0Space(context.Background()) }()
+		select {
+		case err := <-done:
+			t.Fatalf("WaitForL0Space returned %v while L0 is full", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			t:         db.lc.levelTargets(),
+		}
+		cdef.t.baseLevel = 1
+		require.NoError(t, db.lc.runCompactDef(-1, 0, cdef))
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("WaitForL0Space didn't return once L0 drained")
+		}
+	})
+}
+
+func TestL0StallMetrics(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumLevelZeroTables(1).
+		WithNumLevelZeroTablesStall(2)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		stalls := func() int64 {
+			v := expvar.Get(y.BADGER_METRIC_PREFIX + "stall_num_lsm").(*expvar.Map).Get("l0")
+			if v == nil {
+				return 0
+			}
+			return v.(*expvar.Int).Value()
+		}
+		stallNs := func() int64 {
+			v := expvar.Get(y.BADGER_METRIC_PREFIX + "stall_ns_lsm").(*expvar.Map).Get("l0")
+			if v == nil {
+				return 0
+			}
+			return v.(*expvar.Int).Value()
+		}
+		startStalls, startNs := stalls(), stallNs()
+
+		l0 := db.lc.levels[0]
+		t1 := createTable(db, []keyValVersion{{"foo", "bar", 1, 0}})
+		defer func() { require.NoError(t, t1.DecrRef()) }()
+		t0 := createTable(db, []keyValVersion{{"bar", "foo", 1, 0}})
+		defer func() { require.NoError(t, t0.DecrRef()) }()
+		require.True(t, tryAddLevel0Table(l0, t0))
+		require.True(t, tryAddLevel0Table(l0, t1))
+		require.Equal(t, startStalls, stalls())
+
+		t2 := createTable(db, []keyValVersion{{"fooz", "baz", 1, 0}})
+		defer func() { require.NoError(t, t2.DecrRef()) }()
+		require.False(t, tryAddLevel0Table(l0, t2))
+		require.False(t, tryAddLevel0Table(l0, t2))
+		require.Equal(t, startStalls+2, stalls())
+		require.Equal(t, startNs, stallNs())
+
+		time.Sleep(10 * time.Millisecond)
+		_, err := l0.deleteTables([]*table.Table{t1})
+		require.NoError(t, err)
+		require.True(t, tryAddLevel0Table(l0, t2))
+		require.Equal(t, startStalls+2, stalls())
+		require.GreaterOrEqual(t, stallNs()-startNs, int64(10*time.Millisecond))
+	})
+}
+
+func TestDeleteTablesReportsDeleted(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		opt := getTestOptions("").WithNumCompactors(0).WithNumTableDeleteWorkers(workers)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			l := db.lc.levels[1]
+			shared := createTable(db, []keyValVersion{{"a", "1", 1, 0}})
+			owned := createTable(db, []keyValVersion{{"b", "1", 1, 0}})
+			l.addTable(shared)
+			l.addTable(owned)
+			// The level now holds the only reference to owned, while shared is also held by the
+			// reference createTable returned, as an iterator would.
+			require.NoError(t, owned.DecrRef())
+
+			deleted, err := l.deleteTables([]*table.Table{shared, owned})
+			require.NoError(t, err)
+			require.Equal(t, []uint64{owned.ID()}, deleted)
+
+			ok, err := shared.DecrRefDeleted()
+			require.NoError(t, err)
+			require.True(t, ok)
+		})
+	}
+}
+
+func TestVerifyTableDeletes(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		opt := getTestOptions("").WithNumCompactors(0).WithVerifyTableDeletes(verify)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			l := db.lc.levels[1]
+			in := createTable(db, []keyValVersion{{"a", "1", 1, 0}})
+			defer func() { require.NoError(t, in.DecrRef()) }()
+			out := createTable(db, []keyValVersion{{"b", "1", 1, 0}})
+			defer func() { require.NoError(t, out.DecrRef()) }()
+			// The level takes over the reference it's given.
+			in.IncrRef()
+			l.addTable(in)
+
+			if !verify {
+				// The table which isn't in the level is skipped, but its reference is released
+				// all the same.
+				out.IncrRef()
+				_, err := l.replaceTables([]*table.Table{in, out}, nil)
+				require.NoError(t, err)
+				require.Empty(t, l.tables)
+				return
+			}
+			for _, toDel := range [][]*table.Table{{in, out}, {in, in}} {
+				require.Error(t, l.verifyTablesToDelete(toDel))
+			}
+			require.NoError(t, l.verifyTablesToDelete([]*table.Table{in}))
+
+			// A compaction failing the check fails before the manifest is changed, and leaves
+			// the levels as they were.
+			numManifestTables := func() int {
+				db.manifest.appendLock.Lock()
+				defer db.manifest.appendLock.Unlock()
+				return len(db.manifest.manifest.Tables)
+			}
+			before := numManifestTables()
+			cd := compactDef{
+				thisLevel: l,
+				nextLevel: db.lc.levels[2],
+				top:       []*table.Table{in},
+				bot:       []*table.Table{out},
+				t:         db.lc.levelTargets(),
+			}
+			require.Error(t, db.lc.runCompactDef(-1, 1, cd))
+			require.Equal(t, before, numManifestTables())
+			require.Equal(t, []*table.Table{in}, l.tables)
+			require.Equal(t, in.Size(), l.totalSize)
+			require.Empty(t, db.lc.levels[2].tables)
+
+			_, err := l.deleteTables([]*table.Table{in})
+			require.NoError(t, err)
+			require.Empty(t, l.tables)
+		})
+	}
+}
+
+func TestVerifyTableOverlaps(t *testing.T) {
+	opt := getTestOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		l := db.lc.levels[1]
+		ac := createTable(db, []keyValVersion{{"a", "1", 1, 0}, {"c", "1", 1, 0}})
+		defer func() { require.NoError(t, ac.DecrRef()) }()
+		ac.IncrRef()
+		l.addTable(ac)
+
+		// b overlaps with a-c, and c-d with both a-c and the d-e table added with it.
+		for _, toAdd := range [][]keyValVersion{
+			{{"b", "1", 1, 0}},
+			{{"c", "2", 2, 0}, {"d", "1", 1, 0}},
+		} {
+			tab := createTable(db, toAdd)
+			de := createTable(db, []keyValVersion{{"d", "2", 2, 0}, {"e", "1", 1, 0}})
+			require.Error(t, l.verifyTableOverlaps(nil, []*table.Table{de, tab}))
+			require.NoError(t, tab.DecrRef())
+			require.NoError(t, de.DecrRef())
+		}
+
+		// Replacing an overlapping table with its rewrite is fine, and so is any change of level
+		// 0.
+		rewrite := createTable(db, []keyValVersion{{"a", "1", 1, 0}, {"d", "1", 1, 0}})
+		defer func() { require.NoError(t, rewrite.DecrRef()) }()
+		require.NoError(t, l.verifyTableOverlaps([]*table.Table{ac}, []*table.Table{rewrite}))
+		require.NoError(t, db.lc.levels[0].verifyTableOverlaps(nil, []*table.Table{ac, rewrite}))
+
+		// A compaction leaving overlapping tables fails before the manifest is changed, and
+		// leaves the levels as they were.
+		l2 := db.lc.levels[2]
+		bc := createTable(db, []keyValVersion{{"b", "1", 1, 0}, {"c", "2", 2, 0}})
+		defer func() { require.NoError(t, bc.DecrRef()) }()
+		bc.IncrRef()
+		l2.addTable(bc)
+		db.manifest.appendLock.Lock()
+		before := len(db.manifest.manifest.Tables)
+		db.manifest.appendLock.Unlock()
+		cd := compactDef{
+			thisLevel: l,
+			nextLevel: l2,
+			top:       []*table.Table{ac},
+			t:         db.lc.levelTargets(),
+		}
+		require.Error(t, db.lc.runCompactDef(-1, 1, cd))
+		db.manifest.appendLock.Lock()
+		require.Equal(t, before, len(db.manifest.manifest.Tables))
+		db.manifest.appendLock.Unlock()
+		require.Equal(t, []*table.Table{ac}, l.tables)
+		require.Equal(t, []*table.Table{bc}, l2.tables)
+		require.Equal(t, bc.Size(), l2.totalSize)
+	})
+}
+
+func TestL0StallPolicy(t *testing.T) {
+	linear := LinearL0StallPolicy(40 * time.Millisecond)
+	for _, tc := range []struct {
+		numTables int
+		accept    bool
+		delay     time.Duration
+	}{
+		{0, true, 0}, {4, true, 0}, {5, true, 10 * time.Millisecond},
+		{6, true, 20 * time.Millisecond}, {8, true, 40 * time.Millisecond}, {9, false, 0},
+	} {
+		accept, delay := linear(tc.numTables, 5, 9)
+		require.Equal(t, tc.accept, accept, "numTables=%d", tc.numTables)
+		require.Equal(t, tc.delay, delay, "numTables=%d", tc.numTables)
+	}
+	accept, delay := DefaultL0StallPolicy(14, 5, 15)
+	require.True(t, accept)
+	require.Zero(t, delay)
+	accept, _ = DefaultL0StallPolicy(15, 5, 15)
+	require.False(t, accept)
+
+	type call struct{ numTables, numLevelZeroTables, stallThreshold int }
+	var mu sync.Mutex
+	var calls []call
+	var policyDB atomic.Pointer[DB]
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumLevelZeroTables(3).
+		WithNumLevelZeroTablesStall(10).
+		WithL0StallPolicy(func(numTables, numLevelZeroTables, stallThreshold int) (bool,
+			time.Duration) {
+			// The policy can read the state of the DB without deadlocking.
+			if db := policyDB.Load(); db != nil {
+				require.Equal(t, numTables, db.Levels()[0].NumTables)
+			}
+			mu.Lock()
+			calls = append(calls, call{numTables, numLevelZeroTables, stallThreshold})
+			mu.Unlock()
+			// Refuse a third table, and delay the second one.
+			return numTables < 2, time.Duration(numTables) * 20 * time.Millisecond
+		})
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		var tables []*table.Table
+		for i := 0; i < 3; i++ {
+			tab := createTable(db, []keyValVersion{{fmt.Sprintf("foo%d", i), "bar", 1, 0}})
+			defer func() { require.NoError(t, tab.DecrRef()) }()
+			tables = append(tables, tab)
+		}
+		policyDB.Store(db)
+		start := time.Now()
+		require.NoError(t, db.lc.addLevel0Table(tables[0]))
+		require.NoError(t, db.lc.addLevel0Table(tables[1]))
+		require.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+		// Delays are throttling, not stalls.
+		require.Zero(t, db.lc.l0stallsMs.Load())
+		mu.Lock()
+		require.Equal(t, []call{{0, 3, 10}, {1, 3, 10}}, calls)
+		mu.Unlock()
+
+		l0 := db.lc.levels[0]
+		require.False(t, tryAddLevel0Table(l0, tables[2]))
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		require.Equal(t, context.DeadlineExceeded, db.WaitForL0Space(ctx))
+
+		_, err := l0.deleteTables(l0.tables[:1])
+		require.NoError(t, err)
+		require.NoError(t, db.WaitForL0Space(context.Background()))
+		require.True(t, tryAddLevel0Table(l0, tables[2]))
+	})
+}
+
+func TestLevelCloseAllTables(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumTableCloseWorkers(4)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		var tables []*table.Table
+		for i := 0; i < 10; i++ {
+			tab := createTable(db, []keyValVersion{{fmt.Sprintf("foo%d", i), "bar", 1, 0}})
+			defer func() { require.NoError(t, tab.DecrRef()) }()
+			tables = append(tables, tab)
+		}
+
+		var mu sync.Mutex
+		closed := make(map[uint64]bool)
+		errBad := errors.New("bad close")
+		failed, err := forEachTable(tables, opt.NumTableCloseWorkers, func(tab *table.Table) error {
+			mu.Lock()
+			closed[tab.ID()] = true
+			mu.Unlock()
+			if tab == tables[3] {
+				return errBad
+			}
+			return nil
+		})
+		require.Equal(t, errBad, err)
+		require.Equal(t, 1, failed)
+		require.Len(t, closed, len(tables))
+	})
+}
+
+func TestLevelDeleteTablesConcurrent(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumTableDeleteWorkers(4)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		l := db.lc.levels[1]
+		var tables []*table.Table
+		for i := 0; i < 20; i++ {
+			tab := createTable(db, []keyValVersion{{fmt.Sprintf("foo%02d", i), "bar", 1, 0}})
+			l.addTable(tab)
+			require.NoError(t, tab.DecrRef())
+			tables = append(tables, tab)
+		}
+		l.sortTables()
+		_, err := l.deleteTables(tables[5:])
+		require.NoError(t, err)
+		require.Equal(t, tables[:5], l.tables)
+		for _, tab := range tables[5:] {
+			_, err := os.Stat(tab.Filename())
+			require.True(t, os.IsNotExist(err))
+		}
+	})
+}
+
+func BenchmarkDeleteTables(b *testing.B) {
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "badger-test")
+			require.NoError(b, err)
+			defer removeDir(dir)
+			opt := getTestOptions(dir).WithNumCompactors(0).WithNumTableDeleteWorkers(workers)
+			db, err := Open(opt)
+			require.NoError(b, err)
+			defer func() { require.NoError(b, db.Close()) }()
+
+			l := db.lc.levels[1]
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				var tables []*table.Table
+				for j := 0; j < 500; j++ {
+					tab := createTable(db, []keyValVersion{{fmt.Sprintf("foo%03d", j), "bar", 1, 0}})
+					l.addTable(tab)
+					require.NoError(b, tab.DecrRef())
+					tables = append(tables, tab)
+				}
+				b.StartTimer()
+				_, err := l.deleteTables(tables)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func TestGetCandidateTablesForKey(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		add := func(level int, key string) *table.Table {
+			tab := createTable(db, []keyValVersion{{key, "bar", 1, 0}})
+			db.lc.levels[level].addTable(tab)
+			require.NoError(t, tab.DecrRef())
+			return tab
+		}
+		add(0, "a")
+		t2 := add(0, "b")
+		add(0, "c")
+		t4 := add(1, "b")
+
+		key := y.KeyWithTs([]byte("b"), math.MaxUint64)
+		hash := y.Hash([]byte("b"))
+		tables, decr := db.lc.levels[0].getCandidateTablesForKey(key, hash)
+		require.Equal(t, []*table.Table{t2}, tables)
+		require.NoError(t, decr())
+
+		tables, decr = db.lc.levels[1].getCandidateTablesForKey(key, hash)
+		require.Equal(t, []*table.Table{t4}, tables)
+		require.NoError(t, decr())
+
+		missing := y.KeyWithTs([]byte("a"), math.MaxUint64)
+		tables, decr = db.lc.levels[1].getCandidateTablesForKey(missing, y.Hash([]byte("a")))
+		require.Empty(t, tables)
+		require.NoError(t, decr())
+
+		vs, err := db.lc.levels[0].get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("bar"), vs.Value)
+	})
+}
+
+func TestTablesOverlapping(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		add := func(level int, td []keyValVersion) uint64 {
+			tab := createTable(db, td)
+			db.lc.levels[level].addTable(tab)
+			require.NoError(t, tab.DecrRef())
+			return tab.ID()
+		}
+		l0a := add(0, []keyValVersion{{"c", "v", 2, 0}, {"m", "v", 2, 0}})
+		l0b := add(0, []keyValVersion{{"p", "v", 3, 0}, {"t", "v", 3, 0}})
+		l1a := add(1, []keyValVersion{{"b", "v", 1, 0}, {"d", "v", 1, 0}})
+		l1b := add(1, []keyValVersion{{"k", "v", 1, 0}, {"x", "v", 1, 0}})
+		db.lc.levels[1].sortTables()
+
+		ids := func(level int, start, end string) []uint64 {
+			var out []uint64
+			for _, ti := range db.TablesOverlapping(level, []byte(start), []byte(end)) {
+				out = append(out, ti.ID)
+			}
+			return out
+		}
+		require.Equal(t, []uint64{l0a}, ids(0, "a", "c"))
+		require.Equal(t, []uint64{l0a, l0b}, ids(0, "e", "q"))
+		require.Empty(t, ids(0, "n", "o"))
+		require.Equal(t, []uint64{l1a}, ids(1, "d", "e"))
+		require.Equal(t, []uint64{l1a, l1b}, ids(1, "a", "z"))
+		require.Empty(t, ids(1, "e", "j"))
+		require.Empty(t, ids(1, "", "z"))
+		require.Empty(t, ids(1, "z", "a"))
+		require.Empty(t, ids(0, "z", "a"))
+		require.Empty(t, ids(7, "a", "z"))
+
+		tis := db.TablesOverlapping(1, []byte("k"), []byte("k"))
+		require.Len(t, tis, 1)
+		require.Equal(t, []byte("k"), y.ParseKey(tis[0].Left))
+		require.Equal(t, []byte("x"), y.ParseKey(tis[0].Right))
+	})
+}
+
+func TestLevelsGetAtLeast(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		for v := 3; v <= 5; v++ {
+			createAndOpen(db, []keyValVersion{{"foo", fmt.Sprintf("bar%d", v), v, 0}}, 0)
+		}
+		createAndOpen(db, []keyValVersion{{"foo", "bar2", 2, 0}, {"foo", "bar1", 1, 0}}, 1)
+		key := y.KeyWithTs([]byte("foo"), 10)
+
+		// The newest level 0 table holds a version above the watermark, so the older level 0
+		// tables and level 1 are never looked at.
+		vs, err := db.lc.getAtLeast(key, y.ValueStruct{}, 0, 4)
+		require.NoError(t, err)
+		require.Equal(t, "bar5", string(vs.Value))
+		levels := db.Levels()
+		require.EqualValues(t, 1, levels[0].VersionsExaminedPerGet.Sum)
+		require.EqualValues(t, 0, levels[1].VersionsExaminedPerGet.Count)
+
+		// No version reaches the watermark, so every table is looked at.
+		vs, err = db.lc.getAtLeast(key, y.ValueStruct{}, 0, 6)
+		require.NoError(t, err)
+		require.Equal(t, "bar5", string(vs.Value))
+		levels = db.Levels()
+		require.EqualValues(t, 4, levels[0].VersionsExaminedPerGet.Sum)
+		require.EqualValues(t, 1, levels[1].VersionsExaminedPerGet.Count)
+	})
+}
+
+func TestLevelIterateTables(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		l := db.lc.levels[1]
+		var want []uint64
+		for _, k := range []string{"d", "a", "c", "b"} {
+			tab := createTable(db, []keyValVersion{{k, "v", 1, 0}})
+			l.addTable(tab)
+			require.NoError(t, tab.DecrRef())
+		}
+		l.sortTables()
+		for _, tab := range l.tables {
+			want = append(want, tab.ID())
+		}
+
+		var got []uint64
+		l.iterateTables(func(tab *table.Table) bool {
+			got = append(got, tab.ID())
+			return true
+		})
+		require.Equal(t, want, got)
+
+		got = got[:0]
+		l.iterateTables(func(tab *table.Table) bool {
+			got = append(got, tab.ID())
+			return len(got) < 2
+		})
+		require.Equal(t, want[:2], got)
+	})
+}
+
+func TestOverlappingTablesWithSize(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		l1 := db.lc.levels[1]
+		add := func(stale bool, keys ...string) *table.Table {
+			b := table.NewTableBuilder(buildTableOptions(db))
+			defer b.Close()
+			for _, k := range keys {
+				key := y.KeyWithTs([]byte(k), 1)
+				if stale {
+					b.AddStaleKey(key, y.ValueStruct{Value: []byte("v")}, 0)
+				} else {
+					b.Add(key, y.ValueStruct{Value: []byte("v")}, 0)
+				}
+			}
+			tab, err := table.CreateTable(table.NewFilename(db.lc.reserveFileID(), db.opt.Dir), b)
+			require.NoError(t, err)
+			l1.addTable(tab)
+			require.NoError(t, tab.DecrRef())
+			return tab
+		}
+		t1 := add(false, "a", "c")
+		t2 := add(true, "e", "g")
+		add(false, "i", "k")
+		l1.sortTables()
+		require.NotZero(t, t2.StaleDataSize())
+
+		kr := keyRange{
+			left:  y.KeyWithTs([]byte("b"), math.MaxUint64),
+			right: y.KeyWithTs([]byte("f"), 0),
+		}
+		left, right, size, stale := l1.overlappingTablesWithSize(kr)
+		require.Equal(t, 0, left)
+		require.Equal(t, 2, right)
+		require.Equal(t, t1.Size()+t2.Size(), size)
+		require.Equal(t, int64(t2.StaleDataSize()), stale)
+
+		kr = keyRange{
+			left:  y.KeyWithTs([]byte("l"), math.MaxUint64),
+			right: y.KeyWithTs([]byte("z"), 0),
+		}
+		left, right, size, stale = l1.overlappingTablesWithSize(kr)
+		require.Equal(t, left, right)
+		require.Zero(t, size)
+		require.Zero(t, stale)
+	})
+}
+
+func TestSetL0StallThreshold(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumLevelZeroTables(1).
+		WithNumLevelZeroTablesStall(2)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.Equal(t, 2, db.L0StallThreshold())
+		l0 := db.lc.levels[0]
+		var tables []*table.Table
+		for i := 0; i < 3; i++ {
+			tab := createTable(db, []keyValVersion{{fmt.Sprintf("foo%d", i), "bar", 1, 0}})
+			defer func() { require.NoError(t, tab.DecrRef()) }()
+			tables = append(tables, tab)
+		}
+		require.True(t, tryAddLevel0Table(l0, tables[0]))
+		require.True(t, tryAddLevel0Table(l0, tables[1]))
+		require.False(t, tryAddLevel0Table(l0, tables[2]))
+
+		done := make(chan error, 1)
+		go func() { done <- db.WaitForL0Space(context.Background()) }()
+
+		require.Error(t, db.SetL0StallThreshold(0))
+		require.Equal(t, 2, db.L0StallThreshold())
+		require.NoError(t, db.SetL0StallThreshold(3))
+		require.Equal(t, 3, db.L0StallThreshold())
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("WaitForL0Space didn't return once the threshold was raised")
+		}
+		require.True(t, tryAddLevel0Table(l0, tables[2]))
+	})
+}
+
+func TestLevelBloomFalsePositive(t *testing.T) {
+	_, err := Open(DefaultOptions("").WithInMemory(true).WithLevelBloomFalsePositive([]float64{1}))
+	require.Error(t, err)
+
+	bloomHits := func() int64 {
+		v := expvar.Get(y.BADGER_METRIC_PREFIX + "hit_num_lsm_bloom_filter").(*expvar.Map).Get("l0")
+		if v == nil {
+			return 0
+		}
+		return v.(*expvar.Int).Value()
+	}
+	// run writes keys to a level 0 table built with the given false positive probability, and
+	// returns the size of its bloom filter and the number of bloom filter hits when looking up
+	// keys which are not there.
+	run := func(fp float64) (int, int64) {
+		dir, err := os.MkdirTemp("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		opt := getTestOptions(dir).WithNumCompactors(0).
+			WithLevelBloomFalsePositive([]float64{fp})
+		db, err := Open(opt)
+		require.NoError(t, err)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 1000; i++ {
+				e := NewEntry([]byte(fmt.Sprintf("key%05d", i)), []byte("v"))
+				if err := txn.SetEntry(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		// Closing flushes the memtable to level 0.
+		require.NoError(t, db.Close())
+
+		db, err = Open(opt)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Close()) }()
+		tables := db.Tables()
+		require.Len(t, tables, 1)
+		require.Zero(t, tables[0].Level)
+
+		start := bloomHits()
+		for i := 0; i < 1000; i++ {
+			vs, err := db.get(y.KeyWithTs([]byte(fmt.Sprintf("missing%05d", i)), math.MaxUint64))
+			require.NoError(t, err)
+			require.Nil(t, vs.Value)
+		}
+		return tables[0].BloomFilterSize, bloomHits() - start
+	}
+
+	bigSize, bigHits := run(0.001)
+	smallSize, smallHits := run(0.3)
+	require.Greater(t, bigSize, smallSize)
+	// With a 0.1% false positive rate, almost all missing keys are filtered out.
+	require.Greater(t, bigHits, int64(950))
+	require.Greater(t, bigHits, smallHits)
+}
+
+func TestRequestCompaction(t *testing.T) {
+	opt := getTestOptions("").WithNumLevelZeroTables(10).WithNumLevelZeroTablesStall(20)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		// Keep the requests queued until the checks below are done.
+		db.PauseCompaction(true)
+
+		createAndOpen(db, []keyValVersion{{"foo", "bar", 3, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"foo", "baz", 2, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"fooz", "baz", 1, 0}}, 1)
+		require.Error(t, db.RequestCompaction(-1))
+		require.Error(t, db.RequestCompaction(len(db.lc.levels)))
+		require.Error(t, db.RequestCompaction(3))
+
+		// A level which is the target of a running compaction can't be requested.
+		db.lc.cstatus.Lock()
+		db.lc.cstatus.levels[1].ranges = append(db.lc.cstatus.levels[1].ranges, infRange)
+		db.lc.cstatus.Unlock()
+		require.Error(t, db.RequestCompaction(1))
+		db.lc.cstatus.Lock()
+		db.lc.cstatus.levels[1].ranges = nil
+		db.lc.cstatus.Unlock()
+
+		require.NoError(t, db.RequestCompaction(0))
+		require.Error(t, db.RequestCompaction(0))
+		require.Equal(t, 2, db.lc.levels[0].numTables())
+
+		// Level 0 is compacted once the compactors get to the request, though it's far below
+		// NumLevelZeroTables.
+		db.ResumeCompaction()
+		require.Eventually(t, func() bool {
+			return db.lc.levels[0].numTables() == 0
+		}, 10*time.Second, 10*time.Millisecond)
+		require.False(t, db.lc.levels[0].compactionRequested.Load())
+		getAllAndCheck(t, db, []keyValVersion{
+			{"foo", "bar", 3, 0}, {"foo", "baz", 2, 0}, {"fooz", "baz", 1, 0},
+		})
+
+		// The level can be requested again.
+		require.NoError(t, db.RequestCompaction(1))
+		require.Eventually(t, func() bool {
+			return !db.lc.levels[1].compactionRequested.Load()
+		}, 10*time.Second, 10*time.Millisecond)
+	})
+
+	opt = getTestOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"foo", "bar", 3, 0}}, 0)
+		require.Error(t, db.RequestCompaction(0))
+	})
+}
+
+func TestDropLevel(t *testing.T) {
+	opt := getTestOptions("").WithNumCompactors(0)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"foo", "new", 3, 0}, {"fooz", "baz", 3, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"foo", "old", 1, 0}}, 2)
+		_, _, err := db.DropLevel(len(db.lc.levels))
+		require.Error(t, err)
+
+		// A level which is being compacted can't be dropped.
+		db.lc.cstatus.Lock()
+		db.lc.cstatus.levels[1].ranges = append(db.lc.cstatus.levels[1].ranges, infRange)
+		db.lc.cstatus.Unlock()
+		_, _, err = db.DropLevel(1)
+		require.Error(t, err)
+		db.lc.cstatus.Lock()
+		db.lc.cstatus.levels[1].ranges = nil
+		db.lc.cstatus.Unlock()
+
+		size := db.lc.levels[1].tables[0].Size()
+		n, dropped, err := db.DropLevel(1)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		require.Equal(t, size, dropped)
+		require.Zero(t, db.lc.levels[1].numTables())
+		require.Empty(t, db.lc.cstatus.levels[1].ranges)
+
+		// The keys now come from the level below.
+		getAllAndCheck(t, db, []keyValVersion{{"foo", "old", 1, 0}})
+		txn := db.NewTransactionAt(math.MaxUint64, false)
+		defer txn.Discard()
+		_, err = txn.Get([]byte("fooz"))
+		require.Equal(t, ErrKeyNotFound, err)
+
+		n, dropped, err = db.DropLevel(1)
+		require.NoError(t, err)
+		require.Zero(t, n)
+		require.Zero(t, dropped)
+	})
+}
+
+func TestCompactionPlan(t *testing.T) {
+	opt := getTestOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		_, err := db.CompactionPlan(len(db.lc.levels))
+		require.Error(t, err)
+
+		add := func(level int, td []keyValVersion) *table.Table {
+			tab := createTable(db, td)
+			db.lc.levels[level].addTable(tab)
+			tab.DecrRef()
+			db.lc.levels[level].sortTables()
+			return tab
+		}
+		t1 := add(1, []keyValVersion{{"a", "a2", 2, 0}, {"c", "c2", 2, 0}})
+		t2 := add(2, []keyValVersion{{"b", "b1", 1, 0}})
+		add(2, []keyValVersion{{"x", "x1", 1, 0}})
+
+		plan, err := db.CompactionPlan(1)
+		require.NoError(t, err)
+		require.Equal(t, 2, plan.NextLevel)
+		require.Equal(t, 1, plan.NumTables)
+		require.Equal(t, 1, plan.NumNextTables)
+		require.Equal(t, t1.Size()+t2.Size(), plan.BytesRead)
+		stale := int64(t1.StaleDataSize() + t2.StaleDataSize())
+		require.Equal(t, stale, plan.StaleBytes)
+		require.Equal(t, plan.BytesRead-stale, plan.EstimatedBytesWritten)
+		require.Equal(t, 1, plan.EstimatedNumTables)
+		require.Equal(t, 2, db.lc.levels[2].numTables(), "the plan must not compact anything")
+
+		plan, err = db.CompactionPlan(3)
+		require.NoError(t, err)
+		require.Equal(t, CompactionPlan{Level: 3, NextLevel: 4}, plan)
+
+		// The last level is compacted into itself.
+		last := len(db.lc.levels) - 1
+		t3 := add(last, []keyValVersion{{"a", "a1", 1, 0}})
+		plan, err = db.CompactionPlan(last)
+		require.NoError(t, err)
+		require.Equal(t, last, plan.NextLevel)
+		require.Equal(t, 1, plan.NumTables)
+		require.Zero(t, plan.NumNextTables)
+		require.Equal(t, t3.Size(), plan.BytesRead)
+	})
+}
+
+func TestPinRange(t *testing.T) {
+	opt := getTestOptions("").WithNumCompactors(0)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"c", "c3", 3, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"a", "a2", 2, 0}, {"b", "b2", 2, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"x", "x2", 2, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"b", "b1", 1, 0}, {"z", "z1", 1, 0}}, 2)
+		l0, l1, l2 := db.lc.levels[0].tables, db.lc.levels[1].tables, db.lc.levels[2].tables
+
+		n, err := db.PinRange([]byte("b"), []byte("c"))
+		require.NoError(t, err)
+		require.Equal(t, 3, n)
+		require.True(t, l0[0].IsPinned())
+		require.True(t, l1[0].IsPinned())
+		require.False(t, l1[1].IsPinned())
+		require.True(t, l2[0].IsPinned())
+		n, err = db.PinRange([]byte("a"), []byte("b"))
+		require.NoError(t, err)
+		require.Zero(t, n)
+		getAllAndCheck(t, db, []keyValVersion{
+			{"a", "a2", 2, 0}, {"b", "b2", 2, 0}, {"b", "b1", 1, 0}, {"c", "c3", 3, 0},
+			{"x", "x2", 2, 0}, {"z", "z1", 1, 0},
+		})
+
+		n, err = db.UnpinRange([]byte("c"), []byte("c"))
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+		require.False(t, l0[0].IsPinned())
+		require.False(t, l2[0].IsPinned())
+
+		// A pinned table is unpinned once deleted.
+		_, err = db.lc.levels[1].deleteTables(l1[:1])
+		require.NoError(t, err)
+		require.False(t, l1[0].IsPinned())
+	})
+}
+
+func TestGetTableID(t *testing.T) {
+	test := func(t *testing.T, metrics bool) {
+		opt := getTestOptions("").WithNumCompactors(0).WithMetricsEnabled(metrics)
+		opt.managedTxns = true
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createAndOpen(db, []keyValVersion{{"foo", "v3", 3, 0}}, 0)
+			createAndOpen(db, []keyValVersion{{"foo", "v2", 2, 0}, {"fooz", "z2", 2, 0}}, 1)
+			createAndOpen(db, []keyValVersion{{"foo", "v1", 1, 0}}, 2)
+			ids := make([]uint64, 3)
+			for i := range ids {
+				if metrics {
+					ids[i] = db.lc.levels[i].tables[0].ID()
+				}
+			}
+
+			for i, h := range db.lc.levels[:3] {
+				vs, err := h.get(y.KeyWithTs([]byte("foo"), math.MaxUint64))
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("v%d", 3-i), string(vs.Value))
+				require.Equal(t, ids[i], vs.TableID)
+			}
+
+			txn := db.NewTransactionAt(math.MaxUint64, false)
+			defer txn.Discard()
+			item, err := txn.Get([]byte("foo"))
+			require.NoError(t, err)
+			require.Equal(t, ids[0], item.TableID())
+			item, err = txn.Get([]byte("fooz"))
+			require.NoError(t, err)
+			require.Equal(t, ids[1], item.TableID())
+
+			txn = db.NewTransactionAt(2, false)
+			defer txn.Discard()
+			item, err = txn.Get([]byte("foo"))
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), item.Version())
+			require.Equal(t, ids[1], item.TableID())
+		})
+	}
+	t.Run("metrics enabled", func(t *testing.T) { test(t, true) })
+	t.Run("metrics disabled", func(t *testing.T) { test(t, false) })
+}
+
+func TestSnapshotLevel(t *testing.T) {
+	opt := getTestOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		l1 := db.lc.levels[1]
+		for _, k := range []string{"b", "a"} {
+			tab := createTable(db, []keyValVersion{{k, "v", 1, 0}, {k + "z", "v", 1, 0}})
+			l1.addTable(tab)
+			require.NoError(t, tab.DecrRef())
+		}
+		l1.sortTables()
+		_, _, err := db.SnapshotLevel(len(db.lc.levels))
+		require.Error(t, err)
+
+		refs, release, err := db.SnapshotLevel(1)
+		require.NoError(t, err)
+		require.Len(t, refs, 2)
+		for i, ref := range refs {
+			tab := l1.tables[i]
+			require.Equal(t, tab.ID(), ref.ID)
+			require.Equal(t, 1, ref.Level)
+			require.Equal(t, tab.Filename(), ref.Path)
+			require.Equal(t, tab.Smallest(), ref.Left)
+			require.Equal(t, tab.Biggest(), ref.Right)
+			require.Equal(t, tab.Size(), ref.Size)
+		}
+		require.Equal(t, "a", string(y.ParseKey(refs[0].Left)))
+
+		// The files stay around while the snapshot is held, even once the tables are gone from the
+		// level.
+		_, err = l1.deleteTables(l1.tables)
+		require.NoError(t, err)
+		for _, ref := range refs {
+			_, err := os.Stat(ref.Path)
+			require.NoError(t, err)
+		}
+		require.NoError(t, release())
+		for _, ref := range refs {
+			_, err := os.Stat(ref.Path)
+			require.True(t, os.IsNotExist(err))
+		}
+
+		refs, release, err = db.SnapshotLevel(2)
+		require.NoError(t, err)
+		require.Empty(t, refs)
+		require.NoError(t, release())
+	})
+}
+
+func TestLevelHandlerGetBatch(t *testing.T) {
+	opt := getTestOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		add := func(level, from, to int, version uint64) {
+			var kvs []keyValVersion
+			for i := from; i < to; i += 2 {
+				kvs = append(kvs, keyValVersion{fmt.Sprintf("key%03d", i), fmt.Sprintf("v%d", version),
+					int(version), 0})
+			}
+			tab := createTable(db, kvs)
+			db.lc.levels[level].addTable(tab)
+			require.NoError(t, tab.DecrRef())
+		}
+		add(0, 0, 100, 3)
+		add(0, 50, 150, 4)
+		add(0, 20, 60, 2)
+		for i := 0; i < 200; i += 40 {
+			add(1, i, i+30, 1)
+		}
+
+		// Unsorted keys, with duplicates, versions below the latest, and missing keys.
+		var keys [][]byte
+		for i := 0; i < 300; i++ {
+			ts := uint64(math.MaxUint64)
+			if i%7 == 0 {
+				ts = 3
+			}
+			keys = append(keys, y.KeyWithTs([]byte(fmt.Sprintf("key%03d", rand.Intn(210))), ts))
+		}
+		keys = append(keys, keys[0], keys[10])
+		for _, h := range db.lc.levels[:2] {
+			vals, err := h.getBatch(keys)
+			require.NoError(t, err)
+			require.Len(t, vals, len(keys))
+			var found int
+			for i, key := range keys {
+				vs, err := h.get(key)
+				require.NoError(t, err)
+				require.Equal(t, vs, vals[i], "key %s at level %d", key, h.level)
+				if vs.Value != nil {
+					found++
+				}
+			}
+			require.Greater(t, found, 0)
+		}
+
+		vals, err := db.lc.levels[2].getBatch(keys)
+		require.NoError(t, err)
+		require.Equal(t, make([]y.ValueStruct, len(keys)), vals)
+	})
+}
+
+func BenchmarkLevelHandlerGetBatch(b *testing.B) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(b, err)
+	defer removeDir(dir)
+	db, err := Open(getTestOptions(dir).WithNumCompactors(0))
+	require.NoError(b, err)
+	defer func() { require.NoError(b, db.Close()) }()
+
+	l := db.lc.levels[1]
+	for i := 0; i < 20; i++ {
+		var kvs []keyValVersion
+		for j := 0; j < 1000; j++ {
+			kvs = append(kvs, keyValVersion{fmt.Sprintf("key%06d", i*1000+j), "value", 1, 0})
+		}
+		tab := createTable(db, kvs)
+		l.addTable(tab)
+		require.NoError(b, tab.DecrRef())
+	}
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, y.KeyWithTs([]byte(fmt.Sprintf("key%06d", i*20)), math.MaxUint64))
+	}
+
+	b.Run("get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				_, err := l.get(key)
+				require.NoError(b, err)
+			}
+		}
+	})
+	b.Run("getBatch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := l.getBatch(keys)
+			require.NoError(b, err)
+		}
+	})
+}
+
+// Reads racing with compactions must never miss the latest version of a key, and the references
+// readers take on tables must be released, so that the files of compacted tables get deleted.
+func TestReadsDuringCompaction(t *testing.T) {
+	opt := getTestOptions("").WithMemTableSize(1 << 18).WithValueThreshold(1 << 10).
+		WithBaseTableSize(1 << 16).WithBaseLevelSize(1 << 18).WithNumLevelZeroTables(2).
+		WithNumLevelZeroTablesStall(8).WithNumCompactors(2)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		const numKeys = 100
+		key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+		// committed is the last round of writes which is fully committed.
+		var committed atomic.Int64
+		committed.Store(-1)
+		done := make(chan struct{})
+
+		var wg sync.WaitGroup
+		errCh := make(chan error, 4)
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					min := committed.Load()
+					err := db.View(func(txn *Txn) error {
+						for i := 0; i < numKeys; i++ {
+							item, err := txn.Get(key(rand.Intn(numKeys)))
+							if err == ErrKeyNotFound && min < 0 {
+								continue
+							}
+							if err != nil {
+								return err
+							}
+							val, err := item.ValueCopy(nil)
+							if err != nil {
+								return err
+							}
+							if round := int64(binary.BigEndian.Uint64(val)); round < min {
+								return fmt.Errorf("read round %d of %s, want at least %d",
+									round, item.Key(), min)
+							}
+						}
+						return nil
+					})
+					if err != nil {
+						errCh <- err
+						return
+					}
+				}
+			}()
+		}
+
+		val := make([]byte, 256)
+		for round := 0; round < 200; round++ {
+			binary.BigEndian.PutUint64(val, uint64(round))
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for i := 0; i < numKeys; i++ {
+					if err := txn.Set(key(i), val); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+			committed.Store(int64(round))
+		}
+		close(done)
+		wg.Wait()
+		close(errCh)
+		for err := range errCh {
+			require.NoError(t, err)
+		}
+
+		var deeper int
+		for _, h := range db.lc.levels[1:] {
+			deeper += h.numTables()
+		}
+		require.Greater(t, deeper, 0, "no compaction ran")
+
+		// Once the flushes and compactions are done, the only table files left are those of the
+		// tables in the levels.
+		require.Eventually(t, func() bool {
+			live := make(map[uint64]struct{})
+			for _, h := range db.lc.levels {
+				h.RLock()
+				for _, tab := range h.tables {
+					live[tab.ID()] = struct{}{}
+				}
+				h.RUnlock()
+			}
+			files, err := os.ReadDir(db.opt.Dir)
+			require.NoError(t, err)
+			var onDisk int
+			for _, f := range files {
+				id, ok := table.ParseFileID(f.Name())
+				if !ok {
+					continue
+				}
+				if _, found := live[id]; !found {
+					return false
+				}
+				onDisk++
+			}
+			return onDisk == len(live)
+		}, 10*time.Second, 50*time.Millisecond)
+	})
+}
+
+func TestCompactStaleRatio(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithCompactStaleRatio(0.3)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		l1 := db.lc.levels[1]
+		add := func(prefix string, stale bool) *table.Table {
+			b := table.NewTableBuilder(buildTableOptions(db))
+			defer b.Close()
+			for i := 0; i < 100; i++ {
+				key := y.KeyWithTs([]byte(fmt.Sprintf("%s%03d", prefix, i)), 1)
+				// Random values, which don't compress, so that the table size is close to the
+				// size of the entries.
+				vs := y.ValueStruct{Value: make([]byte, 1<<10)}
+				rand.Read(vs.Value)
+				if stale {
+					b.AddStaleKey(key, vs, 0)
+				} else {
+					b.Add(key, vs, 0)
+				}
+			}
+			tab, err := table.CreateTable(table.NewFilename(db.lc.reserveFileID(), db.opt.Dir), b)
+			require.NoError(t, err)
+			require.NoError(t, db.manifest.addChanges([]*pb.ManifestChange{
+				newCreateChange(tab.ID(), 1, 0, tab.CompressionType()),
+			}))
+			l1.addTable(tab)
+			require.NoError(t, tab.DecrRef())
+			return tab
+		}
+		live := add("a", false)
+		add("m", true)
+		l1.sortTables()
+		require.Greater(t, float64(l1.getTotalStaleSize())/float64(l1.getTotalSize()), 0.3)
+		// The level is far below its target size.
+		require.Less(t, l1.getTotalSize(), db.lc.levelTargets().targetSz[1])
+
+		picked := func() *compactionPriority {
+			for _, p := range db.lc.pickCompactLevels(nil) {
+				if p.level == 1 {
+					return &p
+				}
+			}
+			return nil
+		}
+		db.opt.CompactStaleRatio = 0.9
+		require.Nil(t, picked())
+		db.opt.CompactStaleRatio = 0
+		require.Nil(t, picked())
+
+		db.opt.CompactStaleRatio = 0.3
+		p := picked()
+		require.NotNil(t, p)
+		require.True(t, p.staleData)
+		require.GreaterOrEqual(t, p.adjusted, 1.0)
+
+		// The stale table is compacted first.
+		require.NoError(t, db.lc.doCompact(-1, *p))
+		require.Equal(t, 1, l1.numTables())
+		l1.RLock()
+		require.Equal(t, live.ID(), l1.tables[0].ID())
+		l1.RUnlock()
+		require.Zero(t, l1.getTotalStaleSize())
+		require.Equal(t, 1, db.lc.levels[2].numTables())
+		require.Nil(t, picked())
+	})
+
+	_, err := Open(DefaultOptions("").WithInMemory(true).WithCompactStaleRatio(1.5))
+	require.Error(t, err)
+}
+
+func TestEstimatedKeysPerLevel(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.Equal(t, make([]int64, db.opt.MaxLevels), db.EstimatedKeysPerLevel())
+
+		createAndOpen(db, []keyValVersion{{"a", "1", 2, 0}, {"b", "1", 2, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"a", "2", 3, 0}}, 0)
+		// Both versions of c are counted, and so is a, though it's on level 0 already.
+		createAndOpen(db, []keyValVersion{{"a", "1", 1, 0}, {"c", "2", 2, 0}, {"c", "1", 1, 0}}, 2)
+		createAndOpen(db, []keyValVersion{{"d", "1", 1, bitDelete}}, 2)
+
+		want := make([]int64, db.opt.MaxLevels)
+		want[0], want[2] = 3, 4
+		require.Equal(t, want, db.EstimatedKeysPerLevel())
+	})
+}
+
+func TestTableSizeHistogram(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		stats := db.TableSizeHistogram()
+		require.Len(t, stats, db.opt.MaxLevels)
+		for i, st := range stats {
+			require.Equal(t, TableSizeStats{Level: i}, st)
+		}
+
+		for i := 10; i > 0; i-- {
+			val := strings.Repeat("v", i*1000)
+			createAndOpen(db, []keyValVersion{{fmt.Sprintf("k%02d", i), val, 1, 0}}, 1)
+		}
+		var sizes []int64
+		var total int64
+		for _, tab := range db.lc.levels[1].tables {
+			sizes = append(sizes, tab.Size())
+			total += tab.Size()
+		}
+		sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+
+		st := db.TableSizeHistogram()[1]
+		require.Equal(t, 1, st.Level)
+		require.Equal(t, 10, st.NumTables)
+		require.Equal(t, sizes[0], st.Min)
+		require.Equal(t, sizes[9], st.Max)
+		require.Equal(t, float64(total)/10, st.Mean)
+		require.Equal(t, sizes[4], st.P50)
+		require.Equal(t, sizes[8], st.P90)
+		require.Equal(t, sizes[9], st.P99)
+		require.Zero(t, db.TableSizeHistogram()[2].NumTables)
+	})
+}
+
+func TestFindTable(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		_, ok := db.FindTable(1)
+		require.False(t, ok)
+
+		createAndOpen(db, []keyValVersion{{"a", "1", 2, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"b", "1", 1, 0}, {"d", "1", 1, 0}}, 3)
+		createAndOpen(db, []keyValVersion{{"e", "1", 1, 0}}, 3)
+		tab := db.lc.levels[3].tables[0]
+
+		info, ok := db.FindTable(tab.ID())
+		require.True(t, ok)
+		require.Equal(t, tab.ID(), info.ID)
+		require.Equal(t, 3, info.Level)
+		require.Equal(t, y.KeyWithTs([]byte("b"), 1), info.Left)
+		require.Equal(t, y.KeyWithTs([]byte("d"), 1), info.Right)
+		require.Equal(t, tab.OnDiskSize(), info.OnDiskSize)
+		require.Equal(t, tab.StaleDataSize(), info.StaleDataSize)
+
+		info, ok = db.FindTable(db.lc.levels[0].tables[0].ID())
+		require.True(t, ok)
+		require.Zero(t, info.Level)
+
+		_, ok = db.FindTable(db.lc.reserveFileID())
+		require.False(t, ok)
+	})
+}
+
+func TestDropPrefixWholeTables(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	opt.managedTxns = true
+	ids := func(db *DB, level int) []uint64 {
+		var res []uint64
+		for _, tab := range db.lc.levels[level].tables {
+			res = append(res, tab.ID())
+		}
+		return res
+	}
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"a1", "1", 1, 0}, {"a2", "1", 1, 0}}, 6)
+		createAndOpen(db, []keyValVersion{{"b1", "1", 1, 0}, {"b2", "1", 1, 0}}, 6)
+		createAndOpen(db, []keyValVersion{{"b3", "1", 1, 0}, {"b4", "1", 1, 0}}, 6)
+		createAndOpen(db, []keyValVersion{{"c1", "1", 1, 0}}, 6)
+		before := ids(db, 6)
+
+		// The tables holding only keys with the prefix are dropped, and the others untouched.
+		require.NoError(t, db.DropPrefix([]byte("b")))
+		require.Equal(t, []uint64{before[0], before[3]}, ids(db, 6))
+		getAllAndCheck(t, db, []keyValVersion{{"a1", "1", 1, 0}, {"a2", "1", 1, 0},
+			{"c1", "1", 1, 0}})
+	})
+}
+
+func TestNewLevelsIterator(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"a", "0", 4, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"a", "1", 3, 0}, {"d", "1", 3, bitDelete}}, 1)
+		createAndOpen(db, []keyValVersion{{"b", "2", 2, 0}, {"d", "2", 2, 0}}, 2)
+		createAndOpen(db, []keyValVersion{{"e", "2", 2, 0}}, 2)
+		createAndOpen(db, []keyValVersion{{"c", "3", 1, 0}}, 3)
+
+		scan := func(minLevel, maxLevel int, opt IteratorOptions) []string {
+			it, err := db.NewLevelsIterator(minLevel, maxLevel, opt)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, it.Close()) }()
+			var res []string
+			for it.Rewind(); it.Valid(); it.Next() {
+				res = append(res, fmt.Sprintf("%s@%d=%s", y.ParseKey(it.Key()),
+					y.ParseTs(it.Key()), it.Value().Value))
+			}
+			return res
+		}
+		// L0 and L3 are left out, and all the versions and deletes are returned.
+		require.Equal(t, []string{"a@3=1", "b@2=2", "d@3=1", "d@2=2", "e@2=2"},
+			scan(1, 2, DefaultIteratorOptions))
+		require.Equal(t, []string{"e@2=2", "d@2=2", "d@3=1", "b@2=2", "a@3=1"},
+			scan(1, 2, IteratorOptions{Reverse: true}))
+		require.Equal(t, []string{"b@2=2", "d@2=2", "e@2=2"}, scan(2, 2, DefaultIteratorOptions))
+		// Only the tables which can hold the prefix are picked, but all their keys are returned.
+		require.Equal(t, []string{"a@3=1", "b@2=2", "d@3=1", "d@2=2"},
+			scan(1, 3, IteratorOptions{Prefix: []byte("d")}))
+		require.Empty(t, scan(4, 6, DefaultIteratorOptions))
+
+		for _, r := range [][2]int{{-1, 2}, {2, 1}, {0, len(db.lc.levels)}} {
+			_, err := db.NewLevelsIterator(r[0], r[1], DefaultIteratorOptions)
+			require.Error(t, err)
+		}
+	})
+}
+
+func TestColdTables(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"a", "1", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"b", "1", 1, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"c", "1", 1, 0}}, 2)
+		l1, l2 := db.lc.levels[1].tables, db.lc.levels[2].tables
+		for _, tab := range append(append([]*table.Table{}, l1...), l2...) {
+			tab.Touch(time.Now().Add(-time.Hour).Unix())
+		}
+		ids := func(infos []TableInfo) []uint64 {
+			var res []uint64
+			for _, info := range infos {
+				res = append(res, info.ID)
+			}
+			return res
+		}
+		require.Equal(t, []uint64{l1[0].ID(), l1[1].ID(), l2[0].ID()}, ids(db.ColdTables(time.Minute)))
+		require.Empty(t, db.ColdTables(2*time.Hour))
+
+		// A get only touches the table holding the key.
+		_, err := db.lc.levels[1].get(y.KeyWithTs([]byte("b"), math.MaxUint64))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{l1[0].ID(), l2[0].ID()}, ids(db.ColdTables(time.Minute)))
+		_, err = db.lc.levels[1].getBatch([][]byte{y.KeyWithTs([]byte("a"), math.MaxUint64)})
+		require.NoError(t, err)
+		require.Equal(t, []uint64{l2[0].ID()}, ids(db.ColdTables(time.Minute)))
+
+		// So does an iterator, for the tables it picks.
+		iopt := DefaultIteratorOptions
+		it := db.lc.levels[2].appendIterators(nil, &iopt)
+		require.NoError(t, it[0].Close())
+		require.Empty(t, db.ColdTables(time.Minute))
+		info, ok := db.FindTable(l2[0].ID())
+		require.True(t, ok)
+		require.WithinDuration(t, time.Now(), info.LastAccess, 2*time.Second)
+	})
+}
+
+func TestMaxCompactionMemory(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithMaxCompactionMemory(1)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		l5, l6 := db.lc.levels[5], db.lc.levels[6]
+		for level, kvs := range map[int][]keyValVersion{
+			5: {{"a", "2", 2, 0}},
+			6: {{"a", "1", 1, 0}, {"b", "1", 1, 0}},
+		} {
+			tab := createTable(db, kvs)
+			require.NoError(t, db.manifest.addChanges([]*pb.ManifestChange{
+				newCreateChange(tab.ID(), level, 0, tab.CompressionType()),
+			}))
+			db.lc.levels[level].addTable(tab)
+		}
+		before := l6.tables[0].ID()
+
+		// A compaction bigger than the budget waits for the running ones to release all of it.
+		held, err := db.compactionMem.acquire(1<<20, nil)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), held)
+		tt := db.lc.levelTargets()
+		done := make(chan error, 1)
+		go func() { done <- db.lc.doCompact(-1, compactionPriority{level: 5, t: tt}) }()
+		select {
+		case err := <-done:
+			t.Fatalf("compaction ran while over the budget: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		require.Equal(t, 1, l5.numTables())
+		l6.RLock()
+		require.Equal(t, before, l6.tables[0].ID())
+		l6.RUnlock()
+		// The waiting compaction doesn't keep its tables reserved.
+		db.lc.cstatus.RLock()
+		require.Empty(t, db.lc.cstatus.tables)
+		require.Empty(t, db.lc.cstatus.levels[5].ranges)
+		db.lc.cstatus.RUnlock()
+
+		// A canceled compaction stops waiting.
+		cancel := make(chan struct{})
+		close(cancel)
+		require.Equal(t, errMemCanceled,
+			db.lc.doCompactUntil(-1, compactionPriority{level: 5, t: tt}, cancel))
+
+		db.compactionMem.release(held)
+		require.NoError(t, <-done)
+		require.Zero(t, l5.numTables())
+		l6.RLock()
+		require.NotEqual(t, before, l6.tables[0].ID())
+		l6.RUnlock()
+		require.Zero(t, db.compactionMem.used)
+	})
+}
+
+func TestLevelForKey(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"a", "a2", 2, 0}, {"b", "b1", 1, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"a", "a1", 1, 0}, {"c", "c3", 3, 0}}, 1)
+		// Like a value log GC rewrite, d has a newer version in a deeper level.
+		createAndOpen(db, []keyValVersion{{"c", "c1", 1, 0}, {"d", "d1", 1, 0}}, 2)
+		createAndOpen(db, []keyValVersion{{"d", "d5", 5, 0}, {"e", "e1", 1, bitDelete}}, 3)
+
+		for _, tc := range []struct {
+			key   string
+			level int
+			found bool
+		}{
+			{"a", 0, true},
+			{"b", 0, true},
+			{"c", 1, true},
+			{"d", 3, true},
+			{"e", 3, true}, // Tombstones are versions too.
+			{"f", 0, false},
+		} {
+			level, found := db.LevelForKey([]byte(tc.key))
+			require.Equal(t, tc.found, found, "key %s", tc.key)
+			require.Equal(t, tc.level, level, "key %s", tc.key)
+		}
+	})
+}
+
+func TestContainsExpired(t *testing.T) {
+	opt := getTestOptions("").WithNumCompactors(0)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		build := func(expiresAt ...uint64) *table.Table {
+			b := table.NewTableBuilder(buildTableOptions(db))
+			defer b.Close()
+			for i, e := range expiresAt {
+				b.Add(y.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 1),
+					y.ValueStruct{Value: []byte("v"), ExpiresAt: e}, 0)
+			}
+			tab, err := table.CreateTable(table.NewFilename(db.lc.reserveFileID(), db.opt.Dir), b)
+			require.NoError(t, err)
+			return tab
+		}
+		tab := build(0, 30, 20)
+		defer func() { require.NoError(t, tab.DecrRef()) }()
+		// The answer comes from the index.
+		require.Equal(t, uint64(20), tab.MinExpiresAt())
+		require.False(t, containsExpired(tab, 19))
+		require.True(t, containsExpired(tab, 20))
+
+		never := build(0, 0)
+		defer func() { require.NoError(t, never.DecrRef()) }()
+		require.False(t, containsExpired(never, math.MaxUint64-1))
+	})
+}
@@ -26,6 +26,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/golang/protobuf/proto"
@@ -52,6 +53,10 @@ type Manifest struct {
 	// whether it'd be useful to rewrite the manifest.
 	Creations int
 	Deletions int
+
+	// level0 holds the ids of the tables of level 0, in the order they were created in. Memtable
+	// flushes create them in increasing order of id, which is the order reads rely on.
+	level0 []uint64
 }
 
 func createManifest() Manifest {
@@ -107,10 +112,16 @@ const (
 )
 
 // asChanges returns a sequence of changes that could be used to recreate the Manifest in its
-// present state.
+// present state. The tables are created in increasing order of id.
 func (m *Manifest) asChanges() []*pb.ManifestChange {
+	ids := make([]uint64, 0, len(m.Tables))
+	for id := range m.Tables {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
 	changes := make([]*pb.ManifestChange, 0, len(m.Tables))
-	for id, tm := range m.Tables {
+	for _, id := range ids {
+		tm := m.Tables[id]
 		changes = append(changes, newCreateChange(id, int(tm.Level), tm.KeyID, tm.Compression))
 	}
 	return changes
@@ -452,6 +463,9 @@ func applyManifestChange(build *Manifest, tc *pb.ManifestChange) error {
 			build.Levels = append(build.Levels, levelManifest{make(map[uint64]struct{})})
 		}
 		build.Levels[tc.Level].Tables[tc.Id] = struct{}{}
+		if tc.Level == 0 {
+			build.level0 = append(build.level0, tc.Id)
+		}
 		build.Creations++
 	case pb.ManifestChange_DELETE:
 		tm, ok := build.Tables[tc.Id]
@@ -460,6 +474,14 @@ func applyManifestChange(build *Manifest, tc *pb.ManifestChange) error {
 		}
 		delete(build.Levels[tm.Level].Tables, tc.Id)
 		delete(build.Tables, tc.Id)
+		if tm.Level == 0 {
+			for i, id := range build.level0 {
+				if id == tc.Id {
+					build.level0 = append(build.level0[:i], build.level0[i+1:]...)
+					break
+				}
+			}
+		}
 		build.Deletions++
 	default:
 		return fmt.Errorf("MANIFEST file has invalid manifestChange op")
@@ -175,7 +175,7 @@ func TestOverlappingKeyRangeError(t *testing.T) {
 	t1 := buildTestTable(t, "k", 2, opts)
 	defer func() { require.NoError(t, t1.DecrRef()) }()
 
-	done := lh0.tryAddLevel0Table(t1)
+	done, _ := lh0.tryAddLevel0Table(t1)
 	require.Equal(t, true, done)
 	_, span := otrace.StartSpan(context.Background(), "Badger.Compaction")
 	span.Annotatef(nil, "Compaction level: %v", lh0)
@@ -199,7 +199,7 @@ func TestOverlappingKeyRangeError(t *testing.T) {
 	span.Annotatef(nil, "Compaction level: %v", lh0)
 	t2 := buildTestTable(t, "l", 2, opts)
 	defer func() { require.NoError(t, t2.DecrRef()) }()
-	done = lh0.tryAddLevel0Table(t2)
+	done, _ = lh0.tryAddLevel0Table(t2)
 	require.Equal(t, true, done)
 
 	cd = compactDef{
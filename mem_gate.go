@@ -0,0 +1,162 @@
+/*
+ * Copyright 2026 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// memGate limits the estimated memory used by the iterators open at the same time, or by the
+// compactions running at the same time. Waiters are served in the order they arrived, so that a
+// big reservation isn't starved by smaller ones. A nil memGate puts no limit.
+type memGate struct {
+	sync.Mutex
+	max     int64
+	used    int64
+	waiters []*memWaiter
+	closed  chan struct{} // Closed by close, to fail the pending and later acquires.
+}
+
+var errMemCanceled = errors.New("Memory reservation canceled")
+
+type memWaiter struct {
+	n     int64
+	ready chan struct{} // Closed once n bytes have been reserved for the waiter.
+}
+
+func newMemGate(max int64) *memGate {
+	if max <= 0 {
+		return nil
+	}
+	return &memGate{max: max, closed: make(chan struct{})}
+}
+
+// clamp returns n, reduced to the whole budget. An iterator or a compaction larger than the whole
+// budget reserves all of it, so that it can still run, alone.
+func (g *memGate) clamp(n int64) int64 {
+	if n > g.max {
+		return g.max
+	}
+	return n
+}
+
+// tryAcquire reserves n bytes if they fit in the budget and nobody is waiting, and returns the
+// number of bytes reserved and true. Otherwise, it reserves nothing and returns false.
+func (g *memGate) tryAcquire(n int64) (int64, bool) {
+	if g == nil || n <= 0 {
+		return 0, true
+	}
+	n = g.clamp(n)
+	g.Lock()
+	defer g.Unlock()
+	if len(g.waiters) > 0 || g.used+n > g.max {
+		return 0, false
+	}
+	g.used += n
+	return n, true
+}
+
+// acquire blocks until n bytes fit in the budget, and returns the number of bytes reserved. It
+// gives up and returns an error once cancel is closed, or the gate is closed.
+func (g *memGate) acquire(n int64, cancel <-chan struct{}) (int64, error) {
+	if g == nil || n <= 0 {
+		return 0, nil
+	}
+	n = g.clamp(n)
+	g.Lock()
+	select {
+	case <-g.closed:
+		g.Unlock()
+		return 0, ErrDBClosed
+	default:
+	}
+	if len(g.waiters) == 0 && g.used+n <= g.max {
+		g.used += n
+		g.Unlock()
+		return n, nil
+	}
+	w := &memWaiter{n: n, ready: make(chan struct{})}
+	g.waiters = append(g.waiters, w)
+	g.Unlock()
+
+	var err error
+	select {
+	case <-w.ready:
+		return n, nil
+	case <-cancel:
+		err = errMemCanceled
+	case <-g.closed:
+		err = ErrDBClosed
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	select {
+	case <-w.ready:
+		// Reserved in the meantime. Give it back.
+		g.used -= n
+	default:
+		for i, other := range g.waiters {
+			if other == w {
+				g.waiters = append(g.waiters[:i], g.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	g.notify()
+	return 0, err
+}
+
+func (g *memGate) release(n int64) {
+	if g == nil || n <= 0 {
+		return
+	}
+	g.Lock()
+	defer g.Unlock()
+	g.used -= n
+	g.notify()
+}
+
+// notify reserves memory for the waiters at the head of the queue, as long as they fit. It must be
+// called with the lock held.
+func (g *memGate) notify() {
+	for len(g.waiters) > 0 {
+		w := g.waiters[0]
+		if g.used+w.n > g.max {
+			return
+		}
+		g.used += w.n
+		close(w.ready)
+		g.waiters = g.waiters[1:]
+	}
+}
+
+// close fails the pending and later calls to acquire with ErrDBClosed.
+func (g *memGate) close() {
+	if g == nil {
+		return
+	}
+	g.Lock()
+	defer g.Unlock()
+	select {
+	case <-g.closed:
+	default:
+		close(g.closed)
+	}
+}
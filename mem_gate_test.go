@@ -0,0 +1,61 @@
+/*
+ * Copyright 2026 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemGateCancel(t *testing.T) {
+	g := newMemGate(10)
+	held, err := g.acquire(8, nil)
+	require.NoError(t, err)
+
+	// A canceled waiter gives its place to the next one.
+	cancel := make(chan struct{})
+	close(cancel)
+	_, err = g.acquire(5, cancel)
+	require.Equal(t, errMemCanceled, err)
+	n, ok := g.tryAcquire(2)
+	require.True(t, ok)
+	g.release(n)
+
+	// Waiters are served in order, so a small reservation doesn't get ahead of a big one.
+	done := make(chan error)
+	go func() {
+		_, err := g.acquire(5, nil)
+		done <- err
+	}()
+	require.Eventually(t, func() bool {
+		g.Lock()
+		defer g.Unlock()
+		return len(g.waiters) == 1
+	}, time.Second, time.Millisecond)
+	_, ok = g.tryAcquire(1)
+	require.False(t, ok)
+
+	// Closing the gate fails the waiters.
+	g.close()
+	require.Equal(t, ErrDBClosed, <-done)
+	_, err = g.acquire(1, nil)
+	require.Equal(t, ErrDBClosed, err)
+	g.release(held)
+	require.Zero(t, g.used)
+}
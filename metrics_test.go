@@ -18,10 +18,15 @@ package badger
 
 import (
 	"expvar"
+	"fmt"
+	"math"
 	"math/rand"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/dgraph-io/badger/v4/y"
 )
 
 func clearAllMetrics() {
@@ -201,3 +206,108 @@ func TestReadMetrics(t *testing.T) {
 		require.Equal(t, int64(1), rangeQueries.(*expvar.Int).Value())
 	})
 }
+
+func TestResetLevelReadMetrics(t *testing.T) {
+	opt := getTestOptions("")
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		db.ResetLevelReadMetrics()
+		const adders, perAdder = 8, 10000
+		l1 := db.lc.levels[1].strLevel
+
+		var wg sync.WaitGroup
+		for i := 0; i < adders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perAdder; j++ {
+					y.NumLSMGetsAdd(true, l1, 1)
+					y.NumLSMBloomHitsAdd(true, l1, 2)
+				}
+			}()
+		}
+		// Reset while the counters are being added to, until all the adds have been returned.
+		done := make(chan struct{})
+		var gets, hits int64
+		go func() {
+			defer close(done)
+			for gets < adders*perAdder || hits < 2*adders*perAdder {
+				m := db.ResetLevelReadMetrics()
+				gets += m[1].Gets
+				hits += m[1].BloomHits
+			}
+		}()
+		wg.Wait()
+		<-done
+		require.Equal(t, int64(adders*perAdder), gets)
+		require.Equal(t, int64(2*adders*perAdder), hits)
+
+		m := db.ResetLevelReadMetrics()
+		require.Len(t, m, len(db.lc.levels))
+		require.Zero(t, m[1].Gets)
+		require.Zero(t, m[1].BloomHits)
+	})
+
+	opt = getTestOptions("").WithMetricsEnabled(false)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.Nil(t, db.ResetLevelReadMetrics())
+	})
+}
+
+func TestBloomFalsePositives(t *testing.T) {
+	opt := getTestOptions("")
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		var kvs []keyValVersion
+		for i := 0; i < 100; i++ {
+			kvs = append(kvs, keyValVersion{fmt.Sprintf("key%03d", i), "v", 1, 0})
+		}
+		createAndOpen(db, kvs, 1)
+		l := db.lc.levels[1]
+		tab := l.tables[0]
+		require.Greater(t, tab.BloomFilterSize(), 0)
+
+		// Find missing keys within the range of the table, which its bloom filter rules out or not.
+		var ruledOut, passed []byte
+		for i := 0; ruledOut == nil || passed == nil; i++ {
+			key := []byte(fmt.Sprintf("key050-%d", i))
+			if tab.DoesNotHave(y.Hash(key)) {
+				ruledOut = key
+			} else {
+				passed = key
+			}
+		}
+
+		db.ResetLevelReadMetrics()
+		lookup := func(key []byte) {
+			vs, err := l.get(y.KeyWithTs(key, math.MaxUint64))
+			require.NoError(t, err)
+			require.Zero(t, vs.Version)
+		}
+		lookup(passed)
+		lookup(passed)
+		lookup(ruledOut)
+		vs, err := l.get(y.KeyWithTs([]byte("key010"), math.MaxUint64))
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), vs.Version)
+		vals, err := l.getBatch([][]byte{
+			y.KeyWithTs(passed, math.MaxUint64), y.KeyWithTs([]byte("key020"), math.MaxUint64),
+		})
+		require.NoError(t, err)
+		require.Zero(t, vals[0].Version)
+		require.Equal(t, uint64(1), vals[1].Version)
+
+		// A key the table only holds at versions above the read timestamp is no false positive.
+		vs, err = l.get(y.KeyWithTs([]byte("key030"), 0))
+		require.NoError(t, err)
+		require.Zero(t, vs.Version)
+		vals, err = l.getBatch([][]byte{y.KeyWithTs([]byte("key030"), 0)})
+		require.NoError(t, err)
+		require.Zero(t, vals[0].Version)
+
+		m := db.ResetLevelReadMetrics()[1]
+		require.Equal(t, int64(7), m.Gets)
+		require.Equal(t, int64(1), m.BloomHits)
+		require.Equal(t, int64(3), m.BloomFalsePositives)
+		require.Equal(t, 0.75, m.BloomFalsePositiveRate())
+		require.Zero(t, LevelReadMetrics{}.BloomFalsePositiveRate())
+	})
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -80,8 +81,16 @@ type Options struct {
 	BlockCacheSize     int64
 	IndexCacheSize     int64
 
+	// LevelBloomFalsePositive overrides BloomFalsePositive for the tables written to some levels.
+	LevelBloomFalsePositive []float64
+
+	// LevelVersionsToKeep is the number of most recent versions of each key which compactions
+	// keep in the tables written to some levels.
+	LevelVersionsToKeep []int
+
 	NumLevelZeroTables      int
 	NumLevelZeroTablesStall int
+	L0StallPolicy           L0StallPolicy
 
 	ValueLogFileSize   int64
 	ValueLogMaxEntries uint32
@@ -91,9 +100,55 @@ type Options struct {
 	LmaxCompaction       bool
 	ZSTDCompressionLevel int
 
+	// When set, compactions make keys whose value log values are identical share a single copy.
+	CompactionValueDedup bool
+
+	// A level whose stale data makes up more than this fraction of its size is compacted, even if
+	// it's within its target size. Zero disables it.
+	CompactStaleRatio float64
+
+	// Size of the DISCARD file when it is created. Must be a multiple of 16 bytes, the size of an
+	// entry, with room for the header and at least one entry.
+	DiscardStatsInitialSize int64
+	// How the DISCARD file grows when it's full: by DiscardStatsGrowthIncrement bytes if it's set,
+	// and by DiscardStatsGrowthFactor times its size otherwise.
+	DiscardStatsGrowthFactor    float64
+	DiscardStatsGrowthIncrement int64
+
+	// When more than this fraction of the discard stats slots have zero discard, the discard stats
+	// are compacted to reclaim them. Zero disables compaction.
+	DiscardStatsCompactZeroRatio float64
+
+	// Number of goroutines used to close the tables of a level when the DB is closed.
+	NumTableCloseWorkers int
+	// Number of goroutines used to release tables removed from a level by a compaction.
+	NumTableDeleteWorkers int
+
+	// Upper bound on the estimated memory held by all open iterators. Zero means no limit.
+	MaxConcurrentIteratorMemory int64
+	// Upper bound on the estimated memory used by the compactions running at the same time. Zero
+	// means no limit.
+	MaxCompactionMemory int64
+
+	// Number of table creations and deletions kept for DB.TableEventLog.
+	TableEventLogSize int
+
+	// Called when a level of the LSM tree becomes empty, or stops being empty.
+	OnLevelEmptyChange func(level int, empty bool)
+	// Called with the new size and stale data size of a level of the LSM tree, after it changed.
+	OnLevelSizeChange func(level int, total, stale int64)
+
 	// When set, checksum will be validated for each entry read from the value log file.
 	VerifyValueChecksum bool
 
+	// When set, the order of the tables of level 0, and the key ranges and versions of the tables
+	// of every level are verified on open.
+	VerifyInvariantsOnOpen bool
+	// When set, removing from a level a table which isn't in it is an error.
+	VerifyTableDeletes bool
+	// When set, a change of the tables of a level leaving them overlapping is an error.
+	VerifyTableOverlaps bool
+
 	// Encryption related options.
 	EncryptionKey                 []byte        // encryption key
 	EncryptionKeyRotationDuration time.Duration // key rotation duration
@@ -150,6 +205,7 @@ func DefaultOptions(path string) Options {
 		NumCompactors:           4, // Run at least 2 compactors. Zero-th compactor prioritizes L0.
 		NumLevelZeroTables:      5,
 		NumLevelZeroTablesStall: 15,
+		L0StallPolicy:           DefaultL0StallPolicy,
 		NumMemtables:            5,
 		BloomFalsePositive:      0.01,
 		BlockSize:               4 * 1024,
@@ -173,6 +229,13 @@ func DefaultOptions(path string) Options {
 		// Benchmark code can be found in table/builder_test.go file
 		ZSTDCompressionLevel: 1,
 
+		TableEventLogSize:     1000,
+		NumTableCloseWorkers:  runtime.GOMAXPROCS(0),
+		NumTableDeleteWorkers: 1,
+
+		DiscardStatsInitialSize:  1 << 20,
+		DiscardStatsGrowthFactor: 2,
+
 		// Nothing to read/write value log using standard File I/O
 		// MemoryMap to mmap() the value log files
 		// (2^30 - 1)*2 when mmapping < 2^31 - 1, max int32.
@@ -209,6 +272,7 @@ func buildTableOptions(db *DB) table.Options {
 		IndexCache:           db.indexCache,
 		AllocPool:            db.allocPool,
 		DataKey:              dk,
+		TombstoneMeta:        bitDelete,
 	}
 }
 
@@ -406,6 +470,32 @@ func (opt Options) WithNumVersionsToKeep(val int) Options {
 	return opt
 }
 
+// WithLevelVersionsToKeep returns a new Options value with LevelVersionsToKeep set to the given
+// value.
+//
+// LevelVersionsToKeep sets, for each level, the number of most recent versions of each key which
+// compactions keep in the tables they write to the level, the i-th value being used for level i.
+// These versions are kept even if they are older than the oldest running transaction, deleted,
+// expired, or followed by a version with DiscardEarlierVersions set, so a history of each key
+// survives on the level, for example for auditing. Older versions are dropped as usual, following
+// NumVersionsToKeep. Keeping versions on a level doesn't keep a compaction into a level below it
+// from dropping them. Levels past the end of the slice, and a value of 0, keep no extra version.
+//
+// The default value of LevelVersionsToKeep is nil.
+func (opt Options) WithLevelVersionsToKeep(val []int) Options {
+	opt.LevelVersionsToKeep = val
+	return opt
+}
+
+// versionsToKeep returns the number of most recent versions of each key a compaction into the
+// given level must keep.
+func (opt *Options) versionsToKeep(level int) int {
+	if level < len(opt.LevelVersionsToKeep) {
+		return opt.LevelVersionsToKeep[level]
+	}
+	return 0
+}
+
 // WithNumGoroutines sets the number of goroutines to be used in Stream.
 //
 // The default value of NumGoroutines is 8.
@@ -561,6 +651,32 @@ func (opt Options) WithBloomFalsePositive(val float64) Options {
 	return opt
 }
 
+// WithLevelBloomFalsePositive returns a new Options value with LevelBloomFalsePositive set to the
+// given value.
+//
+// LevelBloomFalsePositive sets the false positive probability of the bloom filter of the tables
+// written to each level, the i-th value being used for level i. This allows bigger filters for the
+// upper levels, which take most of the reads, and smaller ones for the last levels, which hold
+// mostly cold data. Levels past the end of the slice use BloomFalsePositive, and a value of 0
+// disables the bloom filter of the tables written to that level. Only new tables are affected, as
+// each table keeps the bloom filter it was written with.
+//
+// The default value of LevelBloomFalsePositive is nil, so BloomFalsePositive is used for all
+// levels.
+func (opt Options) WithLevelBloomFalsePositive(val []float64) Options {
+	opt.LevelBloomFalsePositive = val
+	return opt
+}
+
+// bloomFalsePositive returns the false positive probability of the bloom filter of the tables
+// written to the given level.
+func (opt *Options) bloomFalsePositive(level int) float64 {
+	if level < len(opt.LevelBloomFalsePositive) {
+		return opt.LevelBloomFalsePositive[level]
+	}
+	return opt.BloomFalsePositive
+}
+
 // WithBlockSize returns a new Options value with BlockSize set to the given value.
 //
 // BlockSize sets the size of any block in SSTable. SSTable is divided into multiple blocks
@@ -589,6 +705,182 @@ func (opt Options) WithNumLevelZeroTablesStall(val int) Options {
 	return opt
 }
 
+// L0StallPolicy decides whether level 0, holding numTables tables, accepts the table of a memtable
+// flush, or stalls the flush until compactions make room. numLevelZeroTables is
+// Options.NumLevelZeroTables, and stallThreshold the current stall threshold, see
+// DB.L0StallThreshold. A table accepted can come with a delay, applied to the flush once the table
+// is added, so that writes slow down as level 0 fills up instead of stopping all at once.
+type L0StallPolicy func(numTables, numLevelZeroTables, stallThreshold int) (accept bool,
+	delay time.Duration)
+
+// DefaultL0StallPolicy accepts tables until level 0 holds stallThreshold tables, without any delay.
+func DefaultL0StallPolicy(numTables, numLevelZeroTables, stallThreshold int) (bool, time.Duration) {
+	return numTables < stallThreshold, 0
+}
+
+// LinearL0StallPolicy returns a policy which accepts tables until level 0 holds stallThreshold
+// tables, like DefaultL0StallPolicy, but delays the flushes which find numLevelZeroTables tables or
+// more on level 0, by a share of maxDelay growing linearly with the number of tables, up to
+// maxDelay for the last table accepted.
+func LinearL0StallPolicy(maxDelay time.Duration) L0StallPolicy {
+	return func(numTables, numLevelZeroTables, stallThreshold int) (bool, time.Duration) {
+		if numTables >= stallThreshold {
+			return false, 0
+		}
+		if numTables < numLevelZeroTables {
+			return true, 0
+		}
+		// Tables from numLevelZeroTables to stallThreshold-1 get 1/n to n/n of maxDelay.
+		n := stallThreshold - numLevelZeroTables
+		return true, maxDelay * time.Duration(numTables-numLevelZeroTables+1) / time.Duration(n)
+	}
+}
+
+// WithL0StallPolicy sets the policy deciding whether a memtable flush stalls, or is delayed, given
+// the number of tables on level 0. A nil policy is DefaultL0StallPolicy.
+//
+// The policy is called from the memtable flush, without any lock on the LSM tree held, so it can
+// read the state of the DB, for example with DB.Levels. It must not write to the DB or wait on a
+// write, as writes might themselves wait on the flush. The delays it returns are not counted as
+// stalls.
+//
+// The default value of L0StallPolicy is DefaultL0StallPolicy.
+func (opt Options) WithL0StallPolicy(policy L0StallPolicy) Options {
+	opt.L0StallPolicy = policy
+	return opt
+}
+
+// WithNumTableCloseWorkers sets the number of goroutines used to close the tables of each level
+// when the DB is closed. Closing thousands of tables one at a time can make shutdown slow. Values
+// less than one are treated as one.
+//
+// The default value of NumTableCloseWorkers is runtime.GOMAXPROCS(0).
+func (opt Options) WithNumTableCloseWorkers(val int) Options {
+	opt.NumTableCloseWorkers = val
+	return opt
+}
+
+// WithNumTableDeleteWorkers sets the number of goroutines used to drop the references a level
+// holds on the tables a compaction removed from it. Dropping the last reference deletes the table
+// file, which is slow on some filesystems, so large compactions can benefit from doing it
+// concurrently. A value of one or less releases the tables one at a time, stopping at the first
+// error.
+//
+// The default value of NumTableDeleteWorkers is 1.
+func (opt Options) WithNumTableDeleteWorkers(val int) Options {
+	opt.NumTableDeleteWorkers = val
+	return opt
+}
+
+// WithDiscardStatsInitialSize sets the size in bytes of the DISCARD file, which keeps the discard
+// stats of the value log files, when it is created. Each value log file takes an entry of 16 bytes,
+// and the file grows when it runs out of room, as set by WithDiscardStatsGrowthFactor and
+// WithDiscardStatsGrowthIncrement. A smaller file suits small deployments,
+// while a bigger one saves growing it on databases with many value log files. An existing smaller
+// file is grown to this size on open. The file starts with a header of 16 bytes, so val must be a
+// multiple of 16 of at least 32.
+//
+// The default value of DiscardStatsInitialSize is 1MB.
+func (opt Options) WithDiscardStatsInitialSize(val int64) Options {
+	opt.DiscardStatsInitialSize = val
+	return opt
+}
+
+// WithDiscardStatsGrowthFactor sets the factor by which the size of the DISCARD file is multiplied
+// when it runs out of room for new entries. Growing the file remaps it, which blocks the updates of
+// the discard stats, and a big growth makes the syncs which follow write more. A smaller factor
+// spreads the cost over more, smaller, growths on databases with many value log files. The new
+// size is rounded up to a multiple of 16, the size of an entry. val must be greater than 1. It is
+// ignored if DiscardStatsGrowthIncrement is set.
+//
+// The default value of DiscardStatsGrowthFactor is 2.
+func (opt Options) WithDiscardStatsGrowthFactor(val float64) Options {
+	opt.DiscardStatsGrowthFactor = val
+	return opt
+}
+
+// WithDiscardStatsGrowthIncrement makes the DISCARD file grow by val bytes when it runs out of room
+// for new entries, instead of by DiscardStatsGrowthFactor times its size. This bounds the cost of
+// each growth, at the price of more of them as the file gets bigger. val must be a multiple of 16,
+// the size of an entry. Zero uses DiscardStatsGrowthFactor.
+//
+// The default value of DiscardStatsGrowthIncrement is 0.
+func (opt Options) WithDiscardStatsGrowthIncrement(val int64) Options {
+	opt.DiscardStatsGrowthIncrement = val
+	return opt
+}
+
+// WithDiscardStatsCompactZeroRatio sets the fraction of discard stats slots with zero discard
+// above which the discard stats are compacted. A slot is reset to zero once value log GC has
+// rewritten its file, and compacting drops such slots. A value of zero disables compaction.
+//
+// The default value of DiscardStatsCompactZeroRatio is 0.
+func (opt Options) WithDiscardStatsCompactZeroRatio(val float64) Options {
+	opt.DiscardStatsCompactZeroRatio = val
+	return opt
+}
+
+// WithMaxConcurrentIteratorMemory sets the budget for the memory held by the iterators open at the
+// same time. Each iterator is estimated to hold one block of BlockSize bytes per table iterator it
+// merges: one per level 0 table and one per other level. Creating an iterator blocks until enough
+// of the budget is released by closing other iterators, so a goroutine must not wait on a new
+// iterator while it keeps others open. Iterators get the budget in the order they were created,
+// and one still waiting when the DB is closed panics with ErrDBClosed. A value of zero or less
+// puts no limit.
+//
+// The default value of MaxConcurrentIteratorMemory is 0.
+func (opt Options) WithMaxConcurrentIteratorMemory(val int64) Options {
+	opt.MaxConcurrentIteratorMemory = val
+	return opt
+}
+
+// WithMaxCompactionMemory sets the budget for the memory used by the compactions running at the
+// same time, so that several compactors picking big compactions at once don't make the memory use
+// spike. A compaction is estimated to use as much memory as the total size of its input tables,
+// which are read while the new tables are built. A compaction whose estimate doesn't fit in what
+// the running compactions leave of the budget gives its tables back, waits for its turn, and picks
+// its tables again. A compaction bigger than the whole budget runs alone. A value of zero or less
+// puts no limit.
+//
+// The default value of MaxCompactionMemory is 0.
+func (opt Options) WithMaxCompactionMemory(val int64) Options {
+	opt.MaxCompactionMemory = val
+	return opt
+}
+
+// WithTableEventLogSize sets the number of table events kept by the DB. Once the log is full, the
+// oldest events are dropped. A value of zero or less disables the log.
+//
+// The default value of TableEventLogSize is 1000.
+func (opt Options) WithTableEventLogSize(val int) Options {
+	opt.TableEventLogSize = val
+	return opt
+}
+
+// WithOnLevelEmptyChange sets a function to call when a level of the LSM tree loses its last table
+// (empty set to true), or gets its first table (empty set to false). The function is called from
+// the goroutine which changed the level, such as a compactor or the memtable flush, so it should
+// return quickly. Tables loaded when the DB is opened are not reported.
+//
+// The default value of OnLevelEmptyChange is nil.
+func (opt Options) WithOnLevelEmptyChange(f func(level int, empty bool)) Options {
+	opt.OnLevelEmptyChange = f
+	return opt
+}
+
+// WithOnLevelSizeChange sets a function to call with the total size and stale data size of a level
+// of the LSM tree, in bytes, after they changed, for example to throttle writes as levels grow. The
+// function is called from a single goroutine of its own, without any lock held, so it can call
+// into the DB, but must not close it. Changes made while a call is pending are coalesced, so the
+// function gets the latest sizes rather than each change. The sizes of the tables loaded when the
+// DB is opened are reported too.
+//
+// The default value of OnLevelSizeChange is nil.
+func (opt Options) WithOnLevelSizeChange(f func(level int, total, stale int64)) Options {
+	opt.OnLevelSizeChange = f
+	return opt
+}
+
 // WithBaseLevelSize sets the maximum size target for the base level.
 //
 // The default value is 10MB.
@@ -633,6 +925,38 @@ func (opt Options) WithCompactL0OnClose(val bool) Options {
 	return opt
 }
 
+// WithCompactionValueDedup returns a new Options value with CompactionValueDedup set to the given
+// value.
+//
+// When CompactionValueDedup is set, compactions read the value log values of the keys they
+// rewrite, and point the keys holding identical values at the first copy seen. The other copies
+// are then reclaimed by value log GC. This saves space on datasets with many duplicate large
+// values, at the cost of reading every value log value during compactions. A value log file holding
+// a shared copy is not garbage collected while other keys point into it. Such files are recorded
+// in the SHAREDVLOG file, and value log GC scans the LSM tree for the keys pointing into one of them
+// before rewriting it. The record outlives the option, so that turning it off is safe.
+//
+// The default value of CompactionValueDedup is false.
+func (opt Options) WithCompactionValueDedup(val bool) Options {
+	opt.CompactionValueDedup = val
+	return opt
+}
+
+// WithCompactStaleRatio returns a new Options value with CompactStaleRatio set to the given value.
+//
+// CompactStaleRatio makes compactions pick a level once the stale data of its tables, such as
+// older versions and deleted keys, makes up more than the given fraction of the level's size, even
+// if the level is within its target size. The tables with the most stale data are compacted first.
+// This reclaims space sooner on levels which are overwritten a lot but don't grow. Level 0, which
+// is compacted based on its number of tables, and the last level, which has LmaxCompaction, are
+// not affected.
+//
+// The default value of CompactStaleRatio is 0, which disables it.
+func (opt Options) WithCompactStaleRatio(val float64) Options {
+	opt.CompactStaleRatio = val
+	return opt
+}
+
 // WithEncryptionKey is used to encrypt the data with AES. Type of AES is used based on the key
 // size. For example 16 bytes will use AES-128. 24 bytes will use AES-192. 32 bytes will
 // use AES-256.
@@ -673,6 +997,52 @@ func (opt Options) WithVerifyValueChecksum(val bool) Options {
 	return opt
 }
 
+// WithVerifyInvariantsOnOpen returns a new Options value with VerifyInvariantsOnOpen set to the
+// given value.
+//
+// Open always checks that the tables of the levels other than level 0 are sorted by key and don't
+// overlap. When VerifyInvariantsOnOpen is set, Open also checks that the tables of level 0 were
+// added to the manifest in increasing order of file ID, that the smallest key of every table, on
+// every level, is no greater than its biggest key, and that the versions of those keys are no
+// greater than the max version of the table. Open fails with a descriptive error if any of
+// these invariants is violated, instead of the corruption being discovered later during reads or
+// compactions.
+//
+// The default value of VerifyInvariantsOnOpen is false.
+func (opt Options) WithVerifyInvariantsOnOpen(val bool) Options {
+	opt.VerifyInvariantsOnOpen = val
+	return opt
+}
+
+// WithVerifyTableDeletes returns a new Options value with VerifyTableDeletes set to the given value.
+//
+// When VerifyTableDeletes is set, a compaction, or any other change of the tables of a level, fails
+// if one of the tables it removes is not in the level, or is removed twice, instead of these
+// tables being skipped. Such a change means that the same table was picked by two changes, which
+// is a bug, and would otherwise go unnoticed until it corrupts the level. The level and the
+// MANIFEST are left as they were. This is meant for tests and debugging.
+//
+// The default value of VerifyTableDeletes is false.
+func (opt Options) WithVerifyTableDeletes(val bool) Options {
+	opt.VerifyTableDeletes = val
+	return opt
+}
+
+// WithVerifyTableOverlaps returns a new Options value with VerifyTableOverlaps set to the given
+// value.
+//
+// When VerifyTableOverlaps is set, a compaction fails if the tables it leaves in a level other than
+// level 0 overlap. Reads binary search the tables of those levels for the only one which can hold a
+// key, so overlapping tables would silently hide some versions of the keys. The level and the
+// MANIFEST are left as they were. This is meant for tests and debugging, as it looks at all the
+// tables of the level.
+//
+// The default value of VerifyTableOverlaps is false.
+func (opt Options) WithVerifyTableOverlaps(val bool) Options {
+	opt.VerifyTableOverlaps = val
+	return opt
+}
+
 // WithChecksumVerificationMode returns a new Options value with ChecksumVerificationMode set to
 // the given value.
 //
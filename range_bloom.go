@@ -0,0 +1,80 @@
+/*
+ * Copyright 2023 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v4/y"
+)
+
+// RangeBloom is a bloom filter over the keys present in a key range at the time it was built.
+// It can be queried without touching the DB. It may report false positives, but never false
+// negatives for keys which were present when the filter was built.
+type RangeBloom struct {
+	filter  y.Filter
+	numKeys int
+}
+
+// MightContainKey returns false if the key was definitely not present in the range when the
+// filter was built.
+func (rb *RangeBloom) MightContainKey(key []byte) bool {
+	return rb.filter.MayContainKey(key)
+}
+
+// NumKeys returns the number of keys the filter was built from.
+func (rb *RangeBloom) NumKeys() int {
+	return rb.numKeys
+}
+
+// BuildRangeBloom scans the keys in [start, end) once, without fetching values, and returns a
+// bloom filter over them. A nil end means the scan runs to the last key. Only keys visible to a
+// read-only transaction are included, so deleted and expired keys are left out. The false
+// positive rate is Options.BloomFalsePositive, or 1% if bloom filters are disabled.
+func (db *DB) BuildRangeBloom(start, end []byte) (*RangeBloom, error) {
+	var hashes []uint32
+	err := db.View(func(txn *Txn) error {
+		opt := DefaultIteratorOptions
+		opt.PrefetchValues = false
+		it := txn.NewIterator(opt)
+		defer it.Close()
+
+		for it.Seek(start); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			if end != nil && bytes.Compare(key, end) >= 0 {
+				break
+			}
+			hashes = append(hashes, y.Hash(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rb := &RangeBloom{numKeys: len(hashes)}
+	if len(hashes) == 0 {
+		// An empty filter never matches.
+		return rb, nil
+	}
+	fp := db.opt.BloomFalsePositive
+	if fp <= 0 || fp >= 1 {
+		fp = 0.01
+	}
+	rb.filter = y.NewFilter(hashes, y.BloomBitsPerKey(len(hashes), fp))
+	return rb, nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2023 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildRangeBloom(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := func(prefix string, i int) []byte {
+			return []byte(fmt.Sprintf("%s%04d", prefix, i))
+		}
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 1000; i++ {
+				for _, prefix := range []string{"a", "b", "c"} {
+					if err := txn.Set(key(prefix, i), []byte("val")); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}))
+		txnDelete(t, db, key("b", 7))
+
+		rb, err := db.BuildRangeBloom([]byte("b"), []byte("c"))
+		require.NoError(t, err)
+		require.Equal(t, 999, rb.NumKeys())
+		var falsePositives int
+		for i := 0; i < 1000; i++ {
+			if i != 7 {
+				require.True(t, rb.MightContainKey(key("b", i)), "key %d", i)
+			}
+			for _, prefix := range []string{"a", "c"} {
+				if rb.MightContainKey(key(prefix, i)) {
+					falsePositives++
+				}
+			}
+		}
+		// The default false positive rate is 1%, leave plenty of slack.
+		require.Less(t, falsePositives, 100)
+
+		rb, err = db.BuildRangeBloom([]byte("x"), nil)
+		require.NoError(t, err)
+		require.Zero(t, rb.NumKeys())
+		require.False(t, rb.MightContainKey(key("a", 1)))
+	})
+}
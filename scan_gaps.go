@@ -0,0 +1,76 @@
+/*
+ * Copyright 2023 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// keyDistance returns how far apart two keys are, taking their first 8 bytes as a big-endian
+// number. Shorter keys are padded with zeros, and bytes past the first 8 are ignored.
+func keyDistance(a, b []byte) uint64 {
+	prefix := func(key []byte) uint64 {
+		var buf [8]byte
+		copy(buf[:], key)
+		return binary.BigEndian.Uint64(buf[:])
+	}
+	pa, pb := prefix(a), prefix(b)
+	if pa > pb {
+		return pa - pb
+	}
+	return pb - pa
+}
+
+// ScanGaps scans the keys in [start, end) and calls f for each pair of consecutive keys more than
+// minGap apart, with gapStart and gapEnd set to those keys. The distance between two keys is the
+// difference of their first 8 bytes, read as big-endian numbers, which suits keys made of fixed
+// width integers. A non-empty start and a non-nil end bound the first and the last gap. Only keys
+// visible to a read-only transaction are taken into account, so deleted and expired keys count as
+// missing. The keys passed to f are only valid during the call.
+func (db *DB) ScanGaps(start, end []byte, minGap int, f func(gapStart, gapEnd []byte)) error {
+	return db.View(func(txn *Txn) error {
+		opt := DefaultIteratorOptions
+		opt.PrefetchValues = false
+		it := txn.NewIterator(opt)
+		defer it.Close()
+
+		report := func(lo, hi []byte) {
+			if minGap < 0 || keyDistance(lo, hi) > uint64(minGap) {
+				f(lo, hi)
+			}
+		}
+		var prev []byte
+		if len(start) > 0 {
+			prev = start
+		}
+		for it.Seek(start); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			if end != nil && bytes.Compare(key, end) >= 0 {
+				break
+			}
+			if prev != nil && !bytes.Equal(prev, key) {
+				report(prev, key)
+			}
+			prev = it.Item().KeyCopy(nil)
+		}
+		if prev != nil && end != nil {
+			report(prev, end)
+		}
+		return nil
+	})
+}
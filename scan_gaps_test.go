@@ -0,0 +1,67 @@
+/*
+ * Copyright 2023 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanGaps(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := func(i uint64) []byte {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], i)
+			return k[:]
+		}
+		num := func(k []byte) uint64 { return binary.BigEndian.Uint64(k) }
+
+		// Dense runs at 10-14 and 100-104, and lone keys at 50 and 1000.
+		var keys []uint64
+		for i := uint64(10); i < 15; i++ {
+			keys = append(keys, i, i+90)
+		}
+		keys = append(keys, 50, 1000)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for _, k := range keys {
+				if err := txn.Set(key(k), []byte("val")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		// Deleted keys leave a gap behind.
+		txnDelete(t, db, key(50))
+
+		type gap struct{ lo, hi uint64 }
+		scan := func(start, end []byte, minGap int) []gap {
+			var gaps []gap
+			require.NoError(t, db.ScanGaps(start, end, minGap, func(lo, hi []byte) {
+				gaps = append(gaps, gap{num(lo), num(hi)})
+			}))
+			return gaps
+		}
+		require.Equal(t, []gap{{14, 100}, {104, 1000}}, scan(nil, nil, 10))
+		require.Equal(t, []gap{{104, 1000}}, scan(nil, nil, 86))
+		require.Equal(t, []gap{{0, 10}, {14, 100}, {104, 1000}, {1000, 2000}},
+			scan(key(0), key(2000), 5))
+		require.Empty(t, scan(key(11), key(14), 1))
+		require.Equal(t, []gap{{200, 1000}, {1000, 1200}}, scan(key(200), key(1200), 100))
+	})
+}
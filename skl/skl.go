@@ -518,5 +518,8 @@ func (s *UniIterator) Value() y.ValueStruct { return s.iter.Value() }
 // Valid implements y.Interface
 func (s *UniIterator) Valid() bool { return s.iter.Valid() }
 
+// Reversed implements y.DirectedIterator.
+func (s *UniIterator) Reversed() bool { return s.reversed }
+
 // Close implements y.Interface (and frees up the iter's resources)
 func (s *UniIterator) Close() error { return s.iter.Close() }
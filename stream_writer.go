@@ -366,6 +366,7 @@ func (sw *StreamWriter) newWriter(streamID uint32) (*sortedWriter, error) {
 	for i := 2; i < sw.db.opt.MaxLevels; i++ {
 		bopts.TableSize *= uint64(sw.db.opt.TableSizeMultiplier)
 	}
+	bopts.BloomFalsePositive = sw.db.opt.bloomFalsePositive(sw.prevLevel - 1)
 	w := &sortedWriter{
 		db:       sw.db,
 		opts:     bopts,
@@ -87,8 +87,11 @@ type Builder struct {
 	keyHashes     []uint32 // Used for building the bloomfilter.
 	opts          *Options
 	maxVersion    uint64
+	minVersion    uint64
 	onDiskSize    uint32
 	staleDataSize int
+	numTombstones uint32
+	minExpiresAt  uint64 // Smallest non-zero ExpiresAt, or zero if none of the entries expires.
 
 	// Used to concurrently compress/encrypt blocks.
 	wg        sync.WaitGroup
@@ -220,9 +223,19 @@ func (b *Builder) keyDiff(newKey []byte) []byte {
 func (b *Builder) addHelper(key []byte, v y.ValueStruct, vpLen uint32) {
 	b.keyHashes = append(b.keyHashes, y.Hash(y.ParseKey(key)))
 
-	if version := y.ParseTs(key); version > b.maxVersion {
+	version := y.ParseTs(key)
+	if version > b.maxVersion {
 		b.maxVersion = version
 	}
+	if len(b.keyHashes) == 1 || version < b.minVersion {
+		b.minVersion = version
+	}
+	if v.Meta&b.opts.TombstoneMeta != 0 {
+		b.numTombstones++
+	}
+	if v.ExpiresAt > 0 && (b.minExpiresAt == 0 || v.ExpiresAt < b.minExpiresAt) {
+		b.minExpiresAt = v.ExpiresAt
+	}
 
 	// diffKey stores the difference of key with baseKey.
 	var diffKey []byte
@@ -561,6 +574,14 @@ func (b *Builder) buildIndex(bloom []byte) ([]byte, uint32) {
 	fb.TableIndexAddKeyCount(builder, uint32(len(b.keyHashes)))
 	fb.TableIndexAddOnDiskSize(builder, b.onDiskSize)
 	fb.TableIndexAddStaleDataSize(builder, uint32(b.staleDataSize))
+	fb.TableIndexAddMinVersion(builder, b.minVersion)
+	fb.TableIndexAddTombstoneCount(builder, b.numTombstones)
+	// Zero is left to tables written before the field was added, see Table.MinExpiresAt.
+	minExpiresAt := b.minExpiresAt
+	if minExpiresAt == 0 {
+		minExpiresAt = math.MaxUint64
+	}
+	fb.TableIndexAddMinExpiresAt(builder, minExpiresAt)
 	builder.Finish(fb.TableIndexEnd(builder))
 
 	buf := builder.FinishedBytes()
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2023 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v4/y"
+)
+
+// HeapMergeIterator merges multiple iterators using a single min-heap (max-heap when reversed) of
+// the valid iterators, instead of the tree of 2-way merges built by NewMergeIterator. It returns
+// the same keys and values as a MergeIterator over the same iterators: when several iterators hold
+// the same key, it is returned from the one which comes first in the list of iterators, and the
+// copies held by the others are skipped.
+// NOTE: HeapMergeIterator owns the array of iterators and is responsible for closing them.
+type HeapMergeIterator struct {
+	all  []heapNode
+	heap []*heapNode // The valid iterators, with the smallest key at index 0.
+
+	curKey  []byte
+	reverse bool
+}
+
+type heapNode struct {
+	iter y.Iterator
+	key  []byte
+	idx  int // Position of the iterator in the list of iterators, to break ties.
+}
+
+// less returns true if a comes before b in iteration order.
+func (mi *HeapMergeIterator) less(a, b *heapNode) bool {
+	cmp := y.CompareKeys(a.key, b.key)
+	if cmp == 0 {
+		return a.idx < b.idx
+	}
+	if mi.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (mi *HeapMergeIterator) down(i int) {
+	h := mi.heap
+	for {
+		smallest := i
+		if l := 2*i + 1; l < len(h) && mi.less(h[l], h[smallest]) {
+			smallest = l
+		}
+		if r := 2*i + 2; r < len(h) && mi.less(h[r], h[smallest]) {
+			smallest = r
+		}
+		if smallest == i {
+			return
+		}
+		h[i], h[smallest] = h[smallest], h[i]
+		i = smallest
+	}
+}
+
+// init rebuilds the heap from the iterators, after they have all been repositioned.
+func (mi *HeapMergeIterator) init() {
+	mi.heap = mi.heap[:0]
+	for i := range mi.all {
+		n := &mi.all[i]
+		if n.iter.Valid() {
+			n.key = n.iter.Key()
+			mi.heap = append(mi.heap, n)
+		}
+	}
+	for i := len(mi.heap)/2 - 1; i >= 0; i-- {
+		mi.down(i)
+	}
+	mi.setCurrent()
+}
+
+// advance moves the iterator at the top of the heap to its next key.
+func (mi *HeapMergeIterator) advance() {
+	top := mi.heap[0]
+	top.iter.Next()
+	if top.iter.Valid() {
+		top.key = top.iter.Key()
+	} else {
+		last := len(mi.heap) - 1
+		mi.heap[0] = mi.heap[last]
+		mi.heap = mi.heap[:last]
+	}
+	mi.down(0)
+}
+
+func (mi *HeapMergeIterator) setCurrent() {
+	if mi.Valid() {
+		mi.curKey = append(mi.curKey[:0], mi.heap[0].key...)
+	}
+}
+
+// Next returns the next element. The copies of the current key held by the other iterators are
+// skipped.
+func (mi *HeapMergeIterator) Next() {
+	for mi.Valid() && bytes.Equal(mi.heap[0].key, mi.curKey) {
+		mi.advance()
+	}
+	mi.setCurrent()
+}
+
+// Rewind seeks to first element (or last element for reverse iterator).
+func (mi *HeapMergeIterator) Rewind() {
+	for i := range mi.all {
+		mi.all[i].iter.Rewind()
+	}
+	mi.init()
+}
+
+// Seek brings us to element with key >= given key.
+func (mi *HeapMergeIterator) Seek(key []byte) {
+	for i := range mi.all {
+		mi.all[i].iter.Seek(key)
+	}
+	mi.init()
+}
+
+// Valid returns whether the HeapMergeIterator is at a valid element.
+func (mi *HeapMergeIterator) Valid() bool {
+	return len(mi.heap) > 0
+}
+
+// Key returns the key associated with the current iterator.
+func (mi *HeapMergeIterator) Key() []byte {
+	return mi.heap[0].key
+}
+
+// Value returns the value associated with the iterator.
+func (mi *HeapMergeIterator) Value() y.ValueStruct {
+	return mi.heap[0].iter.Value()
+}
+
+// CurrentSource returns the position, in the list of iterators the HeapMergeIterator was created
+// with, of the iterator holding the current key. It returns -1 if the iterator is not valid.
+func (mi *HeapMergeIterator) CurrentSource() int {
+	if !mi.Valid() {
+		return -1
+	}
+	return mi.heap[0].idx
+}
+
+// Reversed implements y.DirectedIterator.
+func (mi *HeapMergeIterator) Reversed() bool {
+	return mi.reverse
+}
+
+// Close implements y.Iterator. It closes all the iterators, and returns the first error.
+func (mi *HeapMergeIterator) Close() error {
+	var err error
+	for i := range mi.all {
+		if closeErr := mi.all[i].iter.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return y.Wrap(err, "HeapMergeIterator")
+}
+
+// NewMergeIteratorHeap creates a merge iterator which keeps iters in a heap, which takes fewer
+// comparisons and calls per key than NewMergeIterator when merging many iterators. As with
+// NewMergeIterator, a single iterator is returned as is, and iters must all go in the direction
+// given by reverse.
+func NewMergeIteratorHeap(iters []y.Iterator, reverse bool) y.Iterator {
+	checkDirections(iters, reverse)
+	switch len(iters) {
+	case 0:
+		return nil
+	case 1:
+		return iters[0]
+	}
+	mi := &HeapMergeIterator{
+		all:     make([]heapNode, len(iters)),
+		heap:    make([]*heapNode, 0, len(iters)),
+		reverse: reverse,
+	}
+	for i, it := range iters {
+		mi.all[i] = heapNode{iter: it, idx: i}
+	}
+	return mi
+}
@@ -38,6 +38,8 @@ type blockIterator struct {
 
 	tableID uint64
 	blockID int
+	// keysOnly skips slicing out the values, which are then empty.
+	keysOnly bool
 	// prevOverlap stores the overlap of the previous key with the base key.
 	// This avoids unnecessary copy of base key when the overlap is same for multiple keys.
 	prevOverlap uint16
@@ -111,7 +113,9 @@ func (itr *blockIterator) setIdx(i int) {
 	valueOff := headerSize + h.diff
 	diffKey := entryData[headerSize:valueOff]
 	itr.key = append(itr.key[:h.overlap], diffKey...)
-	itr.val = entryData[valueOff:]
+	if !itr.keysOnly {
+		itr.val = entryData[valueOff:]
+	}
 }
 
 func (itr *blockIterator) Valid() bool {
@@ -181,16 +185,22 @@ type Iterator struct {
 
 	// Internally, Iterator is bidirectional. However, we only expose the
 	// unidirectional functionality for now.
-	opt int // Valid options are REVERSED and NOCACHE.
+	opt int // Valid options are REVERSED, NOCACHE and KEYSONLY.
 }
 
 // NewIterator returns a new iterator of the Table
 func (t *Table) NewIterator(opt int) *Iterator {
 	t.IncrRef() // Important.
 	ti := &Iterator{t: t, opt: opt}
+	ti.bi.keysOnly = opt&KEYSONLY > 0
 	return ti
 }
 
+// Reversed implements y.DirectedIterator.
+func (itr *Iterator) Reversed() bool {
+	return itr.opt&REVERSED > 0
+}
+
 // Close closes the iterator (and it must be called).
 func (itr *Iterator) Close() error {
 	itr.bi.Close()
@@ -386,8 +396,12 @@ func (itr *Iterator) Key() []byte {
 	return itr.bi.key
 }
 
-// Value follows the y.Iterator interface
+// Value follows the y.Iterator interface. It returns an empty ValueStruct for a KEYSONLY
+// iterator.
 func (itr *Iterator) Value() (ret y.ValueStruct) {
+	if itr.bi.keysOnly {
+		return
+	}
 	ret.Decode(itr.bi.val)
 	return
 }
@@ -395,6 +409,9 @@ func (itr *Iterator) Value() (ret y.ValueStruct) {
 // ValueCopy copies the current value and returns it as decoded
 // ValueStruct.
 func (itr *Iterator) ValueCopy() (ret y.ValueStruct) {
+	if itr.bi.keysOnly {
+		return
+	}
 	dst := y.Copy(itr.bi.val)
 	ret.Decode(dst)
 	return
@@ -430,6 +447,9 @@ func (itr *Iterator) Seek(key []byte) {
 var (
 	REVERSED int = 2
 	NOCACHE  int = 4
+	// KEYSONLY iterates over the keys without reading the values, which are returned empty. It's
+	// meant for scans which only care about keys, such as counting them or finding key ranges.
+	KEYSONLY int = 8
 )
 
 // ConcatIterator concatenates the sequences defined by several iterators.  (It only works with
@@ -439,7 +459,11 @@ type ConcatIterator struct {
 	cur     *Iterator
 	iters   []*Iterator // Corresponds to tables.
 	tables  []*Table    // Disregarding reversed, this is in ascending order.
-	options int         // Valid options are REVERSED and NOCACHE.
+	options int         // Valid options are REVERSED, NOCACHE and KEYSONLY.
+
+	// bound, if set, is the user key at which iteration stops, set by a MergeIterator above. Tables
+	// entirely past it are not opened.
+	bound []byte
 }
 
 // NewConcatIterator creates a new concatenated iterator
@@ -461,9 +485,39 @@ func NewConcatIterator(tbls []*Table, opt int) *ConcatIterator {
 	}
 }
 
+// NewIteratorOverTables returns a single iterator over tables, which must be sorted by their
+// smallest key and must not overlap, as is the case for the tables of a level other than 0. The
+// tables are referenced until the iterator is closed.
+func NewIteratorOverTables(tables []*Table, reverse bool) y.Iterator {
+	var opt int
+	if reverse {
+		opt = REVERSED
+	}
+	// Take a copy, so that the caller can reuse the slice.
+	tbls := make([]*Table, len(tables))
+	copy(tbls, tables)
+	return NewConcatIterator(tbls, opt)
+}
+
+// setBound sets the user key past which tables are not opened: their smallest key is at or after
+// it, or their biggest key before it when reversed. A nil bound opens all tables.
+func (s *ConcatIterator) setBound(bound []byte) {
+	s.bound = bound
+}
+
+func (s *ConcatIterator) pastBound(idx int) bool {
+	if s.bound == nil {
+		return false
+	}
+	if s.options&REVERSED == 0 {
+		return bytes.Compare(y.ParseKey(s.tables[idx].Smallest()), s.bound) >= 0
+	}
+	return bytes.Compare(y.ParseKey(s.tables[idx].Biggest()), s.bound) < 0
+}
+
 func (s *ConcatIterator) setIdx(idx int) {
 	s.idx = idx
-	if idx < 0 || idx >= len(s.iters) {
+	if idx < 0 || idx >= len(s.iters) || s.pastBound(idx) {
 		s.cur = nil
 		return
 	}
@@ -483,7 +537,9 @@ func (s *ConcatIterator) Rewind() {
 	} else {
 		s.setIdx(len(s.iters) - 1)
 	}
-	s.cur.Rewind()
+	if s.cur != nil {
+		s.cur.Rewind()
+	}
 }
 
 // Valid implements y.Interface
@@ -521,7 +577,9 @@ func (s *ConcatIterator) Seek(key []byte) {
 	// For reversed=false, we know s.tables[i-1].Biggest() < key. Thus, the
 	// previous table cannot possibly contain key.
 	s.setIdx(idx)
-	s.cur.Seek(key)
+	if s.cur != nil {
+		s.cur.Seek(key)
+	}
 }
 
 // Next advances our concat iterator.
@@ -548,6 +606,32 @@ func (s *ConcatIterator) Next() {
 	}
 }
 
+// EstimatedCount returns the number of entries in the tables of the ConcatIterator, as recorded in
+// their indexes. It is an upper bound of the entries iteration returns, as it ignores the bound
+// and the position of the iterator. It doesn't move the iterator.
+func (s *ConcatIterator) EstimatedCount() uint64 {
+	var count uint64
+	for _, t := range s.tables {
+		count += uint64(t.KeyCount())
+	}
+	return count
+}
+
+// EstimatedSize returns the total size of the tables of the ConcatIterator, in bytes. Like
+// EstimatedCount, it ignores the bound and the position of the iterator, and doesn't move it.
+func (s *ConcatIterator) EstimatedSize() int64 {
+	var size int64
+	for _, t := range s.tables {
+		size += t.Size()
+	}
+	return size
+}
+
+// Reversed implements y.DirectedIterator.
+func (s *ConcatIterator) Reversed() bool {
+	return s.options&REVERSED > 0
+}
+
 // Close implements y.Interface.
 func (s *ConcatIterator) Close() error {
 	for _, t := range s.tables {
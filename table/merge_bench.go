@@ -0,0 +1,126 @@
+/*
+ * Copyright 2023 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4/y"
+)
+
+// BenchmarkMerge runs full scans over a MergeIterator built from numIters synthetic iterators
+// holding entriesPer keys each. Keys are interleaved across the iterators, so that the merge has
+// to pick a new winner on every Next. Even numbered iterators are ConcatIterators and odd numbered
+// ones are nested MergeIterators, which exercises both the type asserted paths in node. Every scan
+// checks that all the keys were returned, and the first scan also checks their order. It lives
+// outside of the test files so that other packages can run it, to track merge throughput across
+// versions.
+func BenchmarkMerge(b *testing.B, numIters, entriesPer int, reverse bool) {
+	y.AssertTrue(numIters > 0 && entriesPer > 0)
+
+	opts := &Options{BlockSize: 4 * 1024, BloomFalsePositive: 0.01}
+	var fileID uint64
+	var all []*Table
+	buildTable := func(ids []int) *Table {
+		builder := NewTableBuilder(*opts)
+		defer builder.Close()
+		for _, id := range ids {
+			k := y.KeyWithTs([]byte(fmt.Sprintf("%016x", id)), 1)
+			builder.Add(k, y.ValueStruct{Value: []byte(fmt.Sprintf("%d", id))}, 0)
+		}
+		fileID++
+		tbl, err := OpenInMemoryTable(builder.Finish(), fileID, opts)
+		if err != nil {
+			b.Fatalf("while opening table: %v", err)
+		}
+		all = append(all, tbl)
+		return tbl
+	}
+	defer func() {
+		for _, tbl := range all {
+			_ = tbl.DecrRef()
+		}
+	}()
+
+	// Each leaf gets two tables. A ConcatIterator needs non-overlapping tables, so its keys are
+	// split in halves. A nested MergeIterator gets overlapping tables, split by parity.
+	leaves := make([][]*Table, numIters)
+	for i := range leaves {
+		var first, second []int
+		for j := 0; j < entriesPer; j++ {
+			id := j*numIters + i
+			switch {
+			case i%2 == 0 && j < entriesPer/2, i%2 == 1 && j%2 == 0:
+				first = append(first, id)
+			default:
+				second = append(second, id)
+			}
+		}
+		for _, ids := range [][]int{first, second} {
+			if len(ids) > 0 {
+				leaves[i] = append(leaves[i], buildTable(ids))
+			}
+		}
+	}
+
+	var topt int
+	if reverse {
+		topt = REVERSED
+	}
+	newIterator := func() y.Iterator {
+		iters := make([]y.Iterator, 0, numIters)
+		for i, leaf := range leaves {
+			switch {
+			case len(leaf) == 1:
+				iters = append(iters, leaf[0].NewIterator(topt))
+			case i%2 == 0:
+				iters = append(iters, NewConcatIterator(leaf, topt))
+			default:
+				iters = append(iters, NewMergeIterator([]y.Iterator{
+					leaf[0].NewIterator(topt), leaf[1].NewIterator(topt)}, reverse))
+			}
+		}
+		return NewMergeIterator(iters, reverse)
+	}
+
+	expected := numIters * entriesPer
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := newIterator()
+		var count int
+		var prev []byte
+		for it.Rewind(); it.Valid(); it.Next() {
+			if i == 0 {
+				if prev != nil {
+					cmp := y.CompareKeys(prev, it.Key())
+					if (!reverse && cmp >= 0) || (reverse && cmp <= 0) {
+						b.Fatalf("keys out of order: %x followed by %x", prev, it.Key())
+					}
+				}
+				prev = append(prev[:0], it.Key()...)
+			}
+			count++
+		}
+		if err := it.Close(); err != nil {
+			b.Fatalf("while closing iterator: %v", err)
+		}
+		if count != expected {
+			b.Fatalf("got %d keys, want %d", count, expected)
+		}
+	}
+}
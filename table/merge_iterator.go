@@ -18,6 +18,8 @@ package table
 
 import (
 	"bytes"
+	"fmt"
+	"sync"
 
 	"github.com/dgraph-io/badger/v4/y"
 )
@@ -31,6 +33,22 @@ type MergeIterator struct {
 
 	curKey  []byte
 	reverse bool
+	// priority makes keys compare equal irrespective of their versions, so that on equal keys the
+	// left iterator (earlier in the list of sources) always wins.
+	priority bool
+	// allVersions returns the keys equal to the current one too, instead of skipping them.
+	allVersions bool
+	// lazy is set if any of the sources is a lazyTableIterator.
+	lazy bool
+	// bound, if set, is the user key at which iteration stops. See SetBound.
+	bound []byte
+	// pooled is set if the MergeIterator comes from mergeIteratorPool.
+	pooled bool
+	// numSources is the number of iterators merged, used to number the ones added by AddIterator.
+	numSources int
+	// compare, if set, orders the user keys instead of bytes.Compare. See
+	// NewMergeIteratorWithComparator.
+	compare func(a, b []byte) int
 }
 
 type node struct {
@@ -43,6 +61,13 @@ type node struct {
 	// interface's function.
 	merge  *MergeIterator
 	concat *ConcatIterator
+	lazy   *lazyTableIterator
+	table  *Iterator
+
+	// source is the position in the list of iterators given to the constructor of the iterator
+	// below the node, or -1 if it is a MergeIterator built by the constructor to merge several of
+	// them.
+	source int
 }
 
 func (n *node) setIterator(iter y.Iterator) {
@@ -51,6 +76,8 @@ func (n *node) setIterator(iter y.Iterator) {
 	// We handle the nil values of merge and concat in all the methods.
 	n.merge, _ = iter.(*MergeIterator)
 	n.concat, _ = iter.(*ConcatIterator)
+	n.lazy, _ = iter.(*lazyTableIterator)
+	n.table, _ = iter.(*Iterator)
 }
 
 func (n *node) setKey() {
@@ -73,10 +100,23 @@ func (n *node) setKey() {
 	}
 }
 
+func (n *node) value() y.ValueStruct {
+	switch {
+	case n.merge != nil:
+		return n.merge.small.value()
+	case n.concat != nil:
+		return n.concat.cur.Value()
+	case n.table != nil:
+		return n.table.Value()
+	default:
+		return n.iter.Value()
+	}
+}
+
 func (n *node) next() {
 	switch {
 	case n.merge != nil:
-		n.merge.Next()
+		n.merge.next()
 	case n.concat != nil:
 		n.concat.Next()
 	default:
@@ -85,13 +125,53 @@ func (n *node) next() {
 	n.setKey()
 }
 
+// The merge and lazy iterators below a node are not resolved on rewind, seek and next. Their key
+// can be a lower bound of the actual key, until resolve is called.
 func (n *node) rewind() {
-	n.iter.Rewind()
+	switch {
+	case n.merge != nil:
+		n.merge.rewind()
+	case n.lazy != nil:
+		n.lazy.deferSeek(nil)
+	default:
+		n.iter.Rewind()
+	}
 	n.setKey()
 }
 
 func (n *node) seek(key []byte) {
-	n.iter.Seek(key)
+	switch {
+	case n.merge != nil:
+		n.merge.seek(key)
+	case n.lazy != nil:
+		n.lazy.deferSeek(key)
+	default:
+		n.iter.Seek(key)
+	}
+	n.setKey()
+}
+
+// pending returns true if the key of the node is a bound, and not the actual key.
+func (n *node) pending() bool {
+	switch {
+	case !n.valid:
+		return false
+	case n.lazy != nil:
+		return n.lazy.it == nil
+	case n.merge != nil:
+		return n.merge.lazy && n.merge.small.pending()
+	}
+	return false
+}
+
+// resolve positions the iterator below the node at its actual key.
+func (n *node) resolve() {
+	switch {
+	case n.lazy != nil:
+		n.lazy.open()
+	case n.merge != nil:
+		n.merge.resolve()
+	}
 	n.setKey()
 }
 
@@ -103,10 +183,34 @@ func (mi *MergeIterator) fix() {
 		mi.swapSmall()
 		return
 	}
-	cmp := y.CompareKeys(mi.small.key, mi.bigger().key)
+	var cmp int
+	if mi.priority {
+		cmp = mi.compareUserKeys(y.ParseKey(mi.small.key), y.ParseKey(mi.bigger().key))
+	} else {
+		cmp = mi.compareKeys(mi.small.key, mi.bigger().key)
+	}
 	switch {
+	case cmp == 0 && mi.lazy && (mi.left.pending() || mi.right.pending()):
+		// A bound equal to the other key tells nothing about which one is smaller.
+		if mi.left.pending() {
+			mi.left.resolve()
+		}
+		if mi.right.pending() {
+			mi.right.resolve()
+		}
+		mi.fix()
+		return
+	case cmp == 0 && mi.allVersions:
+		// Both keys are returned, the one from the left iterator first.
+		if mi.small != &mi.left {
+			mi.swapSmall()
+		}
+		return
 	case cmp == 0: // Both the keys are equal.
-		// In case of same keys, move the right iterator ahead.
+		// In case of same keys, move the right iterator ahead. This holds in reverse too: the left
+		// iterator comes first in the list of iterators and wins whatever the direction, and next
+		// moves the right one to its previous key. Different versions of a key don't compare
+		// equal, and come in the reverse order of their versions when reversed.
 		mi.right.next()
 		if &mi.right == mi.small {
 			mi.swapSmall()
@@ -130,6 +234,25 @@ func (mi *MergeIterator) fix() {
 	}
 }
 
+// compareKeys is y.CompareKeys, with the user keys ordered by mi.compare if set. Versions of the
+// same key are ordered by decreasing version in any case.
+func (mi *MergeIterator) compareKeys(a, b []byte) int {
+	if mi.compare == nil {
+		return y.CompareKeys(a, b)
+	}
+	if cmp := mi.compare(y.ParseKey(a), y.ParseKey(b)); cmp != 0 {
+		return cmp
+	}
+	return bytes.Compare(a[len(a)-8:], b[len(b)-8:])
+}
+
+func (mi *MergeIterator) compareUserKeys(a, b []byte) int {
+	if mi.compare == nil {
+		return bytes.Compare(a, b)
+	}
+	return mi.compare(a, b)
+}
+
 func (mi *MergeIterator) bigger() *node {
 	if mi.small == &mi.left {
 		return &mi.right
@@ -150,22 +273,64 @@ func (mi *MergeIterator) swapSmall() {
 
 // Next returns the next element. If it is the same as the current key, ignore it.
 func (mi *MergeIterator) Next() {
+	mi.next()
+	mi.resolve()
+}
+
+func (mi *MergeIterator) next() {
+	if mi.allVersions {
+		if mi.Valid() {
+			mi.small.next()
+			mi.fix()
+		}
+		mi.setCurrent()
+		return
+	}
 	for mi.Valid() {
-		if !bytes.Equal(mi.small.key, mi.curKey) {
+		if !mi.isCurKey(mi.small.key) {
 			break
 		}
-		mi.small.next()
+		if mi.small.pending() {
+			mi.small.resolve()
+		} else {
+			mi.small.next()
+		}
+		mi.fix()
+	}
+	mi.setCurrent()
+}
+
+// resolve makes sure that the smallest iterator is at its actual key, opening lazy iterators until
+// the one holding the smallest key is found.
+func (mi *MergeIterator) resolve() {
+	if !mi.lazy || !mi.small.pending() {
+		return
+	}
+	for mi.small.pending() {
+		mi.small.resolve()
 		mi.fix()
 	}
 	mi.setCurrent()
 }
 
+func (mi *MergeIterator) isCurKey(key []byte) bool {
+	if mi.priority {
+		return bytes.Equal(y.ParseKey(key), y.ParseKey(mi.curKey))
+	}
+	return bytes.Equal(key, mi.curKey)
+}
+
 func (mi *MergeIterator) setCurrent() {
 	mi.curKey = append(mi.curKey[:0], mi.small.key...)
 }
 
 // Rewind seeks to first element (or last element for reverse iterator).
 func (mi *MergeIterator) Rewind() {
+	mi.rewind()
+	mi.resolve()
+}
+
+func (mi *MergeIterator) rewind() {
 	mi.left.rewind()
 	mi.right.rewind()
 	mi.fix()
@@ -174,15 +339,137 @@ func (mi *MergeIterator) Rewind() {
 
 // Seek brings us to element with key >= given key.
 func (mi *MergeIterator) Seek(key []byte) {
+	mi.seek(key)
+	mi.resolve()
+}
+
+func (mi *MergeIterator) seek(key []byte) {
 	mi.left.seek(key)
 	mi.right.seek(key)
 	mi.fix()
 	mi.setCurrent()
 }
 
+// SeekToFirst moves to the smallest key, whatever the direction of the MergeIterator. Going forward,
+// it is the same as Rewind. Going backward, the MergeIterator ends up on its last element, so that
+// Next makes it invalid.
+func (mi *MergeIterator) SeekToFirst() {
+	if !mi.reverse {
+		mi.Rewind()
+		return
+	}
+	mi.seekToEnd()
+}
+
+// SeekToLast moves to the biggest key, whatever the direction of the MergeIterator. Going backward,
+// it is the same as Rewind. Going forward, the MergeIterator ends up on its last element, so that
+// Next makes it invalid.
+func (mi *MergeIterator) SeekToLast() {
+	if mi.reverse {
+		mi.Rewind()
+		return
+	}
+	mi.seekToEnd()
+}
+
+// seekToEnd moves to the last element in the direction of iteration, by seeking to the last key of
+// the iterators below.
+func (mi *MergeIterator) seekToEnd() {
+	key := mi.endKey()
+	if key == nil {
+		// There are no keys at all.
+		mi.Rewind()
+		return
+	}
+	mi.Seek(key)
+}
+
+// endKey returns the last key of the MergeIterator in the direction of iteration, or nil if it has
+// no keys.
+func (mi *MergeIterator) endKey() []byte {
+	left, right := mi.left.endKey(mi.reverse), mi.right.endKey(mi.reverse)
+	switch {
+	case left == nil:
+		return right
+	case right == nil:
+		return left
+	}
+	cmp := mi.compareKeys(left, right)
+	if (cmp > 0) != mi.reverse {
+		return left
+	}
+	return right
+}
+
+// endKey returns the last key of the iterator below the node in the direction of iteration, or nil
+// if it has no keys. The last key of tables is known from their index. Iterators of other types
+// have no way to get to their last key other than going through all their keys.
+func (n *node) endKey(reverse bool) []byte {
+	var t *Table
+	switch {
+	case n.merge != nil:
+		return n.merge.endKey()
+	case n.concat != nil:
+		if len(n.concat.tables) == 0 {
+			return nil
+		}
+		if reverse {
+			t = n.concat.tables[0]
+		} else {
+			t = n.concat.tables[len(n.concat.tables)-1]
+		}
+	case n.lazy != nil:
+		t = n.lazy.t
+	case n.table != nil:
+		t = n.table.t
+	default:
+		var last []byte
+		for n.iter.Rewind(); n.iter.Valid(); n.iter.Next() {
+			last = append(last[:0], n.iter.Key()...)
+		}
+		return last
+	}
+	if reverse {
+		return t.Smallest()
+	}
+	return t.Biggest()
+}
+
 // Valid returns whether the MergeIterator is at a valid element.
 func (mi *MergeIterator) Valid() bool {
-	return mi.small.valid
+	return mi.small.valid && (mi.bound == nil || mi.withinBound(mi.small.key))
+}
+
+func (mi *MergeIterator) withinBound(key []byte) bool {
+	cmp := mi.compareUserKeys(y.ParseKey(key), mi.bound)
+	if mi.reverse {
+		return cmp >= 0
+	}
+	return cmp < 0
+}
+
+// SetBound limits iteration to the user keys before bound, or when reversed, to the ones at or
+// after bound, so a scan over the range [start, end) sets end as the bound going forward and start
+// going backward. Valid returns false once the current key is past the bound, and Next then stops
+// advancing the iterators below. The bound is passed on to the ConcatIterators and MergeIterators
+// below, so that a ConcatIterator doesn't open the tables past it. It should be set before Rewind
+// or Seek. A nil bound removes it.
+func (mi *MergeIterator) SetBound(bound []byte) {
+	if bound != nil {
+		bound = append([]byte{}, bound...)
+	}
+	mi.bound = bound
+	mi.left.setBound(bound)
+	mi.right.setBound(bound)
+}
+
+func (n *node) setBound(bound []byte) {
+	switch {
+	case n.merge != nil:
+		n.merge.SetBound(bound)
+	case n.concat != nil:
+		n.concat.setBound(bound)
+	}
 }
 
 // Key returns the key associated with the current iterator.
@@ -192,7 +479,131 @@ func (mi *MergeIterator) Key() []byte {
 
 // Value returns the value associated with the iterator.
 func (mi *MergeIterator) Value() y.ValueStruct {
-	return mi.small.iter.Value()
+	return mi.small.value()
+}
+
+// CurrentSource returns the position, in the list of iterators the MergeIterator was created with,
+// of the iterator holding the current key. It returns -1 if the MergeIterator is not valid.
+func (mi *MergeIterator) CurrentSource() int {
+	if !mi.Valid() {
+		return -1
+	}
+	n := mi.small
+	for n.source < 0 {
+		n = n.merge.small
+	}
+	return n.source
+}
+
+// EstimatedCount returns the number of entries held by the iterators below the MergeIterator, from
+// the indexes of their tables. It doesn't move the iterators, and counts all the entries whatever
+// the position of the MergeIterator and its bound, so keys held by several iterators are counted
+// more than once. Iterators which are not over tables, such as those over memtables, count for
+// zero, as there is no cheap way to know their number of entries.
+func (mi *MergeIterator) EstimatedCount() uint64 {
+	count, _ := mi.left.estimate()
+	c, _ := mi.right.estimate()
+	return count + c
+}
+
+// EstimatedSize returns the total size of the tables below the MergeIterator, in bytes, counted
+// like EstimatedCount.
+func (mi *MergeIterator) EstimatedSize() int64 {
+	_, size := mi.left.estimate()
+	_, s := mi.right.estimate()
+	return size + s
+}
+
+// NumLeaves returns the number of iterators merged below the MergeIterator, including those of the
+// MergeIterators nested in it. Any other iterator, such as a ConcatIterator, counts as one leaf.
+func (mi *MergeIterator) NumLeaves() int {
+	return mi.left.numLeaves() + mi.right.numLeaves()
+}
+
+// Depth returns the number of levels of MergeIterators in the tree below the MergeIterator,
+// itself included. A MergeIterator over two iterators which are not MergeIterators has depth 1.
+func (mi *MergeIterator) Depth() int {
+	d := mi.left.depth()
+	if r := mi.right.depth(); r > d {
+		d = r
+	}
+	return 1 + d
+}
+
+func (n *node) numLeaves() int {
+	if n.merge != nil {
+		return n.merge.NumLeaves()
+	}
+	return 1
+}
+
+func (n *node) depth() int {
+	if n.merge != nil {
+		return n.merge.Depth()
+	}
+	return 0
+}
+
+// estimate returns the number of entries and the size of the tables below the node.
+func (n *node) estimate() (uint64, int64) {
+	var t *Table
+	switch {
+	case n.merge != nil:
+		return n.merge.EstimatedCount(), n.merge.EstimatedSize()
+	case n.concat != nil:
+		return n.concat.EstimatedCount(), n.concat.EstimatedSize()
+	case n.lazy != nil:
+		t = n.lazy.t
+	case n.table != nil:
+		t = n.table.t
+	default:
+		return 0, 0
+	}
+	return uint64(t.KeyCount()), t.Size()
+}
+
+// AddIterator merges it with the iterators of the MergeIterator, which then owns it. It must only be
+// called on a MergeIterator returned by a constructor, and not on one nested in another
+// MergeIterator. The iterator added gets the next position for CurrentSource, and loses against
+// the other iterators on equal keys, as if it had been last in the list given to the constructor.
+//
+// If the MergeIterator is valid, it is sought to the current key, so that iteration carries on
+// from there and also returns the keys of it which come after the current one. Otherwise, it is not
+// positioned, and the MergeIterator stays invalid until the next Rewind or Seek.
+func (mi *MergeIterator) AddIterator(it y.Iterator) {
+	checkDirections([]y.Iterator{it}, mi.reverse)
+	// The current tree moves below a new root, which keeps the address of mi.
+	old := new(MergeIterator)
+	*old = *mi
+	if mi.small == &mi.left {
+		old.small = &old.left
+	} else {
+		old.small = &old.right
+	}
+	old.curKey = append([]byte{}, mi.curKey...)
+	valid := mi.Valid()
+
+	mi.left = node{source: -1}
+	mi.left.setIterator(old)
+	mi.left.setKey()
+	mi.right = node{source: mi.numSources}
+	mi.right.setIterator(it)
+	mi.right.setBound(mi.bound)
+	mi.numSources++
+	mi.lazy = old.lazy || mi.right.lazy != nil || (mi.right.merge != nil && mi.right.merge.lazy)
+	mi.small = &mi.left
+	if !valid {
+		return
+	}
+	mi.right.seek(mi.curKey)
+	mi.fix()
+	mi.setCurrent()
+	mi.resolve()
+}
+
+// Reversed implements y.DirectedIterator.
+func (mi *MergeIterator) Reversed() bool {
+	return mi.reverse
 }
 
 // Close implements y.Iterator.
@@ -205,27 +616,287 @@ func (mi *MergeIterator) Close() error {
 	return y.Wrap(err2, "MergeIterator")
 }
 
-// NewMergeIterator creates a merge iterator.
+// NewMergeIterator creates a merge iterator. All of iters must return their keys in the direction
+// given by reverse: increasing order, or decreasing order if reverse is set. It panics if one of
+// them is a y.DirectedIterator going in the other direction, which can be turned around with
+// y.NewReversedIterator. The same goes for the other merge iterators and AddIterator.
 func NewMergeIterator(iters []y.Iterator, reverse bool) y.Iterator {
+	return newMergeIterator(iters, mergeConfig{reverse: reverse})
+}
+
+// NewMergeIteratorWithComparator is like NewMergeIterator, but orders the user keys, the keys
+// without their timestamps, with compare instead of bytes.Compare. The versions of a key are still
+// ordered by decreasing version, and equal keys with equal versions are still returned once. This
+// allows merging iterators over keys with a custom collation. All the iterators merged must
+// already return their keys in the order of compare: the MergeIterator only merges them. Seek and
+// the bound set by SetBound are passed on to the iterators below as is, so table and concat
+// iterators, which search their keys with y.CompareKeys, only support them for key encodings
+// where compare agrees with bytes.Compare on the keys sought.
+func NewMergeIteratorWithComparator(iters []y.Iterator, reverse bool,
+	compare func(a, b []byte) int) y.Iterator {
+	return newMergeIterator(iters, mergeConfig{reverse: reverse, compare: compare})
+}
+
+// mergeIteratorPool recycles the MergeIterators of the trees built by NewPooledMergeIterator.
+var mergeIteratorPool = sync.Pool{
+	New: func() interface{} { return new(MergeIterator) },
+}
+
+// NewPooledMergeIterator is like NewMergeIterator, but takes the MergeIterators making up the merge
+// tree from a pool, to which Release gives them back. This saves allocations when many short lived
+// merge iterators are created.
+func NewPooledMergeIterator(iters []y.Iterator, reverse bool) y.Iterator {
+	return newMergeIterator(iters, mergeConfig{reverse: reverse, pooled: true})
+}
+
+// Release gives a MergeIterator created by NewPooledMergeIterator back to the pool, along with the
+// MergeIterators it built below it, after the MergeIterator has been closed. The MergeIterator must
+// not be used in any way after Release, as it may already be handed out again. Release does
+// nothing for a MergeIterator which does not come from the pool.
+func (mi *MergeIterator) Release() {
+	if !mi.pooled {
+		return
+	}
+	for _, n := range []*node{&mi.left, &mi.right} {
+		if n.source < 0 && n.merge != nil {
+			n.merge.Release()
+		}
+	}
+	*mi = MergeIterator{curKey: mi.curKey[:0]}
+	mergeIteratorPool.Put(mi)
+}
+
+// NewPriorityMergeIterator creates a merge iterator which orders keys without their versions and,
+// when several iterators hold the same key, returns it only from the iterator which comes first
+// in iters, irrespective of the versions held by the others. This suits layered overlays, where
+// an upper layer must shadow the lower ones. Within the winning iterator, the first entry for the
+// key in iteration order is returned and its other versions are skipped. As with
+// NewMergeIterator, a single iterator is returned as is.
+func NewPriorityMergeIterator(iters []y.Iterator, reverse bool) y.Iterator {
+	return newMergeIterator(iters, mergeConfig{reverse: reverse, mode: mergePriority})
+}
+
+// NewAllVersionsMergeIterator creates a merge iterator which returns every entry of every
+// iterator, in the order of y.CompareKeys: by key, then by decreasing version. Unlike
+// NewMergeIterator, an entry with the same key and version as the previous one is returned too,
+// with the entries of the iterators which come first in iters returned first. When reversed, the
+// whole order is reversed, so the versions of a key come in increasing order, but entries of the
+// same key and version still come from the iterators in the order of iters. As with
+// NewMergeIterator, a single iterator is returned as is, so the entries of that iterator are all
+// returned in any case.
+//
+// This is the raw mode for tools dumping tables as stored, and for debugging: duplicates which
+// NewMergeIterator would collapse, even byte-identical keys with the same version, are surfaced.
+// It breaks the read semantics relied upon by the DB, where each key and version is seen once, so
+// it must not be used to serve reads.
+func NewAllVersionsMergeIterator(iters []y.Iterator, reverse bool) y.Iterator {
+	return newMergeIterator(iters, mergeConfig{reverse: reverse, mode: mergeAllVersions})
+}
+
+// mergeMode decides what a MergeIterator does with keys which are equal.
+type mergeMode int
+
+const (
+	// mergeDedup returns a key with a given version only once.
+	mergeDedup mergeMode = iota
+	// mergePriority returns a key only once, whatever its versions.
+	mergePriority
+	// mergeAllVersions returns all the keys.
+	mergeAllVersions
+)
+
+// mergeConfig holds the settings shared by all the MergeIterators of a tree.
+type mergeConfig struct {
+	reverse bool
+	mode    mergeMode
+	// pooled takes the MergeIterators from mergeIteratorPool.
+	pooled bool
+	// compare orders the user keys, if set.
+	compare func(a, b []byte) int
+}
+
+func newMergeIterator(iters []y.Iterator, cfg mergeConfig) y.Iterator {
+	checkDirections(iters, cfg.reverse)
 	switch len(iters) {
 	case 0:
 		return nil
 	case 1:
 		return iters[0]
-	case 2:
-		mi := &MergeIterator{
-			reverse: reverse,
+	}
+	return buildMergeIterator(iters, cfg, 0)
+}
+
+// checkDirections panics if any of iters is known to iterate in another direction than reverse,
+// which would make a merge iterator over them silently return keys out of order.
+func checkDirections(iters []y.Iterator, reverse bool) {
+	for i, it := range iters {
+		d, ok := it.(y.DirectedIterator)
+		if !ok || d.Reversed() == reverse {
+			continue
 		}
-		mi.left.setIterator(iters[0])
-		mi.right.setIterator(iters[1])
-		// Assign left iterator randomly. This will be fixed when user calls rewind/seek.
-		mi.small = &mi.left
-		return mi
+		panic(fmt.Sprintf("cannot merge iterator %d (%T) with reversed=%v into a merge iterator "+
+			"with reversed=%v: wrap it with y.NewReversedIterator, or create it in the other "+
+			"direction", i, it, d.Reversed(), reverse))
+	}
+}
+
+// buildMergeIterator builds a balanced tree of MergeIterators over two or more iterators, the
+// first of which is at position offset in the list given to the constructor.
+func buildMergeIterator(iters []y.Iterator, cfg mergeConfig, offset int) *MergeIterator {
+	var mi *MergeIterator
+	if cfg.pooled {
+		mi = mergeIteratorPool.Get().(*MergeIterator)
+	} else {
+		mi = new(MergeIterator)
 	}
+	mi.reverse = cfg.reverse
+	mi.priority = cfg.mode == mergePriority
+	mi.allVersions = cfg.mode == mergeAllVersions
+	mi.pooled = cfg.pooled
+	mi.compare = cfg.compare
+	mi.numSources = len(iters)
 	mid := len(iters) / 2
-	return NewMergeIterator(
-		[]y.Iterator{
-			NewMergeIterator(iters[:mid], reverse),
-			NewMergeIterator(iters[mid:], reverse),
-		}, reverse)
+	mi.left.setChild(iters[:mid], cfg, offset)
+	mi.right.setChild(iters[mid:], cfg, offset+mid)
+	for _, n := range []*node{&mi.left, &mi.right} {
+		mi.lazy = mi.lazy || n.lazy != nil || (n.merge != nil && n.merge.lazy)
+	}
+	// Assign left iterator randomly. This will be fixed when user calls rewind/seek.
+	mi.small = &mi.left
+	return mi
+}
+
+// setChild sets the iterator of the node to iters, merging them if there are several.
+func (n *node) setChild(iters []y.Iterator, cfg mergeConfig, offset int) {
+	if len(iters) == 1 {
+		n.setIterator(iters[0])
+		n.source = offset
+		return
+	}
+	n.setIterator(buildMergeIterator(iters, cfg, offset))
+	n.source = -1
+}
+
+// NewLazyMergeIterator creates a merge iterator over tables which may overlap, such as the level 0
+// tables, in decreasing order of precedence. A table is only opened once its first key is needed
+// to decide which key comes next, so tables whose keys are never reached, as in a scan stopping
+// after a few keys, don't load any block. Until then, the position of a table is bounded by its
+// smallest key (biggest when reversed) and the seek key. The tables are referenced until the
+// iterator is closed. Valid options are REVERSED, NOCACHE and KEYSONLY.
+func NewLazyMergeIterator(tables []*Table, opt int) y.Iterator {
+	iters := make([]y.Iterator, 0, len(tables))
+	for _, t := range tables {
+		iters = append(iters, newLazyTableIterator(t, opt))
+	}
+	return newMergeIterator(iters, mergeConfig{reverse: opt&REVERSED > 0})
+}
+
+// lazyTableIterator is a table iterator which is created on first use. Used on its own, it opens
+// the table on Rewind and Seek. Under a MergeIterator, the table is opened once its key is needed.
+type lazyTableIterator struct {
+	t   *Table
+	opt int
+	it  *Iterator // Nil until the table is opened.
+
+	seekKey []byte // Key to seek to on open, nil to rewind.
+	bound   []byte // Lower bound of the first key (upper bound when reversed) while not open.
+	valid   bool
+}
+
+func newLazyTableIterator(t *Table, opt int) *lazyTableIterator {
+	t.IncrRef()
+	return &lazyTableIterator{t: t, opt: opt}
+}
+
+// Reversed implements y.DirectedIterator.
+func (li *lazyTableIterator) Reversed() bool {
+	return li.opt&REVERSED > 0
+}
+
+// deferSeek records where to position the iterator, without opening the table. A nil key rewinds.
+func (li *lazyTableIterator) deferSeek(key []byte) {
+	if li.it != nil {
+		if key == nil {
+			li.it.Rewind()
+		} else {
+			li.it.Seek(key)
+		}
+		return
+	}
+	li.seekKey = key
+	smallest, biggest := li.t.Smallest(), li.t.Biggest()
+	switch {
+	case li.Reversed() && key != nil && y.CompareKeys(key, biggest) < 0:
+		li.bound, li.valid = key, y.CompareKeys(key, smallest) >= 0
+	case li.Reversed():
+		li.bound, li.valid = biggest, true
+	case key != nil && y.CompareKeys(key, smallest) > 0:
+		li.bound, li.valid = key, y.CompareKeys(key, biggest) <= 0
+	default:
+		li.bound, li.valid = smallest, true
+	}
+}
+
+// open creates the table iterator and moves it to the position recorded by deferSeek.
+func (li *lazyTableIterator) open() {
+	if li.it != nil {
+		return
+	}
+	li.it = li.t.NewIterator(li.opt)
+	if li.seekKey == nil {
+		li.it.Rewind()
+	} else {
+		li.it.Seek(li.seekKey)
+	}
+	li.seekKey, li.bound = nil, nil
+}
+
+// Rewind implements y.Iterator.
+func (li *lazyTableIterator) Rewind() {
+	li.deferSeek(nil)
+	li.open()
+}
+
+// Seek implements y.Iterator.
+func (li *lazyTableIterator) Seek(key []byte) {
+	li.deferSeek(key)
+	li.open()
+}
+
+// Next implements y.Iterator.
+func (li *lazyTableIterator) Next() {
+	li.open()
+	li.it.Next()
+}
+
+// Valid implements y.Iterator.
+func (li *lazyTableIterator) Valid() bool {
+	if li.it == nil {
+		return li.valid
+	}
+	return li.it.Valid()
+}
+
+// Key implements y.Iterator. It returns the bound of the key if the table is not open yet.
+func (li *lazyTableIterator) Key() []byte {
+	if li.it == nil {
+		return li.bound
+	}
+	return li.it.Key()
+}
+
+// Value implements y.Iterator.
+func (li *lazyTableIterator) Value() y.ValueStruct {
+	li.open()
+	return li.it.Value()
+}
+
+// Close implements y.Iterator.
+func (li *lazyTableIterator) Close() error {
+	if li.it != nil {
+		if err := li.it.Close(); err != nil {
+			return y.Wrap(err, "lazyTableIterator")
+		}
+	}
+	return li.t.DecrRef()
 }
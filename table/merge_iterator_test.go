@@ -17,7 +17,13 @@
 package table
 
 import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -369,3 +375,984 @@ func TestMergeDuplicates(t *testing.T) {
 		closeAndCheck(t, mergeIt, 4)
 	})
 }
+
+func TestPriorityMergeIterator(t *testing.T) {
+	// newIter builds an iterator over keys of the form "key@version", which must be sorted.
+	newIter := func(keys []string, vals []string, reversed bool) *SimpleIterator {
+		it := newSimpleIterator(keys, vals, reversed)
+		for i, k := range keys {
+			var key string
+			var version uint64
+			_, err := fmt.Sscanf(k, "%1s@%d", &key, &version)
+			require.NoError(t, err)
+			it.keys[i] = y.KeyWithTs([]byte(key), version)
+		}
+		return it
+	}
+	// All three sources hold k, and the highest priority source holds its oldest version.
+	newIters := func(reversed bool) []y.Iterator {
+		return []y.Iterator{
+			newIter([]string{"k@1", "x@3"}, []string{"a", "ax"}, reversed),
+			newIter([]string{"k@5", "m@2"}, []string{"b", "bm"}, reversed),
+			newIter([]string{"k@9", "k@8", "z@1"}, []string{"c", "c8", "cz"}, reversed),
+		}
+	}
+
+	t.Run("forward", func(t *testing.T) {
+		it := NewPriorityMergeIterator(newIters(false), false)
+		it.Rewind()
+		k, v := getAll(it)
+		require.Equal(t, []string{"k", "m", "x", "z"}, k)
+		require.Equal(t, []string{"a", "bm", "ax", "cz"}, v)
+		closeAndCheck(t, it, 3)
+
+		// A regular merge iterator picks the newest version instead.
+		it = NewMergeIterator(newIters(false), false)
+		it.Rewind()
+		require.Equal(t, "c", string(it.Value().Value))
+	})
+	t.Run("reverse", func(t *testing.T) {
+		it := NewPriorityMergeIterator(newIters(true), true)
+		it.Rewind()
+		k, v := getAll(it)
+		require.Equal(t, []string{"z", "x", "m", "k"}, k)
+		require.Equal(t, []string{"cz", "ax", "bm", "a"}, v)
+		closeAndCheck(t, it, 3)
+	})
+	t.Run("seek", func(t *testing.T) {
+		it := NewPriorityMergeIterator(newIters(false), false)
+		// The simple iterator seeks to the oldest version of the key, so seek before k.
+		it.Seek([]byte("j"))
+		require.True(t, it.Valid())
+		require.Equal(t, "a", string(it.Value().Value))
+	})
+}
+
+func BenchmarkMergeIterator(b *testing.B) {
+	for _, numIters := range []int{2, 8, 32} {
+		for _, reverse := range []bool{false, true} {
+			b.Run(fmt.Sprintf("iters=%d/reverse=%v", numIters, reverse), func(b *testing.B) {
+				BenchmarkMerge(b, numIters, 1000, reverse)
+			})
+		}
+	}
+}
+
+func TestLazyMergeIterator(t *testing.T) {
+	opts := getTestTableOptions()
+	var tables []*Table
+	for i := 0; i < 8; i++ {
+		// Tables overlap each other, and the keys they share have different values.
+		var kvs [][]string
+		for j := i; j < 200; j += i + 1 {
+			kvs = append(kvs, []string{fmt.Sprintf("key%03d", j), fmt.Sprintf("%d-%d", i, j)})
+		}
+		tables = append(tables, buildTable(t, kvs, opts))
+	}
+	defer func() {
+		for _, tbl := range tables {
+			require.NoError(t, tbl.DecrRef())
+		}
+	}()
+	eager := func(reverse bool) y.Iterator {
+		var opt int
+		if reverse {
+			opt = REVERSED
+		}
+		var iters []y.Iterator
+		for _, tbl := range tables {
+			iters = append(iters, tbl.NewIterator(opt))
+		}
+		return NewMergeIterator(iters, reverse)
+	}
+
+	for _, reverse := range []bool{false, true} {
+		var opt int
+		if reverse {
+			opt = REVERSED
+		}
+		want, lazy := eager(reverse), NewLazyMergeIterator(tables, opt)
+		want.Rewind()
+		lazy.Rewind()
+		wantKeys, wantVals := getAll(want)
+		keys, vals := getAll(lazy)
+		require.Equal(t, wantKeys, keys)
+		require.Equal(t, wantVals, vals)
+		require.Len(t, keys, 200)
+
+		for _, k := range []string{"a", "key000", "key077", "key150", "key199", "z"} {
+			seek := y.KeyWithTs([]byte(k), 0)
+			want.Seek(seek)
+			lazy.Seek(seek)
+			wantKeys, wantVals = getAll(want)
+			keys, vals = getAll(lazy)
+			require.Equal(t, wantKeys, keys, "seek %s reverse %v", k, reverse)
+			require.Equal(t, wantVals, vals, "seek %s reverse %v", k, reverse)
+		}
+		require.NoError(t, want.Close())
+		require.NoError(t, lazy.Close())
+	}
+
+	// Over tables with disjoint ranges, reading the first key opens a single table.
+	var disjoint []*Table
+	for i := 0; i < 8; i++ {
+		disjoint = append(disjoint, buildTestTable(t, fmt.Sprintf("key%d", i), 100, opts))
+	}
+	var leaves []*lazyTableIterator
+	var iters []y.Iterator
+	for _, tbl := range disjoint {
+		leaf := newLazyTableIterator(tbl, 0)
+		leaves = append(leaves, leaf)
+		iters = append(iters, leaf)
+		require.NoError(t, tbl.DecrRef())
+	}
+	it := NewMergeIterator(iters, false)
+	opened := func() (n int) {
+		for _, leaf := range leaves {
+			if leaf.it != nil {
+				n++
+			}
+		}
+		return n
+	}
+	it.Rewind()
+	require.True(t, it.Valid())
+	require.Equal(t, "key00000", string(y.ParseKey(it.Key())))
+	require.Equal(t, 1, opened())
+	it.Seek(y.KeyWithTs([]byte("key5"), 0))
+	require.Equal(t, "key50000", string(y.ParseKey(it.Key())))
+	require.Equal(t, 2, opened())
+	require.NoError(t, it.Close())
+}
+
+func BenchmarkLazyMergeIteratorLimit1(b *testing.B) {
+	m := 32 // Number of tables.
+	var tables []*Table
+	for i := 0; i < m; i++ {
+		filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Uint32())
+		builder := NewTableBuilder(getTestTableOptions())
+		for j := 0; j < 1000; j++ {
+			// Keys are interleaved, so all the tables overlap.
+			k := y.KeyWithTs([]byte(fmt.Sprintf("%016x", j*m+i)), 0)
+			builder.Add(k, y.ValueStruct{Value: []byte("val")}, 0)
+		}
+		tbl, err := CreateTable(filename, builder)
+		y.Check(err)
+		builder.Close()
+		tables = append(tables, tbl)
+		defer func() { _ = tbl.DecrRef() }()
+	}
+
+	b.Run("eager", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var iters []y.Iterator
+			for _, tbl := range tables {
+				iters = append(iters, tbl.NewIterator(0))
+			}
+			it := NewMergeIterator(iters, false)
+			it.Rewind()
+			_ = it.Value()
+			_ = it.Close()
+		}
+		b.ReportMetric(float64(len(tables)), "opens/op")
+	})
+	b.Run("lazy", func(b *testing.B) {
+		var opens int
+		for i := 0; i < b.N; i++ {
+			var leaves []*lazyTableIterator
+			var iters []y.Iterator
+			for _, tbl := range tables {
+				leaf := newLazyTableIterator(tbl, 0)
+				leaves = append(leaves, leaf)
+				iters = append(iters, leaf)
+			}
+			it := NewMergeIterator(iters, false)
+			it.Rewind()
+			_ = it.Value()
+			for _, leaf := range leaves {
+				if leaf.it != nil {
+					opens++
+				}
+			}
+			_ = it.Close()
+		}
+		b.ReportMetric(float64(opens)/float64(b.N), "opens/op")
+	})
+}
+
+func TestMergeIteratorHeap(t *testing.T) {
+	newIters := func(reversed bool) []y.Iterator {
+		return []y.Iterator{
+			newSimpleIterator([]string{"1", "1", "3", "7"}, []string{"a1", "a1-1", "a3", "a7"},
+				reversed),
+			newSimpleIterator([]string{"2", "3", "5"}, []string{"b2", "b3", "b5"}, reversed),
+			newSimpleIterator([]string{"1"}, []string{"c1"}, reversed),
+			newSimpleIterator([]string{"1", "7", "9"}, []string{"d1", "d7", "d9"}, reversed),
+			newSimpleIterator(nil, nil, reversed),
+		}
+	}
+	for _, reversed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reversed=%v", reversed), func(t *testing.T) {
+			tree := NewMergeIterator(newIters(reversed), reversed)
+			heap := NewMergeIteratorHeap(newIters(reversed), reversed)
+			tree.Rewind()
+			heap.Rewind()
+			wantKeys, wantVals := getAll(tree)
+			k, v := getAll(heap)
+			require.Equal(t, wantKeys, k)
+			require.Equal(t, wantVals, v)
+
+			for _, key := range []string{"0", "3", "4", "9", "z"} {
+				tree.Seek([]byte(key))
+				heap.Seek([]byte(key))
+				wantKeys, wantVals := getAll(tree)
+				k, v := getAll(heap)
+				require.Equal(t, wantKeys, k, "seek %s", key)
+				require.Equal(t, wantVals, v, "seek %s", key)
+			}
+			closeAndCheck(t, heap, 5)
+			closeAndCheck(t, tree, 5)
+		})
+	}
+
+	// Versions of the same key are returned newest first, unless reversed.
+	newVersioned := func(reversed bool) []y.Iterator {
+		a := newSimpleIterator([]string{"k", "k"}, []string{"a9", "a3"}, reversed)
+		a.keys = [][]byte{y.KeyWithTs([]byte("k"), 9), y.KeyWithTs([]byte("k"), 3)}
+		b := newSimpleIterator([]string{"k"}, []string{"b5"}, reversed)
+		b.keys = [][]byte{y.KeyWithTs([]byte("k"), 5)}
+		return []y.Iterator{a, b}
+	}
+	it := NewMergeIteratorHeap(newVersioned(false), false)
+	it.Rewind()
+	_, v := getAll(it)
+	require.Equal(t, []string{"a9", "b5", "a3"}, v)
+	it = NewMergeIteratorHeap(newVersioned(true), true)
+	it.Rewind()
+	_, v = getAll(it)
+	require.Equal(t, []string{"a3", "b5", "a9"}, v)
+
+	require.Nil(t, NewMergeIteratorHeap(nil, false))
+	single := newSimpleIterator([]string{"1"}, []string{"v1"}, false)
+	require.Equal(t, y.Iterator(single), NewMergeIteratorHeap([]y.Iterator{single}, false))
+}
+
+func BenchmarkMergeIteratorHeap(b *testing.B) {
+	opts := &Options{BlockSize: 4 * 1024, BloomFalsePositive: 0.01}
+	const entries = 20000 // Total number of keys, split across the iterators.
+	for _, n := range []int{4, 16, 64, 256} {
+		var tables []*Table
+		for i := 0; i < n; i++ {
+			builder := NewTableBuilder(*opts)
+			for j := i; j < entries; j += n {
+				k := y.KeyWithTs([]byte(fmt.Sprintf("%016x", j)), 1)
+				builder.Add(k, y.ValueStruct{Value: []byte("val")}, 0)
+			}
+			tbl, err := OpenInMemoryTable(builder.Finish(), uint64(i+1), opts)
+			y.Check(err)
+			builder.Close()
+			tables = append(tables, tbl)
+		}
+		scan := func(b *testing.B, newMerge func([]y.Iterator, bool) y.Iterator) {
+			for i := 0; i < b.N; i++ {
+				iters := make([]y.Iterator, 0, n)
+				for _, tbl := range tables {
+					iters = append(iters, tbl.NewIterator(0))
+				}
+				it := newMerge(iters, false)
+				var count int
+				for it.Rewind(); it.Valid(); it.Next() {
+					count++
+				}
+				if count != entries {
+					b.Fatalf("got %d keys, want %d", count, entries)
+				}
+				_ = it.Close()
+			}
+		}
+		b.Run(fmt.Sprintf("tree/n=%d", n), func(b *testing.B) { scan(b, NewMergeIterator) })
+		b.Run(fmt.Sprintf("heap/n=%d", n), func(b *testing.B) { scan(b, NewMergeIteratorHeap) })
+		for _, tbl := range tables {
+			_ = tbl.DecrRef()
+		}
+	}
+}
+
+func TestMergeIteratorCurrentSource(t *testing.T) {
+	newIters := func() []y.Iterator {
+		return []y.Iterator{
+			newSimpleIterator([]string{"1", "4"}, []string{"a1", "a4"}, false),
+			newSimpleIterator([]string{"2", "4"}, []string{"b2", "b4"}, false),
+			newSimpleIterator([]string{"3"}, []string{"c3"}, false),
+			newSimpleIterator([]string{"0", "5"}, []string{"d0", "d5"}, false),
+			newSimpleIterator([]string{"6"}, []string{"e6"}, false),
+		}
+	}
+	want := []int{3, 0, 1, 2, 0, 3, 4}
+	for name, newMerge := range map[string]func([]y.Iterator, bool) y.Iterator{
+		"tree": NewMergeIterator,
+		"heap": NewMergeIteratorHeap,
+	} {
+		t.Run(name, func(t *testing.T) {
+			it := newMerge(newIters(), false).(interface {
+				y.Iterator
+				CurrentSource() int
+			})
+			var got []int
+			for it.Rewind(); it.Valid(); it.Next() {
+				got = append(got, it.CurrentSource())
+			}
+			require.Equal(t, want, got)
+			require.Equal(t, -1, it.CurrentSource())
+		})
+	}
+}
+
+func TestAllVersionsMergeIterator(t *testing.T) {
+	newIter := func(vals []string, reversed bool) *SimpleIterator {
+		// Values are of the form "key@version@source" and must be in y.CompareKeys order.
+		it := newSimpleIterator(vals, vals, reversed)
+		for i, v := range vals {
+			var key, source string
+			var version uint64
+			_, err := fmt.Sscanf(v, "%1s@%d@%s", &key, &version, &source)
+			require.NoError(t, err)
+			it.keys[i] = y.KeyWithTs([]byte(key), version)
+		}
+		return it
+	}
+	newIters := func(reversed bool) []y.Iterator {
+		return []y.Iterator{
+			newIter([]string{"k@9@a", "k@3@a", "m@1@a"}, reversed),
+			newIter([]string{"k@5@b", "k@3@b", "z@2@b"}, reversed),
+			newIter([]string{"k@7@c", "m@1@c"}, reversed),
+		}
+	}
+	want := []string{"k@9@a", "k@7@c", "k@5@b", "k@3@a", "k@3@b", "m@1@a", "m@1@c", "z@2@b"}
+
+	it := NewAllVersionsMergeIterator(newIters(false), false)
+	it.Rewind()
+	_, v := getAll(it)
+	require.Equal(t, want, v)
+	closeAndCheck(t, it, 3)
+
+	it = NewAllVersionsMergeIterator(newIters(true), true)
+	it.Rewind()
+	_, v = getAll(it)
+	require.Equal(t, []string{"z@2@b", "m@1@a", "m@1@c", "k@3@a", "k@3@b", "k@5@b", "k@7@c",
+		"k@9@a"}, v)
+
+	it = NewAllVersionsMergeIterator(newIters(false), false)
+	it.Seek([]byte("l"))
+	_, v = getAll(it)
+	require.Equal(t, want[5:], v)
+
+	// A regular merge iterator returns each key and version once.
+	it = NewMergeIterator(newIters(false), false)
+	it.Rewind()
+	_, v = getAll(it)
+	require.Equal(t, []string{"k@9@a", "k@7@c", "k@5@b", "k@3@a", "m@1@a", "z@2@b"}, v)
+}
+
+func TestMergeIteratorAddIterator(t *testing.T) {
+	newIters := func(reversed bool) []y.Iterator {
+		return []y.Iterator{
+			newSimpleIterator([]string{"1", "3", "5", "7"}, []string{"a1", "a3", "a5", "a7"},
+				reversed),
+			newSimpleIterator([]string{"2", "6"}, []string{"b2", "b6"}, reversed),
+		}
+	}
+	newAdded := func(reversed bool) y.Iterator {
+		return newSimpleIterator([]string{"0", "3", "4", "8"}, []string{"c0", "c3", "c4", "c8"},
+			reversed)
+	}
+
+	t.Run("before rewind", func(t *testing.T) {
+		it := NewMergeIterator(newIters(false), false).(*MergeIterator)
+		it.AddIterator(newAdded(false))
+		it.Rewind()
+		require.Equal(t, 2, it.CurrentSource())
+		k, v := getAll(it)
+		require.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8"}, k)
+		require.Equal(t, []string{"c0", "a1", "b2", "a3", "c4", "a5", "b6", "a7", "c8"}, v)
+		closeAndCheck(t, it, 3)
+	})
+	t.Run("after next", func(t *testing.T) {
+		it := NewMergeIterator(newIters(false), false).(*MergeIterator)
+		it.Rewind()
+		it.Next()
+		it.Next()
+		require.Equal(t, "a3", string(it.Value().Value))
+		it.AddIterator(newAdded(false))
+		k, v := getAll(it)
+		require.Equal(t, []string{"3", "4", "5", "6", "7", "8"}, k)
+		require.Equal(t, []string{"a3", "c4", "a5", "b6", "a7", "c8"}, v)
+
+		// Rewinding takes all the iterators back to their start.
+		it.Rewind()
+		k, _ = getAll(it)
+		require.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8"}, k)
+		closeAndCheck(t, it, 3)
+	})
+	t.Run("after next reversed", func(t *testing.T) {
+		it := NewMergeIterator(newIters(true), true).(*MergeIterator)
+		it.Rewind()
+		it.Next()
+		require.Equal(t, "b6", string(it.Value().Value))
+		it.AddIterator(newAdded(true))
+		k, v := getAll(it)
+		require.Equal(t, []string{"6", "5", "4", "3", "2", "1", "0"}, k)
+		require.Equal(t, []string{"b6", "a5", "c4", "a3", "b2", "a1", "c0"}, v)
+	})
+	t.Run("exhausted", func(t *testing.T) {
+		it := NewMergeIterator(newIters(false), false).(*MergeIterator)
+		it.Rewind()
+		getAll(it)
+		it.AddIterator(newAdded(false))
+		require.False(t, it.Valid())
+		it.Seek([]byte("7"))
+		k, _ := getAll(it)
+		require.Equal(t, []string{"7", "8"}, k)
+	})
+}
+
+func TestMergeIteratorSetBound(t *testing.T) {
+	opts := getTestTableOptions()
+	var tables []*Table
+	for _, prefix := range []string{"keya", "keyb", "keyc"} {
+		tbl := buildTestTable(t, prefix, 100, opts)
+		defer func() { require.NoError(t, tbl.DecrRef()) }()
+		tables = append(tables, tbl)
+	}
+	other := buildTable(t, [][]string{{"keya0050x", "o1"}, {"keyb0050x", "o2"}}, opts)
+	defer func() { require.NoError(t, other.DecrRef()) }()
+
+	count := func(it y.Iterator) (int, string, string) {
+		var n int
+		var first, last string
+		for ; it.Valid(); it.Next() {
+			if n == 0 {
+				first = string(y.ParseKey(it.Key()))
+			}
+			last = string(y.ParseKey(it.Key()))
+			n++
+		}
+		return n, first, last
+	}
+
+	t.Run("forward", func(t *testing.T) {
+		concat := NewConcatIterator(tables, 0)
+		it := NewMergeIterator([]y.Iterator{concat, other.NewIterator(0)}, false).(*MergeIterator)
+		defer it.Close()
+		it.SetBound([]byte("keyb"))
+		it.Rewind()
+		n, first, last := count(it)
+		require.Equal(t, 101, n)
+		require.Equal(t, "keya0000", first)
+		require.Equal(t, "keya0099", last)
+		require.Nil(t, concat.iters[1])
+		require.Nil(t, concat.iters[2])
+
+		it.Seek(y.KeyWithTs([]byte("keya0090"), math.MaxUint64))
+		n, _, _ = count(it)
+		require.Equal(t, 10, n)
+
+		it.SetBound(nil)
+		it.Rewind()
+		n, _, _ = count(it)
+		require.Equal(t, 302, n)
+	})
+	t.Run("reverse", func(t *testing.T) {
+		concat := NewConcatIterator(tables, REVERSED)
+		it := NewMergeIterator([]y.Iterator{concat, other.NewIterator(REVERSED)},
+			true).(*MergeIterator)
+		defer it.Close()
+		it.SetBound([]byte("keyb0050"))
+		it.Rewind()
+		n, first, last := count(it)
+		require.Equal(t, 151, n)
+		require.Equal(t, "keyc0099", first)
+		require.Equal(t, "keyb0050", last)
+		require.Nil(t, concat.iters[0])
+	})
+}
+
+func BenchmarkMergeIteratorValue(b *testing.B) {
+	opts := &Options{BlockSize: 4 * 1024, BloomFalsePositive: 0.01}
+	const n, entries = 8, 20000
+	var tables []*Table
+	for i := 0; i < 2*n; i++ {
+		builder := NewTableBuilder(*opts)
+		for j := i; j < entries; j += 2 * n {
+			k := y.KeyWithTs([]byte(fmt.Sprintf("%016x", j)), 1)
+			builder.Add(k, y.ValueStruct{Value: []byte(fmt.Sprintf("val%d", j))}, 0)
+		}
+		tbl, err := OpenInMemoryTable(builder.Finish(), uint64(i+1), opts)
+		y.Check(err)
+		builder.Close()
+		tables = append(tables, tbl)
+		defer func() { _ = tbl.DecrRef() }()
+	}
+	// Half of the sources are table iterators, the other half are merges of two tables.
+	newIterator := func() *MergeIterator {
+		iters := make([]y.Iterator, 0, n)
+		for i := 0; i < n; i++ {
+			if i%2 == 0 {
+				iters = append(iters, tables[2*i].NewIterator(0), tables[2*i+1].NewIterator(0))
+				continue
+			}
+			iters = append(iters, NewMergeIterator([]y.Iterator{
+				tables[2*i].NewIterator(0), tables[2*i+1].NewIterator(0)}, false))
+		}
+		return NewMergeIterator(iters, false).(*MergeIterator)
+	}
+	scan := func(b *testing.B, value func(mi *MergeIterator) y.ValueStruct) {
+		for i := 0; i < b.N; i++ {
+			it := newIterator()
+			var size int
+			for it.Rewind(); it.Valid(); it.Next() {
+				// Read the value several times, as callers looking at both the value and its
+				// metadata do, so that the cost of the dispatch shows over the one of Next.
+				for j := 0; j < 8; j++ {
+					size += len(value(it).Value)
+				}
+			}
+			if size == 0 {
+				b.Fatal("no values read")
+			}
+			_ = it.Close()
+		}
+	}
+	b.Run("interface", func(b *testing.B) {
+		// The dispatch through y.Iterator that Value used before the node cached it.
+		scan(b, func(mi *MergeIterator) y.ValueStruct { return mi.small.iter.Value() })
+	})
+	b.Run("concrete", func(b *testing.B) {
+		scan(b, func(mi *MergeIterator) y.ValueStruct { return mi.Value() })
+	})
+}
+
+func TestMergeIteratorReverseEqualKeys(t *testing.T) {
+	opts := &Options{BlockSize: 4 * 1024, BloomFalsePositive: 0.01}
+	var fileID uint64
+	newTable := func(entries ...string) *Table {
+		// Entries are of the form "key@version=value", in y.CompareKeys order.
+		builder := NewTableBuilder(*opts)
+		defer builder.Close()
+		for _, e := range entries {
+			var key, val string
+			var version uint64
+			_, err := fmt.Sscanf(strings.Replace(e, "=", " ", 1), "%1s@%d %s", &key, &version, &val)
+			require.NoError(t, err)
+			builder.Add(y.KeyWithTs([]byte(key), version), y.ValueStruct{Value: []byte(val)}, 0)
+		}
+		fileID++
+		tbl, err := OpenInMemoryTable(builder.Finish(), fileID, opts)
+		require.NoError(t, err)
+		return tbl
+	}
+	scan := func(tables []*Table, reverse bool) []string {
+		var topt int
+		if reverse {
+			topt = REVERSED
+		}
+		var iters []y.Iterator
+		for _, tbl := range tables {
+			iters = append(iters, tbl.NewIterator(topt))
+		}
+		it := NewMergeIterator(iters, reverse)
+		defer it.Close()
+		var out []string
+		for it.Rewind(); it.Valid(); it.Next() {
+			out = append(out, fmt.Sprintf("%s@%d=%s", y.ParseKey(it.Key()), y.ParseTs(it.Key()),
+				it.Value().Value))
+		}
+		return out
+	}
+
+	// The newest table comes first. When the tables hold the same key and version, the first one
+	// wins in both directions, wherever the key is in them.
+	tables := []*Table{
+		newTable("a@1=new", "k@5=new", "z@1=new"),
+		newTable("k@5=old", "m@1=old"),
+		newTable("b@1=oldest", "k@5=oldest"),
+	}
+	defer func() {
+		for _, tbl := range tables {
+			require.NoError(t, tbl.DecrRef())
+		}
+	}()
+	require.Equal(t, []string{"a@1=new", "b@1=oldest", "k@5=new", "m@1=old", "z@1=new"},
+		scan(tables, false))
+	require.Equal(t, []string{"z@1=new", "m@1=old", "k@5=new", "b@1=oldest", "a@1=new"},
+		scan(tables, true))
+	require.Equal(t, []string{"z@1=new", "m@1=old", "k@5=new", "b@1=oldest", "a@1=new"},
+		scan([]*Table{tables[0], tables[2], tables[1]}, true))
+	require.Equal(t, []string{"m@1=old", "k@5=old", "b@1=oldest"},
+		scan([]*Table{tables[1], tables[2]}, true))
+
+	// Different versions of a key are all returned, the newest first going forward and last in
+	// reverse, so that a reverse scan ends each key on its newest version.
+	versions := []*Table{newTable("k@3=v3", "k@1=v1"), newTable("k@7=v7")}
+	defer func() {
+		for _, tbl := range versions {
+			require.NoError(t, tbl.DecrRef())
+		}
+	}()
+	require.Equal(t, []string{"k@7=v7", "k@3=v3", "k@1=v1"}, scan(versions, false))
+	require.Equal(t, []string{"k@1=v1", "k@3=v3", "k@7=v7"}, scan(versions, true))
+}
+
+// opaqueIterator hides the type of the iterator it wraps from MergeIterator.
+type opaqueIterator struct {
+	y.Iterator
+}
+
+func TestMergeIteratorSeekToFirstLast(t *testing.T) {
+	opts := &Options{BlockSize: 4 * 1024, BloomFalsePositive: 0.01}
+	var fileID uint64
+	var all []*Table
+	newTable := func(keys ...string) *Table {
+		builder := NewTableBuilder(*opts)
+		defer builder.Close()
+		for _, k := range keys {
+			builder.Add(y.KeyWithTs([]byte(k), 1), y.ValueStruct{Value: []byte(k)}, 0)
+		}
+		fileID++
+		tbl, err := OpenInMemoryTable(builder.Finish(), fileID, opts)
+		require.NoError(t, err)
+		all = append(all, tbl)
+		return tbl
+	}
+	defer func() {
+		for _, tbl := range all {
+			require.NoError(t, tbl.DecrRef())
+		}
+	}()
+	ta, tb, tc, td := newTable("b", "d"), newTable("a", "c"), newTable("e"), newTable("f", "g")
+	newIters := func(reverse bool) []y.Iterator {
+		var topt int
+		if reverse {
+			topt = REVERSED
+		}
+		return []y.Iterator{
+			ta.NewIterator(topt),
+			newLazyTableIterator(tb, topt),
+			&opaqueIterator{tc.NewIterator(topt)},
+			NewConcatIterator([]*Table{td}, topt),
+		}
+	}
+	check := func(it *MergeIterator, want string) {
+		require.True(t, it.Valid())
+		require.Equal(t, want, string(y.ParseKey(it.Key())))
+		require.Equal(t, want, string(it.Value().Value))
+	}
+
+	fwd := NewMergeIterator(newIters(false), false).(*MergeIterator)
+	fwd.SeekToLast()
+	check(fwd, "g")
+	fwd.Next()
+	require.False(t, fwd.Valid())
+	fwd.SeekToFirst()
+	check(fwd, "a")
+	require.NoError(t, fwd.Close())
+
+	rev := NewMergeIterator(newIters(true), true).(*MergeIterator)
+	rev.SeekToFirst()
+	check(rev, "a")
+	rev.Next()
+	require.False(t, rev.Valid())
+	rev.SeekToLast()
+	check(rev, "g")
+	require.NoError(t, rev.Close())
+
+	// Iterators holding a single element, the same in all of them.
+	tx, ty := newTable("x"), newTable("x")
+	for _, reverse := range []bool{false, true} {
+		var topt int
+		if reverse {
+			topt = REVERSED
+		}
+		it := NewMergeIterator([]y.Iterator{tx.NewIterator(topt), &opaqueIterator{ty.NewIterator(topt)}},
+			reverse).(*MergeIterator)
+		it.SeekToLast()
+		check(it, "x")
+		it.Next()
+		require.False(t, it.Valid())
+		it.SeekToFirst()
+		check(it, "x")
+		it.Next()
+		require.False(t, it.Valid())
+		require.NoError(t, it.Close())
+	}
+
+	// Iterators without any element.
+	empty := NewMergeIterator([]y.Iterator{newSimpleIterator(nil, nil, false),
+		newSimpleIterator(nil, nil, false)}, false).(*MergeIterator)
+	empty.SeekToLast()
+	require.False(t, empty.Valid())
+	empty.SeekToFirst()
+	require.False(t, empty.Valid())
+}
+
+func TestPooledMergeIterator(t *testing.T) {
+	newIters := func() []y.Iterator {
+		return []y.Iterator{
+			newSimpleIterator([]string{"1", "3"}, []string{"a1", "a3"}, false),
+			newSimpleIterator([]string{"2"}, []string{"b2"}, false),
+			newSimpleIterator([]string{"0", "4"}, []string{"c0", "c4"}, false),
+		}
+	}
+	for i := 0; i < 3; i++ {
+		it := NewPooledMergeIterator(newIters(), false).(*MergeIterator)
+		it.Rewind()
+		k, v := getAll(it)
+		require.Equal(t, []string{"0", "1", "2", "3", "4"}, k)
+		require.Equal(t, []string{"c0", "a1", "b2", "a3", "c4"}, v)
+		closeAndCheck(t, it, 3)
+		it.Release()
+	}
+
+	// A reused MergeIterator doesn't keep anything from its previous use.
+	it := NewPooledMergeIterator(newIters(), true).(*MergeIterator)
+	it.Release()
+	rev := func() []y.Iterator {
+		iters := newIters()
+		for _, it := range iters {
+			it.(*SimpleIterator).reversed = true
+		}
+		return iters
+	}
+	it = NewPooledMergeIterator(rev(), true).(*MergeIterator)
+	it.Rewind()
+	k, _ := getAll(it)
+	require.Equal(t, []string{"4", "3", "2", "1", "0"}, k)
+	it.Release()
+
+	// Release doesn't touch a MergeIterator which doesn't come from the pool.
+	regular := NewMergeIterator(newIters(), false).(*MergeIterator)
+	regular.Release()
+	regular.Rewind()
+	k, _ = getAll(regular)
+	require.Equal(t, []string{"0", "1", "2", "3", "4"}, k)
+}
+
+func TestMergeIteratorWithComparator(t *testing.T) {
+	// Shorter keys come first.
+	byLength := func(a, b []byte) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return bytes.Compare(a, b)
+	}
+	newIter := func(kvs ...interface{}) *SimpleIterator {
+		it := &SimpleIterator{idx: -1}
+		for i := 0; i < len(kvs); i += 3 {
+			it.keys = append(it.keys, y.KeyWithTs([]byte(kvs[i].(string)), uint64(kvs[i+1].(int))))
+			it.vals = append(it.vals, []byte(kvs[i+2].(string)))
+		}
+		return it
+	}
+	newIters := func() []y.Iterator {
+		return []y.Iterator{
+			newIter("b", 2, "a-b2", "aa", 1, "a-aa1", "ccc", 1, "a-ccc1"),
+			newIter("b", 3, "b-b3", "b", 2, "b-b2", "aa", 1, "b-aa1"),
+		}
+	}
+	getAllVersions := func(it y.Iterator) ([]string, []string) {
+		var keys, vals []string
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, fmt.Sprintf("%s@%d", y.ParseKey(it.Key()), y.ParseTs(it.Key())))
+			vals = append(vals, string(it.Value().Value))
+		}
+		return keys, vals
+	}
+
+	it := NewMergeIteratorWithComparator(newIters(), false, byLength)
+	k, v := getAllVersions(it)
+	require.Equal(t, []string{"b@3", "b@2", "aa@1", "ccc@1"}, k)
+	require.Equal(t, []string{"b-b3", "a-b2", "a-aa1", "a-ccc1"}, v)
+	closeAndCheck(t, it, 2)
+
+	// The bound is compared with the comparator too.
+	it = NewMergeIteratorWithComparator(newIters(), false, byLength)
+	it.(*MergeIterator).SetBound([]byte("aa"))
+	k, _ = getAllVersions(it)
+	require.Equal(t, []string{"b@3", "b@2"}, k)
+	closeAndCheck(t, it, 2)
+
+	// Reversed, the whole order is reversed.
+	rev := newIters()
+	for _, it := range rev {
+		it.(*SimpleIterator).reversed = true
+	}
+	it = NewMergeIteratorWithComparator(rev, true, byLength)
+	k, v = getAllVersions(it)
+	require.Equal(t, []string{"ccc@1", "aa@1", "b@2", "b@3"}, k)
+	require.Equal(t, []string{"a-ccc1", "a-aa1", "a-b2", "b-b3"}, v)
+	closeAndCheck(t, it, 2)
+}
+
+func TestMergeIteratorEstimatedCount(t *testing.T) {
+	opts := getTestTableOptions()
+	t1 := buildTestTable(t, "keya", 1000, opts)
+	defer func() { require.NoError(t, t1.DecrRef()) }()
+	t2 := buildTestTable(t, "keyb", 500, opts)
+	defer func() { require.NoError(t, t2.DecrRef()) }()
+	t3 := buildTestTable(t, "keya", 200, opts)
+	defer func() { require.NoError(t, t3.DecrRef()) }()
+
+	concat := NewConcatIterator([]*Table{t1, t2}, 0)
+	require.Equal(t, uint64(1500), concat.EstimatedCount())
+	require.Equal(t, t1.Size()+t2.Size(), concat.EstimatedSize())
+
+	it := NewMergeIterator([]y.Iterator{
+		concat,
+		t3.NewIterator(0),
+		newSimpleIterator([]string{"keyc"}, []string{"c"}, false),
+	}, false).(*MergeIterator)
+	defer it.Close()
+	it.Seek(y.KeyWithTs([]byte("keya0100"), 0))
+	it.Next()
+	key := y.Copy(it.Key())
+
+	require.Equal(t, uint64(1700), it.EstimatedCount())
+	require.Equal(t, t1.Size()+t2.Size()+t3.Size(), it.EstimatedSize())
+	// The iterator stays where it was.
+	require.True(t, it.Valid())
+	require.Equal(t, key, it.Key())
+	it.Next()
+	require.Equal(t, "keya0102", string(y.ParseKey(it.Key())))
+}
+
+func TestMergeIteratorShape(t *testing.T) {
+	opts := getTestTableOptions()
+	tbl := buildTestTable(t, "key", 10, opts)
+	defer func() { require.NoError(t, tbl.DecrRef()) }()
+
+	simple := func(n int) []y.Iterator {
+		var iters []y.Iterator
+		for i := 0; i < n; i++ {
+			iters = append(iters, newSimpleIterator([]string{"k"}, []string{"v"}, false))
+		}
+		return iters
+	}
+	for _, tt := range []struct{ n, depth int }{
+		{2, 1}, {3, 2}, {4, 2}, {5, 3}, {8, 3}, {9, 4}, {16, 4}, {100, 7},
+	} {
+		it := NewMergeIterator(simple(tt.n), false).(*MergeIterator)
+		require.Equal(t, tt.n, it.NumLeaves(), "n=%d", tt.n)
+		require.Equal(t, tt.depth, it.Depth(), "n=%d", tt.n)
+		require.NoError(t, it.Close())
+	}
+
+	// A ConcatIterator and a table iterator are leaves, and a nested MergeIterator is walked.
+	nested := NewMergeIterator(simple(3), false)
+	it := NewMergeIterator([]y.Iterator{
+		NewConcatIterator([]*Table{tbl}, 0), tbl.NewIterator(0), nested,
+	}, false).(*MergeIterator)
+	require.Equal(t, 5, it.NumLeaves())
+	require.Equal(t, 4, it.Depth())
+	require.NoError(t, it.Close())
+
+	// AddIterator puts the tree below a new root.
+	it = NewMergeIterator(simple(4), false).(*MergeIterator)
+	it.AddIterator(newSimpleIterator([]string{"k"}, []string{"v"}, false))
+	require.Equal(t, 5, it.NumLeaves())
+	require.Equal(t, 3, it.Depth())
+	require.NoError(t, it.Close())
+}
+
+func BenchmarkPooledMergeIterator(b *testing.B) {
+	opts := &Options{BlockSize: 4 * 1024, BloomFalsePositive: 0.01}
+	const n = 16
+	var tables []*Table
+	for i := 0; i < n; i++ {
+		builder := NewTableBuilder(*opts)
+		for j := i; j < 1000*n; j += n {
+			k := y.KeyWithTs([]byte(fmt.Sprintf("%016x", j)), 1)
+			builder.Add(k, y.ValueStruct{Value: []byte("val")}, 0)
+		}
+		tbl, err := OpenInMemoryTable(builder.Finish(), uint64(i+1), opts)
+		y.Check(err)
+		builder.Close()
+		tables = append(tables, tbl)
+		defer func() { _ = tbl.DecrRef() }()
+	}
+	// Each scan reads a few keys, so the cost of building the merge tree shows.
+	scan := func(b *testing.B, pooled bool) {
+		b.ReportAllocs()
+		iters := make([]y.Iterator, n)
+		seek := y.KeyWithTs([]byte(fmt.Sprintf("%016x", 500)), math.MaxUint64)
+		for i := 0; i < b.N; i++ {
+			for j, tbl := range tables {
+				iters[j] = tbl.NewIterator(0)
+			}
+			var it y.Iterator
+			if pooled {
+				it = NewPooledMergeIterator(iters, false)
+			} else {
+				it = NewMergeIterator(iters, false)
+			}
+			var count int
+			for it.Seek(seek); it.Valid() && count < 10; it.Next() {
+				count++
+			}
+			_ = it.Close()
+			if pooled {
+				it.(*MergeIterator).Release()
+			}
+		}
+	}
+	b.Run("regular", func(b *testing.B) { scan(b, false) })
+	b.Run("pooled", func(b *testing.B) { scan(b, true) })
+}
+
+func TestMergeIteratorDirections(t *testing.T) {
+	opts := getTestTableOptions()
+	t1 := buildTable(t, [][]string{{"a", "1"}, {"c", "1"}, {"e", "1"}}, opts)
+	defer func() { require.NoError(t, t1.DecrRef()) }()
+	t2 := buildTable(t, [][]string{{"b", "2"}, {"d", "2"}}, opts)
+	defer func() { require.NoError(t, t2.DecrRef()) }()
+
+	// Iterators known to go in the other direction are rejected.
+	fwd, rev := t1.NewIterator(0), t2.NewIterator(REVERSED)
+	require.Panics(t, func() { NewMergeIterator([]y.Iterator{fwd, rev}, false) })
+	require.Panics(t, func() { NewMergeIteratorHeap([]y.Iterator{fwd, rev}, false) })
+	require.Panics(t, func() { NewMergeIterator([]y.Iterator{rev}, false) })
+	mi := NewMergeIterator([]y.Iterator{fwd, t2.NewIterator(0)}, false).(*MergeIterator)
+	require.Panics(t, func() { mi.AddIterator(rev) })
+	require.NoError(t, mi.Close())
+	require.NoError(t, rev.Close())
+
+	// Turned around, they can be merged.
+	it := NewMergeIterator([]y.Iterator{
+		t1.NewIterator(REVERSED), y.NewReversedIterator(t2.NewIterator(0)),
+	}, true)
+	defer func() { require.NoError(t, it.Close()) }()
+	require.True(t, it.(y.DirectedIterator).Reversed())
+	it.Rewind()
+	keys, vals := getAll(it)
+	require.Equal(t, []string{"e", "d", "c", "b", "a"}, keys)
+	require.Equal(t, []string{"1", "2", "1", "2", "1"}, vals)
+	it.Seek(y.KeyWithTs([]byte("cc"), 0))
+	keys, _ = getAll(it)
+	require.Equal(t, []string{"c", "b", "a"}, keys)
+
+	// A reversed iterator going backwards goes forward.
+	ri := y.NewReversedIterator(t2.NewIterator(REVERSED))
+	defer func() { require.NoError(t, ri.Close()) }()
+	require.False(t, ri.Reversed())
+	require.False(t, ri.Valid())
+	ri.Seek(y.KeyWithTs([]byte("c"), 0))
+	keys, _ = getAll(ri)
+	require.Equal(t, []string{"d"}, keys)
+
+	// Iterators which don't know their direction are taken to go forward.
+	si := y.NewReversedIterator(newSimpleIterator([]string{"k1", "k2"}, []string{"v1", "v2"}, false))
+	require.True(t, si.Reversed())
+	si.Rewind()
+	keys, _ = getAll(si)
+	require.Equal(t, []string{"k2", "k1"}, keys)
+	require.NoError(t, si.Close())
+}
@@ -84,6 +84,10 @@ type Options struct {
 
 	// ZSTDCompressionLevel is the ZSTD compression level used for compressing blocks.
 	ZSTDCompressionLevel int
+
+	// TombstoneMeta holds the meta bits of delete markers. Entries with any of these bits set are
+	// counted in the table index.
+	TombstoneMeta byte
 }
 
 // TableInterface is useful for testing.
@@ -117,10 +121,17 @@ type Table struct {
 
 	IsInmemory bool // Set to true if the table is on level 0 and opened in memory.
 	opt        *Options
+
+	pinned atomic.Pointer[[]*block] // All the blocks, held outside the block cache. See Pin.
+	// Unix time, in seconds, of the last read served by the table, or of its opening. See Touch.
+	lastAccess atomic.Int64
 }
 
 type cheapIndex struct {
 	MaxVersion        uint64
+	MinVersion        uint64
+	TombstoneCount    uint32
+	MinExpiresAt      uint64
 	KeyCount          uint32
 	UncompressedSize  uint32
 	OnDiskSize        uint32
@@ -136,6 +147,18 @@ func (t *Table) offsetsLength() int { return t.cheapIndex().OffsetsLength }
 // MaxVersion returns the maximum version across all keys stored in this table.
 func (t *Table) MaxVersion() uint64 { return t.cheapIndex().MaxVersion }
 
+// MinVersion returns the minimum version across all keys stored in this table. It is zero for
+// tables written before the minimum version was recorded.
+func (t *Table) MinVersion() uint64 { return t.cheapIndex().MinVersion }
+
+// TombstoneCount returns the number of delete markers stored in this table, as set by
+// Options.TombstoneMeta when the table was built.
+func (t *Table) TombstoneCount() uint32 { return t.cheapIndex().TombstoneCount }
+
+// MinExpiresAt returns the smallest non-zero ExpiresAt of the entries stored in this table, or
+// math.MaxUint64 if none of them expires. It is zero for tables written before it was recorded.
+func (t *Table) MinExpiresAt() uint64 { return t.cheapIndex().MinExpiresAt }
+
 // BloomFilterSize returns the size of the bloom filter in bytes stored in memory.
 func (t *Table) BloomFilterSize() int { return t.cheapIndex().BloomFilterLength }
 
@@ -161,6 +184,13 @@ func (t *Table) IncrRef() {
 
 // DecrRef decrements the refcount and possibly deletes the table
 func (t *Table) DecrRef() error {
+	_, err := t.DecrRefDeleted()
+	return err
+}
+
+// DecrRefDeleted decrements the refcount like DecrRef, and returns true if it dropped the last
+// reference, in which case the table has been closed and its file deleted.
+func (t *Table) DecrRefDeleted() (bool, error) {
 	newRef := t.ref.Add(-1)
 	if newRef == 0 {
 		// We can safely delete this file, because for all the current files, we always have
@@ -170,13 +200,57 @@ func (t *Table) DecrRef() error {
 		for i := 0; i < t.offsetsLength(); i++ {
 			t.opt.BlockCache.Del(t.blockCacheKey(i))
 		}
+		t.Unpin()
 		if err := t.Delete(); err != nil {
-			return err
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Pin reads all the blocks of the table and keeps them in memory until Unpin is called, or the
+// table is deleted. Reads of a pinned table never go to the block cache, so its blocks can't be
+// evicted from it. Pinning a table which is already pinned is a no-op.
+func (t *Table) Pin() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.pinned.Load() != nil {
+		return nil
+	}
+	blocks := make([]*block, t.offsetsLength())
+	for i := range blocks {
+		b, err := t.block(i, false)
+		if err != nil {
+			for _, b := range blocks[:i] {
+				b.decrRef()
+			}
+			return y.Wrapf(err, "while pinning table: %s", t.Filename())
 		}
+		blocks[i] = b
 	}
+	t.pinned.Store(&blocks)
 	return nil
 }
 
+// Unpin releases the blocks held by Pin. It is a no-op if the table isn't pinned.
+func (t *Table) Unpin() {
+	t.Lock()
+	defer t.Unlock()
+	blocks := t.pinned.Swap(nil)
+	if blocks == nil {
+		return
+	}
+	for _, b := range *blocks {
+		b.decrRef()
+	}
+}
+
+// IsPinned returns true if the blocks of the table are pinned in memory.
+func (t *Table) IsPinned() bool {
+	return t.pinned.Load() != nil
+}
+
 // BlockEvictHandler is used to reuse the byte slice stored in the block on cache eviction.
 func BlockEvictHandler(value interface{}) {
 	if b, ok := value.(*block); ok {
@@ -306,6 +380,7 @@ func OpenTable(mf *z.MmapFile, opts Options) (*Table, error) {
 	}
 	// Caller is given one reference.
 	t.ref.Store(1)
+	t.lastAccess.Store(time.Now().Unix())
 
 	if err := t.initBiggestAndSmallest(); err != nil {
 		return nil, y.Wrapf(err, "failed to initialize table")
@@ -337,6 +412,7 @@ func OpenInMemoryTable(data []byte, id uint64, opt *Options) (*Table, error) {
 	}
 	// Caller is given one reference.
 	t.ref.Store(1)
+	t.lastAccess.Store(time.Now().Unix())
 
 	if err := t.initBiggestAndSmallest(); err != nil {
 		return nil, err
@@ -472,6 +548,9 @@ func (t *Table) initIndex() (*fb.BlockOffset, error) {
 	}
 	t._cheap = &cheapIndex{
 		MaxVersion:        index.MaxVersion(),
+		MinVersion:        index.MinVersion(),
+		TombstoneCount:    index.TombstoneCount(),
+		MinExpiresAt:      index.MinExpiresAt(),
 		KeyCount:          index.KeyCount(),
 		UncompressedSize:  index.UncompressedSize(),
 		OnDiskSize:        index.OnDiskSize(),
@@ -542,6 +621,13 @@ func (t *Table) block(idx int, useCache bool) (*block, error) {
 	if idx >= t.offsetsLength() {
 		return nil, errors.New("block out of index")
 	}
+	if blocks := t.pinned.Load(); blocks != nil {
+		// The block could be released by Unpin between the Load() call and the incrRef() call,
+		// in which case it is read again below.
+		if b := (*blocks)[idx]; b.incrRef() {
+			return b, nil
+		}
+	}
 	if t.opt.BlockCache != nil {
 		key := t.blockCacheKey(idx)
 		blk, ok := t.opt.BlockCache.Get(key)
@@ -677,6 +763,18 @@ func (t *Table) Filename() string { return t.Fd.Name() }
 // ID is the table's ID number (used to make the file name).
 func (t *Table) ID() uint64 { return t.id }
 
+// Touch records that the table served a read at now, a unix time in seconds. The timestamp is only
+// written when the second changes, so that tables read concurrently don't contend on it.
+func (t *Table) Touch(now int64) {
+	if t.lastAccess.Load() != now {
+		t.lastAccess.Store(now)
+	}
+}
+
+// LastAccess returns the time of the last read recorded by Touch, to the second, or the time the
+// table was opened if there was none.
+func (t *Table) LastAccess() time.Time { return time.Unix(t.lastAccess.Load(), 0) }
+
 // DoesNotHave returns true if and only if the table does not have the key hash.
 // It does a bloom filter lookup.
 func (t *Table) DoesNotHave(hash uint32) bool {
@@ -21,6 +21,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"hash/crc32"
+	"math"
 	"math/rand"
 	"os"
 	"sort"
@@ -106,6 +107,142 @@ func TestTableIterator(t *testing.T) {
 	}
 }
 
+func TestDecrRefDeleted(t *testing.T) {
+	tbl := buildTestTable(t, "key", 100, getTestTableOptions())
+	tbl.IncrRef()
+	deleted, err := tbl.DecrRefDeleted()
+	require.NoError(t, err)
+	require.False(t, deleted)
+	_, err = os.Stat(tbl.Filename())
+	require.NoError(t, err)
+
+	deleted, err = tbl.DecrRefDeleted()
+	require.NoError(t, err)
+	require.True(t, deleted)
+	_, err = os.Stat(tbl.Filename())
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestMinExpiresAt(t *testing.T) {
+	build := func(expiresAt ...uint64) *Table {
+		b := NewTableBuilder(getTestTableOptions())
+		defer b.Close()
+		for i, e := range expiresAt {
+			b.Add(y.KeyWithTs([]byte(key("key", i)), 1), y.ValueStruct{Value: []byte("v"),
+				ExpiresAt: e}, 0)
+		}
+		filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Uint32())
+		tbl, err := CreateTable(filename, b)
+		require.NoError(t, err)
+		return tbl
+	}
+	tbl := build(0, 30, 20, 0, 40)
+	require.Equal(t, uint64(20), tbl.MinExpiresAt())
+	require.NoError(t, tbl.DecrRef())
+
+	// Zero is left to tables written before the field was added.
+	tbl = build(0, 0)
+	require.Equal(t, uint64(math.MaxUint64), tbl.MinExpiresAt())
+	require.NoError(t, tbl.DecrRef())
+}
+
+func TestPinTable(t *testing.T) {
+	cache, err := ristretto.NewCache(&cacheConfig)
+	require.NoError(t, err)
+	defer cache.Close()
+	opts := getTestTableOptions()
+	opts.BlockCache = cache
+	tbl := buildTestTable(t, "key", 1000, opts)
+	defer func() { require.NoError(t, tbl.DecrRef()) }()
+	require.Greater(t, tbl.offsetsLength(), 1)
+
+	require.False(t, tbl.IsPinned())
+	require.NoError(t, tbl.Pin())
+	require.True(t, tbl.IsPinned())
+	require.NoError(t, tbl.Pin())
+	pinned := *tbl.pinned.Load()
+
+	// Pinned blocks are served without going through the cache.
+	for i := range pinned {
+		b, err := tbl.block(i, true)
+		require.NoError(t, err)
+		require.True(t, b == pinned[i])
+		b.decrRef()
+	}
+	cache.Wait()
+	_, ok := cache.Get(tbl.blockCacheKey(0))
+	require.False(t, ok)
+
+	it := tbl.NewIterator(0)
+	var n int
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.Equal(t, key("key", n), string(y.ParseKey(it.Key())))
+		require.Equal(t, fmt.Sprintf("%d", n), string(it.Value().Value))
+		n++
+	}
+	require.Equal(t, 1000, n)
+	require.NoError(t, it.Close())
+
+	tbl.Unpin()
+	require.False(t, tbl.IsPinned())
+	tbl.Unpin()
+	b, err := tbl.block(0, true)
+	require.NoError(t, err)
+	require.False(t, b == pinned[0])
+	b.decrRef()
+}
+
+func TestKeysOnlyIterator(t *testing.T) {
+	opts := getTestTableOptions()
+	tbl := buildTestTable(t, "keya", 1000, opts)
+	defer func() { require.NoError(t, tbl.DecrRef()) }()
+	tbl2 := buildTestTable(t, "keyb", 1000, opts)
+	defer func() { require.NoError(t, tbl2.DecrRef()) }()
+
+	check := func(it y.Iterator, want []string) {
+		defer it.Close()
+		var got []string
+		for it.Rewind(); it.Valid(); it.Next() {
+			got = append(got, string(y.ParseKey(it.Key())))
+			require.Equal(t, y.ValueStruct{}, it.Value())
+		}
+		require.Equal(t, want, got)
+		it.Seek(y.KeyWithTs([]byte("keya0500"), 0))
+		require.True(t, it.Valid())
+		require.Equal(t, "keya0500", string(y.ParseKey(it.Key())))
+		require.Equal(t, y.ValueStruct{}, it.Value())
+	}
+	var want, wantReversed []string
+	for _, prefix := range []string{"keya", "keyb"} {
+		for i := 0; i < 1000; i++ {
+			want = append(want, key(prefix, i))
+		}
+	}
+	for i := len(want) - 1; i >= 0; i-- {
+		wantReversed = append(wantReversed, want[i])
+	}
+
+	check(tbl.NewIterator(KEYSONLY), want[:1000])
+	it := tbl.NewIterator(KEYSONLY)
+	it.Rewind()
+	require.Equal(t, y.ValueStruct{}, it.ValueCopy())
+	require.NoError(t, it.Close())
+
+	// The option carries over to the tables opened by concat and lazy merge iterators.
+	check(NewConcatIterator([]*Table{tbl, tbl2}, KEYSONLY), want)
+	check(NewConcatIterator([]*Table{tbl, tbl2}, KEYSONLY|REVERSED), wantReversed)
+	check(NewLazyMergeIterator([]*Table{tbl2, tbl}, KEYSONLY), want)
+	check(NewMergeIterator([]y.Iterator{
+		tbl.NewIterator(KEYSONLY), NewConcatIterator([]*Table{tbl2}, KEYSONLY),
+	}, false), want)
+
+	// Without the option, the values are there.
+	it = tbl.NewIterator(0)
+	defer it.Close()
+	it.Rewind()
+	require.Equal(t, "0", string(it.Value().Value))
+}
+
 func TestSeekToFirst(t *testing.T) {
 	for _, n := range []int{99, 100, 101, 199, 200, 250, 9999, 10000} {
 		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
@@ -381,6 +518,49 @@ func TestConcatIteratorOneTable(t *testing.T) {
 	require.EqualValues(t, 'A', vs.Meta)
 }
 
+func TestIteratorOverTables(t *testing.T) {
+	opts := getTestTableOptions()
+	var tables []*Table
+	for _, prefix := range []string{"keya", "keyb", "keyc"} {
+		tbl := buildTestTable(t, prefix, 100, opts)
+		defer func() { require.NoError(t, tbl.DecrRef()) }()
+		tables = append(tables, tbl)
+	}
+	refs := func() []int32 {
+		var out []int32
+		for _, tbl := range tables {
+			out = append(out, tbl.ref.Load())
+		}
+		return out
+	}
+	before := refs()
+
+	for _, reverse := range []bool{false, true} {
+		it := NewIteratorOverTables(tables, reverse)
+		for i, r := range refs() {
+			require.Equal(t, before[i]+1, r)
+		}
+		var keys []string
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, string(y.ParseKey(it.Key())))
+		}
+		require.Len(t, keys, 300)
+		first, last := "keya0000", "keyc0099"
+		if reverse {
+			first, last = last, first
+		}
+		require.Equal(t, first, keys[0])
+		require.Equal(t, last, keys[len(keys)-1])
+
+		it.Seek(y.KeyWithTs([]byte("keyb0050"), 0))
+		require.True(t, it.Valid())
+		require.Equal(t, "keyb0050", string(y.ParseKey(it.Key())))
+
+		require.NoError(t, it.Close())
+		require.Equal(t, before, refs())
+	}
+}
+
 func TestConcatIterator(t *testing.T) {
 	opts := getTestTableOptions()
 	tbl := buildTestTable(t, "keya", 10000, opts)
@@ -729,6 +909,31 @@ func BenchmarkRead(b *testing.B) {
 	}
 }
 
+func BenchmarkReadKeysOnly(b *testing.B) {
+	n := int(1e6)
+	tbl := getTableForBenchmarks(b, n, nil)
+	defer func() { _ = tbl.DecrRef() }()
+
+	// A full table key scan through the y.Iterator interface, which reads the values as well
+	// unless the iterator is KEYSONLY.
+	for _, opt := range []int{0, KEYSONLY} {
+		b.Run(fmt.Sprintf("keysonly=%v", opt == KEYSONLY), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				func() {
+					var it y.Iterator = tbl.NewIterator(opt)
+					defer it.Close()
+					var count int
+					for it.Rewind(); it.Valid(); it.Next() {
+						_ = it.Value()
+						count++
+					}
+					require.Equal(b, n, count)
+				}()
+			}
+		})
+	}
+}
+
 func BenchmarkReadAndBuild(b *testing.B) {
 	n := int(5 * 1e6)
 
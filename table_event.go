@@ -0,0 +1,121 @@
+/*
+ * Copyright 2023 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4/table"
+)
+
+// TableEventType is the kind of change a TableEvent records.
+type TableEventType int
+
+const (
+	// TableCreated is recorded when a table is added to a level.
+	TableCreated TableEventType = iota
+	// TableDeleted is recorded when a table is removed from a level.
+	TableDeleted
+	// TableFileDeleted is recorded when the file of a table removed from a level is deleted
+	// right away, as the level held its last reference. Tables still held elsewhere, like by
+	// iterators, are deleted once released, without an event.
+	TableFileDeleted
+)
+
+func (t TableEventType) String() string {
+	switch t {
+	case TableCreated:
+		return "created"
+	case TableDeleted:
+		return "deleted"
+	case TableFileDeleted:
+		return "file deleted"
+	}
+	return "unknown"
+}
+
+// TableEvent records a table being added to or removed from a level of the LSM tree, or its file
+// being deleted.
+type TableEvent struct {
+	Type    TableEventType
+	TableID uint64
+	Level   int
+	Time    time.Time
+}
+
+// tableEventLog keeps the last TableEventLogSize table events in a ring buffer. A nil
+// tableEventLog records nothing.
+type tableEventLog struct {
+	sync.Mutex
+	events []TableEvent
+	next   int  // Index in events of the slot to write the next event to.
+	full   bool // Set once events has wrapped around.
+}
+
+func newTableEventLog(size int) *tableEventLog {
+	if size <= 0 {
+		return nil
+	}
+	return &tableEventLog{events: make([]TableEvent, size)}
+}
+
+// record adds an event of type typ for each of the tables at the given level. It must not be
+// called while holding the lock of a level.
+func (l *tableEventLog) record(typ TableEventType, level int, tables []*table.Table) {
+	if l == nil || len(tables) == 0 {
+		return
+	}
+	ids := make([]uint64, 0, len(tables))
+	for _, t := range tables {
+		ids = append(ids, t.ID())
+	}
+	l.recordIDs(typ, level, ids)
+}
+
+// recordIDs is like record, for the tables with the given IDs.
+func (l *tableEventLog) recordIDs(typ TableEventType, level int, ids []uint64) {
+	if l == nil || len(ids) == 0 {
+		return
+	}
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	for _, id := range ids {
+		l.events[l.next] = TableEvent{Type: typ, TableID: id, Level: level, Time: now}
+		l.next++
+		if l.next == len(l.events) {
+			l.next = 0
+			l.full = true
+		}
+	}
+}
+
+// get returns a copy of the events in the log, oldest first.
+func (l *tableEventLog) get() []TableEvent {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	if !l.full {
+		return append([]TableEvent{}, l.events[:l.next]...)
+	}
+	out := make([]TableEvent, 0, len(l.events))
+	out = append(out, l.events[l.next:]...)
+	return append(out, l.events[:l.next]...)
+}
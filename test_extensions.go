@@ -70,10 +70,8 @@ func (db *DB) logToSyncChan(msg string) {
 // for a production system as opposed to a test system), this is a no-op.
 func (db *DB) captureDiscardStats() {
 	if db.onCloseDiscardCapture != nil {
-		db.vlog.discardStats.Lock()
 		db.vlog.discardStats.Iterate(func(id, val uint64) {
 			db.onCloseDiscardCapture[id] = val
 		})
-		db.vlog.discardStats.Unlock()
 	}
 }
@@ -316,6 +316,11 @@ func (pi *pendingWritesIterator) Valid() bool {
 	return pi.nextIdx < len(pi.entries)
 }
 
+// Reversed implements y.DirectedIterator.
+func (pi *pendingWritesIterator) Reversed() bool {
+	return pi.reversed
+}
+
 func (pi *pendingWritesIterator) Close() error {
 	return nil
 }
@@ -443,6 +448,10 @@ func (txn *Txn) Delete(key []byte) error {
 // Get looks for key and returns corresponding Item.
 // If key is not found, ErrKeyNotFound is returned.
 func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
+	return txn.getWithConsistency(key, Strong)
+}
+
+func (txn *Txn) getWithConsistency(key []byte, level ConsistencyLevel) (item *Item, rerr error) {
 	if len(key) == 0 {
 		return nil, ErrEmptyKey
 	} else if txn.discarded {
@@ -476,7 +485,7 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	}
 
 	seek := y.KeyWithTs(key, txn.readTs)
-	vs, err := txn.db.get(seek)
+	vs, err := txn.db.getWithConsistency(seek, level)
 	if err != nil {
 		return nil, y.Wrapf(err, "DB::Get key: %q", key)
 	}
@@ -494,6 +503,7 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	item.vptr = y.SafeCopy(item.vptr, vs.Value)
 	item.txn = txn
 	item.expiresAt = vs.ExpiresAt
+	item.tableID = vs.TableID
 	return item, nil
 }
 
@@ -809,6 +819,46 @@ func (db *DB) View(fn func(txn *Txn) error) error {
 	return fn(txn)
 }
 
+// ConsistencyLevel decides how much of the LSM tree a lookup looks at, to find the version of a
+// key to return.
+type ConsistencyLevel int
+
+const (
+	// Strong looks at all the memtables and levels which could hold the key, and returns its latest
+	// version. This is what Txn.Get does.
+	Strong ConsistencyLevel = iota
+	// Fast returns the first version of the key found, looking at the memtables, then at the
+	// level 0 tables from the newest, and then at the other levels from the top. Newer versions
+	// normally sit above older ones, so this is the latest version too. However, value log GC
+	// rewrites the versions it moves into the memtable, which can put them above newer versions
+	// of the same key. Fast may then return an older version. It is only safe to use when value
+	// log GC doesn't run.
+	Fast
+)
+
+// GetWithConsistency looks up key at the latest read timestamp with the given consistency level,
+// and returns the item found. The value of the item is fetched before returning, so the item
+// remains valid after the call. If key is not found, ErrKeyNotFound is returned.
+func (db *DB) GetWithConsistency(key []byte, level ConsistencyLevel) (*Item, error) {
+	var item *Item
+	err := db.View(func(txn *Txn) error {
+		var err error
+		if item, err = txn.getWithConsistency(key, level); err != nil {
+			return err
+		}
+		// The item outlives the transaction, so fetch its value now.
+		if item.val, err = item.ValueCopy(nil); err != nil {
+			return err
+		}
+		item.status = prefetched
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
 // Update executes a function, creating and managing a read-write transaction
 // for the user. Error returned by the function is relayed by the Update method.
 // Update cannot be used with managed transactions.
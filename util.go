@@ -37,6 +37,15 @@ func (s *levelsController) validate() error {
 	return nil
 }
 
+func (s *levelsController) verifyInvariants() error {
+	for _, l := range s.levels {
+		if err := l.verifyInvariants(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Check does some sanity check on one level of data or in-memory index.
 func (s *levelHandler) validate() error {
 	if s.level == 0 {
@@ -68,6 +77,52 @@ func (s *levelHandler) validate() error {
 	return nil
 }
 
+// verifyLevel0Order returns an error if the tables of level 0 were not created in the manifest in
+// increasing order of file ID, which reads rely on to find the newest versions of keys first.
+// Tables missing from l0, like those ignored on a checksum mismatch, are left out.
+func verifyLevel0Order(mf *Manifest, l0 []*table.Table) error {
+	opened := make(map[uint64]struct{}, len(l0))
+	for _, t := range l0 {
+		opened[t.ID()] = struct{}{}
+	}
+	var ids []uint64
+	for _, id := range mf.level0 {
+		if _, ok := opened[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	for j := 1; j < len(ids); j++ {
+		if ids[j-1] >= ids[j] {
+			return errors.Errorf("Level 0: table %d was added to the manifest after table %d, "+
+				"which has a higher file ID", ids[j], ids[j-1])
+		}
+	}
+	return nil
+}
+
+// verifyInvariants checks what validate doesn't on one level: the tables of level 0, and the first
+// table of the other levels, must have their smallest key <= their biggest key too, and no table
+// may hold a key with a version above its MaxVersion. validate already checks that the tables of
+// the other levels don't overlap.
+func (s *levelHandler) verifyInvariants() error {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, t := range s.tables {
+		if y.CompareKeys(t.Smallest(), t.Biggest()) > 0 {
+			return errors.Errorf("Level %d: table %d has smallest key %x > biggest key %x",
+				s.level, t.ID(), t.Smallest(), t.Biggest())
+		}
+		for _, key := range [][]byte{t.Smallest(), t.Biggest()} {
+			if version := y.ParseTs(key); version > t.MaxVersion() {
+				return errors.Errorf("Level %d: table %d holds key %x with version %d above "+
+					"its max version %d", s.level, t.ID(), key, version, t.MaxVersion())
+			}
+		}
+	}
+	return nil
+}
+
 // func (s *KV) debugPrintMore() { s.lc.debugPrintMore() }
 
 // // debugPrintMore shows key ranges of each level.
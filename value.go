@@ -50,6 +50,9 @@ const (
 	bitDiscardEarlierVersions byte = 1 << 2 // Set if earlier versions can be discarded.
 	// Set if item shouldn't be discarded via compactions (used by merge operator)
 	bitMergeEntry byte = 1 << 3
+	// Set if the value pointer points at a copy of the value written for another key. Only set
+	// in the LSM tree by compactions, when CompactionValueDedup is enabled.
+	bitSharedValue byte = 1 << 4
 	// The MSB 2 bits are for transactions.
 	bitTxn    byte = 1 << 6 // Set if the entry is part of a txn.
 	bitFinTxn byte = 1 << 7 // Set if the entry is to indicate end of txn in value log.
@@ -429,6 +432,13 @@ func (vlog *valueLog) dropAll() (int, error) {
 	if err := deleteAll(); err != nil {
 		return count, err
 	}
+	// The tables were dropped before the value log, so no key shares values anymore.
+	vlog.sharedLock.Lock()
+	err := vlog.sharedFids.reset()
+	vlog.sharedLock.Unlock()
+	if err != nil {
+		return count, err
+	}
 
 	vlog.db.opt.Infof("Value logs deleted. Creating value log file: 1")
 	if _, err := vlog.createVlogFile(); err != nil { // Called while writes are stopped.
@@ -459,6 +469,12 @@ type valueLog struct {
 
 	garbageCh    chan struct{}
 	discardStats *discardStats
+
+	// sharedLock guards gcFid, the value log file currently being garbage collected, and
+	// sharedFids. Compactions sharing values hold it while installing their tables, see valueDedup.
+	sharedLock sync.Mutex
+	gcFid      uint32
+	sharedFids *sharedFids
 }
 
 func vlogFilePath(dirPath string, fid uint32) string {
@@ -554,6 +570,8 @@ func (vlog *valueLog) init(db *DB) {
 	lf, err := InitDiscardStats(vlog.opt)
 	y.Check(err)
 	vlog.discardStats = lf
+	vlog.sharedFids, err = openSharedFids(vlog.dirPath)
+	y.Check(err)
 	// See TestPersistLFDiscardStats for purpose of statement below.
 	db.logToSyncChan(endVLogInitMsg)
 }
@@ -1000,12 +1018,17 @@ func (vlog *valueLog) readValueBytes(vp valuePointer) ([]byte, *logFile, error)
 }
 
 func (vlog *valueLog) pickLog(discardRatio float64) *logFile {
+	// Taken before filesLock, which valueDedup.lock takes while holding sharedLock.
+	vlog.sharedLock.Lock()
+	skipped := vlog.sharedFids.skipped()
+	vlog.sharedLock.Unlock()
+
 	vlog.filesLock.RLock()
 	defer vlog.filesLock.RUnlock()
 
 LOOP:
 	// Pick a candidate that contains the largest amount of discardable data
-	fid, discard := vlog.discardStats.MaxDiscard()
+	fid, discard := vlog.maxDiscard(skipped)
 
 	// MaxDiscard will return fid=0 if it doesn't have any discard data. The
 	// vlog files start from 1.
@@ -1042,6 +1065,28 @@ LOOP:
 	return nil
 }
 
+// maxDiscard returns the file id with maximum discard bytes, leaving out the files GC skipped, as
+// given by sharedFids.skipped, whose discard hasn't changed since.
+func (vlog *valueLog) maxDiscard(skipped map[uint32]int64) (uint32, int64) {
+	if len(skipped) == 0 {
+		return vlog.discardStats.MaxDiscard()
+	}
+	if vlog.discardStats.readOnly {
+		return 0, 0
+	}
+	var maxFid, maxVal uint64
+	vlog.discardStats.Iterate(func(fid, val uint64) {
+		if discard, ok := skipped[uint32(fid)]; ok && discard == int64(val) {
+			return
+		}
+		if maxVal < val {
+			maxVal = val
+			maxFid = fid
+		}
+	})
+	return uint32(maxFid), int64(maxVal)
+}
+
 func discardEntry(e Entry, vs y.ValueStruct, db *DB) bool {
 	if vs.Version != y.ParseTs(e.Key) {
 		// Version not found. Discard.
@@ -1065,6 +1110,38 @@ func (vlog *valueLog) doRunGC(lf *logFile) error {
 	_, span := otrace.StartSpan(context.Background(), "Badger.GC")
 	span.Annotatef(nil, "GC rewrite for: %v", lf.path)
 	defer span.End()
+
+	// Publish the file being rewritten before looking for shared values in it. A compaction
+	// installing tables after this point would see gcFid, and one installing them before would
+	// have recorded the file in sharedFids, and have its tables show up in the scan below. The
+	// scan only runs for recorded files, so GC costs nothing more if CompactionValueDedup was
+	// never used, and the record outlives the option being turned off.
+	vlog.sharedLock.Lock()
+	vlog.gcFid = lf.fid
+	shared := vlog.sharedFids.has(lf.fid)
+	vlog.sharedLock.Unlock()
+	defer func() {
+		vlog.sharedLock.Lock()
+		vlog.gcFid = 0
+		vlog.sharedLock.Unlock()
+	}()
+	if shared {
+		if vlog.db.lc.hasSharedValues(lf.fid) {
+			// Rewriting the file would leave the keys sharing its values dangling.
+			// Leave its discard stats alone, and have pickLog move on to other files instead.
+			vlog.opt.Infof("Skipping GC of fid: %d, it holds values shared by other keys", lf.fid)
+			vlog.sharedLock.Lock()
+			vlog.sharedFids.fids[lf.fid] = vlog.discardStats.Update(lf.fid, 0)
+			vlog.sharedLock.Unlock()
+			return ErrNoRewrite
+		}
+		vlog.sharedLock.Lock()
+		err := vlog.sharedFids.remove(lf.fid)
+		vlog.sharedLock.Unlock()
+		if err != nil {
+			return y.Wrapf(err, "while recording value log files with shared values")
+		}
+	}
 	if err := vlog.rewrite(lf); err != nil {
 		return err
 	}
@@ -1105,9 +1182,7 @@ func (vlog *valueLog) updateDiscardStats(stats map[uint32]int64) {
 	if vlog.opt.InMemory {
 		return
 	}
-	for fid, discard := range stats {
-		vlog.discardStats.Update(fid, discard)
-	}
+	vlog.discardStats.UpdateBatch(stats)
 	// The following is to coordinate with some test cases where we want to
 	// verify that at least one iteration of updateDiscardStats has been completed.
 	vlog.db.logToSyncChan(updateDiscardStatsMsg)
@@ -0,0 +1,259 @@
+/*
+ * Copyright 2023 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/dgraph-io/badger/v4/y"
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// valueDedup finds identical value log values among the keys rewritten by a compaction, so that
+// all of them can point at the first copy seen. It is shared by the subcompactions of a single
+// compaction.
+//
+// Keys pointing at a copy written for another key have bitSharedValue set. Value log GC must not
+// rewrite a file holding such a copy, as the pointers to it would be left dangling. The files
+// holding copies are recorded in valueLog.sharedFids before the tables are installed. GC publishes
+// the file it is about to rewrite in valueLog.gcFid before scanning the LSM tree for shared values
+// in a recorded file, and compactions check gcFid while holding valueLog.sharedLock until their
+// tables are installed.
+type valueDedup struct {
+	vlog *valueLog
+
+	sync.Mutex
+	seen map[uint64]valuePointer // Hash of the value to the first copy seen.
+	fids map[uint32]struct{}     // Value log files holding the copies shared so far.
+}
+
+func newValueDedup(vlog *valueLog) *valueDedup {
+	return &valueDedup{
+		vlog: vlog,
+		seen: make(map[uint64]valuePointer),
+		fids: make(map[uint32]struct{}),
+	}
+}
+
+// dedupValue returns the location of an earlier copy of the value at vp, and true if there is
+// one. Otherwise, it remembers vp as the copy to use for later identical values and returns false.
+// It always returns false on a nil valueDedup.
+func (d *valueDedup) dedupValue(vp valuePointer) (valuePointer, bool) {
+	if d == nil {
+		return vp, false
+	}
+	// Copy the value and release the read right away. Holding on to it while reading the shared
+	// copy below would nest two read locks on the same log file, which deadlocks if deleteLogFile
+	// is waiting for the write lock in between.
+	v, cb, err := d.vlog.Read(vp, nil)
+	if err != nil {
+		runCallback(cb)
+		// The file might have been garbage collected. Leave the value alone.
+		return vp, false
+	}
+	val := y.SafeCopy(nil, v)
+	runCallback(cb)
+	hash := z.MemHash(val)
+
+	d.Lock()
+	shared, ok := d.seen[hash]
+	if !ok {
+		d.seen[hash] = vp
+	}
+	d.Unlock()
+	if !ok || shared == vp {
+		return vp, false
+	}
+
+	// Compare the values, to guard against hash collisions.
+	sharedVal, sharedCb, err := d.vlog.Read(shared, nil)
+	defer runCallback(sharedCb)
+	if err != nil || !bytes.Equal(val, sharedVal) {
+		return vp, false
+	}
+
+	d.Lock()
+	d.fids[shared.Fid] = struct{}{}
+	d.Unlock()
+	return shared, true
+}
+
+// lock acquires valueLog.sharedLock, once it has checked that none of the files holding shared
+// copies is being garbage collected or is going away, and has recorded them in
+// valueLog.sharedFids. The returned function releases the lock and must be called once the new
+// tables have been installed.
+func (d *valueDedup) lock() (func(), error) {
+	vlog := d.vlog
+	vlog.sharedLock.Lock()
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	d.Lock()
+	defer d.Unlock()
+	removed := func(fid uint32) bool {
+		if _, ok := vlog.filesMap[fid]; !ok || fid == vlog.gcFid {
+			return true
+		}
+		for _, id := range vlog.filesToBeDeleted {
+			if id == fid {
+				return true
+			}
+		}
+		return false
+	}
+	for fid := range d.fids {
+		if removed(fid) {
+			vlog.sharedLock.Unlock()
+			return nil, errors.Errorf("value log file %d with shared values is being removed", fid)
+		}
+	}
+	if err := vlog.sharedFids.add(d.fids); err != nil {
+		vlog.sharedLock.Unlock()
+		return nil, y.Wrapf(err, "while recording value log files with shared values")
+	}
+	return vlog.sharedLock.Unlock, nil
+}
+
+const sharedFidsFname = "SHAREDVLOG"
+
+// sharedFids records the value log files which may hold values shared by several keys, in the
+// SHAREDVLOG file, so that GC only scans the LSM tree for shared values in those. Compactions
+// sharing values add the files holding the copies before their tables are installed, and GC removes
+// a file once it has found no key sharing its values. The file holds the big-endian fids, followed
+// by the CRC of those bytes. It is guarded by valueLog.sharedLock.
+type sharedFids struct {
+	path string
+	// fids maps the recorded files to their discard when GC last skipped them, or -1 if it
+	// hasn't. pickLog leaves out skipped files until their discard changes.
+	fids map[uint32]int64
+}
+
+// openSharedFids reads the record in dir. A missing file reads as an empty record.
+func openSharedFids(dir string) (*sharedFids, error) {
+	s := &sharedFids{path: filepath.Join(dir, sharedFidsFname), fids: make(map[uint32]int64)}
+	data, err := os.ReadFile(s.path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	if len(data) < 4 || len(data)%4 != 0 {
+		return nil, errors.Errorf("invalid size %d of file: %s", len(data), s.path)
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, y.CastagnoliCrcTable) != binary.BigEndian.Uint32(data[len(body):]) {
+		return nil, errors.Errorf("checksum mismatch in file: %s", s.path)
+	}
+	for ; len(body) > 0; body = body[4:] {
+		s.fids[binary.BigEndian.Uint32(body)] = -1
+	}
+	return s, nil
+}
+
+// has returns true if fid is recorded.
+func (s *sharedFids) has(fid uint32) bool {
+	_, ok := s.fids[fid]
+	return ok
+}
+
+// add records fids, and writes the record if any of them is new.
+func (s *sharedFids) add(fids map[uint32]struct{}) error {
+	var changed bool
+	for fid := range fids {
+		if !s.has(fid) {
+			s.fids[fid] = -1
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.write()
+}
+
+// remove drops fid from the record, and writes it.
+func (s *sharedFids) remove(fid uint32) error {
+	if !s.has(fid) {
+		return nil
+	}
+	delete(s.fids, fid)
+	return s.write()
+}
+
+// reset empties the record, and writes it.
+func (s *sharedFids) reset() error {
+	if len(s.fids) == 0 {
+		return nil
+	}
+	s.fids = make(map[uint32]int64)
+	return s.write()
+}
+
+// skipped returns a copy of the discard of the recorded files GC skipped.
+func (s *sharedFids) skipped() map[uint32]int64 {
+	out := make(map[uint32]int64)
+	for fid, discard := range s.fids {
+		if discard >= 0 {
+			out[fid] = discard
+		}
+	}
+	return out
+}
+
+// write writes the record next to the file, and renames it over the file, so that a crash leaves
+// either the old record or the new one.
+func (s *sharedFids) write() error {
+	fids := make([]uint32, 0, len(s.fids))
+	for fid := range s.fids {
+		fids = append(fids, fid)
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	buf := make([]byte, 4*len(fids)+4)
+	for i, fid := range fids {
+		binary.BigEndian.PutUint32(buf[4*i:], fid)
+	}
+	body := buf[:4*len(fids)]
+	binary.BigEndian.PutUint32(buf[len(body):], crc32.Checksum(body, y.CastagnoliCrcTable))
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		return y.CombineErrors(err, f.Close())
+	}
+	if err := f.Sync(); err != nil {
+		return y.CombineErrors(err, f.Close())
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.path))
+}
@@ -257,6 +257,140 @@ func TestValueGC(t *testing.T) {
 	}
 }
 
+func TestCompactionValueDedup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithCompactionValueDedup(true).WithNumCompactors(0)
+	opt.ValueLogFileSize = 1 << 20
+	opt.ValueThreshold = 1 << 10
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	// All the even keys hold one value, and all the odd keys another one.
+	vals := [][]byte{make([]byte, 8<<10), make([]byte, 8<<10)}
+	rand.Read(vals[0])
+	rand.Read(vals[1])
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+	const n = 400
+	// The value log only moves to a new file between writes, so use small transactions.
+	txn := db.NewTransaction(true)
+	for i := 0; i < n; i++ {
+		require.NoError(t, txn.Set(key(i), vals[i%2]))
+		if i%20 == 19 {
+			require.NoError(t, txn.Commit())
+			txn = db.NewTransaction(true)
+		}
+	}
+	require.NoError(t, txn.Commit())
+	// Closing the DB flushes the memtable to level 0.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	check := func() {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				item, err := txn.Get(key(i))
+				require.NoError(t, err)
+				require.Equal(t, vals[i%2], getItemValue(t, item), "key %d", i)
+			}
+			return nil
+		}))
+	}
+	numVlogFiles := func() int {
+		db.vlog.filesLock.RLock()
+		defer db.vlog.filesLock.RUnlock()
+		return len(db.vlog.filesMap)
+	}
+	before := numVlogFiles()
+	require.Greater(t, before, 3)
+
+	cdef := compactDef{
+		thisLevel: db.lc.levels[0],
+		nextLevel: db.lc.levels[1],
+		top:       db.lc.levels[0].tables,
+		bot:       db.lc.levels[1].tables,
+		t:         db.lc.levelTargets(),
+	}
+	cdef.t.baseLevel = 1
+	require.NoError(t, db.lc.runCompactDef(-1, 0, cdef))
+	check()
+
+	// Every key but the first one holding each value points at a shared copy.
+	var shared int
+	for _, tbl := range db.lc.levels[1].tables {
+		it := tbl.NewIterator(0)
+		for it.Rewind(); it.Valid(); it.Next() {
+			if it.Value().Meta&bitSharedValue > 0 {
+				shared++
+			}
+		}
+		require.NoError(t, it.Close())
+	}
+	require.Equal(t, n-2, shared)
+
+	// GC reclaims the files holding only duplicates, but keeps the one with the shared copies.
+	for i := 0; i < 10; i++ {
+		if err := db.RunValueLogGC(0.5); err != nil {
+			require.Equal(t, ErrNoRewrite, err)
+		}
+	}
+	require.Less(t, numVlogFiles(), before-1)
+	sharedFid := db.vlog.sortedFids()[0]
+	require.True(t, db.vlog.sharedFids.has(sharedFid))
+	require.True(t, db.lc.hasSharedValues(sharedFid))
+	// Skipping the file leaves its discard stats alone.
+	require.Greater(t, db.vlog.discardStats.Update(sharedFid, 0), int64(0))
+	check()
+
+	// The shared values outlive the option, so GC keeps skipping the file once it's turned off.
+	require.NoError(t, db.Close())
+	db, err = Open(opt.WithCompactionValueDedup(false))
+	require.NoError(t, err)
+	require.True(t, db.vlog.sharedFids.has(sharedFid))
+	for i := 0; i < 10; i++ {
+		if err := db.RunValueLogGC(0.5); err != nil {
+			require.Equal(t, ErrNoRewrite, err)
+		}
+	}
+	require.Equal(t, sharedFid, db.vlog.sortedFids()[0])
+	check()
+}
+
+func TestSharedFids(t *testing.T) {
+	dir, err := os.MkdirTemp("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// A missing file is an empty record.
+	s, err := openSharedFids(dir)
+	require.NoError(t, err)
+	require.False(t, s.has(1))
+	require.NoError(t, s.add(map[uint32]struct{}{1: {}, 3: {}}))
+	s.fids[3] = 10
+	require.Equal(t, map[uint32]int64{3: 10}, s.skipped())
+	require.NoError(t, s.remove(1))
+
+	s, err = openSharedFids(dir)
+	require.NoError(t, err)
+	require.Equal(t, map[uint32]int64{3: -1}, s.fids)
+	require.NoError(t, s.reset())
+	s, err = openSharedFids(dir)
+	require.NoError(t, err)
+	require.Empty(t, s.fids)
+
+	// A corrupted record is an error, rather than letting GC rewrite files with shared values.
+	require.NoError(t, s.add(map[uint32]struct{}{2: {}}))
+	data, err := os.ReadFile(s.path)
+	require.NoError(t, err)
+	data[0] ^= 1
+	require.NoError(t, os.WriteFile(s.path, data, 0666))
+	_, err = openSharedFids(dir)
+	require.Error(t, err)
+}
+
 func TestValueGC2(t *testing.T) {
 	dir, err := os.MkdirTemp("", "badger-test")
 	require.NoError(t, err)
@@ -541,7 +675,6 @@ func TestPersistLFDiscardStats(t *testing.T) {
 	require.NoError(t, err)
 	defer db.Close()
 	waitForMessage(tChan, endVLogInitMsg, 1, 60, t)
-	db.vlog.discardStats.Lock()
 	statsMap := make(map[uint64]uint64)
 	db.vlog.discardStats.Iterate(func(fid, val uint64) {
 		statsMap[fid] = val
@@ -549,7 +682,6 @@ func TestPersistLFDiscardStats(t *testing.T) {
 	require.Truef(t, reflect.DeepEqual(capturedDiscardStats, statsMap),
 		"Discard maps are not equal. On Close: %+v, After Reopen: %+v",
 		capturedDiscardStats, statsMap)
-	db.vlog.discardStats.Unlock()
 }
 
 func TestValueChecksums(t *testing.T) {
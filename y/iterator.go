@@ -19,6 +19,7 @@ package y
 import (
 	"bytes"
 	"encoding/binary"
+	"sort"
 )
 
 // ValueStruct represents the value info that can be associated with a key, but also the internal
@@ -30,6 +31,9 @@ type ValueStruct struct {
 	Value     []byte
 
 	Version uint64 // This field is not serialized. Only for internal usage.
+	// TableID is the ID of the table the value was read from by a lookup, set only when metrics
+	// are enabled. It is not serialized either.
+	TableID uint64
 }
 
 func sizeVarint(x uint64) (n int) {
@@ -93,3 +97,106 @@ type Iterator interface {
 	// All iterators should be closed so that file garbage collection works.
 	Close() error
 }
+
+// DirectedIterator is implemented by the iterators which know the direction they iterate in. Merge
+// iterators check that the ones they merge all go in their own direction, as merging iterators
+// which go in different directions returns keys out of order. Iterators which don't implement it
+// are trusted to go in the direction of the merge iterator.
+type DirectedIterator interface {
+	Iterator
+	// Reversed returns true if the iterator returns its keys in decreasing order.
+	Reversed() bool
+}
+
+// ReversedIterator returns the entries of an iterator in the opposite order. See
+// NewReversedIterator.
+type ReversedIterator struct {
+	it       Iterator
+	reversed bool
+	loaded   bool
+	keys     [][]byte
+	vals     []ValueStruct
+	idx      int
+}
+
+// NewReversedIterator returns an iterator over the entries of it, in the opposite order, so that
+// an iterator can be merged with iterators going in the other direction. The direction of it is
+// given by its Reversed method if it's a DirectedIterator, and is taken to be increasing
+// otherwise. As it can only be walked in its own direction, all its entries are copied in memory
+// on the first Rewind or Seek, which makes this only suitable for small iterators: to iterate over
+// tables in reverse, create reversed table iterators instead. The entries are read once, so
+// changes to the data below it are not seen afterwards. Closing the ReversedIterator closes it.
+func NewReversedIterator(it Iterator) *ReversedIterator {
+	reversed := true
+	if d, ok := it.(DirectedIterator); ok {
+		reversed = !d.Reversed()
+	}
+	return &ReversedIterator{it: it, reversed: reversed}
+}
+
+// load copies the entries of the iterator below, in the order of the ReversedIterator.
+func (ri *ReversedIterator) load() {
+	if ri.loaded {
+		return
+	}
+	ri.loaded = true
+	for ri.it.Rewind(); ri.it.Valid(); ri.it.Next() {
+		vs := ri.it.Value()
+		vs.Value = SafeCopy(nil, vs.Value)
+		ri.keys = append(ri.keys, SafeCopy(nil, ri.it.Key()))
+		ri.vals = append(ri.vals, vs)
+	}
+	for i, j := 0, len(ri.keys)-1; i < j; i, j = i+1, j-1 {
+		ri.keys[i], ri.keys[j] = ri.keys[j], ri.keys[i]
+		ri.vals[i], ri.vals[j] = ri.vals[j], ri.vals[i]
+	}
+}
+
+// Reversed implements DirectedIterator.
+func (ri *ReversedIterator) Reversed() bool {
+	return ri.reversed
+}
+
+// Rewind moves to the first entry, which is the last one of the iterator below.
+func (ri *ReversedIterator) Rewind() {
+	ri.load()
+	ri.idx = 0
+}
+
+// Seek moves to the first entry whose key is >= key, or <= key if the ReversedIterator is
+// reversed.
+func (ri *ReversedIterator) Seek(key []byte) {
+	ri.load()
+	ri.idx = sort.Search(len(ri.keys), func(i int) bool {
+		if ri.reversed {
+			return CompareKeys(ri.keys[i], key) <= 0
+		}
+		return CompareKeys(ri.keys[i], key) >= 0
+	})
+}
+
+// Next moves to the next entry.
+func (ri *ReversedIterator) Next() {
+	ri.idx++
+}
+
+// Valid returns whether the ReversedIterator is at an entry. It isn't before the first Rewind or
+// Seek.
+func (ri *ReversedIterator) Valid() bool {
+	return ri.loaded && ri.idx < len(ri.keys)
+}
+
+// Key returns the key of the current entry.
+func (ri *ReversedIterator) Key() []byte {
+	return ri.keys[ri.idx]
+}
+
+// Value returns the value of the current entry.
+func (ri *ReversedIterator) Value() ValueStruct {
+	return ri.vals[ri.idx]
+}
+
+// Close closes the iterator below.
+func (ri *ReversedIterator) Close() error {
+	return ri.it.Close()
+}
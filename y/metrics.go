@@ -55,6 +55,13 @@ var (
 	numBytesCompactionWritten *expvar.Map
 	// numLSMBloomHits is number of LMS bloom hits
 	numLSMBloomHits *expvar.Map
+	// numLSMBloomFalsePositives is the number of tables whose bloom filter didn't rule out a key
+	// they didn't hold
+	numLSMBloomFalsePositives *expvar.Map
+	// numLSMStalls is the number of times adding a table to a level was refused due to a stall
+	numLSMStalls *expvar.Map
+	// numLSMStallNs is the cumulative time in nanoseconds spent stalled before a table was added
+	numLSMStallNs *expvar.Map
 
 	// DB METRICS
 	// numGets is number of gets -> Number of get requests made
@@ -87,6 +94,10 @@ func init() {
 
 	numLSMGets = expvar.NewMap(BADGER_METRIC_PREFIX + "get_num_lsm")
 	numLSMBloomHits = expvar.NewMap(BADGER_METRIC_PREFIX + "hit_num_lsm_bloom_filter")
+	numLSMBloomFalsePositives = expvar.NewMap(BADGER_METRIC_PREFIX +
+		"false_positive_num_lsm_bloom_filter")
+	numLSMStalls = expvar.NewMap(BADGER_METRIC_PREFIX + "stall_num_lsm")
+	numLSMStallNs = expvar.NewMap(BADGER_METRIC_PREFIX + "stall_ns_lsm")
 	numMemtableGets = expvar.NewInt(BADGER_METRIC_PREFIX + "get_num_memtable")
 
 	// User operations
@@ -178,10 +189,39 @@ func NumLSMBloomHitsAdd(enabled bool, key string, val int64) {
 	addToMap(enabled, numLSMBloomHits, key, val)
 }
 
+func NumLSMBloomFalsePositivesAdd(enabled bool, key string, val int64) {
+	addToMap(enabled, numLSMBloomFalsePositives, key, val)
+}
+
 func NumLSMGetsAdd(enabled bool, key string, val int64) {
 	addToMap(enabled, numLSMGets, key, val)
 }
 
+func NumLSMStallsAdd(enabled bool, key string, val int64) {
+	addToMap(enabled, numLSMStalls, key, val)
+}
+
+func NumLSMStallNsAdd(enabled bool, key string, val int64) {
+	addToMap(enabled, numLSMStallNs, key, val)
+}
+
+// NumLSMGetsReset returns the number of LSM gets counted for key, and subtracts it from the
+// counter. Gets counted concurrently are either returned or left in the counter, never lost.
+func NumLSMGetsReset(enabled bool, key string) int64 {
+	return resetInMap(enabled, numLSMGets, key)
+}
+
+// NumLSMBloomHitsReset is like NumLSMGetsReset, for the bloom filter hits counted for key.
+func NumLSMBloomHitsReset(enabled bool, key string) int64 {
+	return resetInMap(enabled, numLSMBloomHits, key)
+}
+
+// NumLSMBloomFalsePositivesReset is like NumLSMGetsReset, for the bloom filter false positives
+// counted for key.
+func NumLSMBloomFalsePositivesReset(enabled bool, key string) int64 {
+	return resetInMap(enabled, numLSMBloomFalsePositives, key)
+}
+
 func LSMSizeGet(enabled bool, key string) expvar.Var {
 	return getFromMap(enabled, lsmSize, key)
 }
@@ -221,3 +261,20 @@ func getFromMap(enabled bool, metric *expvar.Map, key string) expvar.Var {
 
 	return metric.Get(key)
 }
+
+// resetInMap returns the value of the counter of metric at key, and subtracts it from the counter.
+// Subtracting the value read, rather than setting the counter to zero, keeps what is added between
+// the two operations.
+func resetInMap(enabled bool, metric *expvar.Map, key string) int64 {
+	if !enabled {
+		return 0
+	}
+
+	v, ok := metric.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	val := v.Value()
+	v.Add(-val)
+	return val
+}